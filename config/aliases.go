@@ -0,0 +1,159 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+)
+
+// AliasesConfig holds a session's aliases: the hand-written ones in
+// aliases.yaml, those defined with #alias in user_aliases.yaml, or those
+// written to imported_aliases.yaml by zif import
+type AliasesConfig struct {
+	Aliases []AliasConfig `yaml:"aliases"`
+
+	File string `yaml:"-"` // file the aliases were read from, for errors
+}
+
+// AliasConfig is a single alias. Aliases saved by #alias have a name and a
+// body; declarative aliases have a regex pattern (or just a name) and a list
+// of commands, where %0-%9 refer to the pattern's captures.
+type AliasConfig struct {
+	Name     string   `yaml:"name"`
+	Body     string   `yaml:"body,omitempty"`
+	Pattern  string   `yaml:"pattern,omitempty"`
+	Commands Commands `yaml:"commands,omitempty"`
+	Group    string   `yaml:"group,omitempty"`
+	Priority int      `yaml:"priority,omitempty"`
+	Enabled  *bool    `yaml:"enabled,omitempty"`
+	When     string   `yaml:"when,omitempty"`
+
+	Line int `yaml:"-"` // line of the entry in its file, 0 if unknown
+}
+
+// Declarative reports whether the alias was written by hand rather than saved by #alias
+func (a AliasConfig) Declarative() bool {
+	return a.Body == ""
+}
+
+// GetSessionAliasesPath returns the path to a session's aliases.yaml
+func GetSessionAliasesPath(sessionName string) (string, error) {
+	sessionDir, err := GetSessionDir(sessionName)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(sessionDir, "aliases.yaml"), nil
+}
+
+// GetSessionUserAliasesPath returns the path to a session's user_aliases.yaml,
+// which #alias and #unalias rewrite so that aliases.yaml is left as written
+func GetSessionUserAliasesPath(sessionName string) (string, error) {
+	return sessionFile(sessionName, "user_aliases.yaml")
+}
+
+// LoadSessionAliases reads a session's aliases.yaml. A missing file is not an error.
+func LoadSessionAliases(sessionName string) (*AliasesConfig, error) {
+	path, err := GetSessionAliasesPath(sessionName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aliases path: %v", err)
+	}
+	return loadAliases(path)
+}
+
+// LoadSessionImportedAliases reads the aliases zif import wrote to a
+// session's imported_aliases.yaml. A missing file is not an error.
+func LoadSessionImportedAliases(sessionName string) (*AliasesConfig, error) {
+	path, err := sessionFile(sessionName, ImportedAliasesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aliases path: %v", err)
+	}
+	return loadAliases(path)
+}
+
+func loadAliases(path string) (*AliasesConfig, error) {
+	aliases := AliasesConfig{File: filepath.Base(path)}
+	data, err := readSessionFile(path, &aliases)
+	if err != nil {
+		return nil, err
+	}
+	lines := entryLines(data, "aliases")
+	for i := range aliases.Aliases {
+		aliases.Aliases[i].Line = lineAt(lines, i)
+	}
+	return &aliases, nil
+}
+
+// Validate checks every alias and returns one error per problem
+func (c *AliasesConfig) Validate() []error {
+	var errs []error
+	seen := map[string]int{}
+	for i, a := range c.Aliases {
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, ValidationError{File: fileOr(c.File, "aliases.yaml"), Line: a.Line, Entry: i, Msg: fmt.Sprintf(format, args...)})
+		}
+		if a.Name == "" {
+			fail("alias is missing a name")
+			continue
+		}
+		if line, dup := seen[a.Name]; dup {
+			fail("alias %q is already defined on line %d", a.Name, line)
+		}
+		seen[a.Name] = a.Line
+		if !a.Declarative() {
+			if a.Pattern != "" || len(a.Commands) > 0 {
+				fail("alias %q has a body and pattern/commands; use one or the other", a.Name)
+			}
+			continue
+		}
+		if len(a.Commands) == 0 {
+			fail("alias %q needs a body or commands", a.Name)
+		}
+		if a.Pattern != "" {
+			if _, err := regexp.Compile(a.Pattern); err != nil {
+				fail("alias %q has a bad pattern: %v", a.Name, err)
+			}
+		}
+	}
+	return errs
+}
+
+// SaveSessionAliases writes a session's aliases.yaml, creating the session directory if needed
+func SaveSessionAliases(sessionName string, aliases *AliasesConfig) error {
+	path, err := GetSessionAliasesPath(sessionName)
+	if err != nil {
+		return fmt.Errorf("failed to get aliases path: %v", err)
+	}
+	return saveSessionFile(path, aliases)
+}
+
+// SaveSessionImportedAliases writes a session's imported_aliases.yaml
+func SaveSessionImportedAliases(sessionName string, aliases *AliasesConfig) error {
+	path, err := sessionFile(sessionName, ImportedAliasesFile)
+	if err != nil {
+		return fmt.Errorf("failed to get aliases path: %v", err)
+	}
+	return saveSessionFile(path, aliases)
+}
+
+// LoadSessionUserAliases reads the aliases saved by #alias. A missing file is not an error.
+func LoadSessionUserAliases(sessionName string) (*AliasesConfig, error) {
+	path, err := GetSessionUserAliasesPath(sessionName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aliases path: %v", err)
+	}
+
+	var aliases AliasesConfig
+	if _, err := readSessionFile(path, &aliases); err != nil {
+		return nil, err
+	}
+	return &aliases, nil
+}
+
+// SaveSessionUserAliases writes the aliases defined with #alias to user_aliases.yaml
+func SaveSessionUserAliases(sessionName string, aliases *AliasesConfig) error {
+	path, err := GetSessionUserAliasesPath(sessionName)
+	if err != nil {
+		return fmt.Errorf("failed to get aliases path: %v", err)
+	}
+	return saveSessionFile(path, aliases)
+}
@@ -0,0 +1,393 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/perlsaiyan/zif/schedule"
+	"gopkg.in/yaml.v2"
+)
+
+// TriggersConfig holds the triggers declared in a session's triggers.yaml,
+// or those written to imported_triggers.yaml by zif import
+type TriggersConfig struct {
+	Triggers []TriggerConfig `yaml:"triggers"`
+
+	File string `yaml:"-"` // file the triggers were read from, for errors
+}
+
+// TriggerConfig is a single declarative trigger
+type TriggerConfig struct {
+	Name      string   `yaml:"name"`
+	Pattern   string   `yaml:"pattern"`
+	Commands  Commands `yaml:"commands,omitempty"`
+	Color     bool     `yaml:"color,omitempty"`
+	Gag       bool     `yaml:"gag,omitempty"`
+	Highlight string   `yaml:"highlight,omitempty"`
+	Group     string   `yaml:"group,omitempty"`
+	Priority  int      `yaml:"priority,omitempty"`
+	Enabled   *bool    `yaml:"enabled,omitempty"`
+	When      string   `yaml:"when,omitempty"`
+
+	Line int `yaml:"-"` // line of the entry in its file, 0 if unknown
+}
+
+// TimersConfig holds the timers declared in a session's timers.yaml, or
+// those written to imported_timers.yaml by zif import
+type TimersConfig struct {
+	Timers []TimerConfig `yaml:"timers"`
+
+	File string `yaml:"-"` // file the timers were read from, for errors
+}
+
+// TimerConfig is a single declarative timer. Interval and Jitter are Go
+// durations such as "30s"; Schedule is a cron or wall-clock schedule
+// (see schedule.Parse) used instead of Interval. Repeat limits how many
+// times the timer fires.
+type TimerConfig struct {
+	Name     string   `yaml:"name"`
+	Interval string   `yaml:"interval,omitempty"`
+	Schedule string   `yaml:"schedule,omitempty"`
+	Jitter   string   `yaml:"jitter,omitempty"`
+	Repeat   uint     `yaml:"repeat,omitempty"`
+	Commands Commands `yaml:"commands"`
+	Group    string   `yaml:"group,omitempty"`
+	Enabled  *bool    `yaml:"enabled,omitempty"`
+	When     string   `yaml:"when,omitempty"`
+
+	Line int `yaml:"-"`
+}
+
+// Commands is a list of commands to run. In YAML it may be written as a
+// list or as a single string.
+type Commands []string
+
+func (c *Commands) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var one string
+	if err := unmarshal(&one); err == nil {
+		*c = Commands{one}
+		return nil
+	}
+	var many []string
+	if err := unmarshal(&many); err != nil {
+		return err
+	}
+	*c = many
+	return nil
+}
+
+// ValidationError is a problem with a single entry of a config file
+type ValidationError struct {
+	File  string
+	Line  int
+	Entry int // index of the entry in the file's list
+	Msg   string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Msg)
+}
+
+// InvalidEntries returns the indexes of the entries that have validation errors
+func InvalidEntries(errs []error) map[int]bool {
+	bad := map[int]bool{}
+	for _, err := range errs {
+		var ve ValidationError
+		if errors.As(err, &ve) {
+			bad[ve.Entry] = true
+		}
+	}
+	return bad
+}
+
+// IsEnabled reports whether an optional enabled flag is set, defaulting to true
+func IsEnabled(enabled *bool) bool {
+	return enabled == nil || *enabled
+}
+
+var hexColorRE = regexp.MustCompile(`^(#[0-9a-fA-F]{3}|#[0-9a-fA-F]{6}|[0-9]{1,3})$`)
+
+// GetSessionTriggersPath returns the path to a session's triggers.yaml
+func GetSessionTriggersPath(sessionName string) (string, error) {
+	return sessionFile(sessionName, "triggers.yaml")
+}
+
+// GetSessionTimersPath returns the path to a session's timers.yaml
+func GetSessionTimersPath(sessionName string) (string, error) {
+	return sessionFile(sessionName, "timers.yaml")
+}
+
+// Files zif import writes, next to the hand-written files they mirror. They
+// load after those, so re-running an import never rewrites a file the user
+// edits.
+const (
+	ImportedTriggersFile = "imported_triggers.yaml"
+	ImportedAliasesFile  = "imported_aliases.yaml"
+	ImportedTimersFile   = "imported_timers.yaml"
+)
+
+func sessionFile(sessionName, file string) (string, error) {
+	sessionDir, err := GetSessionDir(sessionName)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(sessionDir, file), nil
+}
+
+// readSessionFile reads and strictly unmarshals a session's config file into
+// out. It returns the raw data, or nil if the file does not exist.
+func readSessionFile(path string, out interface{}) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", filepath.Base(path), err)
+	}
+	if err := yaml.UnmarshalStrict(data, out); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", filepath.Base(path), err)
+	}
+	return data, nil
+}
+
+// saveSessionFile marshals v to path, creating the session directory if needed
+func saveSessionFile(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create session directory: %v", err)
+	}
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", filepath.Base(path), err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// entryLines returns the line numbers of the list items under a top-level
+// key. yaml.v2 does not expose node positions, so this scans the block-style
+// layout the config files use; flow-style lists yield no lines.
+func entryLines(data []byte, key string) []int {
+	var lines []int
+	inKey := false
+	indent := -1
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		ind := len(line) - len(trimmed)
+		if ind == 0 && !strings.HasPrefix(trimmed, "-") {
+			inKey = strings.HasPrefix(trimmed, key+":")
+			indent = -1
+			continue
+		}
+		if !inKey || !strings.HasPrefix(trimmed, "-") {
+			continue
+		}
+		if indent == -1 {
+			indent = ind
+		}
+		if ind == indent {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+// fileOr returns file, or def for a config that was not read from disk
+func fileOr(file, def string) string {
+	if file == "" {
+		return def
+	}
+	return file
+}
+
+func lineAt(lines []int, i int) int {
+	if i < len(lines) {
+		return lines[i]
+	}
+	return 0
+}
+
+// LoadSessionTriggers reads a session's triggers.yaml. A missing file is not an error.
+func LoadSessionTriggers(sessionName string) (*TriggersConfig, error) {
+	path, err := GetSessionTriggersPath(sessionName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get triggers path: %v", err)
+	}
+	return loadTriggers(path)
+}
+
+// LoadSessionImportedTriggers reads the triggers zif import wrote to a
+// session's imported_triggers.yaml. A missing file is not an error.
+func LoadSessionImportedTriggers(sessionName string) (*TriggersConfig, error) {
+	path, err := sessionFile(sessionName, ImportedTriggersFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get triggers path: %v", err)
+	}
+	return loadTriggers(path)
+}
+
+func loadTriggers(path string) (*TriggersConfig, error) {
+	cfg := TriggersConfig{File: filepath.Base(path)}
+	data, err := readSessionFile(path, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	lines := entryLines(data, "triggers")
+	for i := range cfg.Triggers {
+		cfg.Triggers[i].Line = lineAt(lines, i)
+	}
+	return &cfg, nil
+}
+
+// LoadSessionTimers reads a session's timers.yaml. A missing file is not an error.
+func LoadSessionTimers(sessionName string) (*TimersConfig, error) {
+	path, err := GetSessionTimersPath(sessionName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get timers path: %v", err)
+	}
+	return loadTimers(path)
+}
+
+// LoadSessionImportedTimers reads the timers zif import wrote to a
+// session's imported_timers.yaml. A missing file is not an error.
+func LoadSessionImportedTimers(sessionName string) (*TimersConfig, error) {
+	path, err := sessionFile(sessionName, ImportedTimersFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get timers path: %v", err)
+	}
+	return loadTimers(path)
+}
+
+func loadTimers(path string) (*TimersConfig, error) {
+	cfg := TimersConfig{File: filepath.Base(path)}
+	data, err := readSessionFile(path, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	lines := entryLines(data, "timers")
+	for i := range cfg.Timers {
+		cfg.Timers[i].Line = lineAt(lines, i)
+	}
+	return &cfg, nil
+}
+
+// SaveSessionTriggers writes a session's triggers.yaml
+func SaveSessionTriggers(sessionName string, triggers *TriggersConfig) error {
+	path, err := GetSessionTriggersPath(sessionName)
+	if err != nil {
+		return fmt.Errorf("failed to get triggers path: %v", err)
+	}
+	return saveSessionFile(path, triggers)
+}
+
+// SaveSessionTimers writes a session's timers.yaml
+func SaveSessionTimers(sessionName string, timers *TimersConfig) error {
+	path, err := GetSessionTimersPath(sessionName)
+	if err != nil {
+		return fmt.Errorf("failed to get timers path: %v", err)
+	}
+	return saveSessionFile(path, timers)
+}
+
+// SaveSessionImportedTriggers writes a session's imported_triggers.yaml
+func SaveSessionImportedTriggers(sessionName string, triggers *TriggersConfig) error {
+	path, err := sessionFile(sessionName, ImportedTriggersFile)
+	if err != nil {
+		return fmt.Errorf("failed to get triggers path: %v", err)
+	}
+	return saveSessionFile(path, triggers)
+}
+
+// SaveSessionImportedTimers writes a session's imported_timers.yaml
+func SaveSessionImportedTimers(sessionName string, timers *TimersConfig) error {
+	path, err := sessionFile(sessionName, ImportedTimersFile)
+	if err != nil {
+		return fmt.Errorf("failed to get timers path: %v", err)
+	}
+	return saveSessionFile(path, timers)
+}
+
+// Validate checks every trigger and returns one error per problem
+func (c *TriggersConfig) Validate() []error {
+	var errs []error
+	seen := map[string]int{}
+	for i, t := range c.Triggers {
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, ValidationError{File: fileOr(c.File, "triggers.yaml"), Line: t.Line, Entry: i, Msg: fmt.Sprintf(format, args...)})
+		}
+		if t.Name == "" {
+			fail("trigger is missing a name")
+			continue
+		}
+		if line, dup := seen[t.Name]; dup {
+			fail("trigger %q is already defined on line %d", t.Name, line)
+		}
+		seen[t.Name] = t.Line
+		if t.Pattern == "" {
+			fail("trigger %q is missing a pattern", t.Name)
+		} else if _, err := regexp.Compile(t.Pattern); err != nil {
+			fail("trigger %q has a bad pattern: %v", t.Name, err)
+		}
+		if len(t.Commands) == 0 && !t.Gag && t.Highlight == "" {
+			fail("trigger %q needs commands, gag or highlight", t.Name)
+		}
+		if t.Highlight != "" && !hexColorRE.MatchString(t.Highlight) {
+			fail("trigger %q has a bad highlight color %q (use #rgb, #rrggbb or 0-255)", t.Name, t.Highlight)
+		}
+	}
+	return errs
+}
+
+// Validate checks every timer and returns one error per problem
+func (c *TimersConfig) Validate() []error {
+	var errs []error
+	seen := map[string]int{}
+	for i, t := range c.Timers {
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, ValidationError{File: fileOr(c.File, "timers.yaml"), Line: t.Line, Entry: i, Msg: fmt.Sprintf(format, args...)})
+		}
+		if t.Name == "" {
+			fail("timer is missing a name")
+			continue
+		}
+		if line, dup := seen[t.Name]; dup {
+			fail("timer %q is already defined on line %d", t.Name, line)
+		}
+		seen[t.Name] = t.Line
+		switch {
+		case t.Schedule != "" && t.Interval != "":
+			fail("timer %q has both an interval and a schedule", t.Name)
+		case t.Schedule != "":
+			if _, err := schedule.Parse(t.Schedule); err != nil {
+				fail("timer %q: %v", t.Name, err)
+			}
+		default:
+			if d, err := time.ParseDuration(t.Interval); err != nil {
+				fail("timer %q has a bad interval %q (use a duration such as 30s)", t.Name, t.Interval)
+			} else if d < 100*time.Millisecond {
+				fail("timer %q interval %s is shorter than 100ms", t.Name, d)
+			}
+		}
+		if t.Jitter != "" {
+			if d, err := time.ParseDuration(t.Jitter); err != nil || d < 0 {
+				fail("timer %q has a bad jitter %q (use a duration such as 2s)", t.Name, t.Jitter)
+			}
+		}
+		if len(t.Commands) == 0 {
+			fail("timer %q has no commands", t.Name)
+		}
+	}
+	return errs
+}
@@ -16,11 +16,40 @@ type SessionsConfig struct {
 
 // SessionConfig represents a single session configuration
 type SessionConfig struct {
-	Name      string `yaml:"name"`
-	Address   string `yaml:"address"`
-	Autostart bool   `yaml:"autostart"`
-	Username  string `yaml:"username,omitempty"`
-	Password  string `yaml:"password,omitempty"`
+	Name      string   `yaml:"name"`
+	Address   string   `yaml:"address"`
+	Autostart bool     `yaml:"autostart"`
+	Username  string   `yaml:"username,omitempty"`
+	Password  string   `yaml:"password,omitempty"`
+	SendRate  *float64 `yaml:"send_rate,omitempty"`  // commands per second, default 8; 0 turns limiting off
+	SendBurst int      `yaml:"send_burst,omitempty"` // commands sent before limiting, default 15
+
+	Scrollback int `yaml:"scrollback,omitempty"` // lines kept for the main window, default 20000
+
+	Ringlog *RingLogConfig `yaml:"ringlog,omitempty"`
+	Log     *LogConfig     `yaml:"log,omitempty"`
+	Lua     *LuaConfig     `yaml:"lua,omitempty"`
+}
+
+// RingLogConfig sizes a session's log of recent MUD output
+type RingLogConfig struct {
+	Size    int  `yaml:"size,omitempty"`    // lines kept, default 10000
+	Persist bool `yaml:"persist,omitempty"` // keep the log in ringlog.db in the session directory
+}
+
+// LogConfig sets up a session's log files
+type LogConfig struct {
+	Daily  bool   `yaml:"daily,omitempty"`  // log to a new file each day from connecting
+	Format string `yaml:"format,omitempty"` // raw, ansi, plain or html, default plain
+	Dir    string `yaml:"dir,omitempty"`    // default logs in the session directory
+	Keep   int    `yaml:"keep,omitempty"`   // daily logs kept, 0 keeps them all
+}
+
+// LuaConfig limits what a session's Lua modules may do
+type LuaConfig struct {
+	Budget  int      `yaml:"budget,omitempty"`  // milliseconds one Lua call may run, default 1000
+	Trusted []string `yaml:"trusted,omitempty"` // modules given the full os and io libraries
+	Watch   bool     `yaml:"watch,omitempty"`   // reload modules when their files change
 }
 
 // GetSessionsConfigPath returns the path to sessions.yaml in the XDG config directory
@@ -0,0 +1,41 @@
+package config
+
+import "fmt"
+
+// SettingsConfig holds the module settings changed with #set for a session.
+// Values are kept as typed and checked against the module's declared type
+// when read.
+type SettingsConfig struct {
+	Modules map[string]map[string]string `yaml:"modules"`
+}
+
+// GetSessionSettingsPath returns the path to a session's settings.yaml
+func GetSessionSettingsPath(sessionName string) (string, error) {
+	return sessionFile(sessionName, "settings.yaml")
+}
+
+// LoadSessionSettings reads a session's settings.yaml. A missing file is not an error.
+func LoadSessionSettings(sessionName string) (*SettingsConfig, error) {
+	path, err := GetSessionSettingsPath(sessionName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get settings path: %v", err)
+	}
+
+	var settings SettingsConfig
+	if _, err := readSessionFile(path, &settings); err != nil {
+		return nil, err
+	}
+	if settings.Modules == nil {
+		settings.Modules = make(map[string]map[string]string)
+	}
+	return &settings, nil
+}
+
+// SaveSessionSettings writes a session's settings.yaml, creating the session directory if needed
+func SaveSessionSettings(sessionName string, settings *SettingsConfig) error {
+	path, err := GetSessionSettingsPath(sessionName)
+	if err != nil {
+		return fmt.Errorf("failed to get settings path: %v", err)
+	}
+	return saveSessionFile(path, settings)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/perlsaiyan/zif/importer"
+)
+
+var importers = map[string]func(io.Reader, string) (*importer.Result, error){
+	"tintin": importer.ParseTintin,
+	"zmud":   importer.ParseZmud,
+	"mudlet": importer.ParseMudlet,
+}
+
+// runImport handles "zif import <format> <file> [--session name]" and
+// returns the process exit code.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	sessionName := fs.String("session", "zif", "Session to import into")
+	dryRun := fs.Bool("dry-run", false, "Report what would be imported without writing anything")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: zif import <tintin|zmud|mudlet> <file> [--session name] [--dry-run]")
+		fs.PrintDefaults()
+	}
+
+	if len(args) < 1 {
+		fs.Usage()
+		return 2
+	}
+	parse, ok := importers[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown import format %q\n", args[0])
+		fs.Usage()
+		return 2
+	}
+
+	// Allow flags before or after the file name
+	fs.Parse(args[1:])
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+	file := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	res, err := parse(f, file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	for _, n := range res.Notes {
+		fmt.Printf("%s: %s\n", file, n)
+	}
+
+	if *dryRun {
+		fmt.Printf("Would import %s into session %s\n", res.Summary(), *sessionName)
+		return 0
+	}
+	if err := res.Write(*sessionName); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Imported %s into session %s\n", res.Summary(), *sessionName)
+	if len(res.Lua) > 0 {
+		fmt.Printf("Generated Lua module %s\n", res.ModuleName())
+	}
+	return 0
+}
@@ -0,0 +1,221 @@
+// Package importer converts configuration from other MUD clients into zif's
+// session config (imported_triggers.yaml, imported_aliases.yaml and
+// imported_timers.yaml) and a generated Lua module for anything that needs
+// scripting.
+package importer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/perlsaiyan/zif/config"
+)
+
+// Result is everything converted from one file, plus notes about what could
+// not be converted.
+type Result struct {
+	Format   string // "tintin", "zmud", "mudlet"
+	File     string
+	Triggers []config.TriggerConfig
+	Aliases  []config.AliasConfig
+	Timers   []config.TimerConfig
+	Lua      []string // chunks of the generated module's init.lua
+	Notes    []Note
+
+	names map[string]bool
+}
+
+// Note describes an item that was skipped or converted with caveats
+type Note struct {
+	Line   int    // line in the source file, 0 if not known
+	Item   string // e.g. "#action {%1 tells you}" or "trigger Combat/loot"
+	Reason string
+}
+
+func (n Note) String() string {
+	if n.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", n.Line, n.Item, n.Reason)
+	}
+	return fmt.Sprintf("%s: %s", n.Item, n.Reason)
+}
+
+func newResult(format, file string) *Result {
+	return &Result{Format: format, File: file, names: map[string]bool{}}
+}
+
+func (r *Result) note(line int, item string, format string, args ...interface{}) {
+	r.Notes = append(r.Notes, Note{Line: line, Item: item, Reason: fmt.Sprintf(format, args...)})
+}
+
+// uniqueName returns name, or name_2, name_3... if it was already used
+func (r *Result) uniqueName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "imported"
+	}
+	unique := name
+	for i := 2; r.names[unique]; i++ {
+		unique = fmt.Sprintf("%s_%d", name, i)
+	}
+	r.names[unique] = true
+	return unique
+}
+
+func (r *Result) addTrigger(line int, item string, t config.TriggerConfig) {
+	if errs := (&config.TriggersConfig{Triggers: []config.TriggerConfig{t}}).Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			r.note(line, item, "%s", validationMsg(err))
+		}
+		return
+	}
+	r.Triggers = append(r.Triggers, t)
+}
+
+func (r *Result) addAlias(line int, item string, a config.AliasConfig) {
+	if errs := (&config.AliasesConfig{Aliases: []config.AliasConfig{a}}).Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			r.note(line, item, "%s", validationMsg(err))
+		}
+		return
+	}
+	r.Aliases = append(r.Aliases, a)
+}
+
+func (r *Result) addTimer(line int, item string, t config.TimerConfig) {
+	if errs := (&config.TimersConfig{Timers: []config.TimerConfig{t}}).Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			r.note(line, item, "%s", validationMsg(err))
+		}
+		return
+	}
+	r.Timers = append(r.Timers, t)
+}
+
+func validationMsg(err error) string {
+	if ve, ok := err.(config.ValidationError); ok {
+		return ve.Msg
+	}
+	return err.Error()
+}
+
+// ModuleName is the name of the Lua module generated for the import
+func (r *Result) ModuleName() string {
+	return strings.ToUpper(r.Format[:1]) + r.Format[1:] + "Import"
+}
+
+// Summary describes what was converted in one line
+func (r *Result) Summary() string {
+	return fmt.Sprintf("%d triggers, %d aliases, %d timers, %d Lua blocks, %d notes",
+		len(r.Triggers), len(r.Aliases), len(r.Timers), len(r.Lua), len(r.Notes))
+}
+
+// Write merges the result into a session's imported_triggers.yaml,
+// imported_aliases.yaml and imported_timers.yaml, which load after the
+// hand-written files and are never edited by hand, so the user's own
+// files keep their comments and layout. Entries with the same name as an
+// earlier import replace it, so importing a file again updates it. Lua goes
+// to modules/<ModuleName>/init.lua.
+func (r *Result) Write(sessionName string) error {
+	if len(r.Triggers) > 0 {
+		cfg, err := config.LoadSessionImportedTriggers(sessionName)
+		if err != nil {
+			return err
+		}
+		cfg.Triggers = mergeByName(cfg.Triggers, r.Triggers, func(t config.TriggerConfig) string { return t.Name })
+		if err := config.SaveSessionImportedTriggers(sessionName, cfg); err != nil {
+			return err
+		}
+	}
+
+	if len(r.Aliases) > 0 {
+		cfg, err := config.LoadSessionImportedAliases(sessionName)
+		if err != nil {
+			return err
+		}
+		cfg.Aliases = mergeByName(cfg.Aliases, r.Aliases, func(a config.AliasConfig) string { return a.Name })
+		if err := config.SaveSessionImportedAliases(sessionName, cfg); err != nil {
+			return err
+		}
+	}
+
+	if len(r.Timers) > 0 {
+		cfg, err := config.LoadSessionImportedTimers(sessionName)
+		if err != nil {
+			return err
+		}
+		cfg.Timers = mergeByName(cfg.Timers, r.Timers, func(t config.TimerConfig) string { return t.Name })
+		if err := config.SaveSessionImportedTimers(sessionName, cfg); err != nil {
+			return err
+		}
+	}
+
+	if len(r.Lua) > 0 {
+		modulesDir, err := config.GetSessionModulesDir(sessionName)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(modulesDir, r.ModuleName())
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create module directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "init.lua"), []byte(r.luaModule()), 0644); err != nil {
+			return fmt.Errorf("failed to write init.lua: %v", err)
+		}
+	}
+	return nil
+}
+
+func mergeByName[T any](existing, imported []T, name func(T) string) []T {
+	replace := map[string]T{}
+	for _, t := range imported {
+		replace[name(t)] = t
+	}
+	out := make([]T, 0, len(existing)+len(imported))
+	for _, t := range existing {
+		if _, ok := replace[name(t)]; !ok {
+			out = append(out, t)
+		}
+	}
+	return append(out, imported...)
+}
+
+func (r *Result) luaModule() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- Generated by zif import %s from %s\n", r.Format, filepath.Base(r.File))
+	b.WriteString("-- Re-running the import overwrites this file.\n\n")
+	if r.Format == "mudlet" {
+		b.WriteString(mudletShim)
+	}
+	for _, chunk := range r.Lua {
+		b.WriteString(chunk)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// luaString quotes s as a Lua long string, which needs no escaping. The
+// level is chosen so that neither s nor its end can close the string early.
+func luaString(s string) string {
+	level := ""
+	for strings.Contains(s, "]"+level+"]") || strings.HasSuffix(s, "]"+level) {
+		level += "="
+	}
+	// A newline right after the opening bracket is dropped by Lua
+	if strings.HasPrefix(s, "\n") || strings.HasPrefix(s, "\r") {
+		s = "\n" + s
+	}
+	return "[" + level + "[" + s + "]" + level + "]"
+}
+
+// sortedKeys returns a map's keys in order, for stable notes
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,271 @@
+package importer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/perlsaiyan/zif/config"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func parseFile(t *testing.T, parse func(f *os.File, name string) (*Result, error), name string) *Result {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	res, err := parse(f, name)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", name, err)
+	}
+	return res
+}
+
+func hasNote(res *Result, line int, substr string) bool {
+	for _, n := range res.Notes {
+		if n.Line == line && strings.Contains(n.Reason, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func findTrigger(res *Result, name string) *config.TriggerConfig {
+	for i := range res.Triggers {
+		if res.Triggers[i].Name == name {
+			return &res.Triggers[i]
+		}
+	}
+	return nil
+}
+
+func TestTintinPattern(t *testing.T) {
+	tests := []struct {
+		in, want, match string
+	}{
+		{`^%1 is dead!`, `^(.*?) is dead!`, "orc is dead!"},
+		{`%1 tells you '%2'`, `(.*?) tells you '(.*?)'`, "Bob tells you 'hi'"},
+		{`You get %d coins`, `You get [0-9]* coins`, "You get 12 coins"},
+		{`^You say %*$`, `^You say .*$`, "You say hi"},
+		{`%iHELLO %1`, `(?i)HELLO (.*)`, "hello world"},
+		{`^{\d+}hp`, `^(\d+)hp`, "120hp"},
+		{`100%% done`, `100% done`, "100% done"},
+	}
+	for _, tt := range tests {
+		got, err := tintinPattern(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("tintinPattern(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+			continue
+		}
+		if !regexp.MustCompile(got).MatchString(tt.match) {
+			t.Errorf("%q does not match %q", got, tt.match)
+		}
+	}
+	if _, err := tintinPattern(`%+1d`); err == nil {
+		t.Errorf("expected an error for %q", "%+1d")
+	}
+}
+
+func TestZmudPattern(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`^(%w) is dead!`, `^([A-Za-z]+) is dead!`},
+		{`(*) tells you`, `(.*?) tells you`},
+		{`You get (%d) coins`, `You get ([0-9]+) coins`},
+		{`{north|south} exit`, `(?:north|south) exit`},
+		{`cost: ~$5`, `cost: \$5`},
+		{`say (*)`, `say (.*)`},
+	}
+	for _, tt := range tests {
+		if got, err := zmudPattern(tt.in); err != nil || got != tt.want {
+			t.Errorf("zmudPattern(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseTintin(t *testing.T) {
+	res := parseFile(t, func(f *os.File, n string) (*Result, error) { return ParseTintin(f, n) }, "sample.tin")
+
+	dead := findTrigger(res, "^%1 is dead!  R.I.P.")
+	if dead == nil {
+		t.Fatal("#action was not converted")
+	}
+	if dead.Group != "combat" || dead.Priority != 1 || dead.Commands[0] != "get all corpse;say bye %1" {
+		t.Errorf("unexpected trigger %+v", *dead)
+	}
+	if h := findTrigger(res, "highlight ^[Gossip]"); h == nil || h.Highlight != "14" {
+		t.Errorf("bold cyan highlight = %+v", h)
+	}
+	if g := findTrigger(res, "gag ^The wind howls."); g == nil || !g.Gag || g.Group != "" {
+		t.Errorf("gag = %+v", g)
+	}
+
+	wantAliases := []config.AliasConfig{
+		{Name: "k", Body: "kill %*"},
+		{Name: "gt %1", Pattern: "^gt (.*)$", Commands: config.Commands{"gtell %1"}},
+		{Name: "heal", Body: "cast 'heal' %*;say healed"},
+	}
+	if !reflect.DeepEqual(res.Aliases, wantAliases) {
+		t.Errorf("aliases = %+v\nwant %+v", res.Aliases, wantAliases)
+	}
+	if len(res.Timers) != 1 || res.Timers[0].Interval != "5m0s" {
+		t.Errorf("timers = %+v", res.Timers)
+	}
+	if len(res.Lua) != 2 || res.Lua[1] != "session.set_data([[hpmin]], 50)" {
+		t.Errorf("lua = %q", res.Lua)
+	}
+
+	for _, n := range []struct {
+		line int
+		text string
+	}{
+		{4, "#if"},
+		{15, "#split is not supported"},
+		{16, "%+"},
+	} {
+		if !hasNote(res, n.line, n.text) {
+			t.Errorf("missing note on line %d about %q: %v", n.line, n.text, res.Notes)
+		}
+	}
+}
+
+func TestParseZmud(t *testing.T) {
+	res := parseFile(t, func(f *os.File, n string) (*Result, error) { return ParseZmud(f, n) }, "sample.zmud")
+
+	if tr := findTrigger(res, "tells"); tr == nil || tr.Group != "chat" || tr.Pattern != `([A-Za-z]+) tells you '(.*?)'` {
+		t.Errorf("named trigger = %+v", tr)
+	}
+	if tr := findTrigger(res, "^(%w) is dead!"); tr == nil || tr.Group != "combat" {
+		t.Errorf("class trigger = %+v", tr)
+	}
+	if len(res.Timers) != 1 || res.Timers[0].Interval != "1m0s" {
+		t.Errorf("timers = %+v", res.Timers)
+	}
+	if !hasNote(res, 8, "repeating") || !hasNote(res, 10, "#KEY") {
+		t.Errorf("missing notes: %v", res.Notes)
+	}
+}
+
+func TestParseMudlet(t *testing.T) {
+	res := parseFile(t, func(f *os.File, n string) (*Result, error) { return ParseMudlet(f, n) }, "sample.xml")
+
+	loot := findTrigger(res, "loot")
+	if loot == nil || loot.Group != "Combat" || !reflect.DeepEqual(loot.Commands, config.Commands{"get all corpse", "say bye %1"}) {
+		t.Errorf("loot = %+v", loot)
+	}
+	if h := findTrigger(res, "hungry_2"); h == nil || h.Pattern != "^You are thirsty" || h.Highlight != "#ffaa00" {
+		t.Errorf("second colorizer pattern = %+v", h)
+	}
+	if len(res.Aliases) != 1 || res.Aliases[0].Commands[0] != "kill %1" {
+		t.Errorf("aliases = %+v", res.Aliases)
+	}
+	if len(res.Timers) != 1 || config.IsEnabled(res.Timers[0].Enabled) {
+		t.Errorf("inactive timer = %+v", res.Timers)
+	}
+
+	lua := res.luaModule()
+	for _, want := range []string{"local function send(cmd)", `session.register_trigger([[lowhp]], [[^HP: (\d+)]]`, "session.register_alias([[tt]]"} {
+		if !strings.Contains(lua, want) {
+			t.Errorf("module is missing %q:\n%s", want, lua)
+		}
+	}
+
+	for _, want := range []string{"selectString()", "not supported by Go", "key bindings", "scripts are not converted"} {
+		if !hasNote(res, 0, want) {
+			t.Errorf("missing note about %q: %v", want, res.Notes)
+		}
+	}
+}
+
+func TestWriteKeepsHandWrittenFiles(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	path, _ := config.GetSessionTriggersPath("test")
+	handWritten := "# my triggers\ntriggers:\n  - name: mine   # keep this\n    pattern: x\n    commands: say x\n"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(handWritten), 0644); err != nil {
+		t.Fatal(err)
+	}
+	earlier := &config.TriggersConfig{Triggers: []config.TriggerConfig{
+		{Name: "loot", Pattern: "x", Commands: config.Commands{"say x"}},
+		{Name: "hungry", Pattern: "old", Commands: config.Commands{"say old"}},
+	}}
+	if err := config.SaveSessionImportedTriggers("test", earlier); err != nil {
+		t.Fatal(err)
+	}
+
+	res := parseFile(t, func(f *os.File, n string) (*Result, error) { return ParseMudlet(f, n) }, "sample.xml")
+	if err := res.Write("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(path); string(data) != handWritten {
+		t.Errorf("import rewrote triggers.yaml:\n%s", data)
+	}
+	triggers, err := config.LoadSessionImportedTriggers("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := triggers.Validate(); len(errs) > 0 {
+		t.Errorf("written triggers do not validate: %v", errs)
+	}
+	var names []string
+	for _, tr := range triggers.Triggers {
+		names = append(names, tr.Name)
+	}
+	if want := []string{"loot", "hungry", "hungry_2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("imported trigger names = %q, want %q", names, want)
+	}
+	if triggers.Triggers[1].Pattern == "old" {
+		t.Error("re-import did not replace the earlier entry")
+	}
+
+	modules, _ := config.GetSessionModulesDir("test")
+	if _, err := os.Stat(filepath.Join(modules, "MudletImport", "init.lua")); err != nil {
+		t.Errorf("module not written: %v", err)
+	}
+}
+
+func TestLuaStringRoundTrip(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	for _, s := range []string{"", "plain", "ends]", "ends]]", "a]]b", "x]=]y]", "]=", "\nleading newline", "[[nested]]"} {
+		if err := L.DoString("result = " + luaString(s)); err != nil {
+			t.Errorf("luaString(%q) = %s does not load: %v", s, luaString(s), err)
+			continue
+		}
+		if got := L.GetGlobal("result").String(); got != s {
+			t.Errorf("luaString(%q) read back as %q", s, got)
+		}
+	}
+}
+
+func TestImportedModuleLoads(t *testing.T) {
+	res, err := ParseTintin(strings.NewReader("#variable {target} {orc]}\n#variable {list} {[a][b]}\n"), "test.tin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	L := lua.NewState()
+	defer L.Close()
+	data := map[string]string{}
+	session := L.NewTable()
+	L.SetField(session, "set_data", L.NewFunction(func(L *lua.LState) int {
+		data[L.CheckString(1)] = L.Get(2).String()
+		return 0
+	}))
+	L.SetGlobal("session", session)
+	if err := L.DoString(res.luaModule()); err != nil {
+		t.Fatalf("generated module does not load: %v\n%s", err, res.luaModule())
+	}
+	if data["target"] != "orc]" || data["list"] != "[a][b]" {
+		t.Errorf("variables = %q", data)
+	}
+}
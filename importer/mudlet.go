@@ -0,0 +1,400 @@
+package importer
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perlsaiyan/zif/config"
+)
+
+// mudletShim is prepended to generated modules so imported scripts can keep
+// calling send() and echo().
+const mudletShim = `-- Minimal Mudlet compatibility for the scripts below
+local function send(cmd) session.send(cmd) end
+local function echo(text) session.output(text) end
+
+`
+
+// mudletItem is any trigger, alias, timer, key or script element, or a
+// group of them. Groups and chained triggers hold their members in Children.
+type mudletItem struct {
+	XMLName     xml.Name
+	IsActive    string       `xml:"isActive,attr"`
+	IsFolder    string       `xml:"isFolder,attr"`
+	IsMultiline string       `xml:"isMultiline,attr"`
+	IsColorizer string       `xml:"isColorizerTrigger,attr"`
+	IsOffset    string       `xml:"isOffsetTimer,attr"`
+	Name        string       `xml:"name"`
+	Script      string       `xml:"script"`
+	Command     string       `xml:"command"`
+	MCommand    string       `xml:"mCommand"`
+	Patterns    []string     `xml:"regexCodeList>string"`
+	Types       []int        `xml:"regexCodePropertyList>integer"`
+	FgColor     string       `xml:"mFgColor"`
+	Regex       string       `xml:"regex"`
+	Time        string       `xml:"time"`
+	KeyCode     string       `xml:"keyCode"`
+	Children    []mudletItem `xml:",any"`
+}
+
+type mudletPackage struct {
+	Triggers mudletItem `xml:"TriggerPackage"`
+	Aliases  mudletItem `xml:"AliasPackage"`
+	Timers   mudletItem `xml:"TimerPackage"`
+	Keys     mudletItem `xml:"KeyPackage"`
+	Scripts  mudletItem `xml:"ScriptPackage"`
+}
+
+func (m mudletItem) kind() string {
+	return strings.TrimSuffix(m.XMLName.Local, "Group")
+}
+
+func (m mudletItem) isGroup() bool {
+	return strings.HasSuffix(m.XMLName.Local, "Group") || m.IsFolder == "yes"
+}
+
+// members returns the child items, skipping the other unmatched elements
+// that ",any" collects.
+func (m mudletItem) members() []mudletItem {
+	var out []mudletItem
+	for _, c := range m.Children {
+		switch c.kind() {
+		case "Trigger", "Alias", "Timer", "Key", "Script":
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// ParseMudlet converts a Mudlet package or profile export (XML). Triggers,
+// aliases and timers that only send commands become session config; those
+// with Lua scripts go into the generated module. Keys and scripts are
+// reported but not converted.
+func ParseMudlet(r io.Reader, file string) (*Result, error) {
+	var pkg mudletPackage
+	if err := xml.NewDecoder(r).Decode(&pkg); err != nil {
+		return nil, fmt.Errorf("failed to parse Mudlet XML: %v", err)
+	}
+
+	res := newResult("mudlet", file)
+	for _, top := range []mudletItem{pkg.Triggers, pkg.Aliases, pkg.Timers, pkg.Keys, pkg.Scripts} {
+		for _, item := range top.members() {
+			res.mudletItem(item, "")
+		}
+	}
+	return res, nil
+}
+
+func (r *Result) mudletItem(m mudletItem, group string) {
+	item := strings.ToLower(m.kind()) + " " + strings.TrimPrefix(group+"/"+m.Name, "/")
+
+	if m.isGroup() {
+		if m.kind() == "Trigger" && len(m.Patterns) > 0 {
+			r.note(0, item, "group patterns (trigger chains) are not supported; members are imported unconditionally")
+		}
+		if strings.TrimSpace(m.Script) != "" {
+			r.note(0, item, "group scripts are not supported")
+		}
+		sub := strings.TrimPrefix(group+"/"+m.Name, "/")
+		for _, c := range m.members() {
+			r.mudletItem(c, sub)
+		}
+		return
+	}
+
+	switch m.kind() {
+	case "Trigger":
+		r.mudletTrigger(m, group, item)
+		if len(m.members()) > 0 {
+			r.note(0, item, "chained triggers are not supported; children are imported unconditionally")
+			for _, c := range m.members() {
+				r.mudletItem(c, group)
+			}
+		}
+	case "Alias":
+		r.mudletAlias(m, group, item)
+	case "Timer":
+		r.mudletTimer(m, group, item)
+	case "Key":
+		r.note(0, item, "key bindings are not supported (key code %s)", m.KeyCode)
+	case "Script":
+		r.note(0, item, "scripts are not converted; copy them into a Lua module by hand")
+	}
+}
+
+func (r *Result) mudletTrigger(m mudletItem, group, item string) {
+	if m.IsMultiline == "yes" {
+		r.note(0, item, "multi-line (AND) triggers are not supported")
+		return
+	}
+
+	var patterns []string
+	for i, p := range m.Patterns {
+		t := 0
+		if i < len(m.Types) {
+			t = m.Types[i]
+		}
+		switch t {
+		case 0: // substring
+			patterns = append(patterns, regexp.QuoteMeta(p))
+		case 1: // perl regex
+			if _, err := regexp.Compile(p); err != nil {
+				r.note(0, item, "regex %q is not supported by Go: %v", p, err)
+				continue
+			}
+			patterns = append(patterns, p)
+		case 2: // begin of line substring
+			patterns = append(patterns, "^"+regexp.QuoteMeta(p))
+		case 3: // exact match
+			patterns = append(patterns, "^"+regexp.QuoteMeta(p)+"$")
+		default:
+			r.note(0, item, "pattern type %d (%q) is not supported", t, p)
+		}
+	}
+	if len(patterns) == 0 {
+		r.note(0, item, "no usable patterns")
+		return
+	}
+
+	enabled := mudletEnabled(m)
+	cmds, simple := mudletCommands(m.MCommand, m.Script)
+	highlight := ""
+	if m.IsColorizer == "yes" {
+		highlight = m.FgColor
+	}
+
+	for _, p := range patterns {
+		if simple || highlight != "" {
+			t := config.TriggerConfig{
+				Name:      r.uniqueName(m.Name),
+				Pattern:   p,
+				Highlight: highlight,
+				Group:     group,
+				Enabled:   enabled,
+			}
+			if simple {
+				t.Commands = cmds
+			}
+			if len(t.Commands) > 0 || t.Highlight != "" {
+				r.addTrigger(0, item, t)
+			} else {
+				r.note(0, item, "trigger does nothing")
+			}
+		}
+		if !simple {
+			if enabled != nil {
+				r.note(0, item, "inactive scripted trigger skipped")
+				continue
+			}
+			r.noteMudletScript(item, m.Script)
+			r.Lua = append(r.Lua, fmt.Sprintf("-- %s\nsession.register_trigger(%s, %s, function(matches)\n%s\nend)\n",
+				item, luaString(r.uniqueName(m.Name)), luaString(p), mudletBody(m.MCommand, m.Script)))
+		}
+	}
+}
+
+func (r *Result) mudletAlias(m mudletItem, group, item string) {
+	if _, err := regexp.Compile(m.Regex); err != nil || m.Regex == "" {
+		r.note(0, item, "regex %q is not supported by Go: %v", m.Regex, err)
+		return
+	}
+
+	cmds, simple := mudletCommands(m.Command, m.Script)
+	if simple {
+		r.addAlias(0, item, config.AliasConfig{
+			Name:     r.uniqueName(m.Name),
+			Pattern:  m.Regex,
+			Commands: cmds,
+			Group:    group,
+			Enabled:  mudletEnabled(m),
+		})
+		return
+	}
+	if mudletEnabled(m) != nil {
+		r.note(0, item, "inactive scripted alias skipped")
+		return
+	}
+	r.noteMudletScript(item, m.Script)
+	r.Lua = append(r.Lua, fmt.Sprintf("-- %s\nsession.register_alias(%s, %s, function(matches)\n%s\nend)\n",
+		item, luaString(r.uniqueName(m.Name)), luaString(m.Regex), mudletBody(m.Command, m.Script)))
+}
+
+func (r *Result) mudletTimer(m mudletItem, group, item string) {
+	if m.IsOffset == "yes" {
+		r.note(0, item, "offset timers are not supported")
+		return
+	}
+	interval, err := mudletTime(m.Time)
+	if err != nil {
+		r.note(0, item, "%v", err)
+		return
+	}
+
+	cmds, simple := mudletCommands(m.Command, m.Script)
+	if simple {
+		r.addTimer(0, item, config.TimerConfig{
+			Name:     r.uniqueName(m.Name),
+			Interval: interval.String(),
+			Commands: cmds,
+			Group:    group,
+			Enabled:  mudletEnabled(m),
+		})
+		return
+	}
+	if mudletEnabled(m) != nil {
+		r.note(0, item, "inactive scripted timer skipped")
+		return
+	}
+	r.noteMudletScript(item, m.Script)
+	r.Lua = append(r.Lua, fmt.Sprintf("-- %s\nsession.add_timer(%s, %d, function()\n%s\nend)\n",
+		item, luaString(r.uniqueName(m.Name)), interval.Milliseconds(), mudletBody(m.Command, m.Script)))
+}
+
+// mudletEnabled returns nil for active items and a false flag otherwise
+func mudletEnabled(m mudletItem) *bool {
+	if m.IsActive == "no" {
+		f := false
+		return &f
+	}
+	return nil
+}
+
+// mudletTime parses Mudlet's hh:mm:ss.zzz timer interval
+func mudletTime(s string) (time.Duration, error) {
+	var h, m int
+	var sec float64
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d:%f", &h, &m, &sec); err != nil {
+		return 0, fmt.Errorf("bad timer interval %q", s)
+	}
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec*float64(time.Second))
+	if d <= 0 {
+		return 0, fmt.Errorf("timer interval %q is zero", s)
+	}
+	return d, nil
+}
+
+var mudletSendRE = regexp.MustCompile(`^send\s*\((.*?)(?:,\s*(?:true|false)\s*)?\)\s*;?$`)
+
+// mudletCommands returns the commands an item sends, if its script is
+// empty or nothing but send() calls built from strings and captures.
+func mudletCommands(command, script string) (config.Commands, bool) {
+	var cmds config.Commands
+	if c := strings.TrimSpace(command); c != "" {
+		cmds = append(cmds, c)
+	}
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+		m := mudletSendRE.FindStringSubmatch(line)
+		if m == nil {
+			return nil, false
+		}
+		cmd, ok := sendExpr(m[1])
+		if !ok {
+			return nil, false
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, true
+}
+
+// sendExpr converts a concatenation of string literals and matches[n] into
+// a command with %n placeholders. Mudlet's matches[2] is the first capture.
+func sendExpr(expr string) (string, bool) {
+	var b strings.Builder
+	rest := strings.TrimSpace(expr)
+	for rest != "" {
+		switch {
+		case rest[0] == '"' || rest[0] == '\'':
+			end := strings.IndexByte(rest[1:], rest[0])
+			if end < 0 {
+				return "", false
+			}
+			lit := rest[1 : end+1]
+			if strings.ContainsAny(lit, "\\%;") {
+				return "", false
+			}
+			b.WriteString(lit)
+			rest = rest[end+2:]
+		case strings.HasPrefix(rest, "matches["):
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return "", false
+			}
+			n, err := strconv.Atoi(rest[len("matches["):end])
+			if err != nil || n < 1 || n > 10 {
+				return "", false
+			}
+			fmt.Fprintf(&b, "%%%d", n-1)
+			rest = rest[end+1:]
+		default:
+			return "", false
+		}
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			break
+		}
+		if !strings.HasPrefix(rest, "..") {
+			return "", false
+		}
+		rest = strings.TrimSpace(rest[2:])
+	}
+	return b.String(), b.Len() > 0
+}
+
+func mudletBody(command, script string) string {
+	var lines []string
+	if c := strings.TrimSpace(command); c != "" {
+		lines = append(lines, "send("+luaString(c)+")")
+	}
+	for _, line := range strings.Split(strings.TrimRight(script, "\n"), "\n") {
+		lines = append(lines, "    "+line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+var (
+	luaCallRE = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_.:]*)\s*\(`)
+	luaDefRE  = regexp.MustCompile(`function\s+([A-Za-z_][A-Za-z0-9_.]*)|local\s+([A-Za-z_][A-Za-z0-9_]*)\s*=`)
+)
+
+var luaKnown = map[string]bool{
+	"send": true, "echo": true, "print": true, "tonumber": true, "tostring": true, "type": true,
+	"pairs": true, "ipairs": true, "select": true, "unpack": true, "error": true, "pcall": true,
+	"assert": true, "setmetatable": true, "getmetatable": true, "rawget": true, "rawset": true,
+	"function": true, "if": true, "elseif": true, "while": true, "and": true, "or": true,
+	"not": true, "return": true, "until": true, "in": true,
+}
+
+// noteMudletScript reports functions a script calls that are neither Lua
+// built-ins nor part of the shim, since they will fail at runtime.
+func (r *Result) noteMudletScript(item, script string) {
+	defined := map[string]bool{}
+	for _, m := range luaDefRE.FindAllStringSubmatch(script, -1) {
+		defined[m[1]+m[2]] = true
+	}
+	unknown := map[string]bool{}
+	for _, m := range luaCallRE.FindAllStringSubmatch(script, -1) {
+		name := m[1]
+		if luaKnown[name] || defined[name] || strings.Contains(name, ":") {
+			continue
+		}
+		if pkg, _, ok := strings.Cut(name, "."); ok {
+			switch pkg {
+			case "string", "table", "math", "os", "session", "module":
+				continue
+			}
+		}
+		unknown[name] = true
+	}
+	for _, name := range sortedKeys(unknown) {
+		r.note(0, item, "script calls %s(), which zif does not provide", name)
+	}
+}
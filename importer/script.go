@@ -0,0 +1,137 @@
+package importer
+
+import (
+	"strings"
+
+	"github.com/perlsaiyan/zif/tintin"
+)
+
+// scriptCommand is one top-level command of a tintin++ or zMUD script file
+type scriptCommand struct {
+	line int
+	name string // lower case, without the leading '#'
+	args []string
+	text string
+}
+
+// splitScript breaks a tintin++/zMUD script into commands. Commands end at a
+// newline or ';' outside braces; braced arguments may span lines and may
+// start on the line after the command.
+// C-style /* comments */ are skipped.
+func splitScript(src string) []scriptCommand {
+	var cmds []scriptCommand
+	var cur strings.Builder
+	depth, line, start := 0, 1, 1
+
+	flush := func() {
+		if text := strings.TrimSpace(cur.String()); text != "" {
+			cmds = append(cmds, parseScriptCommand(start, text))
+		}
+		cur.Reset()
+	}
+
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if depth == 0 && c == '/' && strings.HasPrefix(src[i:], "/*") {
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				end = len(src) - i - 2
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 3
+			continue
+		}
+		if cur.Len() == 0 && (c == ' ' || c == '\t' || c == '\r' || c == '\n') {
+			if c == '\n' {
+				line++
+			}
+			continue
+		}
+		if cur.Len() == 0 {
+			start = line
+		}
+
+		switch c {
+		case '\\':
+			if i+1 < len(src) {
+				cur.WriteByte(c)
+				i++
+				c = src[i]
+			}
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case '\n':
+			line++
+			// "#alias {name}" followed by "{" on the next line continues the command
+			if depth == 0 && !strings.HasPrefix(strings.TrimLeft(src[i+1:], " \t\r\n"), "{") {
+				flush()
+				continue
+			}
+		case ';':
+			if depth == 0 {
+				flush()
+				continue
+			}
+		}
+		cur.WriteByte(c)
+	}
+	flush()
+	return cmds
+}
+
+func parseScriptCommand(line int, text string) scriptCommand {
+	cmd := scriptCommand{line: line, text: text}
+	if !strings.HasPrefix(text, "#") {
+		return cmd
+	}
+	rest := text[1:]
+	end := strings.IndexAny(rest, " \t{")
+	if end < 0 {
+		end = len(rest)
+	}
+	cmd.name = strings.ToLower(rest[:end])
+	cmd.args = tintin.BraceArgs(rest[end:])
+	for i, arg := range cmd.args {
+		cmd.args[i] = joinLines(arg)
+	}
+	return cmd
+}
+
+// joinLines removes the line breaks and indentation of a multi-line
+// argument, as tintin does when reading a script.
+func joinLines(s string) string {
+	if !strings.Contains(s, "\n") {
+		return s
+	}
+	lines := strings.Split(s, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return strings.Join(lines, "")
+}
+
+// clientCommands returns the distinct client commands (e.g. "#if") used in
+// a body, which zif will not understand.
+func clientCommands(body string) []string {
+	seen := map[string]bool{}
+	for _, c := range tintin.SplitCommands(body) {
+		if strings.HasPrefix(c, "#") {
+			name := strings.ToLower(strings.Fields(c)[0])
+			if i := strings.IndexByte(name, '{'); i > 0 {
+				name = name[:i]
+			}
+			seen[name] = true
+		}
+	}
+	return sortedKeys(seen)
+}
+
+// restOfPattern reports whether only group closers and anchors follow,
+// so a wildcard there should match greedily to the end of the line.
+func restOfPattern(rest string) bool {
+	return strings.Trim(rest, ")$") == ""
+}
@@ -0,0 +1,386 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perlsaiyan/zif/config"
+)
+
+// tintinCommands are the tintin++ commands we convert, in the order tintin
+// resolves abbreviations such as #act or #var.
+var tintinCommands = []string{"action", "alias", "class", "gag", "highlight", "nop", "ticker", "variable"}
+
+func tintinCommandName(name string) string {
+	for _, full := range tintinCommands {
+		if name == full || (len(name) >= 3 && strings.HasPrefix(full, name)) {
+			return full
+		}
+	}
+	return ""
+}
+
+// ParseTintin converts a tintin++ script. #action, #alias, #gag, #highlight
+// and #ticker become session config, #variable becomes Lua and #class sets
+// the group of what follows it.
+func ParseTintin(r io.Reader, file string) (*Result, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	res := newResult("tintin", file)
+	group := ""
+
+	for _, cmd := range splitScript(string(src)) {
+		item := shorten(cmd.text)
+		if cmd.name == "" {
+			res.note(cmd.line, item, "not a tintin command")
+			continue
+		}
+		args := cmd.args
+
+		switch tintinCommandName(cmd.name) {
+		case "nop":
+		case "class":
+			if len(args) >= 2 && args[1] == "open" {
+				group = args[0]
+			} else if len(args) >= 2 && args[1] == "close" {
+				group = ""
+			} else {
+				res.note(cmd.line, item, "only #class {name} {open|close} is supported")
+			}
+
+		case "action":
+			if len(args) < 2 {
+				res.note(cmd.line, item, "expected #action {pattern} {commands}")
+				continue
+			}
+			pattern, err := tintinPattern(args[0])
+			if err != nil {
+				res.note(cmd.line, item, "%v", err)
+				continue
+			}
+			res.noteBody(cmd.line, item, args[1])
+			res.addTrigger(cmd.line, item, config.TriggerConfig{
+				Name:     res.uniqueName(args[0]),
+				Pattern:  pattern,
+				Commands: config.Commands{args[1]},
+				Group:    group,
+				Priority: tintinPriority(args, 2),
+			})
+
+		case "gag":
+			if len(args) < 1 {
+				res.note(cmd.line, item, "expected #gag {pattern}")
+				continue
+			}
+			pattern, err := tintinPattern(args[0])
+			if err != nil {
+				res.note(cmd.line, item, "%v", err)
+				continue
+			}
+			res.addTrigger(cmd.line, item, config.TriggerConfig{
+				Name:    res.uniqueName("gag " + args[0]),
+				Pattern: pattern,
+				Gag:     true,
+				Group:   group,
+			})
+
+		case "highlight":
+			if len(args) < 2 {
+				res.note(cmd.line, item, "expected #highlight {pattern} {color}")
+				continue
+			}
+			pattern, err := tintinPattern(args[0])
+			if err != nil {
+				res.note(cmd.line, item, "%v", err)
+				continue
+			}
+			color, ok := tintinColor(args[1])
+			if !ok {
+				res.note(cmd.line, item, "color %q is not supported", args[1])
+				continue
+			}
+			res.addTrigger(cmd.line, item, config.TriggerConfig{
+				Name:      res.uniqueName("highlight " + args[0]),
+				Pattern:   pattern,
+				Highlight: color,
+				Group:     group,
+				Priority:  tintinPriority(args, 2),
+			})
+
+		case "alias":
+			if len(args) < 2 {
+				res.note(cmd.line, item, "expected #alias {name} {commands}")
+				continue
+			}
+			res.noteBody(cmd.line, item, args[1])
+			if !strings.ContainsAny(args[0], " \t%") {
+				// In a tintin alias %0 is the arguments, which is %* in zif
+				res.addAlias(cmd.line, item, config.AliasConfig{
+					Name: res.uniqueName(args[0]),
+					Body: strings.ReplaceAll(args[1], "%0", "%*"),
+				})
+				continue
+			}
+			name := args[0]
+			if !strings.HasPrefix(name, "^") {
+				name = "^" + name
+			}
+			if !strings.HasSuffix(name, "$") {
+				name += "$"
+			}
+			pattern, err := tintinPattern(name)
+			if err != nil {
+				res.note(cmd.line, item, "%v", err)
+				continue
+			}
+			res.addAlias(cmd.line, item, config.AliasConfig{
+				Name:     res.uniqueName(args[0]),
+				Pattern:  pattern,
+				Commands: config.Commands{args[1]},
+				Group:    group,
+				Priority: tintinPriority(args, 2),
+			})
+
+		case "ticker":
+			if len(args) < 3 {
+				res.note(cmd.line, item, "expected #ticker {name} {commands} {seconds}")
+				continue
+			}
+			interval, err := seconds(args[2])
+			if err != nil {
+				res.note(cmd.line, item, "bad interval %q", args[2])
+				continue
+			}
+			res.noteBody(cmd.line, item, args[1])
+			res.addTimer(cmd.line, item, config.TimerConfig{
+				Name:     res.uniqueName(args[0]),
+				Interval: interval,
+				Commands: config.Commands{args[1]},
+				Group:    group,
+			})
+
+		case "variable":
+			if len(args) < 2 {
+				res.note(cmd.line, item, "expected #variable {name} {value}")
+				continue
+			}
+			res.Lua = append(res.Lua, fmt.Sprintf("session.set_data(%s, %s)", luaString(args[0]), luaValue(args[1])))
+
+		default:
+			res.note(cmd.line, item, "#%s is not supported", cmd.name)
+		}
+	}
+	return res, nil
+}
+
+// noteBody records client features in a command body that zif will pass
+// through verbatim rather than interpret.
+func (r *Result) noteBody(line int, item, body string) {
+	for _, c := range clientCommands(body) {
+		r.note(line, item, "body uses %s, which is sent as-is", c)
+	}
+	if strings.ContainsAny(body, "$@") {
+		r.note(line, item, "body may use client variables or functions, which are sent as-is")
+	}
+}
+
+// tintinPattern converts a tintin++ pattern to a Go regex. %1-%99 capture
+// text, %* matches without capturing, %d/%w/%s match digits, word characters
+// and spaces, {...} embeds a regex capture and %i makes the match case
+// insensitive.
+func tintinPattern(p string) (string, error) {
+	var b, lit strings.Builder
+	fold := false
+	flush := func() {
+		b.WriteString(regexp.QuoteMeta(lit.String()))
+		lit.Reset()
+	}
+
+	i, end := 0, len(p)
+	if strings.HasPrefix(p, "^") {
+		b.WriteString("^")
+		i = 1
+	}
+	anchorEnd := end > i && strings.HasSuffix(p, "$") && !strings.HasSuffix(p, "\\$")
+	if anchorEnd {
+		end--
+	}
+
+	for i < end {
+		c := p[i]
+		switch {
+		case c == '%' && i+1 < end:
+			n := p[i+1]
+			j := i + 2
+			flush()
+			switch {
+			case n >= '0' && n <= '9':
+				for j < end && j < i+3 && p[j] >= '0' && p[j] <= '9' {
+					j++
+				}
+				if restOfPattern(p[j:end]) {
+					b.WriteString("(.*)")
+				} else {
+					b.WriteString("(.*?)")
+				}
+			case n == '*' || n == 'a':
+				if restOfPattern(p[j:end]) {
+					b.WriteString(".*")
+				} else {
+					b.WriteString(".*?")
+				}
+			case n == 'd':
+				b.WriteString(`[0-9]*`)
+			case n == 'D':
+				b.WriteString(`[^0-9]*`)
+			case n == 'w':
+				b.WriteString(`\w*`)
+			case n == 'W':
+				b.WriteString(`\W*`)
+			case n == 's':
+				b.WriteString(`\s*`)
+			case n == 'S':
+				b.WriteString(`\S*`)
+			case n == 'i':
+				fold = true
+			case n == 'I':
+			case n == '%':
+				lit.WriteByte('%')
+			default:
+				return "", fmt.Errorf("wildcard %%%c is not supported", n)
+			}
+			i = j
+		case c == '{':
+			depth, j := 1, i+1
+			for ; j < end && depth > 0; j++ {
+				switch p[j] {
+				case '{':
+					depth++
+				case '}':
+					depth--
+				}
+			}
+			if depth > 0 {
+				return "", fmt.Errorf("unbalanced { in pattern")
+			}
+			inner := p[i+1 : j-1]
+			if _, err := regexp.Compile(inner); err != nil {
+				return "", fmt.Errorf("regex {%s} is not supported: %v", inner, err)
+			}
+			flush()
+			b.WriteString("(" + inner + ")")
+			i = j
+		default:
+			lit.WriteByte(c)
+			i++
+		}
+	}
+	flush()
+	if anchorEnd {
+		b.WriteString("$")
+	}
+	if fold {
+		return "(?i)" + b.String(), nil
+	}
+	return b.String(), nil
+}
+
+// tintinPriority converts tintin's priority (1 first, default 5) to zif's
+// (higher first, default 0).
+func tintinPriority(args []string, i int) int {
+	if i >= len(args) {
+		return 0
+	}
+	p, err := strconv.ParseFloat(strings.TrimSpace(args[i]), 64)
+	if err != nil {
+		return 0
+	}
+	return int(math.Round(5 - p))
+}
+
+var tintinColors = map[string]int{
+	"black": 0, "red": 1, "green": 2, "yellow": 3, "blue": 4, "magenta": 5, "cyan": 6, "white": 7,
+}
+
+var tintinExtraColors = map[string]string{
+	"azure": "#0080ff", "ebony": "#333333", "jade": "#00ff80", "lime": "#80ff00",
+	"orange": "#ff8000", "pink": "#ff0080", "silver": "#c0c0c0", "tan": "#c08040", "violet": "#8000ff",
+}
+
+var tintinCodeRE = regexp.MustCompile(`^<([0-9])([0-9])([0-9])>$|^<[Ff]([0-9a-fA-F]{3}|[0-9a-fA-F]{6})>$`)
+
+// tintinColor converts a tintin color name ("bold red", "light green") or
+// code ("<118>", "<F80ff00>") to a foreground color zif understands.
+func tintinColor(spec string) (string, bool) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if m := tintinCodeRE.FindStringSubmatch(spec); m != nil {
+		if m[4] != "" {
+			return "#" + m[4], true
+		}
+		fg := int(m[2][0] - '0')
+		if fg > 7 {
+			return "", false
+		}
+		if m[1] == "1" {
+			fg += 8
+		}
+		return strconv.Itoa(fg), true
+	}
+
+	bright := false
+	color := ""
+	words := strings.Fields(spec)
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		switch {
+		case w == "bold" || w == "light":
+			bright = true
+		case w == "b" || w == "background":
+			i++ // skip the background color
+		case tintinExtraColors[w] != "":
+			color = tintinExtraColors[w]
+		default:
+			if n, ok := tintinColors[w]; ok {
+				if bright {
+					n += 8
+				}
+				color = strconv.Itoa(n)
+			}
+		}
+	}
+	return color, color != ""
+}
+
+// seconds converts a number of seconds to a Go duration string
+func seconds(s string) (string, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || f <= 0 {
+		return "", fmt.Errorf("bad interval %q", s)
+	}
+	return time.Duration(f * float64(time.Second)).String(), nil
+}
+
+var numberRE = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// luaValue returns a Lua literal for a client variable's value
+func luaValue(v string) string {
+	if numberRE.MatchString(v) {
+		return v
+	}
+	return luaString(v)
+}
+
+func shorten(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > 60 {
+		return s[:57] + "..."
+	}
+	return s
+}
@@ -0,0 +1,255 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/perlsaiyan/zif/config"
+)
+
+var zmudCommands = map[string]string{
+	"trigger": "trigger", "tr": "trigger", "action": "trigger", "ac": "trigger",
+	"alias": "alias", "al": "alias",
+	"variable": "variable", "var": "variable", "va": "variable",
+	"alarm": "alarm", "ala": "alarm",
+	"gag": "gag", "ga": "gag",
+	"class": "class", "cl": "class",
+}
+
+// ParseZmud converts a zMUD/CMUD script export (the text form written by
+// "Export" or #SAVE). #TRIGGER, #ALIAS, #GAG and repeating #ALARMs become
+// session config, #VARIABLE becomes Lua and #CLASS sets the group.
+func ParseZmud(r io.Reader, file string) (*Result, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	res := newResult("zmud", file)
+	group := ""
+
+	for _, cmd := range splitScript(string(src)) {
+		item := shorten(cmd.text)
+		if cmd.name == "" {
+			res.note(cmd.line, item, "not a zMUD command")
+			continue
+		}
+		args := cmd.args
+		name := ""
+		// An optional quoted id comes before the pattern: #TRIGGER "id" {pattern} {cmds}
+		if len(args) > 0 && strings.HasPrefix(args[0], `"`) {
+			name = strings.Trim(args[0], `"`)
+			args = args[1:]
+		}
+
+		switch zmudCommands[cmd.name] {
+		case "class":
+			if len(args) == 0 || args[0] == "0" {
+				group = ""
+			} else {
+				group = args[0]
+			}
+
+		case "trigger":
+			if len(args) < 2 {
+				res.note(cmd.line, item, "expected #TRIGGER {pattern} {commands}")
+				continue
+			}
+			pattern, err := zmudPattern(args[0])
+			if err != nil {
+				res.note(cmd.line, item, "%v", err)
+				continue
+			}
+			if name == "" {
+				name = args[0]
+			}
+			res.noteBody(cmd.line, item, args[1])
+			res.addTrigger(cmd.line, item, config.TriggerConfig{
+				Name:     res.uniqueName(name),
+				Pattern:  pattern,
+				Commands: config.Commands{args[1]},
+				Group:    zmudGroup(group, args, 2),
+			})
+
+		case "gag":
+			if len(args) < 1 {
+				res.note(cmd.line, item, "#GAG without a pattern only works inside a trigger")
+				continue
+			}
+			pattern, err := zmudPattern(args[0])
+			if err != nil {
+				res.note(cmd.line, item, "%v", err)
+				continue
+			}
+			res.addTrigger(cmd.line, item, config.TriggerConfig{
+				Name:    res.uniqueName("gag " + args[0]),
+				Pattern: pattern,
+				Gag:     true,
+				Group:   group,
+			})
+
+		case "alias":
+			if len(args) < 2 {
+				res.note(cmd.line, item, "expected #ALIAS name {commands}")
+				continue
+			}
+			res.noteBody(cmd.line, item, args[1])
+			res.addAlias(cmd.line, item, config.AliasConfig{
+				Name: res.uniqueName(args[0]),
+				Body: args[1],
+			})
+
+		case "alarm":
+			if len(args) < 2 {
+				res.note(cmd.line, item, "expected #ALARM {*seconds} {commands}")
+				continue
+			}
+			if !strings.HasPrefix(args[0], "*") {
+				res.note(cmd.line, item, "only repeating alarms (*seconds) are supported")
+				continue
+			}
+			interval, err := seconds(args[0][1:])
+			if err != nil {
+				res.note(cmd.line, item, "%v", err)
+				continue
+			}
+			if name == "" {
+				name = "alarm"
+			}
+			res.noteBody(cmd.line, item, args[1])
+			res.addTimer(cmd.line, item, config.TimerConfig{
+				Name:     res.uniqueName(name),
+				Interval: interval,
+				Commands: config.Commands{args[1]},
+				Group:    zmudGroup(group, args, 2),
+			})
+
+		case "variable":
+			if len(args) < 2 {
+				res.note(cmd.line, item, "expected #VARIABLE name {value}")
+				continue
+			}
+			res.Lua = append(res.Lua, fmt.Sprintf("session.set_data(%s, %s)", luaString(args[0]), luaValue(args[1])))
+
+		default:
+			res.note(cmd.line, item, "#%s is not supported", strings.ToUpper(cmd.name))
+		}
+	}
+	return res, nil
+}
+
+// zmudGroup uses the class argument of a command if it has one
+func zmudGroup(group string, args []string, i int) string {
+	if i < len(args) && args[i] != "" {
+		return args[i]
+	}
+	return group
+}
+
+// zmudPattern converts a zMUD pattern to a Go regex. Parentheses capture,
+// * and ? are wildcards, %w/%d/%a/%s/%n/%x match classes of characters,
+// {a|b} is a list of alternatives, [...] a character class and ~ escapes
+// the next character.
+func zmudPattern(p string) (string, error) {
+	var b, lit strings.Builder
+	flush := func() {
+		b.WriteString(regexp.QuoteMeta(lit.String()))
+		lit.Reset()
+	}
+	wildcards := map[byte]string{
+		'w': `[A-Za-z]+`, 'd': `[0-9]+`, 'a': `[A-Za-z0-9]+`,
+		's': `\s+`, 'n': `[+-]?[0-9]+`, 'x': `\S+`,
+	}
+
+	i, end := 0, len(p)
+	if strings.HasPrefix(p, "^") {
+		b.WriteString("^")
+		i = 1
+	}
+	anchorEnd := end > i && strings.HasSuffix(p, "$") && !strings.HasSuffix(p, "~$")
+	if anchorEnd {
+		end--
+	}
+
+	depth := 0
+	for i < end {
+		c := p[i]
+		switch c {
+		case '~':
+			if i+1 < end {
+				lit.WriteByte(p[i+1])
+			}
+			i += 2
+			continue
+		case '(':
+			flush()
+			b.WriteString("(")
+			depth++
+		case ')':
+			flush()
+			if depth == 0 {
+				return "", fmt.Errorf("unbalanced ) in pattern")
+			}
+			b.WriteString(")")
+			depth--
+		case '*':
+			flush()
+			if restOfPattern(p[i+1 : end]) {
+				b.WriteString(".*")
+			} else {
+				b.WriteString(".*?")
+			}
+		case '?':
+			flush()
+			b.WriteString(".")
+		case '%':
+			if i+1 < end {
+				if re, ok := wildcards[p[i+1]]; ok {
+					flush()
+					b.WriteString(re)
+					i += 2
+					continue
+				}
+				return "", fmt.Errorf("wildcard %%%c is not supported", p[i+1])
+			}
+			lit.WriteByte(c)
+		case '{':
+			j := strings.IndexByte(p[i:end], '}')
+			if j < 0 {
+				return "", fmt.Errorf("unbalanced { in pattern")
+			}
+			alts := strings.Split(p[i+1:i+j], "|")
+			for k := range alts {
+				alts[k] = regexp.QuoteMeta(alts[k])
+			}
+			flush()
+			b.WriteString("(?:" + strings.Join(alts, "|") + ")")
+			i += j + 1
+			continue
+		case '[':
+			j := strings.IndexByte(p[i:end], ']')
+			if j < 0 {
+				return "", fmt.Errorf("unbalanced [ in pattern")
+			}
+			flush()
+			b.WriteString(p[i : i+j+1])
+			i += j + 1
+			continue
+		default:
+			lit.WriteByte(c)
+		}
+		i++
+	}
+	if depth != 0 {
+		return "", fmt.Errorf("unbalanced ( in pattern")
+	}
+	flush()
+	if anchorEnd {
+		b.WriteString("$")
+	}
+	if _, err := regexp.Compile(b.String()); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
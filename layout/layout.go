@@ -264,6 +264,15 @@ func (l *Layout) Update(msg tea.Msg) tea.Cmd {
 
 // handleMouseEvent processes mouse events for pane dragging and resizing
 func (l *Layout) handleMouseEvent(msg tea.MouseMsg) tea.Cmd {
+	// The wheel scrolls the pane under the pointer
+	if tea.MouseEvent(msg).IsWheel() {
+		if pane := l.FindPane(l.findPaneAtPosition(msg.X, msg.Y)); pane != nil {
+			_, cmd := pane.Update(msg)
+			return cmd
+		}
+		return nil
+	}
+
 	switch msg.Action {
 	case tea.MouseActionPress:
 		if msg.Button == tea.MouseButtonLeft {
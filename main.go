@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/acarl005/stripansi"
 	"github.com/charmbracelet/bubbles/progress"
 	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
@@ -27,17 +28,24 @@ import (
 
 const useHighPerformanceRenderer = false
 
+// queryTimeout is how long the UI waits on a session's loop for state to
+// show before keeping what it showed last
+const queryTimeout = 20 * time.Millisecond
+
 type ZifModel struct {
 	Name           string
 	Plugins        []*plugin.Plugin
 	Input          textinput.Model
 	Viewport       viewport.Model // Kept for backward compatibility during transition
 	Layout         *layout.Layout // Flexible layout system
-	SessionHandler session.SessionHandler
+	SessionHandler *session.SessionHandler
 	StatusBar      statusbar.Model
 	Ready          bool
 	Error          string // Track panic/error messages
 	LastMapVnum    string // Track last VNUM to avoid unnecessary map redraws
+
+	REPL        *session.Session // session whose Lua prompt has the input line, nil when closed
+	replHistory int              // lines back in the Lua prompt's history, 0 for a new line
 }
 
 func (m ZifModel) Init() tea.Cmd {
@@ -104,6 +112,68 @@ func wrapViewportContent(content string, viewportWidth int) string {
 	return strings.Join(wrappedLines, "\n")
 }
 
+// followRows is how many wrapped rows of scrollback the main viewport
+// holds while following new output. Scrolling up loads the rest.
+func followRows(height int) int {
+	return max(3*height, 200)
+}
+
+// showScrollback sets the pane to the end of the session's scrollback and
+// follows it. Only the tail is wrapped and handed to the viewport, so this
+// costs the same however long the session has run.
+func showScrollback(pane *layout.Pane, s *session.Session) {
+	rows := s.Scrollback.Tail(followRows(pane.Viewport.Height), pane.Viewport.Width)
+	pane.Viewport.SetContent(strings.Join(rows, "\n"))
+	pane.Viewport.GotoBottom()
+}
+
+// expandScrollback loads the whole scrollback into a pane showing its tail,
+// keeping the rows on screen in place, so the user can scroll back
+func expandScrollback(pane *layout.Pane, s *session.Session) {
+	rows := s.Scrollback.Rows(pane.Viewport.Width)
+	below := pane.Viewport.TotalLineCount() - pane.Viewport.YOffset
+	pane.Viewport.SetContent(strings.Join(rows, "\n"))
+	pane.Viewport.SetYOffset(len(rows) - below)
+}
+
+// followScrollback keeps the main pane in step with however it was last
+// scrolled, by key or mouse wheel: leaving the bottom loads the whole
+// scrollback, and coming back to it returns to following the tail.
+func followScrollback(pane *layout.Pane, s *session.Session) {
+	switch {
+	case pane.Viewport.AtBottom():
+		showScrollback(pane, s)
+	case pane.Viewport.TotalLineCount() <= followRows(pane.Viewport.Height):
+		expandScrollback(pane, s)
+	}
+}
+
+// findLineFromBottom returns the index in the wrapped rows of the
+// occurrence'th line, counting up from the bottom, whose text starts with
+// text, or -1. Only the first wrapped row of each line is compared.
+func findLineFromBottom(rows []string, text string, occurrence, width int) int {
+	if occurrence < 1 {
+		occurrence = 1
+	}
+	prefix := strings.TrimSpace(text)
+	if prefix == "" {
+		return -1
+	}
+	if width > 0 && len(prefix) > width/2 {
+		prefix = prefix[:width/2]
+	}
+	for i := len(rows) - 1; i >= 0; i-- {
+		row := strings.TrimSpace(stripansi.Strip(rows[i]))
+		if row == prefix || row != "" && strings.HasPrefix(row, prefix) {
+			occurrence--
+			if occurrence == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
 // A command that waits for the activity on a channel.
 func waitForActivity(sub chan tea.Msg) tea.Cmd {
 	return func() tea.Msg {
@@ -178,13 +248,13 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			msg.ActiveSession = activeSession
 		}
 
-		log.Printf("Setting active session to %s (test: %s)", msg.ActiveSession.Name, m.SessionHandler.Active)
-		m.SessionHandler.Active = msg.ActiveSession.Name
+		log.Printf("Setting active session to %s (test: %s)", msg.ActiveSession.Name, m.SessionHandler.ActiveName())
+		m.SessionHandler.SetActive(msg.ActiveSession.Name)
 
-		m.StatusBar.FirstColumn = m.SessionHandler.Active
+		m.StatusBar.FirstColumn = m.SessionHandler.ActiveName()
 		activeSession := m.SessionHandler.ActiveSession()
 		if activeSession != nil {
-			if activeSession.Connected {
+			if activeSession.IsConnected() {
 				m.StatusBar.SecondColumn = activeSession.Address
 			} else {
 				m.StatusBar.SecondColumn = "Not Connected"
@@ -194,11 +264,8 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if m.Layout != nil {
 				mainPane := m.Layout.FindPane("main")
 				if mainPane != nil {
-					// Wrap content before setting it to viewport
-					wrappedContent := wrapViewportContent(activeSession.Content, mainPane.Viewport.Width)
-					mainPane.Viewport.SetContent(wrappedContent)
-					mainPane.Viewport.GotoBottom()
-					m.StatusBar.ThirdColumn = fmt.Sprintf("%d", mainPane.Viewport.TotalLineCount())
+					showScrollback(mainPane, activeSession)
+					m.StatusBar.ThirdColumn = fmt.Sprintf("%d", activeSession.Scrollback.Len())
 				}
 				// Ensure map pane exists if kallisti is active
 				m.ensureMapPane()
@@ -206,34 +273,18 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		} else {
 			// Fallback if active session is somehow nil
 			m.StatusBar.SecondColumn = "No Session"
-			log.Printf("Warning: ActiveSession() returned nil after setting active to %s", m.SessionHandler.Active)
+			log.Printf("Warning: ActiveSession() returned nil after setting active to %s", m.SessionHandler.ActiveName())
 		}
 
 		cmds = append(cmds, waitForActivity(m.SessionHandler.Sub))
 
 	case session.UpdateMessage:
-		m.StatusBar.FirstColumn = m.SessionHandler.Active
+		m.StatusBar.FirstColumn = m.SessionHandler.ActiveName()
 		activeSession := m.SessionHandler.ActiveSession()
 		if activeSession != nil {
-			if activeSession.Connected {
-				roomName := activeSession.MSDP.GetString("ROOM_NAME")
-				if len(roomName) > 0 {
-					if k, ok := m.SessionHandler.Plugins.Plugins["kallisti"]; ok {
-						tp, err := k.Plugin.Lookup("TravelProgress")
-						if err == nil {
-							m.StatusBar.SecondColumn = tp.(func(*session.Session) string)(activeSession) +
-								" " + roomName
-						} else {
-							m.StatusBar.SecondColumn = roomName
-						}
-					} else {
-						m.StatusBar.SecondColumn = roomName
-					}
-				} else {
-					m.StatusBar.SecondColumn = activeSession.Address
-				}
-			} else {
-				m.StatusBar.SecondColumn = "Not Connected"
+			// A busy session keeps its last status rather than stall the UI
+			if status, ok := session.QueryCoalesced(activeSession, "status", queryTimeout, func() string { return m.sessionStatus(activeSession) }); ok {
+				m.StatusBar.SecondColumn = status
 			}
 
 			// Update content in layout system
@@ -244,21 +295,15 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					mainPane = m.Layout.GetActivePane()
 				}
 				if mainPane != nil {
-					jump := mainPane.Viewport.AtBottom()
-					contentToSet := activeSession.Content
-					if jump {
-						lines := strings.Split(contentToSet, "\n")
-						if len(lines) > 1000 {
-							contentToSet = strings.Join(lines[len(lines)-1000:], "\n")
-						}
+					// Someone scrolled back is left reading; new output
+					// shows once they return to the bottom
+					if mainPane.Viewport.AtBottom() {
+						showScrollback(mainPane, activeSession)
 					}
-					// Wrap content before setting it to viewport
-					wrappedContent := wrapViewportContent(contentToSet, mainPane.Viewport.Width)
-					mainPane.Viewport.SetContent(wrappedContent)
-					if jump {
-						mainPane.Viewport.GotoBottom()
+					m.StatusBar.ThirdColumn = fmt.Sprintf("%d", activeSession.Scrollback.Len())
+					if n := activeSession.PendingSends(); n > 0 {
+						m.StatusBar.ThirdColumn += fmt.Sprintf(" (%d queued)", n)
 					}
-					m.StatusBar.ThirdColumn = fmt.Sprintf("%d", mainPane.Viewport.TotalLineCount())
 				}
 
 				// Update map pane if kallisti plugin is active
@@ -268,6 +313,10 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.StatusBar.SecondColumn = "No Session"
 		}
 
+		if m.REPL != nil {
+			m.showREPL()
+		}
+
 		// Continue with viewport sync even if session is nil
 		if m.Layout != nil {
 
@@ -286,15 +335,14 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case session.TextinputMsg:
 		if msg.Toggle_password {
 			activeSession := m.SessionHandler.ActiveSession()
+			// The session has already set its own PasswordMode on its loop
 			if activeSession != nil {
 				if msg.Password_mode {
 					log.Printf("Turning on password mode\n")
 					m.Input.EchoMode = textinput.EchoPassword
-					activeSession.PasswordMode = true
 				} else {
 					log.Printf("Turning off password mode\n")
 					m.Input.EchoMode = textinput.EchoNormal
-					activeSession.PasswordMode = false
 				}
 			}
 
@@ -307,6 +355,9 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		cmds = append(cmds, waitForActivity(m.SessionHandler.Sub))
 
 	case tea.KeyMsg:
+		if m.REPL != nil && m.replKey(msg) {
+			break
+		}
 		if k := msg.String(); k == "ctrl+c" {
 			return m, tea.Quit
 		} else if k := msg.String(); k == "pgup" || k == "pgdown" || k == "end" || k == "home" {
@@ -314,6 +365,14 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if m.Layout != nil {
 				activePane := m.Layout.GetActivePane()
 				if activePane != nil {
+					// The main pane holds only the tail of the scrollback
+					// until the user scrolls up
+					activeSession := m.SessionHandler.ActiveSession()
+					following := activePane.ID == "main" && activeSession != nil
+					if following && (k == "pgup" || k == "home") && activePane.Viewport.AtBottom() {
+						expandScrollback(activePane, activeSession)
+					}
+
 					var viewcmd tea.Cmd
 					switch k {
 					case "end":
@@ -323,6 +382,9 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					default:
 						activePane.Viewport, viewcmd = activePane.Viewport.Update(msg)
 					}
+					if following {
+						followScrollback(activePane, activeSession)
+					}
 					cmds = append(cmds, viewcmd)
 				}
 			}
@@ -344,7 +406,7 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 			activeSession := m.SessionHandler.ActiveSession()
 			if activeSession != nil {
-				activeSession.HandleInput(order)
+				activeSession.Post(func() { activeSession.HandleInput(order) })
 			}
 			m.Input.SetValue("")
 		} else {
@@ -361,6 +423,11 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if layoutCmd != nil {
 				cmds = append(cmds, layoutCmd)
 			}
+			// The wheel scrolls panes directly, so the main pane may
+			// have left the tail it holds while following
+			if mainPane := m.Layout.FindPane("main"); mainPane != nil && m.SessionHandler.ActiveSession() != nil {
+				followScrollback(mainPane, m.SessionHandler.ActiveSession())
+			}
 		}
 		// Also pass to input for potential mouse interactions
 		var inputcmd tea.Cmd
@@ -405,6 +472,10 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				pane.Viewport.Height = viewportHeight
 			}
 		}
+		// Rewrap the main window at its new width
+		if mainPane := m.Layout.FindPane("main"); mainPane != nil && m.SessionHandler.ActiveSession() != nil {
+			showScrollback(mainPane, m.SessionHandler.ActiveSession())
+		}
 
 		m.Input.Cursor.BlinkSpeed = 500 * time.Millisecond
 
@@ -412,7 +483,7 @@ func (m ZifModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.StatusBar.SetSize(msg.Width)
 		activeSession := m.SessionHandler.ActiveSession()
 		connected := func() string {
-			if activeSession != nil && activeSession.Connected {
+			if activeSession != nil && activeSession.IsConnected() {
 				return "✓"
 			} else {
 				return "✗"
@@ -556,6 +627,52 @@ func (m *ZifModel) handleLayoutCommand(msg layout.LayoutCommandMsg) {
 			pane.Viewport.SetContent(wrappedContent)
 			pane.Viewport.GotoTop()
 		}
+	case "show":
+		// Show text in a pane, splitting it off the bottom of main if needed
+		if len(msg.Args) < 3 {
+			s.Output("Invalid show command\n")
+			return
+		}
+		paneID, title, content := msg.Args[0], msg.Args[1], msg.Args[2]
+		pane := m.Layout.FindPane(paneID)
+		if pane == nil {
+			if err := m.Layout.Split("main", layout.SplitVertical, 65, paneID, layout.PaneTypeComms); err != nil {
+				s.Output(fmt.Sprintf("Error opening pane %s: %v\n", paneID, err))
+				return
+			}
+			pane = m.Layout.FindPane(paneID)
+			pane.Viewport = viewport.New(0, 0)
+			pane.Viewport.HighPerformanceRendering = useHighPerformanceRenderer
+		}
+		pane.Title = title
+		pane.Content = content
+		pane.Viewport.SetContent(wrapViewportContent(content, pane.Viewport.Width))
+		pane.Viewport.GotoTop()
+
+	case "scroll_to":
+		// Scroll the main viewport to the nth line from the bottom
+		// containing the given text
+		if len(msg.Args) < 2 {
+			s.Output("Invalid scroll_to command\n")
+			return
+		}
+		if s != m.SessionHandler.ActiveSession() {
+			s.Output("Switch to this session to jump to a result\n")
+			return
+		}
+		mainPane := m.Layout.FindPane("main")
+		if mainPane == nil {
+			return
+		}
+		occurrence, _ := strconv.Atoi(msg.Args[1])
+		rows := s.Scrollback.Rows(mainPane.Viewport.Width)
+		if line := findLineFromBottom(rows, msg.Args[0], occurrence, mainPane.Viewport.Width); line >= 0 {
+			mainPane.Viewport.SetContent(strings.Join(rows, "\n"))
+			mainPane.Viewport.SetYOffset(line)
+		} else {
+			s.Output("That line is no longer in the scrollback\n")
+		}
+
 	case "set_border":
 		if len(msg.Args) < 2 {
 			s.Output("Invalid set_border command\n")
@@ -678,9 +795,121 @@ func (m *ZifModel) handleLayoutCommand(msg layout.LayoutCommandMsg) {
 		// Reset progress bar model
 		pane.ProgressBar = progress.New(progress.WithDefaultGradient())
 		s.Output(fmt.Sprintf("Destroyed progress bar in pane %s\n", paneID))
+	case "lua_repl":
+		if m.REPL == s {
+			m.closeREPL()
+		} else {
+			m.openREPL(s)
+		}
 	}
 }
 
+// openREPL gives the input line to s's Lua prompt, showing its transcript
+// in a pane below the main one
+func (m *ZifModel) openREPL(s *session.Session) {
+	if m.Layout.FindPane("lua") == nil {
+		if err := m.Layout.Split("main", layout.SplitVertical, 60, "lua", layout.PaneTypeViewport); err != nil {
+			s.Output(fmt.Sprintf("Error opening the Lua prompt: %v\n", err))
+			return
+		}
+		pane := m.Layout.FindPane("lua")
+		pane.Viewport = viewport.New(0, 0)
+		pane.Viewport.HighPerformanceRendering = useHighPerformanceRenderer
+	}
+	m.REPL = s
+	m.replHistory = 0
+	m.Input.Placeholder = "Lua; Esc or #lua to close, Tab completes, Up and Down for history"
+	m.showREPL()
+}
+
+// closeREPL gives the input line back to the session
+func (m *ZifModel) closeREPL() {
+	if m.Layout.FindPane("lua") != nil {
+		if err := m.Layout.Unsplit("lua"); err != nil {
+			log.Printf("Error closing the Lua pane: %v", err)
+		}
+	}
+	m.REPL = nil
+	m.Input.Prompt = "> "
+	m.Input.Placeholder = ""
+}
+
+// showREPL brings the Lua pane and prompt up to date
+func (m *ZifModel) showREPL() {
+	repl := m.REPL.REPL()
+	m.Input.Prompt = repl.Prompt()
+	pane := m.Layout.FindPane("lua")
+	if pane == nil {
+		return
+	}
+	pane.Title = "Lua: " + m.REPL.Name
+	if module := repl.Module(); module != "" {
+		pane.Title += " (" + module + ")"
+	}
+	rows := repl.Output.Tail(followRows(pane.Viewport.Height), pane.Viewport.Width)
+	pane.Viewport.SetContent(strings.Join(rows, "\n"))
+	pane.Viewport.GotoBottom()
+}
+
+// replKey handles a key while the Lua prompt is open, reporting whether it
+// was used
+func (m *ZifModel) replKey(msg tea.KeyMsg) bool {
+	s := m.REPL
+	repl := s.REPL()
+	switch msg.String() {
+	case "esc":
+		m.closeREPL()
+	case "enter":
+		line := m.Input.Value()
+		m.Input.SetValue("")
+		m.replHistory = 0
+		if strings.TrimSpace(line) == "#lua" {
+			m.closeREPL()
+			return true
+		}
+		s.Post(func() { repl.Enter(s, line) })
+	case "up", "down":
+		history := repl.History()
+		if msg.String() == "up" && m.replHistory < len(history) {
+			m.replHistory++
+		} else if msg.String() == "down" && m.replHistory > 0 {
+			m.replHistory--
+		}
+		if m.replHistory == 0 {
+			m.Input.SetValue("")
+		} else {
+			m.Input.SetValue(history[len(history)-m.replHistory])
+		}
+		m.Input.CursorEnd()
+	case "tab":
+		line := m.Input.Value()
+		matches, _ := session.Query(s, queryTimeout, func() []string { return repl.Complete(s, line) })
+		if len(matches) == 0 {
+			return true
+		}
+		m.Input.SetValue(commonPrefix(matches))
+		m.Input.CursorEnd()
+		if len(matches) > 1 {
+			repl.Output.Write(strings.Join(matches, "  ") + "\n")
+			m.showREPL()
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// commonPrefix returns the longest prefix shared by all of words
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
 // handleLayoutCommandFromString parses a command string and handles layout commands
 func (m *ZifModel) handleLayoutCommandFromString(cmd string) {
 	// Layout commands are now handled directly in session/commands.go
@@ -744,6 +973,24 @@ func (m *ZifModel) ensureMapPane() {
 }
 
 // updateMapPane updates the map pane content if kallisti plugin is active
+// sessionStatus returns the status bar's second column for s. It reads
+// plugin state, so it must run on the session's loop.
+func (m *ZifModel) sessionStatus(s *session.Session) string {
+	if !s.IsConnected() {
+		return "Not Connected"
+	}
+	roomName := s.MSDP.GetString("ROOM_NAME")
+	if len(roomName) == 0 {
+		return s.Address
+	}
+	if k, ok := m.SessionHandler.Plugins.Plugins["kallisti"]; ok {
+		if tp, err := k.Plugin.Lookup("TravelProgress"); err == nil {
+			return tp.(func(*session.Session) string)(s) + " " + roomName
+		}
+	}
+	return roomName
+}
+
 func (m *ZifModel) updateMapPane() {
 	if m.Layout == nil {
 		return
@@ -778,7 +1025,7 @@ func (m *ZifModel) updateMapPane() {
 	activeSession := m.SessionHandler.ActiveSession()
 	if activeSession != nil {
 		if k, ok := m.SessionHandler.Plugins.Plugins["kallisti"]; ok {
-			if activeSession.Connected {
+			if activeSession.IsConnected() {
 				// Check if VNUM has changed
 				currentVnum := activeSession.MSDP.GetString("ROOM_VNUM")
 				if currentVnum == m.LastMapVnum && mapPane.Content != "" {
@@ -798,10 +1045,19 @@ func (m *ZifModel) updateMapPane() {
 						mapHeight = 20 // Default size
 					}
 
-					mapContent := tp.(func(*session.Session, int, int) string)(
-						activeSession, mapWidth, mapHeight)
-					mapPane.Content = mapContent
-					m.LastMapVnum = currentVnum
+					// The map reads the plugin's state, so it is drawn on
+					// the session's loop; a busy loop keeps the old map.
+					// A map drawn late may be for an earlier room, so it
+					// carries the room it was drawn for.
+					type drawnMap struct{ content, vnum string }
+					makeMap := tp.(func(*session.Session, int, int) string)
+					drawn, ok := session.QueryCoalesced(activeSession, "map", queryTimeout, func() drawnMap {
+						return drawnMap{makeMap(activeSession, mapWidth, mapHeight), activeSession.MSDP.GetString("ROOM_VNUM")}
+					})
+					if ok {
+						mapPane.Content = drawn.content
+						m.LastMapVnum = drawn.vnum
+					}
 				}
 			}
 		}
@@ -809,6 +1065,10 @@ func (m *ZifModel) updateMapPane() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:]))
+	}
+
 	var kallistiFlag = flag.Bool("kallisti", false, "Use Kallisti plugin")
 	var helpFlag = flag.Bool("help", false, "Show help")
 	var noAutostartFlag = flag.Bool("no-autostart", false, "Skip auto-loading sessions from sessions.yaml")
@@ -829,7 +1089,7 @@ func main() {
 	defer f.Close()
 
 	m := ZifModel{Input: textinput.New(), SessionHandler: session.NewHandler()}
-	m.SessionHandler.Active = "zif"
+	m.SessionHandler.SetActive("zif")
 	m.Input.Placeholder = "Welcome to Zif, type #HELP to get started"
 	m.Input.Focus()
 	m.Input.CharLimit = 156
@@ -854,19 +1114,22 @@ func main() {
 
 	// Register plugins for the default "zif" session
 	if len(m.SessionHandler.Plugins.Plugins) > 0 {
-		for _, sess := range m.SessionHandler.Sessions {
-			for _, v := range m.SessionHandler.Plugins.Plugins {
-				log.Printf("Activating plugin %s for session %s", v.Name, sess.Name)
-				f, err := v.Plugin.Lookup("RegisterSession")
-				if err != nil {
-					log.Printf("RegisterSession() lookup failure on plugin %s", v.Name)
-					continue
+		for _, name := range m.SessionHandler.SessionNames() {
+			sess, _ := m.SessionHandler.Session(name)
+			sess.Call(func() {
+				for _, v := range m.SessionHandler.Plugins.Plugins {
+					log.Printf("Activating plugin %s for session %s", v.Name, sess.Name)
+					f, err := v.Plugin.Lookup("RegisterSession")
+					if err != nil {
+						log.Printf("RegisterSession() lookup failure on plugin %s", v.Name)
+						continue
+					}
+					f.(func(*session.Session))(sess)
 				}
-				f.(func(*session.Session))(sess)
-			}
-			if err := sess.InjectContext(); err != nil {
-				log.Printf("Warning: failed to inject context for session %s: %v", sess.Name, err)
-			}
+				if err := sess.InjectContext(); err != nil {
+					log.Printf("Warning: failed to inject context for session %s: %v", sess.Name, err)
+				}
+			})
 		}
 
 		activeSession := m.SessionHandler.ActiveSession()
@@ -904,11 +1167,11 @@ func main() {
 				}
 			}
 			// Set the first session as active if any sessions were loaded
-			if len(sessionsConfig.Sessions) > 0 && len(m.SessionHandler.Sessions) > 1 {
+			if len(sessionsConfig.Sessions) > 0 && len(m.SessionHandler.SessionNames()) > 1 {
 				for _, sessionConfig := range sessionsConfig.Sessions {
 					if sessionConfig.Autostart {
-						if _, exists := m.SessionHandler.Sessions[sessionConfig.Name]; exists {
-							m.SessionHandler.Active = sessionConfig.Name
+						if _, exists := m.SessionHandler.Session(sessionConfig.Name); exists {
+							m.SessionHandler.SetActive(sessionConfig.Name)
 							activeSession := m.SessionHandler.ActiveSession()
 							if activeSession != nil {
 								m.SessionHandler.Sub <- session.SessionChangeMsg{ActiveSession: activeSession}
@@ -967,7 +1230,9 @@ func main() {
 		}
 	}()
 
-	if _, err := p.Run(); err != nil {
+	_, err = p.Run()
+	m.SessionHandler.Close()
+	if err != nil {
 		fmt.Println("could not run program:", err)
 		os.Exit(1)
 	}
@@ -231,7 +231,7 @@ func CmdBFSRoomToRoom(s *session.Session, arg string) {
 	}
 
 	s.Output("Traveling to " + toVnum + " from " + fromVnum + ", sending " + method + "\n")
-	s.Socket.Write([]byte(method + "\n"))
+	s.Send(method)
 
 }
 
@@ -121,7 +121,7 @@ func RegisterSession(s *session.Session) {
 	AddKallistiTrigger(s, "LoginUsername", `Enter your account name`, func(s *session.Session, matches []string) {
 		if username, ok := s.Data["username"].(string); ok && username != "" {
 			log.Printf("DEBUG LoginUsername: sending username %q", username)
-			s.Socket.Write([]byte(username + "\r\n"))
+			s.Send(username)
 		} else {
 			log.Printf("DEBUG LoginUsername: no username in session data (keys: %v)", dataKeys(s.Data))
 		}
@@ -131,7 +131,7 @@ func RegisterSession(s *session.Session) {
 	AddKallistiTrigger(s, "LoginPassword", `Please enter your account password`, func(s *session.Session, matches []string) {
 		if password, ok := s.Data["password"].(string); ok && password != "" {
 			log.Printf("DEBUG LoginPassword: sending password")
-			s.Socket.Write([]byte(password + "\r\n"))
+			s.SendPassword(password)
 			delete(s.Data, "password") // Clear after use
 		} else {
 			log.Printf("DEBUG LoginPassword: no password in session data")
@@ -141,7 +141,7 @@ func RegisterSession(s *session.Session) {
 	// MOTD: "Have fun, and tell a friend about us!" - press enter to continue
 	AddKallistiTrigger(s, "LoginMOTD", `Have fun, and tell a friend about us!`, func(s *session.Session, matches []string) {
 		log.Printf("DEBUG LoginMOTD: sending CR")
-		s.Socket.Write([]byte("\r\n"))
+		s.Send("")
 	})
 
 	// Account menu: capture active character name and remove login triggers
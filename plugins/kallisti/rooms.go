@@ -55,7 +55,13 @@ func ScanRoom(s *session.Session, d *KallistiData) {
 		}
 	}
 
-	lines := s.Ringlog.GetLog(start, end)
+	// Only the MUD's own lines; commands sent and our output may be mixed in
+	var lines []session.RingRecord
+	for _, line := range s.Ringlog.GetLog(start, end) {
+		if line.Context == session.RingContextLine || line.Context == session.RingContextGagged {
+			lines = append(lines, line)
+		}
+	}
 	if len(lines) == 0 {
 		return
 	}
@@ -160,7 +166,7 @@ func HandleTravel(s *session.Session, d *KallistiData) {
 		method = directions[0]
 	}
 	s.Output(fmt.Sprintf("Moving to %s\n", method))
-	s.Socket.Write([]byte(method + "\n"))
+	s.Send(method)
 }
 
 func PossibleRoomScanner(s *session.Session, matches session.ActionMatches) {
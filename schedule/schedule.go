@@ -0,0 +1,192 @@
+// Package schedule parses the cron-style and wall-clock schedules used by
+// timers.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule computes when a timer should next fire
+type Schedule interface {
+	// Next returns the first time after t that matches the schedule
+	Next(t time.Time) time.Time
+	String() string
+}
+
+// Parse understands three forms of schedule, all in local time:
+//
+//	"*/15 * * * *"  five-field cron: minute hour day-of-month month day-of-week
+//	"@hourly"       also @daily (or @midnight) and @weekly
+//	"at 14:30"      daily at a wall-clock time; the "at" and seconds are optional
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		return Parse("0 * * * *")
+	case "@daily", "@midnight":
+		return Parse("0 0 * * *")
+	case "@weekly":
+		return Parse("0 0 * * 0")
+	}
+
+	clock := strings.TrimSpace(strings.TrimPrefix(spec, "at "))
+	if strings.Contains(clock, ":") && !strings.ContainsAny(clock, " *") {
+		return parseClock(spec, clock)
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: expected 5 cron fields or a time such as \"at 14:30\"", spec)
+	}
+	c := &cron{spec: spec}
+	var err error
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 7},
+	} {
+		if *f.bits, err = parseField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", spec, err)
+		}
+	}
+	// Sunday may be written as 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q never matches a date", spec)
+	}
+	return c, nil
+}
+
+// parseField turns one cron field ("*", "5", "1-5", "*/10", "0,30") into a
+// bit set of the values it allows.
+func parseField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			if i := strings.IndexByte(part, '-'); i >= 0 {
+				lo, err = strconv.Atoi(part[:i])
+				if err == nil {
+					hi, err = strconv.Atoi(part[i+1:])
+				}
+			} else {
+				lo, err = strconv.Atoi(part)
+				hi = lo
+			}
+			if err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+type cron struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+func (c *cron) String() string { return c.spec }
+
+// dayMatches follows cron: when both day fields are restricted, either may match
+func (c *cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Skip whole months, days and hours that cannot match. Five years is
+	// enough to find any valid date, including February 29th.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// clock fires daily at a wall-clock time
+type clock struct {
+	spec                 string
+	hour, minute, second int
+}
+
+func parseClock(spec, s string) (Schedule, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("schedule %q: bad time of day", spec)
+	}
+	var vals [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: bad time of day", spec)
+		}
+		vals[i] = n
+	}
+	if vals[0] > 23 || vals[1] > 59 || vals[2] > 59 || vals[0] < 0 || vals[1] < 0 || vals[2] < 0 {
+		return nil, fmt.Errorf("schedule %q: time of day out of range", spec)
+	}
+	return &clock{spec: spec, hour: vals[0], minute: vals[1], second: vals[2]}, nil
+}
+
+func (c *clock) String() string { return c.spec }
+
+func (c *clock) Next(t time.Time) time.Time {
+	next := time.Date(t.Year(), t.Month(), t.Day(), c.hour, c.minute, c.second, 0, t.Location())
+	if !next.After(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, c.hour, c.minute, c.second, 0, t.Location())
+	}
+	return next
+}
@@ -0,0 +1,42 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2026, 3, 4, 10, 7, 30, 0, time.Local)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2026, 3, 4, 10, 15, 0, 0, time.Local)},
+		{"0 9-17 * * 1-5", time.Date(2026, 3, 4, 11, 0, 0, 0, time.Local)},
+		{"30 2 * * 0", time.Date(2026, 3, 8, 2, 30, 0, 0, time.Local)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.Local)},
+		{"0 12 1 * 5", time.Date(2026, 3, 6, 12, 0, 0, 0, time.Local)},
+		{"@daily", time.Date(2026, 3, 5, 0, 0, 0, 0, time.Local)},
+		{"at 10:07:45", time.Date(2026, 3, 4, 10, 7, 45, 0, time.Local)},
+		{"9:00", time.Date(2026, 3, 5, 9, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q.Next = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "at 25:00", "x * * * *", "0 0 31 2 *", "0 0 30 2 *"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded", spec)
+		}
+	}
+}
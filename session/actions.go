@@ -4,6 +4,7 @@ import (
 	"log"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/acarl005/stripansi"
 	"github.com/charmbracelet/lipgloss"
@@ -19,17 +20,35 @@ type ActionMatches struct {
 }
 
 type Action struct {
-	Name    string
-	Pattern string
-	Color   bool
-	Enabled bool
-	RE      *regexp.Regexp
-	Fn      ActionFunction
-	Count   uint
+	Name      string
+	Pattern   string
+	Color     bool
+	Enabled   bool
+	RE        *regexp.Regexp
+	Fn        ActionFunction
+	Count     uint
+	Condition *Condition // optional gate, checked before the regex
+	Priority  int        // higher priorities are tested first
+	Group     string
+	Gag       bool   // hide matched lines from the output
+	Highlight string // color matched lines, e.g. "#ff0000" or "196"
+
+	Tested  uint          // regex evaluations that passed the literal prefilter
+	Elapsed time.Duration // time spent in the regex and callback
 }
 
 type ActionRegistry struct {
 	Actions map[string]Action
+	matcher *actionMatcher
+}
+
+// getMatcher returns the literal prefilter, rebuilding it if actions were
+// added or removed since it was last built.
+func (ar *ActionRegistry) getMatcher() *actionMatcher {
+	if ar.matcher == nil || ar.matcher.size != len(ar.Actions) {
+		ar.matcher = newActionMatcher(ar.Actions)
+	}
+	return ar.matcher
 }
 
 func NewActionRegistry() *ActionRegistry {
@@ -41,6 +60,7 @@ func NewActionRegistry() *ActionRegistry {
 func (s *Session) AddAction(action Action) {
 	action.RE = regexp.MustCompile(action.Pattern)
 	s.Actions.Actions[action.Name] = action
+	s.Actions.matcher = nil
 }
 
 func (s *Session) RemoveAction(name string) {
@@ -48,14 +68,25 @@ func (s *Session) RemoveAction(name string) {
 		log.Printf("action %s does not exist", name)
 	}
 	delete(s.Actions.Actions, name)
+	s.Actions.matcher = nil
 }
 
 func makeActionsRow(action Action) table.Row {
+	var avg time.Duration
+	if action.Tested > 0 {
+		avg = action.Elapsed / time.Duration(action.Tested)
+	}
 
 	return table.NewRow(table.RowData{
-		"name":    action.Name,
-		"enabled": action.Enabled,
-		"count":   action.Count,
+		"name":     action.Name,
+		"group":    action.Group,
+		"priority": action.Priority,
+		"enabled":  action.Enabled,
+		"when":     action.Condition.String(),
+		"count":    action.Count,
+		"tested":   action.Tested,
+		"time":     action.Elapsed.Round(time.Microsecond).String(),
+		"avg":      avg.Round(time.Microsecond / 10).String(),
 	})
 }
 
@@ -67,8 +98,14 @@ func CmdActions(s *Session, cmd string) {
 
 	t := table.New([]table.Column{
 		table.NewColumn("name", "Name", 25).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("group", "Group", 12).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("priority", "Pri", 5).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 		table.NewColumn("enabled", "Enabled", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
-		table.NewColumn("count", "Count", 20).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center).Foreground(lipgloss.Color("#8c8"))),
+		table.NewColumn("when", "When", 30).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("count", "Count", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center).Foreground(lipgloss.Color("#8c8"))),
+		table.NewColumn("tested", "Tested", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("time", "Time", 12).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("avg", "Avg", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 	}).
 		WithRows(rows).
 		BorderRounded()
@@ -78,33 +115,70 @@ func CmdActions(s *Session, cmd string) {
 
 func (s *Session) ActionParser(line []byte) {
 	test := string(line)
-	striptest := stripansi.Strip(test)
+	s.matchActions(test, stripansi.Strip(test))
+}
+
+// lineEffects are the display changes requested by the triggers that matched a line
+type lineEffects struct {
+	gag       bool
+	highlight string
+}
+
+// render returns the line as it should be displayed, without a line ending.
+// Highlighted lines are recolored from their stripped text.
+func (e lineEffects) render(line, stripped string) string {
+	if e.highlight == "" {
+		return line
+	}
+	return lipgloss.NewStyle().Foreground(lipgloss.Color(e.highlight)).Render(stripped)
+}
 
-	for _, a := range s.Actions.Actions {
-		if !a.Enabled {
+// matchActions runs the triggers against a line that the caller has already
+// stripped of ANSI codes, so each line is only stripped once. Triggers are
+// tested in priority order; the first matching highlight wins.
+func (s *Session) matchActions(test string, striptest string) lineEffects {
+	var fx lineEffects
+	trimmed := strings.TrimRight(striptest, "\r\n")
+
+	for _, name := range s.Actions.getMatcher().candidates(test, striptest) {
+		a, ok := s.Actions.Actions[name]
+		if !ok || !a.Enabled || !a.Condition.Check(s) {
 			continue
 		}
-		
-		var matched bool
-		var matchedText string
 
+		matchedText := striptest
 		if a.Color {
-			matched = a.RE.MatchString(test)
 			matchedText = test
-		} else {
-			matched = a.RE.MatchString(striptest)
-			matchedText = striptest
 		}
 
-		if matched {
+		start := time.Now()
+		matches := a.RE.FindStringSubmatch(matchedText)
+		a.Tested++
+		if matches != nil {
 			a.Count += 1
-			s.Actions.Actions[a.Name] = a
-			m := ActionMatches{
-				ANSILine: test,
-				Line:     strings.TrimRight(striptest, "\r\n"),
-				Matches:  a.RE.FindStringSubmatch(matchedText),
+		}
+		s.Actions.Actions[a.Name] = a
+
+		if matches != nil {
+			fx.gag = fx.gag || a.Gag
+			if fx.highlight == "" {
+				fx.highlight = a.Highlight
 			}
-			a.Fn(s, m)
+		}
+
+		if matches != nil && a.Fn != nil {
+			a.Fn(s, ActionMatches{
+				ANSILine: test,
+				Line:     trimmed,
+				Matches:  matches,
+			})
+		}
+
+		// The callback may have replaced or removed the action
+		if cur, ok := s.Actions.Actions[name]; ok {
+			cur.Elapsed += time.Since(start)
+			s.Actions.Actions[name] = cur
 		}
 	}
+	return fx
 }
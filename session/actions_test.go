@@ -0,0 +1,185 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/acarl005/stripansi"
+)
+
+func loadTranscript(tb testing.TB) []string {
+	tb.Helper()
+	data, err := os.ReadFile("testdata/combat_transcript.txt")
+	if err != nil {
+		tb.Fatalf("reading transcript: %v", err)
+	}
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+}
+
+// transcriptPatterns builds n trigger patterns in the shapes real modules use:
+// anchored literals, captures, alternations, color matches and
+// case-insensitive patterns.
+func transcriptPatterns(n int) []Action {
+	mobs := []string{"cave troll", "orc shaman", "giant rat", "black dragon", "goblin archer", "town guard", "skeletal warrior", "wolf", "bandit", "lich"}
+	shapes := []struct {
+		pattern string
+		color   bool
+	}{
+		{`^(?:A|The) %s (hits|misses|slashes) you`, false},
+		{`^Your slash \w+ (?:a|the) %s\.`, false},
+		{`%s is dead!  R\.I\.P\.`, false},
+		{`^You receive (\d+) gold coins from the corpse of (?:a|the) %s`, false},
+		{`%s flees (north|south|east|west)`, false},
+		{`\x1b\[1;31m(?:A|The) %s`, true},
+		{`(?i)%s tells you`, false},
+		{`^\[Gossip\] .*%s`, false},
+	}
+
+	actions := make([]Action, 0, n)
+	for i := 0; i < n; i++ {
+		shape := shapes[i%len(shapes)]
+		mob := mobs[(i/len(shapes))%len(mobs)]
+		if i >= len(shapes)*len(mobs) {
+			mob = fmt.Sprintf("%s %d", mob, i)
+		}
+		actions = append(actions, Action{
+			Name:    fmt.Sprintf("trigger%04d", i),
+			Pattern: fmt.Sprintf(shape.pattern, regexp.QuoteMeta(mob)),
+			Color:   shape.color,
+			Enabled: true,
+		})
+	}
+	return actions
+}
+
+func newBenchSession(actions []Action, fn ActionFunction) *Session {
+	s := &Session{Actions: NewActionRegistry()}
+	for _, a := range actions {
+		a.Fn = fn
+		s.AddAction(a)
+	}
+	return s
+}
+
+func TestRequiredLiteral(t *testing.T) {
+	tests := []struct {
+		pattern string
+		lit     string
+		fold    bool
+	}{
+		{`^You receive (\d+) gold`, "You receive ", false},
+		{`(foo|bar)baz`, "baz", false},
+		{`is dead!  R\.I\.P\.`, "is dead!  R.I.P.", false},
+		{`(?i)Tells You`, "tells you", true},
+		{`(?i)caf\x{e9}`, "", true},
+		{`^(\w+) tells you '(.*)'`, " tells you '", false},
+		{`\x1b\[1;35m`, "\x1b[1;35m", false},
+		{`a*`, "", false},
+		{`(?:Ayla|Bob) (hits|slays)`, " ", false},
+	}
+	for _, tt := range tests {
+		lit, fold := requiredLiteral(tt.pattern)
+		if lit != tt.lit || (lit != "" && fold != tt.fold) {
+			t.Errorf("requiredLiteral(%q) = %q, %v; want %q, %v", tt.pattern, lit, fold, tt.lit, tt.fold)
+		}
+	}
+}
+
+func TestAhoCorasick(t *testing.T) {
+	ac := newAhoCorasick([]string{"he", "she", "his", "hers", "xyz"})
+	seen := ac.scan("ushers")
+	want := []bool{true, true, false, true, false}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("pattern %d: seen=%v want %v", i, seen[i], want[i])
+		}
+	}
+}
+
+// TestActionParserMatchesNaive checks that the literal prefilter never drops
+// a trigger that a plain regex scan would have fired.
+func TestActionParserMatchesNaive(t *testing.T) {
+	lines := loadTranscript(t)
+	actions := transcriptPatterns(600)
+
+	fired := map[string]int{}
+	s := newBenchSession(actions, nil)
+	for name, a := range s.Actions.Actions {
+		name := name
+		a.Fn = func(*Session, ActionMatches) { fired[name]++ }
+		s.Actions.Actions[name] = a
+	}
+
+	res := make([]*regexp.Regexp, len(actions))
+	for i, a := range actions {
+		res[i] = regexp.MustCompile(a.Pattern)
+	}
+
+	want := map[string]int{}
+	for _, line := range lines {
+		s.ActionParser([]byte(line))
+
+		stripped := stripansi.Strip(line)
+		for i, a := range actions {
+			text := stripped
+			if a.Color {
+				text = line
+			}
+			if res[i].MatchString(text) {
+				want[a.Name]++
+			}
+		}
+	}
+
+	if len(want) == 0 {
+		t.Fatal("no trigger matched the transcript; test data is broken")
+	}
+	for name, n := range want {
+		if fired[name] != n {
+			t.Errorf("%s fired %d times, want %d", name, fired[name], n)
+		}
+	}
+	for name, n := range fired {
+		if want[name] == 0 {
+			t.Errorf("%s fired %d times, want 0", name, n)
+		}
+	}
+}
+
+func BenchmarkActionParser500(b *testing.B) {
+	lines := loadTranscript(b)
+	s := newBenchSession(transcriptPatterns(500), func(*Session, ActionMatches) {})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ActionParser([]byte(lines[i%len(lines)]))
+	}
+}
+
+// BenchmarkNaiveMatch500 is the pre-prefilter baseline: every regex on every line.
+func BenchmarkNaiveMatch500(b *testing.B) {
+	lines := loadTranscript(b)
+	actions := transcriptPatterns(500)
+	res := make([]*regexp.Regexp, len(actions))
+	for i, a := range actions {
+		res[i] = regexp.MustCompile(a.Pattern)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		line := lines[i%len(lines)]
+		stripped := stripansi.Strip(line)
+		for j, re := range res {
+			text := stripped
+			if actions[j].Color {
+				text = line
+			}
+			if re.MatchString(text) {
+				re.FindStringSubmatch(stripansi.Strip(text))
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package session
 import (
 	"log"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/charmbracelet/lipgloss"
@@ -12,12 +13,16 @@ import (
 type AliasFunction func(*Session, []string)
 
 type Alias struct {
-	Name    string
-	Pattern string
-	RE      *regexp.Regexp
-	Fn      AliasFunction
-	Enabled bool
-	Count   uint
+	Name      string
+	Pattern   string
+	RE        *regexp.Regexp
+	Fn        AliasFunction
+	Enabled   bool
+	Count     uint
+	Condition *Condition // optional gate, checked before the regex
+	Body      string     // command body for #alias aliases, empty for Go/Lua aliases
+	Priority  int        // higher priorities are tried first
+	Group     string
 }
 
 type AliasRegistry struct {
@@ -44,8 +49,11 @@ func (s *Session) RemoveAlias(name string) {
 func makeAliasRow(alias Alias) table.Row {
 	return table.NewRow(table.RowData{
 		"name":    alias.Name,
+		"group":   alias.Group,
 		"pattern": alias.Pattern,
+		"body":    alias.Body,
 		"enabled": alias.Enabled,
+		"when":    alias.Condition.String(),
 		"count":   alias.Count,
 	})
 }
@@ -58,8 +66,11 @@ func CmdAliases(s *Session, cmd string) {
 
 	t := table.New([]table.Column{
 		table.NewColumn("name", "Name", 25).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("group", "Group", 12).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 		table.NewColumn("pattern", "Pattern", 30).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("body", "Body", 30).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 		table.NewColumn("enabled", "Enabled", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("when", "When", 30).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 		table.NewColumn("count", "Count", 20).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center).Foreground(lipgloss.Color("#8c8"))),
 	}).
 		WithRows(rows).
@@ -68,15 +79,30 @@ func CmdAliases(s *Session, cmd string) {
 	s.Output(t.View() + "\n")
 }
 
+// sorted returns the aliases in matching order: priority, then name
+func (ar *AliasRegistry) sorted() []Alias {
+	aliases := make([]Alias, 0, len(ar.Aliases))
+	for _, a := range ar.Aliases {
+		aliases = append(aliases, a)
+	}
+	sort.Slice(aliases, func(i, j int) bool {
+		if aliases[i].Priority != aliases[j].Priority {
+			return aliases[i].Priority > aliases[j].Priority
+		}
+		return aliases[i].Name < aliases[j].Name
+	})
+	return aliases
+}
+
 // MatchAlias checks if the input matches any alias and executes it
 func (s *Session) MatchAlias(input string) bool {
 	input = strings.TrimSpace(input)
-	
-	for _, alias := range s.Aliases.Aliases {
-		if !alias.Enabled {
+
+	for _, alias := range s.Aliases.sorted() {
+		if !alias.Enabled || !alias.Condition.Check(s) {
 			continue
 		}
-		
+
 		if matches := alias.RE.FindStringSubmatch(input); matches != nil {
 			alias.Count++
 			s.Aliases.Aliases[alias.Name] = alias
@@ -84,6 +110,6 @@ func (s *Session) MatchAlias(input string) bool {
 			return true
 		}
 	}
-	
+
 	return false
 }
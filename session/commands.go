@@ -17,57 +17,158 @@ import (
 type CommandFunction func(*Session, string)
 
 type Command struct {
-	Name string
-	Fn   CommandFunction
+	Name   string
+	Fn     CommandFunction
+	Help   string // shown in #help, for commands added with AddCommand
+	Module string // the Lua module that registered the command, if any
 }
 
-var internalCommands = []Command{
-	{Name: "actions", Fn: CmdActions},
-	{Name: "aliases", Fn: CmdAliases},
-	{Name: "cancel", Fn: CmdCancelTicker},
-	{Name: "events", Fn: CmdEvents},
-	{"help", CmdHelp},
-	{Name: "modules", Fn: CmdModules},
-	{Name: "msdp", Fn: CmdMSDP},
-	{Name: "pane", Fn: nil},  // Layout command, handled separately
-	{Name: "panes", Fn: nil}, // Layout command, handled separately
-	{Name: "plugins", Fn: CmdPlugins},
-	{Name: "queue", Fn: CmdQueue},
-	{Name: "ringtest", Fn: CmdRingtest},
-	{Name: "session", Fn: CmdSession},
-	{Name: "sessions", Fn: CmdSessions},
-	{Name: "split", Fn: nil},   // Layout command, handled separately
-	{Name: "unsplit", Fn: nil}, // Layout command, handled separately
-	{Name: "focus", Fn: nil},   // Layout command, handled separately
-	{Name: "test", Fn: CmdTestTicker},
-	{Name: "tickers", Fn: CmdTickers},
+var internalCommands []Command
+
+// The table is filled in init because several commands reach
+// ParseInternalCommand again (e.g. through alias expansion).
+func init() {
+	internalCommands = []Command{
+		{Name: "actions", Fn: CmdActions},
+		{Name: "alias", Fn: CmdAlias},
+		{Name: "all", Fn: CmdAll},
+		{Name: "aliases", Fn: CmdAliases},
+		{Name: "cancel", Fn: CmdCancelTicker},
+		{Name: "events", Fn: CmdEvents},
+		{Name: "grep", Fn: CmdGrep},
+		{Name: "help", Fn: CmdHelp},
+		{Name: "history", Fn: CmdHistory},
+		{Name: "log", Fn: CmdLog},
+		{Name: "lua", Fn: CmdLua},
+		{Name: "modules", Fn: CmdModules},
+		{Name: "msdp", Fn: CmdMSDP},
+		{Name: "pane", Fn: nil},  // Layout command, handled separately
+		{Name: "panes", Fn: nil}, // Layout command, handled separately
+		{Name: "plugins", Fn: CmdPlugins},
+		{Name: "queue", Fn: CmdQueue},
+		{Name: "reload", Fn: CmdReload},
+		{Name: "ringtest", Fn: CmdRingtest},
+		{Name: "session", Fn: CmdSession},
+		{Name: "sessions", Fn: CmdSessions},
+		{Name: "set", Fn: CmdSet},
+		{Name: "settings", Fn: CmdSettings},
+		{Name: "scripts", Fn: CmdScripts},
+		{Name: "split", Fn: nil}, // Layout command, handled separately
+		{Name: "unalias", Fn: CmdUnalias},
+		{Name: "unsplit", Fn: nil}, // Layout command, handled separately
+		{Name: "focus", Fn: nil},   // Layout command, handled separately
+		{Name: "flush", Fn: CmdFlush},
+		{Name: "test", Fn: CmdTestTicker},
+		{Name: "tickers", Fn: CmdTickers},
+	}
 }
 
 var internalCommandHelp = map[string]string{
+	"alias":    "Define an alias: #alias {name} {cmd %1;cmd2 %*}",
 	"aliases":  "Show aliases",
+	"all":      "Run a command in every connected session: #all <cmd> (#<session> <cmd> for one)",
 	"cancel":   "Cancel test for timers",
+	"flush":    "Drop commands held back by the send rate limiter",
 	"focus":    "Set active pane: #focus <pane_id>",
+	"grep":     "Search scrollback: #grep <words or regex> [--since 10m] [--context N] [--limit N] [--type line,prompt,gagged,input,sent,system|all], then #grep --goto N to scroll to a result",
 	"help":     "This help command",
-	"modules":  "Show modules or enable/disable: #modules [enable|disable] <name>",
+	"history":  "Show recent scrollback with times: #history [lines] [--since 10m] [--type ...]",
+	"log":      "Log this session to a file: #log start [file] [--format raw|ansi|plain|html], #log stop (no file logs daily as in sessions.yaml)",
+	"lua":      "Evaluate Lua and show the result: #lua [--module <name>] <code>, or #lua alone to open the Lua prompt",
+	"modules":  "Show modules, describe/enable/disable/reload one: #modules [info|enable|disable|reload] <name>, or reload on change: #modules watch [on|off]",
 	"msdp":     "Show MSDP values",
 	"pane":     "Show pane info: #pane <pane_id>",
+	"queue":    "Show or manage the command queue: #queue [add {cmd} [priority N] [after ID] [when {cond}]|cancel <id>|clear|rate <per second>]",
 	"panes":    "List all panes",
+	"reload":   "Reload triggers.yaml, aliases.yaml and timers.yaml: #reload config",
+	"scripts":  "Show running Lua scripts, or stop one: #scripts [cancel <name>]",
 	"session":  "Usage: #session <name> <host:port>",
 	"sessions": "Show current sessions",
+	"set":      "Change a module setting, saved for this session: #set <module>.<setting> <value>",
+	"settings": "Show module settings: #settings [module]",
 	"split":    "Split pane: #split [h|v] [pane_id] [type] [percent]",
 	"test":     "Just a test command/playground",
-	"tickers":  "Show tickers",
+	"tickers":  "Show tickers, or pause/resume one: #tickers [pause|resume <name>]",
+	"unalias":  "Remove an alias: #unalias {name}",
 	"unsplit":  "Remove pane: #unsplit <pane_id>",
 }
 
+// AddCommand adds a #command to this session, replacing any of the same
+// name. A built-in command of the same name still takes precedence.
 func (s *Session) AddCommand(c Command, help string) {
-	internalCommands = append(internalCommands, c)
-	internalCommandHelp[c.Name] = help
+	if s.commands == nil {
+		s.commands = make(map[string]Command)
+	}
+	if help != "" {
+		c.Help = help
+	}
+	s.commands[c.Name] = c
+}
 
-	// sort internal commands alphabetically by Name
-	sort.Slice(internalCommands, func(i, j int) bool {
-		return internalCommands[i].Name < internalCommands[j].Name
-	})
+// RemoveCommand removes a command added with AddCommand and reports
+// whether it existed
+func (s *Session) RemoveCommand(name string) bool {
+	if _, ok := s.commands[name]; !ok {
+		return false
+	}
+	delete(s.commands, name)
+	return true
+}
+
+// findCommand returns the command called name or, failing that, the first
+// whose name starts with it. Built-in commands are checked before the
+// session's own, so a plugin or module cannot change what an abbreviation
+// of a built-in command does.
+func (s *Session) findCommand(name string) (Command, bool) {
+	for _, c := range internalCommands {
+		if c.Name == name && c.Fn != nil {
+			return c, true
+		}
+	}
+	if c, ok := s.commands[name]; ok {
+		return c, true
+	}
+	for _, c := range internalCommands {
+		if strings.HasPrefix(c.Name, name) && c.Fn != nil {
+			return c, true
+		}
+	}
+
+	names := make([]string, 0, len(s.commands))
+	for n := range s.commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if strings.HasPrefix(n, name) {
+			return s.commands[n], true
+		}
+	}
+	return Command{}, false
+}
+
+// splitArgs splits a command's arguments at spaces, keeping "quoted text"
+// together
+func splitArgs(cmd string) ([]string, error) {
+	if strings.TrimSpace(cmd) == "" {
+		return nil, nil
+	}
+	r := csv.NewReader(strings.NewReader(strings.TrimSpace(cmd)))
+	r.Comma = ' '
+	r.LazyQuotes = true
+	record, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	// Runs of spaces give empty fields
+	args := record[:0]
+	for _, arg := range record {
+		if arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return args, nil
 }
 
 func formatMSDPValue(v interface{}, indent int) string {
@@ -230,10 +331,7 @@ func CmdMSDP(s *Session, cmd string) {
 }
 
 func CmdTest(s *Session, cmd string) {
-	r := csv.NewReader(strings.NewReader(cmd))
-	r.Comma = ' '
-	r.LazyQuotes = true
-	record, err := r.Read()
+	record, err := splitArgs(cmd)
 	if err != nil {
 		log.Printf("Error: %v", err)
 	}
@@ -263,13 +361,12 @@ func CmdSession(s *Session, cmd string) {
 
 	// Single argument: switch to existing session
 	if len(fields) == 1 {
-		if _, exists := h.Sessions[sessionName]; !exists {
+		if _, exists := h.Session(sessionName); !exists {
 			s.Output(fmt.Sprintf("Invalid session: %s\n", sessionName))
 			return
 		}
 
-		h.Active = sessionName
-		activeSession := h.ActiveSession()
+		activeSession := h.activate(sessionName)
 		if activeSession == nil {
 			// Revert active session if lookup fails (shouldn't happen, but be safe)
 			s.Output("Error: Could not activate session.\n")
@@ -291,14 +388,13 @@ func CmdSession(s *Session, cmd string) {
 	}
 
 	// Verify session exists in map (more reliable than checking ActiveSession before setting Active)
-	if _, exists := h.Sessions[sessionName]; !exists {
+	if _, exists := h.Session(sessionName); !exists {
 		s.Output("Error: Session was created but not found in session map.\n")
 		return
 	}
 
 	// Set as active and notify
-	h.Active = sessionName
-	activeSession := h.ActiveSession()
+	activeSession := h.activate(sessionName)
 	if activeSession == nil {
 		// This shouldn't happen if the session exists, but handle it gracefully
 		s.Output("Error: Session exists but could not be activated.\n")
@@ -310,14 +406,22 @@ func CmdSession(s *Session, cmd string) {
 func CmdHelp(s *Session, cmd string) {
 	msg := "Commands:\n"
 
+	help := make(map[string]string, len(internalCommandHelp)+len(s.commands))
+	for k, v := range s.commands {
+		help[k] = v.Help
+	}
+	for k, v := range internalCommandHelp {
+		help[k] = v
+	}
+
 	var sortedHelp []string
-	for k := range internalCommandHelp {
+	for k := range help {
 		sortedHelp = append(sortedHelp, k)
 	}
 	sort.Strings(sortedHelp)
 	s.Output(msg)
 	for _, v := range sortedHelp {
-		msg = fmt.Sprintf("%+15s: %-40s\n", v, internalCommandHelp[v])
+		msg = fmt.Sprintf("%+15s: %-40s\n", v, help[v])
 		s.Output(msg)
 	}
 
@@ -335,11 +439,16 @@ func makeRow(name string, address string, start time.Time) table.Row {
 func CmdSessions(s *Session, cmd string) {
 	h := s.Handler
 	var rows []table.Row
-	for i := range h.Sessions {
-		if h.Sessions[i].Name == h.ActiveSession().Name {
-			rows = append(rows, makeRow("> "+h.Sessions[i].Name, h.Sessions[i].Address, h.Sessions[i].Birth))
+	active := h.ActiveName()
+	for _, name := range h.SessionNames() {
+		sess, ok := h.Session(name)
+		if !ok {
+			continue
+		}
+		if name == active {
+			rows = append(rows, makeRow("> "+sess.Name, sess.Address, sess.Birth))
 		} else {
-			rows = append(rows, makeRow("  "+h.Sessions[i].Name, h.Sessions[i].Address, h.Sessions[i].Birth))
+			rows = append(rows, makeRow("  "+sess.Name, sess.Address, sess.Birth))
 		}
 	}
 
@@ -358,27 +467,51 @@ func CmdModules(s *Session, cmd string) {
 	fields := strings.Fields(cmd)
 
 	if len(fields) == 0 {
-		// List all modules
+		// List all modules, then any that were refused
+		names := make([]string, 0, len(s.Modules.Modules))
+		for name := range s.Modules.Modules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
 		var rows []table.Row
-		for _, module := range s.Modules.Modules {
+		for _, name := range names {
+			module := s.Modules.Modules[name]
 			enabledStr := "disabled"
 			if module.Enabled {
 				enabledStr = "enabled"
 			}
 			rows = append(rows, table.NewRow(table.RowData{
 				"name":     module.Name,
+				"version":  module.Manifest.Version,
 				"path":     module.Path,
 				"enabled":  enabledStr,
+				"requires": module.Manifest.requires(),
 				"triggers": len(module.Triggers),
 				"aliases":  len(module.Aliases),
 				"timers":   len(module.Timers),
 			}))
 		}
 
+		refused := make([]string, 0, len(s.Modules.Refused))
+		for name := range s.Modules.Refused {
+			refused = append(refused, name)
+		}
+		sort.Strings(refused)
+		for _, name := range refused {
+			rows = append(rows, table.NewRow(table.RowData{
+				"name":     name,
+				"enabled":  "refused",
+				"requires": s.Modules.Refused[name],
+			}))
+		}
+
 		t := table.New([]table.Column{
 			table.NewColumn("name", "Name", 20).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+			table.NewColumn("version", "Version", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 			table.NewColumn("path", "Path", 40).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 			table.NewColumn("enabled", "Status", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+			table.NewColumn("requires", "Requires", 30).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 			table.NewColumn("triggers", "Triggers", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 			table.NewColumn("aliases", "Aliases", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 			table.NewColumn("timers", "Timers", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
@@ -387,6 +520,17 @@ func CmdModules(s *Session, cmd string) {
 			BorderRounded()
 
 		s.Output(t.View() + "\n")
+	} else if strings.ToLower(fields[0]) == "watch" {
+		on := !s.WatchingModules()
+		if len(fields) >= 2 {
+			on = strings.ToLower(fields[1]) == "on"
+		}
+		s.WatchModules(on)
+		if on {
+			s.Output("Reloading modules when their files change\n")
+		} else {
+			s.Output("No longer watching modules for changes\n")
+		}
 	} else if len(fields) >= 2 {
 		// Enable or disable module
 		action := strings.ToLower(fields[0])
@@ -405,14 +549,67 @@ func CmdModules(s *Session, cmd string) {
 			} else {
 				s.Output(fmt.Sprintf("Disabled module: %s\n", moduleName))
 			}
+		case "info":
+			s.Output(moduleInfo(s, moduleName))
+		case "reload":
+			if err := s.ReloadModule(moduleName); err != nil {
+				s.Output(fmt.Sprintf("Error reloading module %s:\n%v\n", moduleName, err))
+			} else {
+				s.Output(fmt.Sprintf("Reloaded module: %s\n", moduleName))
+			}
 		default:
-			s.Output("Usage: #modules [enable|disable] <name>\n")
+			s.Output("Usage: #modules [info|enable|disable|reload] <name> or #modules watch [on|off]\n")
 		}
 	} else {
-		s.Output("Usage: #modules [enable|disable] <name>\n")
+		s.Output("Usage: #modules [info|enable|disable|reload] <name> or #modules watch [on|off]\n")
 	}
 }
 
+// moduleInfo describes a module from its manifest, or why it was refused
+func moduleInfo(s *Session, name string) string {
+	module, ok := s.Modules.Modules[name]
+	if !ok {
+		if reason, ok := s.Modules.Refused[name]; ok {
+			return fmt.Sprintf("Module %s was not loaded: %s\n", name, reason)
+		}
+		return fmt.Sprintf("Module %s not found\n", name)
+	}
+
+	var b strings.Builder
+	m := module.Manifest
+	fmt.Fprintf(&b, "Module:       %s\n", module.Name)
+	for _, field := range []struct{ label, value string }{
+		{"Version", m.Version},
+		{"Description", m.Description},
+		{"Author", m.Author},
+		{"Path", module.Path},
+		{"Dependencies", strings.Join(m.Dependencies, ", ")},
+		{"Plugins", strings.Join(m.Plugins, ", ")},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&b, "%-13s %s\n", field.label+":", field.value)
+		}
+	}
+	return b.String()
+}
+
+// isInternalCommand reports whether name is the full name of a built-in command
+func isInternalCommand(name string) bool {
+	for _, c := range internalCommands {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isCommand reports whether name is the full name of a built-in command or
+// one added to the session
+func (s *Session) isCommand(name string) bool {
+	_, ok := s.commands[name]
+	return ok || isInternalCommand(name)
+}
+
 func (s *Session) ParseInternalCommand(cmd string) {
 	// Note: Command has already been added to Content (colored) in HandleInput()
 	// so we don't add it again here to avoid duplication
@@ -443,21 +640,18 @@ func (s *Session) ParseInternalCommand(cmd string) {
 		return
 	}
 
-	for lookup := range internalCommands {
-		if strings.HasPrefix(internalCommands[lookup].Name, cmdName) {
-			if internalCommands[lookup].Fn == nil {
-				// Layout command, skip
-				continue
-			}
-			if len(args) < 2 {
-				internalCommands[lookup].Fn(s, "")
-				s.Sub <- UpdateMessage{Session: s.Name}
-				return
-			} else {
-				internalCommands[lookup].Fn(s, args[1])
-				s.Sub <- UpdateMessage{Session: s.Name}
-				return
-			}
+	// "#<session> <cmd>" runs cmd in that session, unless the session is
+	// named like a command
+	if len(args) == 2 && !s.isCommand(cmdName) && s.sessionCommand(parsed[0], args[1]) {
+		s.Sub <- UpdateMessage{Session: s.Name}
+		return
+	}
+
+	if c, ok := s.findCommand(cmdName); ok {
+		if len(args) < 2 {
+			c.Fn(s, "")
+		} else {
+			c.Fn(s, args[1])
 		}
 	}
 	s.Sub <- UpdateMessage{Session: s.Name}
@@ -600,8 +794,8 @@ func (s *Session) ParseCommand(cmd string) {
 	// and an UpdateMessage was already sent, so we don't need to send another one
 
 	// TODO: We'll want to check this for aliases and/or variables
-	if s.Connected {
-		s.Socket.Write([]byte(cmd + LineTerminator))
+	if s.IsConnected() {
+		s.Send(cmd)
 	}
 
 	// No need to send UpdateMessage here - Output() already sent one with the colored command
@@ -0,0 +1,96 @@
+package session
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for cmd, want := range map[string][]string{
+		"":                          nil,
+		"one two":                   {"one", "two"},
+		`say "hello there"  loudly`: {"say", "hello there", "loudly"},
+		` padded `:                  {"padded"},
+	} {
+		got, err := splitArgs(cmd)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("splitArgs(%q) = %q, %v, want %q", cmd, got, err, want)
+		}
+	}
+}
+
+func TestCommandsArePerSession(t *testing.T) {
+	one, two := newModuleTestSession(), newModuleTestSession()
+	one.AddCommand(Command{Name: "greet", Fn: func(s *Session, cmd string) { s.Output("hi " + cmd + "\n") }}, "Say hi")
+
+	one.dispatchInput("#greet you")
+	two.dispatchInput("#greet you")
+	if got := one.Scrollback.String(); got != "hi you\n" {
+		t.Errorf("session with the command printed %q", got)
+	}
+	if got := two.Scrollback.String(); got != "" {
+		t.Errorf("other session ran the command: %q", got)
+	}
+
+	// Abbreviations still find built-in commands first
+	if c, _ := one.findCommand("h"); c.Name != "help" {
+		t.Errorf("#h found %s", c.Name)
+	}
+	if c, _ := one.findCommand("gr"); c.Name != "grep" {
+		t.Errorf("#gr found %s", c.Name)
+	}
+	if c, _ := one.findCommand("gree"); c.Name != "greet" {
+		t.Errorf("#gree found %s", c.Name)
+	}
+
+	CmdHelp(one, "")
+	if !strings.Contains(one.Scrollback.String(), "greet: Say hi") {
+		t.Error("#help does not list the added command")
+	}
+}
+
+func TestLuaCommand(t *testing.T) {
+	s := newModuleTestSession()
+	path := writeModule(t, t.TempDir(), "tools", `
+		session.register_command("pick", "Pick something: #pick <thing> [more]", function(args, line)
+			session.output(#args .. " args: " .. table.concat(args, "|") .. " from " .. line .. "\n")
+		end)
+		session.register_command("boom", "Fail", function() error("went wrong") end)
+	`)
+	if err := LoadModule(s, path); err != nil {
+		t.Fatal(err)
+	}
+
+	s.dispatchInput(`#pick "red apple" pear`)
+	s.dispatchInput("#boom")
+	CmdHelp(s, "")
+	got := s.Scrollback.String()
+	for _, want := range []string{
+		`2 args: red apple|pear from "red apple" pear`,
+		"Error in #boom",
+		"pick: Pick something",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q:\n%s", want, got)
+		}
+	}
+
+	s.DisableModule("tools")
+	if s.isCommand("pick") {
+		t.Error("command kept while its module is disabled")
+	}
+	s.EnableModule("tools")
+	if !s.isCommand("pick") {
+		t.Error("command not restored when its module was enabled")
+	}
+	s.unloadModule(s.Modules.Modules["tools"])
+	if s.isCommand("pick") || s.isCommand("boom") {
+		t.Error("commands left behind after unloading the module")
+	}
+
+	path = writeModule(t, t.TempDir(), "rude", `session.register_command("help", "Mine", function() end)`)
+	if err := LoadModule(s, path); err == nil || !strings.Contains(err.Error(), "#help is a built-in command") {
+		t.Errorf("overriding a built-in command: %v", err)
+	}
+}
@@ -0,0 +1,499 @@
+package session
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Condition gates a trigger or alias on session state. It is checked before
+// the regex runs, so a false condition skips the pattern match entirely.
+type Condition struct {
+	Source string // expression text (or a short description for Go/Lua predicates)
+	Fn     func(*Session) bool
+}
+
+// Check reports whether the condition currently holds. A nil condition always holds.
+func (c *Condition) Check(s *Session) bool {
+	if c == nil || c.Fn == nil {
+		return true
+	}
+	return c.Fn(s)
+}
+
+// String returns the condition source for display in tables.
+func (c *Condition) String() string {
+	if c == nil {
+		return ""
+	}
+	return c.Source
+}
+
+// NewCondition compiles a condition expression such as
+//
+//	msdp.ROOM_VNUM in (3001, 3002) and msdp.HEALTH < 50%
+//	data.autoloot == true
+//	not msdp.IN_COMBAT
+//
+// Identifiers are msdp.<KEY> or data.<key>. A percentage on the right of a
+// comparison compares msdp.<KEY> against msdp.<KEY>_MAX.
+func NewCondition(expr string) (*Condition, error) {
+	p := &condParser{tokens: tokenizeCondition(expr)}
+	if p.tokens == nil {
+		return nil, fmt.Errorf("empty condition")
+	}
+	for _, t := range p.tokens {
+		if t.kind == tokInvalid {
+			return nil, fmt.Errorf("unexpected character %q in condition", t.text)
+		}
+	}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected %q in condition", p.peek().text)
+	}
+	return &Condition{
+		Source: expr,
+		Fn: func(s *Session) bool {
+			return truthy(node.eval(s))
+		},
+	}, nil
+}
+
+type condTokenKind int
+
+const (
+	tokInvalid condTokenKind = iota
+	tokIdent
+	tokNumber
+	tokPercent
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type condToken struct {
+	kind condTokenKind
+	text string
+}
+
+func tokenizeCondition(expr string) []condToken {
+	var tokens []condToken
+	r := []rune(expr)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, condToken{tokLParen, "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, condToken{tokRParen, ")"})
+			i++
+		case c == ',':
+			tokens = append(tokens, condToken{tokComma, ","})
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(r) && r[j] != c {
+				j++
+			}
+			tokens = append(tokens, condToken{tokString, string(r[i+1 : j])})
+			i = j + 1
+		case strings.ContainsRune("=!<>&|", c):
+			j := i + 1
+			if j < len(r) && strings.ContainsRune("=&|", r[j]) {
+				j++
+			}
+			tokens = append(tokens, condToken{tokOp, string(r[i:j])})
+			i = j
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(r) && unicode.IsDigit(r[i+1])):
+			j := i + 1
+			for j < len(r) && (unicode.IsDigit(r[j]) || r[j] == '.') {
+				j++
+			}
+			if j < len(r) && r[j] == '%' {
+				tokens = append(tokens, condToken{tokPercent, string(r[i:j])})
+				j++
+			} else {
+				tokens = append(tokens, condToken{tokNumber, string(r[i:j])})
+			}
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(r) && (unicode.IsLetter(r[j]) || unicode.IsDigit(r[j]) || r[j] == '_' || r[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, condToken{tokIdent, string(r[i:j])})
+			i = j
+		default:
+			tokens = append(tokens, condToken{tokInvalid, string(c)})
+			i++
+		}
+	}
+	return tokens
+}
+
+type condNode interface {
+	eval(*Session) interface{}
+}
+
+type condParser struct {
+	tokens []condToken
+	pos    int
+}
+
+func (p *condParser) done() bool { return p.pos >= len(p.tokens) }
+
+func (p *condParser) peek() condToken {
+	if p.done() {
+		return condToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *condParser) next() condToken {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *condParser) isKeyword(words ...string) bool {
+	t := p.peek()
+	if t.kind != tokIdent && t.kind != tokOp {
+		return false
+	}
+	for _, w := range words {
+		if strings.EqualFold(t.text, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *condParser) parseOr() (condNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or", "||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicNode{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *condParser) parseAnd() (condNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and", "&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicNode{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *condParser) parseUnary() (condNode, error) {
+	if p.isKeyword("not", "!") {
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inner: inner}, nil
+	}
+	if p.peek().kind == tokLParen {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokRParen {
+			return nil, fmt.Errorf("missing ')' in condition")
+		}
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *condParser) parseComparison() (condNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	negate := false
+	if p.isKeyword("not") && p.pos+1 < len(p.tokens) && strings.EqualFold(p.tokens[p.pos+1].text, "in") {
+		p.next()
+		negate = true
+	}
+	if p.isKeyword("in") {
+		p.next()
+		if p.next().kind != tokLParen {
+			return nil, fmt.Errorf("expected '(' after 'in'")
+		}
+		var set []condNode
+		for {
+			item, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, item)
+			t := p.next()
+			if t.kind == tokRParen {
+				break
+			}
+			if t.kind != tokComma {
+				return nil, fmt.Errorf("expected ',' or ')' in set")
+			}
+		}
+		var n condNode = inNode{value: left, set: set}
+		if negate {
+			n = notNode{inner: n}
+		}
+		return n, nil
+	}
+
+	t := p.peek()
+	if t.kind != tokOp || t.text == "&&" || t.text == "||" || t.text == "!" {
+		return left, nil
+	}
+	op := p.next().text
+	switch op {
+	case "==", "=", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("unknown operator %q", op)
+	}
+
+	if p.peek().kind == tokPercent {
+		id, ok := left.(identNode)
+		if !ok || id.scope != "msdp" {
+			return nil, fmt.Errorf("percentages can only be compared against msdp values")
+		}
+		pct, _ := strconv.ParseFloat(p.next().text, 64)
+		return compareNode{op: op, left: percentNode{key: id.key}, right: literalNode{value: pct}}, nil
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{op: op, left: left, right: right}, nil
+}
+
+func (p *condParser) parseOperand() (condNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return literalNode{value: f}, nil
+	case tokString:
+		return literalNode{value: t.text}, nil
+	case tokIdent:
+		switch strings.ToLower(t.text) {
+		case "true":
+			return literalNode{value: true}, nil
+		case "false":
+			return literalNode{value: false}, nil
+		}
+		scope, key, ok := strings.Cut(t.text, ".")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("unknown identifier %q (use msdp.<KEY> or data.<key>)", t.text)
+		}
+		scope = strings.ToLower(scope)
+		if scope != "msdp" && scope != "data" {
+			return nil, fmt.Errorf("unknown scope %q (use msdp or data)", scope)
+		}
+		return identNode{scope: scope, key: key}, nil
+	case tokInvalid:
+		return nil, fmt.Errorf("unexpected end of condition")
+	default:
+		return nil, fmt.Errorf("unexpected %q in condition", t.text)
+	}
+}
+
+type literalNode struct{ value interface{} }
+
+func (n literalNode) eval(*Session) interface{} { return n.value }
+
+type identNode struct{ scope, key string }
+
+func (n identNode) eval(s *Session) interface{} {
+	switch n.scope {
+	case "msdp":
+		if s.MSDP == nil {
+			return nil
+		}
+		v := s.MSDP.GetString(n.key)
+		if v == "" {
+			return nil
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+		return v
+	case "data":
+		if s.Data == nil {
+			return nil
+		}
+		return s.Data[n.key]
+	}
+	return nil
+}
+
+// percentNode evaluates msdp.KEY as a percentage of msdp.KEY_MAX.
+type percentNode struct{ key string }
+
+func (n percentNode) eval(s *Session) interface{} {
+	if s.MSDP == nil {
+		return nil
+	}
+	max := s.MSDP.GetInt(n.key + "_MAX")
+	if max == 0 {
+		return nil
+	}
+	return float64(s.MSDP.GetInt(n.key)) * 100 / float64(max)
+}
+
+type notNode struct{ inner condNode }
+
+func (n notNode) eval(s *Session) interface{} { return !truthy(n.inner.eval(s)) }
+
+type logicNode struct {
+	op          string
+	left, right condNode
+}
+
+func (n logicNode) eval(s *Session) interface{} {
+	if n.op == "and" {
+		return truthy(n.left.eval(s)) && truthy(n.right.eval(s))
+	}
+	return truthy(n.left.eval(s)) || truthy(n.right.eval(s))
+}
+
+type inNode struct {
+	value condNode
+	set   []condNode
+}
+
+func (n inNode) eval(s *Session) interface{} {
+	v := n.value.eval(s)
+	for _, item := range n.set {
+		if condEqual(v, item.eval(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+type compareNode struct {
+	op          string
+	left, right condNode
+}
+
+func (n compareNode) eval(s *Session) interface{} {
+	l, r := n.left.eval(s), n.right.eval(s)
+	switch n.op {
+	case "==", "=":
+		return condEqual(l, r)
+	case "!=":
+		return !condEqual(l, r)
+	}
+	if l == nil || r == nil {
+		return false
+	}
+	lf, lok := condNumber(l)
+	rf, rok := condNumber(r)
+	if lok && rok {
+		switch n.op {
+		case "<":
+			return lf < rf
+		case "<=":
+			return lf <= rf
+		case ">":
+			return lf > rf
+		case ">=":
+			return lf >= rf
+		}
+	}
+	ls, rs := fmt.Sprint(l), fmt.Sprint(r)
+	switch n.op {
+	case "<":
+		return ls < rs
+	case "<=":
+		return ls <= rs
+	case ">":
+		return ls > rs
+	case ">=":
+		return ls >= rs
+	}
+	return false
+}
+
+func condNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func condEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if ab, ok := a.(bool); ok {
+		return ab == truthy(b)
+	}
+	if bb, ok := b.(bool); ok {
+		return bb == truthy(a)
+	}
+	af, aok := condNumber(a)
+	bf, bok := condNumber(b)
+	if aok && bok {
+		return af == bf
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case int:
+		return t != 0
+	case string:
+		return t != "" && t != "0" && !strings.EqualFold(t, "false")
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package session
+
+import (
+	"testing"
+
+	kallisti "github.com/perlsaiyan/zif/protocol"
+)
+
+func TestConditionExpressions(t *testing.T) {
+	s := &Session{
+		MSDP: kallisti.NewMSDP(),
+		Data: map[string]interface{}{"autoloot": true, "target": "orc"},
+	}
+	s.MSDP.Data["ROOM_VNUM"] = "3001"
+	s.MSDP.Data["HEALTH"] = "40"
+	s.MSDP.Data["HEALTH_MAX"] = "100"
+	s.MSDP.Data["IN_COMBAT"] = "0"
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`msdp.ROOM_VNUM in (3001, 3002)`, true},
+		{`msdp.ROOM_VNUM not in (3001, 3002)`, false},
+		{`msdp.HEALTH < 50%`, true},
+		{`msdp.HEALTH >= 50%`, false},
+		{`msdp.HEALTH > 30 and msdp.HEALTH <= 40`, true},
+		{`data.autoloot == true`, true},
+		{`data.autoloot`, true},
+		{`not msdp.IN_COMBAT`, true},
+		{`!data.autoloot || data.target == "orc"`, true},
+		{`data.target != 'orc'`, false},
+		{`data.missing`, false},
+		{`(msdp.ROOM_VNUM == 1 or msdp.ROOM_VNUM == 3001) and not data.missing`, true},
+	}
+
+	for _, tt := range tests {
+		c, err := NewCondition(tt.expr)
+		if err != nil {
+			t.Errorf("NewCondition(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := c.Check(s); got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestConditionErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`foo.BAR == 1`,
+		`msdp.HEALTH <`,
+		`data.x < 50%`,
+		`msdp.ROOM_VNUM in (1, 2`,
+		`msdp.A == 1 )`,
+	} {
+		if _, err := NewCondition(expr); err == nil {
+			t.Errorf("NewCondition(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestActionParserSkipsFailingCondition(t *testing.T) {
+	s := &Session{
+		Actions: NewActionRegistry(),
+		Data:    map[string]interface{}{"enabled": false},
+	}
+	cond, err := NewCondition("data.enabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fired := 0
+	s.AddAction(Action{
+		Name:      "gated",
+		Pattern:   "hello",
+		Enabled:   true,
+		Condition: cond,
+		Fn:        func(*Session, ActionMatches) { fired++ },
+	})
+
+	s.ActionParser([]byte("hello world"))
+	if fired != 0 {
+		t.Fatalf("trigger fired with false condition")
+	}
+
+	s.Data["enabled"] = true
+	s.ActionParser([]byte("hello world"))
+	if fired != 1 {
+		t.Fatalf("trigger did not fire with true condition, fired=%d", fired)
+	}
+}
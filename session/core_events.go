@@ -0,0 +1,84 @@
+package session
+
+// Events fired by the client itself. Plugins and Lua modules may subscribe
+// to any of these, or to "core.*" for all of them.
+const (
+	EventConnect       = "core.connect"
+	EventDisconnect    = "core.disconnect"
+	EventLine          = "core.line"
+	EventPrompt        = "core.prompt"
+	EventInput         = "core.input"
+	EventSend          = "core.send"
+	EventMSDP          = "core.msdp"
+	EventSessionSwitch = "core.session_switch"
+	EventModuleLoad    = "core.module_load"
+	EventSettingChange = "core.setting_change"
+)
+
+// ConnectEvent is fired once a session's socket is open
+type ConnectEvent struct {
+	BaseEvent
+	Session string `json:"session"`
+	Address string `json:"address"`
+}
+
+// DisconnectEvent is fired when the MUD closes the connection or a read fails
+type DisconnectEvent struct {
+	BaseEvent
+	Session string `json:"session"`
+	Address string `json:"address"`
+	Error   string `json:"error"`
+}
+
+// LineEvent is fired for each line from the MUD (core.line) and for each
+// prompt (core.prompt), after triggers have run.
+type LineEvent struct {
+	BaseEvent
+	Line     string `json:"line"`
+	Stripped string `json:"stripped"`
+	Prompt   bool   `json:"prompt"`
+	Gagged   bool   `json:"gagged"`
+}
+
+// InputEvent is fired for each command typed by the user, before aliases
+// are expanded.
+type InputEvent struct {
+	BaseEvent
+	Input string `json:"input"`
+}
+
+// SendEvent is fired for each command written to the MUD
+type SendEvent struct {
+	BaseEvent
+	Command string `json:"command"`
+}
+
+// MSDPEvent is fired after an MSDP update with the full variable table
+type MSDPEvent struct {
+	BaseEvent
+	Data map[string]interface{} `json:"data"`
+}
+
+// SessionSwitchEvent is fired on the newly active session
+type SessionSwitchEvent struct {
+	BaseEvent
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ModuleLoadEvent is fired after a Lua module is loaded, or fails to load
+type ModuleLoadEvent struct {
+	BaseEvent
+	Module string `json:"module"`
+	Path   string `json:"path"`
+	Error  string `json:"error"`
+}
+
+// SettingChangeEvent is fired when a module setting is changed with #set
+type SettingChangeEvent struct {
+	BaseEvent
+	Module string      `json:"module"`
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`
+	Old    interface{} `json:"old"` // nil if the setting had no value
+}
@@ -0,0 +1,284 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/perlsaiyan/zif/config"
+	"github.com/perlsaiyan/zif/schedule"
+	"github.com/perlsaiyan/zif/tintin"
+)
+
+// declaredConfig records what the session's YAML files registered, so that
+// #reload config can remove it before loading the files again.
+type declaredConfig struct {
+	triggers []string
+	aliases  map[string]string // alias name to the file that declared it
+	timers   []string
+}
+
+// expandMatches substitutes %0-%9 in a command with a regex's captures.
+// %* is the whole match, like %0.
+func expandMatches(cmd string, matches []string) string {
+	return placeholderRE.ReplaceAllStringFunc(cmd, func(m string) string {
+		n := 0
+		if m[1] != '*' {
+			n = int(m[1] - '0')
+		}
+		if n < len(matches) {
+			return matches[n]
+		}
+		return ""
+	})
+}
+
+// runExpanded runs commands with captures substituted. Commands are split
+// before substitution so a ';' in MUD text can't inject extra commands.
+func runExpanded(s *Session, cmds []string, matches []string) {
+	expanded := make([]string, 0, len(cmds))
+	for _, c := range cmds {
+		for _, part := range tintin.SplitCommands(c) {
+			expanded = append(expanded, expandMatches(part, matches))
+		}
+	}
+	s.RunCommands(expanded)
+}
+
+// entryCondition compiles an entry's when: expression
+func entryCondition(file string, line int, when string) (*Condition, error) {
+	if when == "" {
+		return nil, nil
+	}
+	cond, err := NewCondition(when)
+	if err != nil {
+		return nil, config.ValidationError{File: file, Line: line, Msg: fmt.Sprintf("bad when: %v", err)}
+	}
+	return cond, nil
+}
+
+// LoadSessionConfig registers the triggers, aliases and timers declared in a
+// session's triggers.yaml, aliases.yaml and timers.yaml, then those zif
+// import wrote to the imported_ files, replacing anything an earlier load
+// registered. Invalid entries are skipped and reported in the returned
+// error, one per line.
+func LoadSessionConfig(s *Session, sessionName string) error {
+	s.unloadDeclared()
+
+	var errs []error
+	errs = append(errs, s.loadDeclaredTriggers(sessionName)...)
+	errs = append(errs, s.loadDeclaredAliases(sessionName)...)
+	errs = append(errs, s.loadDeclaredTimers(sessionName)...)
+	return errors.Join(errs...)
+}
+
+func (s *Session) unloadDeclared() {
+	for _, name := range s.declared.triggers {
+		s.RemoveAction(name)
+	}
+	for name := range s.declared.aliases {
+		s.RemoveAlias(name)
+	}
+	for _, name := range s.declared.timers {
+		s.RemoveTicker(name)
+	}
+	// #alias aliases are read back from user_aliases.yaml
+	for name, a := range s.Aliases.Aliases {
+		if a.Body != "" {
+			s.RemoveAlias(name)
+		}
+	}
+	s.declared = declaredConfig{aliases: map[string]string{}}
+}
+
+func (s *Session) loadDeclaredTriggers(sessionName string) []error {
+	var errs []error
+	for _, load := range []func(string) (*config.TriggersConfig, error){config.LoadSessionTriggers, config.LoadSessionImportedTriggers} {
+		cfg, err := load(sessionName)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, s.addDeclaredTriggers(cfg)...)
+	}
+	return errs
+}
+
+func (s *Session) addDeclaredTriggers(cfg *config.TriggersConfig) []error {
+	errs := cfg.Validate()
+	bad := config.InvalidEntries(errs)
+	for i, t := range cfg.Triggers {
+		if bad[i] {
+			continue
+		}
+		cond, err := entryCondition(cfg.File, t.Line, t.When)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		action := Action{
+			Name:      t.Name,
+			Pattern:   t.Pattern,
+			Color:     t.Color,
+			Enabled:   config.IsEnabled(t.Enabled),
+			Condition: cond,
+			Priority:  t.Priority,
+			Group:     t.Group,
+			Gag:       t.Gag,
+			Highlight: t.Highlight,
+		}
+		if cmds := t.Commands; len(cmds) > 0 {
+			action.Fn = func(sess *Session, m ActionMatches) {
+				runExpanded(sess, cmds, m.Matches)
+			}
+		}
+		s.AddAction(action)
+		s.declared.triggers = append(s.declared.triggers, t.Name)
+	}
+	return errs
+}
+
+func (s *Session) loadDeclaredAliases(sessionName string) []error {
+	var errs []error
+	for _, load := range []func(string) (*config.AliasesConfig, error){config.LoadSessionAliases, config.LoadSessionImportedAliases} {
+		cfg, err := load(sessionName)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, s.addDeclaredAliases(cfg)...)
+	}
+	return append(errs, s.loadUserAliases(sessionName)...)
+}
+
+func (s *Session) addDeclaredAliases(cfg *config.AliasesConfig) []error {
+	errs := cfg.Validate()
+	bad := config.InvalidEntries(errs)
+	for i, a := range cfg.Aliases {
+		if bad[i] {
+			continue
+		}
+		if !a.Declarative() {
+			s.AddTintinAlias(a.Name, a.Body)
+			s.declared.aliases[a.Name] = cfg.File
+			continue
+		}
+		cond, err := entryCondition(cfg.File, a.Line, a.When)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		alias := Alias{
+			Name:      a.Name,
+			Pattern:   a.Pattern,
+			Enabled:   config.IsEnabled(a.Enabled),
+			Condition: cond,
+			Priority:  a.Priority,
+			Group:     a.Group,
+		}
+		cmds := a.Commands
+		if alias.Pattern == "" {
+			// A name without a pattern behaves like #alias: %1-%9 are words
+			body := strings.Join(cmds, ";")
+			alias.Pattern = `^` + regexp.QuoteMeta(a.Name) + `(?:\s+.*)?$`
+			alias.Fn = func(sess *Session, m []string) {
+				sess.RunCommands(tintin.SplitCommands(ExpandAliasBody(body, m[0])))
+			}
+		} else {
+			alias.Fn = func(sess *Session, m []string) {
+				runExpanded(sess, cmds, m)
+			}
+		}
+		s.AddAlias(alias)
+		s.declared.aliases[a.Name] = cfg.File
+	}
+	return errs
+}
+
+// loadUserAliases registers the aliases saved by #alias, which replace
+// aliases of the same name from aliases.yaml or imported_aliases.yaml
+func (s *Session) loadUserAliases(sessionName string) []error {
+	cfg, err := config.LoadSessionUserAliases(sessionName)
+	if err != nil {
+		return []error{err}
+	}
+	for _, a := range cfg.Aliases {
+		if a.Name == "" || a.Body == "" {
+			continue
+		}
+		s.AddTintinAlias(a.Name, a.Body)
+		delete(s.declared.aliases, a.Name)
+	}
+	return nil
+}
+
+func (s *Session) loadDeclaredTimers(sessionName string) []error {
+	var errs []error
+	for _, load := range []func(string) (*config.TimersConfig, error){config.LoadSessionTimers, config.LoadSessionImportedTimers} {
+		cfg, err := load(sessionName)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, s.addDeclaredTimers(cfg)...)
+	}
+	return errs
+}
+
+func (s *Session) addDeclaredTimers(cfg *config.TimersConfig) []error {
+	errs := cfg.Validate()
+	bad := config.InvalidEntries(errs)
+	for i, t := range cfg.Timers {
+		if bad[i] || !config.IsEnabled(t.Enabled) {
+			continue
+		}
+		cond, err := entryCondition(cfg.File, t.Line, t.When)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		interval, _ := time.ParseDuration(t.Interval)
+		jitter, _ := time.ParseDuration(t.Jitter)
+		cmds := t.Commands
+		ticker := &TickerRecord{
+			Name:       t.Name,
+			Interval:   int(interval / time.Millisecond),
+			Jitter:     int(jitter / time.Millisecond),
+			Iterations: t.Repeat,
+			Fn: func(sess *Session) {
+				if cond.Check(sess) {
+					runExpanded(sess, cmds, nil)
+				}
+			},
+		}
+		if t.Schedule != "" {
+			ticker.Schedule, _ = schedule.Parse(t.Schedule)
+		}
+		if err := s.AddTicker(ticker); err != nil {
+			errs = append(errs, config.ValidationError{File: cfg.File, Line: t.Line, Entry: i, Msg: err.Error()})
+			continue
+		}
+		s.declared.timers = append(s.declared.timers, t.Name)
+	}
+	return errs
+}
+
+// CmdReload reloads configuration from disk
+func CmdReload(s *Session, cmd string) {
+	switch strings.TrimSpace(cmd) {
+	case "config":
+		if err := LoadSessionConfig(s, s.Name); err != nil {
+			s.Output("Reloaded config with errors:\n" + err.Error() + "\n")
+			return
+		}
+		s.Output(fmt.Sprintf("Reloaded config: %d triggers, %d aliases, %d timers\n",
+			len(s.declared.triggers), len(s.declared.aliases), len(s.declared.timers)))
+	default:
+		s.Output("Usage: #reload config\n")
+	}
+}
@@ -0,0 +1,168 @@
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTriggers = `triggers:
+  - name: spam
+    pattern: '^\[Auction\]'
+    gag: true
+  - name: broken
+    pattern: '(unclosed'
+    commands: say hi
+  - name: loot
+    pattern: '^(\w+) is dead!'
+    priority: 10
+    group: combat
+    commands:
+      - say killed %1
+      - say again;say %1
+  - name: gated
+    pattern: 'x'
+    commands: say x
+    when: 'msdp.HEALTH <'
+`
+
+const testAliases = `aliases:
+  - name: k
+    body: say kill %1
+  - name: heal
+    pattern: '^heal (\w+)$'
+    commands: say heal %1
+`
+
+func writeSessionFile(t *testing.T, name, data string) {
+	t.Helper()
+	dir := filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "zif", "sessions", "test")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSessionConfig(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	writeSessionFile(t, "triggers.yaml", testTriggers)
+	writeSessionFile(t, "aliases.yaml", testAliases)
+	writeSessionFile(t, "timers.yaml", "timers:\n  - name: tick\n    interval: 1h\n    commands: say tick\n")
+
+	s, said := newAliasTestSession()
+	s.Actions = NewActionRegistry()
+	s.Tickers = &TickerRegistry{Context: context.Background(), Entries: map[string]*TickerRecord{}}
+
+	err := LoadSessionConfig(s, "test")
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"triggers.yaml:5: trigger \"broken\" has a bad pattern", "triggers.yaml:15: bad when"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("errors %q do not mention %q", err, want)
+		}
+	}
+
+	if _, ok := s.Actions.Actions["broken"]; ok {
+		t.Error("invalid trigger was registered")
+	}
+	if fx := s.matchActions("[Auction] a sword\n", "[Auction] a sword\n"); !fx.gag {
+		t.Error("spam line was not gagged")
+	}
+
+	s.matchActions("orc is dead!\n", "orc is dead!\n")
+	s.dispatchInput("heal bob")
+	s.dispatchInput("k troll")
+	want := []string{"killed orc", "again", "orc", "heal bob", "kill troll"}
+	if !reflect.DeepEqual(*said, want) {
+		t.Errorf("said %q, want %q", *said, want)
+	}
+	if _, ok := s.Tickers.Entries["tick"]; !ok {
+		t.Error("timer was not registered")
+	}
+
+	// Reloading with the files gone removes everything they declared
+	os.RemoveAll(filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "zif"))
+	if err := LoadSessionConfig(s, "test"); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if len(s.Actions.Actions) != 0 || len(s.Tickers.Entries) != 0 {
+		t.Errorf("declared entries left after reload: %d actions, %d timers", len(s.Actions.Actions), len(s.Tickers.Entries))
+	}
+	if _, ok := s.Aliases.Aliases["say"]; !ok || len(s.Aliases.Aliases) != 1 {
+		t.Errorf("reload should only leave the Go alias, have %d", len(s.Aliases.Aliases))
+	}
+}
+
+func TestImportedConfig(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	writeSessionFile(t, "aliases.yaml", "aliases:\n  - name: k\n    body: say kill %1\n")
+	writeSessionFile(t, "imported_aliases.yaml", "aliases:\n  - name: k\n    body: say slay %1\n  - name: heal\n    body: say heal %1\n")
+	writeSessionFile(t, "imported_triggers.yaml", "triggers:\n  - name: bad\n    pattern: '(unclosed'\n    commands: say hi\n")
+
+	s, said := newAliasTestSession()
+	s.Actions = NewActionRegistry()
+	err := LoadSessionConfig(s, "test")
+	if err == nil || !strings.Contains(err.Error(), "imported_triggers.yaml:2: trigger \"bad\" has a bad pattern") {
+		t.Errorf("errors in imported_triggers.yaml: %v", err)
+	}
+
+	// Imported entries load after the hand-written ones
+	s.dispatchInput("k orc")
+	s.dispatchInput("heal bob")
+	if want := []string{"slay orc", "heal bob"}; !reflect.DeepEqual(*said, want) {
+		t.Errorf("said %q, want %q", *said, want)
+	}
+	CmdUnalias(s, "{heal}")
+	if !strings.Contains(s.Scrollback.String(), "Alias heal is defined in imported_aliases.yaml") {
+		t.Errorf("#unalias of an imported alias: %q", s.Scrollback.String())
+	}
+}
+
+func TestTriggerCapturesCannotInjectCommands(t *testing.T) {
+	s, said := newAliasTestSession()
+	runExpanded(s, []string{"say %1"}, []string{"", "hi;drop all"})
+	if want := []string{"hi;drop all"}; !reflect.DeepEqual(*said, want) {
+		t.Errorf("said %q, want %q", *said, want)
+	}
+}
+
+func TestAliasCommandKeepsAliasesYAML(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	handWritten := "# my aliases\naliases:\n  - name: k   # kill things\n    body: say kill %1\n"
+	writeSessionFile(t, "aliases.yaml", handWritten)
+
+	s, said := newAliasTestSession()
+	if err := LoadSessionConfig(s, "test"); err != nil {
+		t.Fatal(err)
+	}
+	CmdAlias(s, "{hi} {say hello %1}")
+	CmdUnalias(s, "{k}")
+
+	dir := filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "zif", "sessions", "test")
+	if data, _ := os.ReadFile(filepath.Join(dir, "aliases.yaml")); string(data) != handWritten {
+		t.Errorf("aliases.yaml was rewritten:\n%s", data)
+	}
+	if !strings.Contains(s.Scrollback.String(), "Alias k is defined in aliases.yaml") {
+		t.Errorf("#unalias of a hand-written alias: %q", s.Scrollback.String())
+	}
+
+	// #alias aliases come back from user_aliases.yaml
+	fresh, freshSaid := newAliasTestSession()
+	if err := LoadSessionConfig(fresh, "test"); err != nil {
+		t.Fatal(err)
+	}
+	fresh.dispatchInput("hi bob")
+	fresh.dispatchInput("k orc")
+	if want := []string{"hello bob", "kill orc"}; !reflect.DeepEqual(*freshSaid, want) {
+		t.Errorf("reloaded session said %q, want %q", *freshSaid, want)
+	}
+	if len(*said) != 0 {
+		t.Errorf("original session said %q", *said)
+	}
+}
@@ -1,6 +1,11 @@
 package session
 
 import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,45 +32,61 @@ func NewBaseEvent() BaseEvent {
 }
 
 type Event struct {
-	Name    string
-	Event   string
-	Enabled bool
-	Fn      EventFunction
-	Count   uint
+	Name     string
+	Event    string
+	Enabled  bool
+	Fn       EventFunction
+	Count    uint
+	Priority int // higher priorities run first
+
+	seq uint64 // registration order, breaks priority ties
 }
 
+// DefaultMaxEventDepth limits how deeply handlers may fire further events
+const DefaultMaxEventDepth = 10
+
+// EventRegistry maps a hook to its handlers. A hook is an event name such
+// as "core.line" or a wildcard pattern such as "kallisti.*" or "*".
 type EventRegistry struct {
-	Events map[string][]Event
-	mu     sync.Mutex
+	Events   map[string][]Event
+	MaxDepth int // events fired deeper than this inside handlers are dropped
+	mu       sync.Mutex
+
+	next   uint64
+	firing []string // names of the events being dispatched, innermost last
 }
 
 func NewEventRegistry() *EventRegistry {
 
-	er := EventRegistry{Events: make(map[string][]Event)}
+	er := EventRegistry{Events: make(map[string][]Event), MaxDepth: DefaultMaxEventDepth}
 	return &er
 }
 
 func makeEventRow(e string, evt Event) table.Row {
 
 	return table.NewRow(table.RowData{
-		"event":   e,
-		"name":    evt.Name,
-		"enabled": evt.Enabled,
-		"count":   evt.Count,
+		"event":    e,
+		"name":     evt.Name,
+		"priority": evt.Priority,
+		"enabled":  evt.Enabled,
+		"count":    evt.Count,
 	})
 }
 
 func CmdEvents(s *Session, cmd string) {
+	s.Events.mu.Lock()
 	var rows []table.Row
-	for e, i := range s.Events.Events {
-		for _, j := range i {
+	for _, e := range sortedHooks(s.Events.Events) {
+		for _, j := range s.Events.Events[e] {
 			rows = append(rows, makeEventRow(e, j))
 		}
 	}
+	s.Events.mu.Unlock()
 
 	t := table.New([]table.Column{
 		table.NewColumn("event", "Event", 15).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 		table.NewColumn("name", "Name", 25).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("priority", "Pri", 5).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 		table.NewColumn("enabled", "Enabled", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 		table.NewColumn("count", "Count", 20).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center).Foreground(lipgloss.Color("#8c8"))),
 	}).
@@ -75,20 +96,124 @@ func CmdEvents(s *Session, cmd string) {
 	s.Output(t.View() + "\n")
 }
 
+// AddEvent subscribes a handler to a hook, which may be a wildcard
+// pattern like "kallisti.*".
 func (s *Session) AddEvent(hook string, evt Event) {
 
 	s.Events.mu.Lock()
 	defer s.Events.mu.Unlock()
 
+	s.Events.next++
+	evt.seq = s.Events.next
 	s.Events.Events[hook] = append(s.Events.Events[hook], evt)
 }
 
+// RemoveEvent removes the handlers with the given name from a hook and
+// reports whether any were found.
+func (s *Session) RemoveEvent(hook string, name string) bool {
+
+	s.Events.mu.Lock()
+	defer s.Events.mu.Unlock()
+
+	events := s.Events.Events[hook]
+	kept := events[:0]
+	for _, e := range events {
+		if e.Name != name {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(events) {
+		return false
+	}
+	if len(kept) == 0 {
+		delete(s.Events.Events, hook)
+	} else {
+		s.Events.Events[hook] = kept
+	}
+	return true
+}
+
+// FireEvent calls every handler subscribed to name, directly or through a
+// wildcard hook, highest priority first and in registration order otherwise.
+// Handlers run without the registry locked, so they may add or remove
+// handlers and fire further events; those run depth-first, up to MaxDepth
+// levels deep. Handler changes take effect from the next event fired.
 func (s *Session) FireEvent(name string, evt EventData) {
+	if s.Events == nil {
+		return
+	}
 
+	s.Events.mu.Lock()
+	limit := s.Events.MaxDepth
+	if limit <= 0 {
+		limit = DefaultMaxEventDepth
+	}
+	if len(s.Events.firing) >= limit {
+		chain := strings.Join(s.Events.firing, " > ")
+		s.Events.mu.Unlock()
+		log.Printf("Event recursion limit (%d) reached, dropping %s fired from %s", limit, name, chain)
+		if s.Sub != nil {
+			s.Output(fmt.Sprintf("Event recursion limit (%d) reached, dropping: %s\n", limit, name))
+		}
+		return
+	}
+
+	var handlers []Event
+	for hook, events := range s.Events.Events {
+		if hook != name && !hookMatches(hook, name) {
+			continue
+		}
+		for i := range events {
+			events[i].Count++
+			handlers = append(handlers, events[i])
+		}
+	}
+	s.Events.firing = append(s.Events.firing, name)
+	s.Events.mu.Unlock()
+
+	defer func() {
+		s.Events.mu.Lock()
+		s.Events.firing = s.Events.firing[:len(s.Events.firing)-1]
+		s.Events.mu.Unlock()
+	}()
+
+	sort.Slice(handlers, func(i, j int) bool {
+		if handlers[i].Priority != handlers[j].Priority {
+			return handlers[i].Priority > handlers[j].Priority
+		}
+		return handlers[i].seq < handlers[j].seq
+	})
+	for _, h := range handlers {
+		h.Fn(s, evt)
+	}
+}
+
+// CurrentEvent returns the name of the event being dispatched, so handlers
+// subscribed to a wildcard can tell which event fired.
+func (s *Session) CurrentEvent() string {
 	s.Events.mu.Lock()
 	defer s.Events.mu.Unlock()
 
-	for _, i := range s.Events.Events[name] {
-		i.Fn(s, evt)
+	if n := len(s.Events.firing); n > 0 {
+		return s.Events.firing[n-1]
+	}
+	return ""
+}
+
+// hookMatches reports whether a wildcard hook matches an event name
+func hookMatches(hook, name string) bool {
+	if !strings.ContainsAny(hook, "*?[") {
+		return false
+	}
+	ok, err := path.Match(hook, name)
+	return err == nil && ok
+}
+
+func sortedHooks(events map[string][]Event) []string {
+	hooks := make([]string, 0, len(events))
+	for h := range events {
+		hooks = append(hooks, h)
 	}
+	sort.Strings(hooks)
+	return hooks
 }
@@ -0,0 +1,90 @@
+package session
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestFireEventOrderAndWildcards(t *testing.T) {
+	s := &Session{Events: NewEventRegistry()}
+
+	var calls []string
+	record := func(name string) EventFunction {
+		return func(s *Session, _ EventData) {
+			calls = append(calls, name+":"+s.CurrentEvent())
+		}
+	}
+	s.AddEvent("kallisti.craft", Event{Name: "first", Fn: record("first")})
+	s.AddEvent("kallisti.*", Event{Name: "wild", Fn: record("wild"), Priority: 10})
+	s.AddEvent("kallisti.craft", Event{Name: "second", Fn: record("second")})
+	s.AddEvent("*", Event{Name: "all", Fn: record("all"), Priority: -1})
+	s.AddEvent("core.line", Event{Name: "other", Fn: record("other")})
+
+	s.FireEvent("kallisti.craft", NewBaseEvent())
+	want := []string{"wild:kallisti.craft", "first:kallisti.craft", "second:kallisti.craft", "all:kallisti.craft"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+	if got := s.Events.Events["kallisti.*"][0].Count; got != 1 {
+		t.Errorf("wildcard count = %d, want 1", got)
+	}
+	if s.CurrentEvent() != "" {
+		t.Errorf("CurrentEvent after dispatch = %q", s.CurrentEvent())
+	}
+
+	if !s.RemoveEvent("kallisti.*", "wild") || s.RemoveEvent("kallisti.*", "wild") {
+		t.Error("RemoveEvent should succeed once")
+	}
+	if !s.RemoveEvent("kallisti.craft", "first") {
+		t.Error("RemoveEvent(first) failed")
+	}
+	calls = nil
+	s.FireEvent("kallisti.craft", NewBaseEvent())
+	want = []string{"second:kallisti.craft", "all:kallisti.craft"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("after removal calls = %q, want %q", calls, want)
+	}
+}
+
+func TestNestedFireEvent(t *testing.T) {
+	s := &Session{Events: NewEventRegistry(), Sub: make(chan tea.Msg, 10)}
+
+	var calls []string
+	s.AddEvent("kallisti.death", Event{Name: "loot", Fn: func(s *Session, _ EventData) {
+		calls = append(calls, "death")
+		// Registering and firing from a handler must not deadlock
+		s.AddEvent("loot.done", Event{Name: "late", Fn: func(*Session, EventData) { calls = append(calls, "late") }})
+		s.FireEvent("loot.corpse", NewBaseEvent())
+		calls = append(calls, "after loot")
+	}})
+	s.AddEvent("loot.*", Event{Name: "looter", Fn: func(s *Session, _ EventData) {
+		calls = append(calls, s.CurrentEvent())
+		if s.CurrentEvent() == "loot.corpse" {
+			s.FireEvent("loot.done", NewBaseEvent())
+		}
+	}})
+
+	s.FireEvent("kallisti.death", NewBaseEvent())
+	want := []string{"death", "loot.corpse", "loot.done", "late", "after loot"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+
+	// A handler that fires its own event stops at the recursion limit
+	s.Events.MaxDepth = 3
+	depth := 0
+	s.AddEvent("loop", Event{Name: "loop", Fn: func(s *Session, _ EventData) {
+		depth++
+		s.FireEvent("loop", NewBaseEvent())
+	}})
+	s.FireEvent("loop", NewBaseEvent())
+	if depth != 3 {
+		t.Errorf("recursive handler ran %d times, want 3", depth)
+	}
+	if msg := (<-s.Sub).(UpdateMessage).Content; !strings.Contains(msg, "recursion limit (3)") {
+		t.Errorf("unexpected warning %q", msg)
+	}
+}
@@ -0,0 +1,341 @@
+package session
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perlsaiyan/zif/layout"
+)
+
+// SearchPaneID is the pane #grep and #history show their results in
+const SearchPaneID = "search"
+
+const (
+	defaultGrepLimit    = 50
+	defaultHistoryLines = 50
+	maxGrepContext      = 10
+)
+
+var (
+	plainWords = regexp.MustCompile(`^[\w\s]+$`)
+	grepMarker = "\x1b[1;30;43m"
+	grepReset  = "\x1b[0m"
+	grepDim    = "\x1b[2m"
+)
+
+// searchTypes are the ring log contexts #grep and #history search unless
+// --type says otherwise; zif's own output would only clutter the results
+var searchTypes = []string{RingContextLine, RingContextPrompt, RingContextGagged, RingContextInput, RingContextSent}
+
+// shownTypes are the contexts that appear in the main viewport
+var shownTypes = []string{RingContextLine, RingContextPrompt, RingContextInput, RingContextSystem}
+
+// searchOptions holds the flags shared by #grep and #history
+type searchOptions struct {
+	rest    string // everything before the options, as typed
+	since   time.Duration
+	context int
+	limit   int
+	types   []string
+	jump    int // result to scroll the main viewport to, from --goto
+}
+
+var searchOptionNames = []string{"--since", "--context", "--limit", "--type", "--goto"}
+
+// parseSearchArgs takes --since, --context, --limit, --type and --goto, each
+// with its value, off the end of cmd. The rest is kept verbatim, so a
+// pattern keeps its spacing and may itself contain "--".
+func parseSearchArgs(cmd string) (searchOptions, error) {
+	var opts searchOptions
+	var flags [][2]string
+	rest := strings.TrimSpace(cmd)
+	for {
+		head, val := cutLastField(rest)
+		if slices.Contains(searchOptionNames, val) {
+			return opts, fmt.Errorf("%s needs a value", val)
+		}
+		before, name := cutLastField(head)
+		if !slices.Contains(searchOptionNames, name) {
+			break
+		}
+		flags = append(flags, [2]string{name, val})
+		rest = before
+	}
+	opts.rest = rest
+
+	// Options were taken off from the end; apply them as written so a
+	// repeated option's last value wins
+	for i := len(flags) - 1; i >= 0; i-- {
+		name, val := flags[i][0], flags[i][1]
+		var err error
+		switch name {
+		case "--since":
+			opts.since, err = parseSince(val)
+		case "--context":
+			opts.context, err = strconv.Atoi(val)
+			if err == nil && (opts.context < 0 || opts.context > maxGrepContext) {
+				err = fmt.Errorf("--context must be between 0 and %d", maxGrepContext)
+			}
+		case "--limit":
+			opts.limit, err = strconv.Atoi(val)
+		case "--type":
+			opts.types, err = parseTypes(val)
+		case "--goto":
+			opts.jump, err = strconv.Atoi(val)
+		}
+		if err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// cutLastField splits s into what comes before its last whitespace-separated
+// field, with trailing whitespace removed, and the field itself
+func cutLastField(s string) (head, field string) {
+	i := strings.LastIndexAny(s, " \t")
+	return strings.TrimRight(s[:i+1], " \t"), s[i+1:]
+}
+
+// parseTypes reads a comma-separated list of ring log contexts, or "all"
+func parseTypes(val string) ([]string, error) {
+	if val == "all" {
+		return RingContexts, nil
+	}
+	types := strings.Split(val, ",")
+	for _, t := range types {
+		if !slices.Contains(RingContexts, t) {
+			return nil, fmt.Errorf("unknown type %q, want all or some of %s", t, strings.Join(RingContexts, ","))
+		}
+	}
+	return types, nil
+}
+
+// parseSince reads a duration such as "10m" or "2h", also allowing days ("1d")
+func parseSince(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("bad duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad duration %q", s)
+	}
+	return d, nil
+}
+
+// grepQuery turns a #grep pattern into a ring log query and the regex used
+// to highlight matches. Plain words use the full-text index.
+func grepQuery(pattern string) (RingQuery, *regexp.Regexp, error) {
+	if plainWords.MatchString(pattern) {
+		words := strings.Fields(pattern)
+		quoted := make([]string, len(words))
+		for i, w := range words {
+			quoted[i] = regexp.QuoteMeta(w)
+		}
+		hl := regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\w*`)
+		return RingQuery{Words: words}, hl, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return RingQuery{}, nil, err
+	}
+	return RingQuery{Pattern: re}, re, nil
+}
+
+// highlight marks each match of re in text
+func highlight(text string, re *regexp.Regexp) string {
+	if re == nil {
+		return text
+	}
+	return re.ReplaceAllStringFunc(text, func(m string) string {
+		if m == "" {
+			return m
+		}
+		return grepMarker + m + grepReset
+	})
+}
+
+// showSearchResults numbers the results for --goto and shows them in the
+// search pane, with any context lines dimmed
+func (s *Session) showSearchResults(title string, results []RingRecord, hl *regexp.Regexp, context int) {
+	s.searchResults = results
+
+	var b strings.Builder
+	for i, rec := range results {
+		if context > 0 {
+			if i > 0 {
+				b.WriteString(grepDim + "--" + grepReset + "\n")
+			}
+			for _, c := range s.contextLines(rec, -context) {
+				fmt.Fprintf(&b, "%s     %s  %s%s\n", grepDim, ringTime(c), c.Stripped, grepReset)
+			}
+		}
+		fmt.Fprintf(&b, "[%d] %s  %s\n", i+1, ringTime(rec), highlight(rec.Stripped, hl))
+		if context > 0 {
+			for _, c := range s.contextLines(rec, context) {
+				fmt.Fprintf(&b, "%s     %s  %s%s\n", grepDim, ringTime(c), c.Stripped, grepReset)
+			}
+		}
+	}
+	if len(results) > 0 {
+		b.WriteString(grepDim + "#grep --goto N scrolls the main window to result N" + grepReset + "\n")
+	}
+
+	s.Sub <- layout.LayoutCommandMsg{
+		Command: "show",
+		Args:    []string{SearchPaneID, title, b.String()},
+		Session: s,
+	}
+}
+
+// contextLines returns up to n lines before (n < 0) or after rec, skipping
+// lines that belong to an earlier trip around the ring
+func (s *Session) contextLines(rec RingRecord, n int) []RingRecord {
+	size := s.Ringlog.Size
+	var lines []RingRecord
+	if n < 0 {
+		start := ((rec.RingNumber+n)%size + size) % size
+		end := ((rec.RingNumber-1)%size + size) % size
+		for _, c := range s.Ringlog.GetLog(start, end) {
+			if c.EpochNS <= rec.EpochNS {
+				lines = append(lines, c)
+			}
+		}
+		return lines
+	}
+	start := (rec.RingNumber + 1) % size
+	end := (rec.RingNumber + n) % size
+	for _, c := range s.Ringlog.GetLog(start, end) {
+		if c.EpochNS >= rec.EpochNS {
+			lines = append(lines, c)
+		}
+	}
+	return lines
+}
+
+func ringTime(rec RingRecord) string {
+	return time.Unix(0, rec.EpochNS).Format("15:04:05")
+}
+
+// jumpToResult scrolls the main viewport to the nth search result
+func (s *Session) jumpToResult(n int) {
+	if n < 1 || n > len(s.searchResults) {
+		s.Output(fmt.Sprintf("No search result %d\n", n))
+		return
+	}
+	rec := s.searchResults[n-1]
+	if !slices.Contains(shownTypes, rec.Context) {
+		s.Output(fmt.Sprintf("Result %d (%s) is not shown in the main window\n", n, rec.Context))
+		return
+	}
+
+	// The same text may appear again later; count how many times so the
+	// right copy is found searching back from the bottom
+	later, err := s.Ringlog.Search(RingQuery{Since: rec.EpochNS + 1, Types: shownTypes})
+	if err != nil {
+		s.Output(fmt.Sprintf("Search failed: %v\n", err))
+		return
+	}
+	occurrence := 1
+	for _, l := range later {
+		if l.Stripped == rec.Stripped {
+			occurrence++
+		}
+	}
+
+	s.Sub <- layout.LayoutCommandMsg{
+		Command: "scroll_to",
+		Args:    []string{rec.Stripped, strconv.Itoa(occurrence)},
+		Session: s,
+	}
+}
+
+// CmdGrep searches the scrollback:
+// #grep <words or regex> [--since 10m] [--context N] [--limit N] [--type T], #grep --goto N
+func CmdGrep(s *Session, cmd string) {
+	opts, err := parseSearchArgs(cmd)
+	if err != nil {
+		s.Output(fmt.Sprintf("Error: %v\n", err))
+		return
+	}
+	if opts.jump != 0 {
+		s.jumpToResult(opts.jump)
+		return
+	}
+	if opts.rest == "" {
+		s.Output("Usage: #grep <words or regex> [--since 10m] [--context N] [--limit N] [--type line,prompt,...] | #grep --goto N\n")
+		return
+	}
+
+	pattern := opts.rest
+	q, hl, err := grepQuery(pattern)
+	if err != nil {
+		s.Output(fmt.Sprintf("Invalid regex: %v\n", err))
+		return
+	}
+	q.Limit = defaultGrepLimit
+	q.Types = searchTypes
+	if opts.types != nil {
+		q.Types = opts.types
+	}
+	if opts.limit > 0 {
+		q.Limit = opts.limit
+	}
+	if opts.since > 0 {
+		q.Since = time.Now().Add(-opts.since).UnixNano()
+	}
+
+	results, err := s.Ringlog.Search(q)
+	if err != nil {
+		s.Output(fmt.Sprintf("Search failed: %v\n", err))
+		return
+	}
+	if len(results) == 0 {
+		s.Output(fmt.Sprintf("No lines match %q\n", pattern))
+		return
+	}
+	s.showSearchResults(fmt.Sprintf("grep %s (%d)", pattern, len(results)), results, hl, opts.context)
+}
+
+// CmdHistory shows the last lines of scrollback with their times:
+// #history [N] [--since 10m] [--type T]
+func CmdHistory(s *Session, cmd string) {
+	opts, err := parseSearchArgs(cmd)
+	if err != nil {
+		s.Output(fmt.Sprintf("Error: %v\n", err))
+		return
+	}
+	q := RingQuery{Limit: defaultHistoryLines, Types: searchTypes}
+	if opts.types != nil {
+		q.Types = opts.types
+	}
+	if opts.rest != "" {
+		n, err := strconv.Atoi(opts.rest)
+		if err != nil || n < 1 {
+			s.Output("Usage: #history [lines] [--since 10m] [--type line,prompt,...]\n")
+			return
+		}
+		q.Limit = n
+	}
+	if opts.since > 0 {
+		q.Since = time.Now().Add(-opts.since).UnixNano()
+		if opts.rest == "" {
+			q.Limit = 0
+		}
+	}
+
+	results, err := s.Ringlog.Search(q)
+	if err != nil {
+		s.Output(fmt.Sprintf("Search failed: %v\n", err))
+		return
+	}
+	s.showSearchResults(fmt.Sprintf("history (%d)", len(results)), results, nil, 0)
+}
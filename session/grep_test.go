@@ -0,0 +1,130 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/perlsaiyan/zif/layout"
+)
+
+func newGrepTestSession(t *testing.T) *Session {
+	s := &Session{Name: "test", Ringlog: NewRingLog(), Sub: make(chan tea.Msg, 10)}
+	t.Cleanup(func() { s.Ringlog.Close() })
+
+	now := time.Now()
+	lines := []string{
+		"A grizzled orc tells you 'The key is under the well.'",
+		"You say 'thanks'",
+		"The orcs shout 'For the horde!'",
+		"Someone tells you 'hello'",
+		"You say 'thanks'",
+	}
+	for i, l := range lines {
+		s.AddRinglogEntry(now.Add(time.Duration(i-len(lines))*time.Minute).UnixNano(), RingContextLine, l, l)
+	}
+	return s
+}
+
+func lastLayoutMsg(t *testing.T, s *Session) layout.LayoutCommandMsg {
+	t.Helper()
+	select {
+	case msg := <-s.Sub:
+		if lc, ok := msg.(layout.LayoutCommandMsg); ok {
+			return lc
+		}
+		t.Fatalf("expected a layout command, got %#v", msg)
+	default:
+		t.Fatal("no layout command sent")
+	}
+	return layout.LayoutCommandMsg{}
+}
+
+func TestGrepWords(t *testing.T) {
+	s := newGrepTestSession(t)
+	if s.Ringlog.Indexed() == "" {
+		t.Log("no full-text index, testing the scan fallback only")
+	}
+
+	for _, fts := range []string{s.Ringlog.Indexed(), ""} {
+		s.Ringlog.fts = fts
+		got, err := s.Ringlog.Search(RingQuery{Words: []string{"ORC", "tells"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || !strings.HasPrefix(got[0].Stripped, "A grizzled orc") {
+			t.Errorf("index %q: words search returned %+v", fts, got)
+		}
+	}
+}
+
+func TestCmdGrep(t *testing.T) {
+	s := newGrepTestSession(t)
+
+	// zif's own output is left out unless asked for
+	s.Output("orcs are not here\n")
+	<-s.Sub
+
+	CmdGrep(s, "orc --since 4m30s")
+	msg := lastLayoutMsg(t, s)
+	if msg.Command != "show" || msg.Args[0] != SearchPaneID {
+		t.Fatalf("unexpected layout command %+v", msg)
+	}
+	if !strings.Contains(msg.Args[2], grepMarker+"orcs"+grepReset) || strings.Contains(msg.Args[2], "grizzled") {
+		t.Errorf("results = %q", msg.Args[2])
+	}
+
+	CmdGrep(s, "orcs --type system")
+	lastLayoutMsg(t, s)
+	if len(s.searchResults) != 1 || s.searchResults[0].Context != RingContextSystem {
+		t.Errorf("--type system found %+v", s.searchResults)
+	}
+
+	CmdGrep(s, "^You say --context 1")
+	msg = lastLayoutMsg(t, s)
+	if len(s.searchResults) != 2 || !strings.Contains(msg.Args[2], "Someone tells you") {
+		t.Errorf("regex search with context = %q", msg.Args[2])
+	}
+
+	// The first "You say" is followed by another identical line
+	CmdGrep(s, "--goto 1")
+	msg = lastLayoutMsg(t, s)
+	if msg.Command != "scroll_to" || msg.Args[0] != "You say 'thanks'" || msg.Args[1] != "2" {
+		t.Errorf("--goto sent %+v", msg)
+	}
+}
+
+func TestParseSearchArgs(t *testing.T) {
+	opts, err := parseSearchArgs("key well --since 2d --context 3 --type line,sent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.rest != "key well" || opts.since != 48*time.Hour || opts.context != 3 || len(opts.types) != 2 {
+		t.Errorf("parsed %+v", opts)
+	}
+
+	// Only known options at the end are taken; the pattern is kept as typed
+	for cmd, want := range map[string]string{
+		"foo  bar":              "foo  bar",
+		"a\tb  --limit 5":       "a\tb",
+		"-- --foo x --since 1h": "-- --foo x",
+		"--since 1h x":          "--since 1h x",
+		"--goto 3":              "",
+		"x --limit 1 --limit 2": "x",
+	} {
+		opts, err := parseSearchArgs(cmd)
+		if err != nil || opts.rest != want {
+			t.Errorf("parseSearchArgs(%q) = %q, %v; want %q", cmd, opts.rest, err, want)
+		}
+	}
+	if opts, _ := parseSearchArgs("x --limit 1 --limit 2"); opts.limit != 2 {
+		t.Errorf("repeated --limit gave %d, want the last value", opts.limit)
+	}
+
+	for _, bad := range []string{"x --since soon", "x --context", "x --context 99", "x --type line,bogus"} {
+		if _, err := parseSearchArgs(bad); err == nil {
+			t.Errorf("parseSearchArgs(%q) succeeded", bad)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -17,6 +19,9 @@ import (
 // LineTerminator is the RFC 854 (Telnet) standard line terminator: CR LF
 const LineTerminator = "\r\n"
 
+// closeTimeout is how long Close waits for each session's loop to stop
+const closeTimeout = 2 * time.Second
+
 // ContextInjector is a function type that injects context into a Lua state
 type ContextInjector func(*Session, *lua.LState) error
 
@@ -26,12 +31,17 @@ type MSDPUpdateHook func(*Session, map[string]interface{})
 // MUDLineHook is a function type called when a MUD line is processed
 type MUDLineHook func(*Session, string, string)
 
+// SessionHandler holds the sessions. Sessions run on their own loops and
+// the UI on another goroutine, so Active and Sessions are guarded by mu;
+// use the methods below rather than the fields.
 type SessionHandler struct {
 	Active             string
 	Sessions           map[string]*Session
 	Plugins            *PluginRegistry
 	Sub                chan tea.Msg
 	PendingSessionData map[string]interface{} // Pre-populated data for the next AddSession call
+
+	mu sync.RWMutex
 }
 
 type Session struct {
@@ -40,37 +50,66 @@ type Session struct {
 	Birth          time.Time
 	Context        context.Context
 	Cancel         context.CancelFunc
-	Content        string
-	Ringlog        RingLog
+	Scrollback     *Scrollback
+	Ringlog        *RingLog
+	Logger         *Logger
 	Address        string
 	Socket         net.Conn
 	MSDP           *kallisti.MSDPHandler
 	TTCount        int
 	PasswordMode   bool
-	Connected      bool
+	connected      atomic.Bool
 	Sub            chan tea.Msg
 	Tickers        *TickerRegistry
 	Actions        *ActionRegistry
 	Aliases        *AliasRegistry
 	Events         *EventRegistry
 	Queue          *QueueRegistry
+	Limiter        *SendLimiter
+	Scripts        *ScriptRegistry
 	Data           map[string]interface{}
 	LuaState       *lua.LState
+	Sandbox        LuaSandbox // limits on module code, see newModuleState
 	Modules        *ModuleRegistry
 	EchoNegotiated bool // Infinite loop protection: track if we've responded to ECHO negotiation
 	LoginComplete  bool // Track if we've completed login (entered the game)
 
+	loop *eventLoop // runs the session's work, see Do and Post
+
+	aliasDepth int            // current alias expansion depth, see RunCommands
+	declared   declaredConfig // entries registered from the session's YAML files
+
+	searchResults []RingRecord // last #grep or #history results, for #grep --goto
+
+	moduleSettings *config.SettingsConfig // values from #set, see settings
+	commands       map[string]Command     // #commands added by plugins and modules
+
+	repl     *LuaREPL // the #lua prompt, see REPL
+	replOnce sync.Once
+
 	// Context injection system
 	contextInjectors map[string]ContextInjector
 	msdpUpdateHooks  map[string]MSDPUpdateHook
 	mudLineHooks     map[string]MUDLineHook
 }
 
-// HandleInput processes the input command.
+// IsConnected reports whether the session has a live MUD connection. It
+// is safe to call from any goroutine.
+func (s *Session) IsConnected() bool {
+	return s.connected.Load()
+}
+
+// SetConnected records whether the session has a live MUD connection
+func (s *Session) SetConnected(connected bool) {
+	s.connected.Store(connected)
+}
+
+// HandleInput processes the input command. It runs on the session's loop;
+// other goroutines should Post it there.
 func (s *Session) HandleInput(cmd string) {
 	if cmd == "" {
-		if s.Connected {
-			s.Socket.Write([]byte(LineTerminator))
+		if s.IsConnected() {
+			s.Send("")
 		}
 		return
 	}
@@ -82,7 +121,24 @@ func (s *Session) HandleInput(cmd string) {
 		// Format 2: Bright white (8-bit color)
 		// Using both: set bright white, then RGB as fallback
 		coloredCmd := "\x1b[1;37m" + cmd + "\x1b[0m\n" // Bright white: \x1b[1;37m
-		s.Output(coloredCmd)
+		s.display(coloredCmd)
+		s.recordLines(RingContextInput, cmd)
+		if s.Logger != nil {
+			s.Logger.Input(cmd)
+		}
+	}
+
+	// Passwords are not published to event handlers
+	if !s.PasswordMode {
+		s.FireEvent(EventInput, InputEvent{BaseEvent: NewBaseEvent(), Input: cmd})
+	}
+	s.dispatchInput(cmd)
+}
+
+// dispatchInput routes a command to an alias, an internal #command, or the MUD.
+func (s *Session) dispatchInput(cmd string) {
+	if strings.TrimSpace(cmd) == "" {
+		return
 	}
 
 	// Check for aliases first (before internal commands)
@@ -100,39 +156,107 @@ func (s *Session) HandleInput(cmd string) {
 // ActiveSession returns the currently active session.
 // May return nil if the active session name doesn't exist in the Sessions map.
 func (s *SessionHandler) ActiveSession() *Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.Sessions[s.Active]
 }
 
+// ActiveName returns the name of the active session
+func (s *SessionHandler) ActiveName() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Active
+}
+
+// SetActive makes the named session active without firing any events
+func (s *SessionHandler) SetActive(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Active = name
+}
+
+// Session returns the named session
+func (s *SessionHandler) Session(name string) (*Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sess, ok := s.Sessions[name]
+	return sess, ok
+}
+
+// activate makes the named session active and fires core.session_switch
+// on it. It returns nil if there is no such session.
+func (s *SessionHandler) activate(name string) *Session {
+	s.mu.Lock()
+	from := s.Active
+	s.Active = name
+	sess := s.Sessions[name]
+	s.mu.Unlock()
+	if sess != nil && from != name {
+		sess.Post(func() {
+			sess.FireEvent(EventSessionSwitch, SessionSwitchEvent{BaseEvent: NewBaseEvent(), From: from, To: name})
+		})
+	}
+	return sess
+}
+
+// Close stops every session's loop, then writes out and closes its ring log
+// and log file. Call it once the client is exiting. A session whose loop is
+// still busy after closeTimeout is left open rather than closed under it.
+func (s *SessionHandler) Close() {
+	for _, name := range s.SessionNames() {
+		sess, _ := s.Session(name)
+		if !sess.stopLoop(closeTimeout) {
+			log.Printf("Session %s is still busy, not closing its logs", sess.Name)
+			continue
+		}
+		if sess.Logger != nil {
+			if err := sess.Logger.Stop(); err != nil {
+				log.Printf("Error closing log for %s: %v", sess.Name, err)
+			}
+		}
+		if sess.Ringlog != nil {
+			if err := sess.Ringlog.Close(); err != nil {
+				log.Printf("Error closing ring log for %s: %v", sess.Name, err)
+			}
+		}
+	}
+}
+
 // NewHandler creates and initializes a new SessionHandler.
-func NewHandler() SessionHandler {
+func NewHandler() *SessionHandler {
 	sub := make(chan tea.Msg, 50)
 	s := Session{
-		Name:    "zif",
-		Content: Motd(),
-		MSDP:    kallisti.NewMSDP(),
-		Sub:     sub,
-		Birth:   time.Now(),
+		Name:       "zif",
+		Scrollback: NewScrollback(0),
+		MSDP:       kallisti.NewMSDP(),
+		Sub:        sub,
+		Birth:      time.Now(),
 	}
-	sh := SessionHandler{
+	s.Scrollback.Write(Motd())
+	sh := &SessionHandler{
 		Active:   "zif",
 		Sessions: make(map[string]*Session),
 		Plugins:  NewPluginRegistry(),
 		Sub:      sub,
 	}
-	s.Handler = &sh
+	s.Handler = sh
 	sh.Sessions["zif"] = &s
 
 	// Initialize context for the default session
 	ctx := context.Background()
 	s.Context, s.Cancel = context.WithCancel(ctx)
+	s.loop = newEventLoop()
 
 	// Initialize Lua state and registries for the default session
 	s.LuaState = lua.NewState()
+	s.Sandbox = luaSandbox(sessionConfig("zif"))
 	s.Actions = NewActionRegistry()
 	s.Aliases = NewAliasRegistry()
 	s.Events = NewEventRegistry()
 	s.Queue = NewQueueRegistry()
+	s.Scripts = NewScriptRegistry()
 	s.Ringlog = NewRingLog()
+	s.Logger = NewLogger(s.Name)
 	s.Modules = NewModuleRegistry()
 	s.Data = make(map[string]interface{})
 	s.contextInjectors = make(map[string]ContextInjector)
@@ -150,16 +274,22 @@ func NewHandler() SessionHandler {
 		log.Printf("Warning: failed to ensure config directories: %v", err)
 	}
 
-	// Load global modules first
-	if err := LoadGlobalModules(&s); err != nil {
-		log.Printf("Warning: failed to load global modules: %v", err)
+	// Load global and session modules, session modules replacing global
+	// modules of the same name
+	if err := LoadModules(&s, "zif"); err != nil {
+		log.Printf("Warning: failed to load modules: %v", err)
 	}
 
-	// Load session-specific modules for default session
-	if err := LoadSessionModules(&s, "zif"); err != nil {
-		log.Printf("Warning: failed to load session modules: %v", err)
+	// Load triggers, aliases and timers from the session's YAML files
+	if err := LoadSessionConfig(&s, "zif"); err != nil {
+		log.Printf("Warning: failed to load session config: %v", err)
 	}
 
+	if s.Sandbox.Watch {
+		s.WatchModules(true)
+	}
+
+	s.startLoop()
 	return sh
 }
 
@@ -182,22 +312,32 @@ func (s *SessionHandler) AddSession(name, address string) error {
 		return fmt.Errorf("invalid address format: expected host:port")
 	}
 
+	var scrollback int
+	cfg := sessionConfig(name)
+	if cfg != nil {
+		scrollback = cfg.Scrollback
+	}
+
 	newSession := &Session{
-		Name:  name,
-		Birth: time.Now(),
-		MSDP:  kallisti.NewMSDP(),
-		Sub:   s.Sub,
+		Name:       name,
+		Birth:      time.Now(),
+		MSDP:       kallisti.NewMSDP(),
+		Sub:        s.Sub,
+		Scrollback: NewScrollback(scrollback),
 
 		Actions: NewActionRegistry(),
 		Aliases: NewAliasRegistry(),
 		Events:  NewEventRegistry(),
 		Queue:   NewQueueRegistry(),
+		Scripts: NewScriptRegistry(),
 
-		Ringlog: NewRingLog(),
+		Ringlog: openSessionRinglog(name),
+		Logger:  NewLogger(name),
 		Handler: s,
 
 		Data:     make(map[string]interface{}),
 		LuaState: lua.NewState(),
+		Sandbox:  luaSandbox(cfg),
 		Modules:  NewModuleRegistry(),
 
 		contextInjectors: make(map[string]ContextInjector),
@@ -205,11 +345,14 @@ func (s *SessionHandler) AddSession(name, address string) error {
 		mudLineHooks:     make(map[string]MUDLineHook),
 	}
 
-	// Initialize the priority Queue
-
+	s.mu.Lock()
 	s.Sessions[name] = newSession
+	s.mu.Unlock()
 	ctx := context.Background()
 	newSession.Context, newSession.Cancel = context.WithCancel(ctx)
+	// Timers and the reader queue jobs from here on; they run once the
+	// session is set up and its loop starts
+	newSession.loop = newEventLoop()
 
 	// Output to current active session if it exists
 	if activeSess := s.ActiveSession(); activeSess != nil {
@@ -221,7 +364,11 @@ func (s *SessionHandler) AddSession(name, address string) error {
 	newSession.Socket, err = net.Dial("tcp", address)
 	if err != nil {
 		log.Printf("Error connecting to %s: %v", address, err)
+		s.mu.Lock()
 		delete(s.Sessions, name)
+		s.mu.Unlock()
+		newSession.Cancel()
+		newSession.Ringlog.Close()
 		// Output error to current active session if it exists
 		if activeSess := s.ActiveSession(); activeSess != nil {
 			activeSess.Output(fmt.Sprintf("Failed to connect to %s: %v\n", address, err))
@@ -229,8 +376,12 @@ func (s *SessionHandler) AddSession(name, address string) error {
 		return fmt.Errorf("failed to connect to %s: %w", address, err)
 	}
 
-	newSession.Connected = true
+	newSession.SetConnected(true)
+	newSession.startConfiguredLog()
 	NewTickerRegistry(newSession.Context, newSession)
+	newSession.StartQueueDispatcher()
+	newSession.Limiter = sendLimiter(cfg)
+	newSession.StartSendLimiter()
 
 	// Register Lua API
 	newSession.RegisterLuaAPI()
@@ -240,14 +391,20 @@ func (s *SessionHandler) AddSession(name, address string) error {
 		log.Printf("Warning: failed to ensure config directories: %v", err)
 	}
 
-	// Load global modules first
-	if err := LoadGlobalModules(newSession); err != nil {
-		log.Printf("Warning: failed to load global modules: %v", err)
+	// Load global and session modules, session modules replacing global
+	// modules of the same name
+	if err := LoadModules(newSession, name); err != nil {
+		log.Printf("Warning: failed to load modules: %v", err)
+	}
+
+	// Load triggers, aliases and timers from the session's YAML files
+	if err := LoadSessionConfig(newSession, name); err != nil {
+		log.Printf("Warning: failed to load session config: %v", err)
+		newSession.Output("Errors in session config:\n" + err.Error() + "\n")
 	}
 
-	// Load session-specific modules
-	if err := LoadSessionModules(newSession, name); err != nil {
-		log.Printf("Warning: failed to load session modules: %v", err)
+	if newSession.Sandbox.Watch {
+		newSession.WatchModules(true)
 	}
 
 	for _, v := range s.Plugins.Plugins {
@@ -274,10 +431,28 @@ func (s *SessionHandler) AddSession(name, address string) error {
 		}
 	}
 
+	// Fired once modules and plugins have subscribed
+	newSession.FireEvent(EventConnect, ConnectEvent{BaseEvent: NewBaseEvent(), Session: name, Address: address})
+
+	newSession.startLoop()
 	go newSession.mudReader()
 	return nil
 }
 
+// sessionConfig returns the named session's entry in sessions.yaml, or nil
+func sessionConfig(name string) *config.SessionConfig {
+	cfg, err := config.LoadSessionsConfig()
+	if err != nil {
+		return nil
+	}
+	for i := range cfg.Sessions {
+		if cfg.Sessions[i].Name == name {
+			return &cfg.Sessions[i]
+		}
+	}
+	return nil
+}
+
 // Motd returns the message of the day.
 func Motd() string {
 	return "\n\n\x1b[38;2;165;80;223m" +
@@ -307,7 +482,7 @@ func (h *SessionHandler) PluginMOTD() string {
 
 // OnMSDPUpdate calls all registered MSDP update hooks with the updated MSDP data
 func (s *Session) OnMSDPUpdate(msdpData map[string]interface{}) {
-	if s == nil || s.msdpUpdateHooks == nil {
+	if s == nil {
 		return
 	}
 	for _, hook := range s.msdpUpdateHooks {
@@ -315,6 +490,7 @@ func (s *Session) OnMSDPUpdate(msdpData map[string]interface{}) {
 			hook(s, msdpData)
 		}
 	}
+	s.FireEvent(EventMSDP, MSDPEvent{BaseEvent: NewBaseEvent(), Data: msdpData})
 }
 
 // OnMUDLine calls all registered MUD line hooks with the line content
@@ -0,0 +1,224 @@
+package session
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/perlsaiyan/zif/config"
+)
+
+// Default outbound limits, chosen to stay under common MUD spam filters
+const (
+	DefaultSendRate  = 8.0 // commands per second
+	DefaultSendBurst = 15
+)
+
+// SendLimiter is a token bucket for commands sent to the MUD. Up to Burst
+// commands go out at once; after that they are held and sent at Rate per
+// second. A Rate of 0 disables limiting.
+type SendLimiter struct {
+	Rate  float64
+	Burst int
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	pending []string
+	wake    chan struct{}
+}
+
+// sendLimiter returns a limiter for a session with the send_rate and
+// send_burst from its sessions.yaml entry, or the defaults. A send_rate of
+// 0 turns limiting off.
+func sendLimiter(cfg *config.SessionConfig) *SendLimiter {
+	rate, burst := DefaultSendRate, DefaultSendBurst
+	if cfg != nil && cfg.SendRate != nil {
+		rate = max(*cfg.SendRate, 0)
+	}
+	if cfg != nil && cfg.SendBurst > 0 {
+		burst = cfg.SendBurst
+	}
+	return NewSendLimiter(rate, burst)
+}
+
+func NewSendLimiter(rate float64, burst int) *SendLimiter {
+	return &SendLimiter{Rate: rate, Burst: burst, tokens: float64(burst), last: time.Now(), wake: make(chan struct{}, 1)}
+}
+
+// SetRate changes the limits, keeping any pending commands
+func (l *SendLimiter) SetRate(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Rate, l.Burst = rate, burst
+	if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+	l.notify()
+}
+
+// refill adds the tokens earned since the last call. l.mu must be held.
+func (l *SendLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.Rate
+	if l.tokens > float64(l.Burst) {
+		l.tokens = float64(l.Burst)
+	}
+	l.last = now
+}
+
+// take reports whether cmd may be sent now, queueing it otherwise
+func (l *SendLimiter) take(cmd string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.Rate <= 0 {
+		return len(l.pending) == 0 || l.queue(cmd)
+	}
+	l.refill(time.Now())
+	if len(l.pending) == 0 && l.tokens >= 1 {
+		l.tokens--
+		return true
+	}
+	return l.queue(cmd)
+}
+
+// queue holds cmd for the drain loop and always returns false. l.mu must be held.
+func (l *SendLimiter) queue(cmd string) bool {
+	l.pending = append(l.pending, cmd)
+	l.notify()
+	return false
+}
+
+func (l *SendLimiter) notify() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the next held command if a token is available, otherwise it
+// returns how long to wait for one.
+func (l *SendLimiter) next() (cmd string, ok bool, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.pending) == 0 {
+		return "", false, -1
+	}
+	if l.Rate > 0 {
+		l.refill(time.Now())
+		if l.tokens < 1 {
+			return "", false, time.Duration((1 - l.tokens) / l.Rate * float64(time.Second))
+		}
+		l.tokens--
+	}
+	cmd = l.pending[0]
+	l.pending = l.pending[1:]
+	return cmd, true, 0
+}
+
+// Pending returns how many commands are waiting to be sent
+func (l *SendLimiter) Pending() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.pending)
+}
+
+// Flush drops every waiting command and returns how many there were
+func (l *SendLimiter) Flush() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.pending)
+	l.pending = nil
+	return n
+}
+
+// Send writes a command to the MUD, holding it back if the session is
+// sending faster than its limiter allows. Input typed while the MUD has
+// echo off (passwords) is never held.
+func (s *Session) Send(cmd string) {
+	if s.PasswordMode || s.Limiter == nil || s.Limiter.take(cmd) {
+		s.writeCommand(cmd)
+	}
+}
+
+// SendPassword writes a command immediately and without firing core.send,
+// for credentials sent by login triggers.
+func (s *Session) SendPassword(cmd string) {
+	if s.IsConnected() && s.Socket != nil {
+		s.Socket.Write([]byte(cmd + LineTerminator))
+	}
+}
+
+// writeCommand writes one command to the socket and announces it
+func (s *Session) writeCommand(cmd string) {
+	if !s.IsConnected() || s.Socket == nil {
+		return
+	}
+	if _, err := s.Socket.Write([]byte(cmd + LineTerminator)); err != nil {
+		log.Printf("Error sending to %s: %v", s.Name, err)
+		return
+	}
+	if !s.PasswordMode {
+		s.recordLines(RingContextSent, cmd)
+		s.FireEvent(EventSend, SendEvent{BaseEvent: NewBaseEvent(), Command: cmd})
+	}
+}
+
+// PendingSends returns how many commands the limiter is holding
+func (s *Session) PendingSends() int {
+	if s.Limiter == nil {
+		return 0
+	}
+	return s.Limiter.Pending()
+}
+
+// StartSendLimiter sends held commands as the limiter allows until the
+// session's context is cancelled.
+func (s *Session) StartSendLimiter() {
+	go s.drainSends()
+}
+
+func (s *Session) drainSends() {
+	l := s.Limiter
+	for {
+		cmd, ok, wait := l.next()
+		if ok {
+			s.Do(func() { s.writeCommand(cmd) })
+			if s.Sub != nil {
+				// Refresh the queue depth shown in the status bar
+				s.Sub <- UpdateMessage{Session: s.Name}
+			}
+			continue
+		}
+
+		var timer *time.Timer
+		var ready <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			ready = timer.C
+		}
+		select {
+		case <-s.Context.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-l.wake:
+		case <-ready:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// CmdFlush drops commands waiting to be sent: #flush
+func CmdFlush(s *Session, cmd string) {
+	if s.Limiter == nil {
+		s.Output("Nothing to flush.\n")
+		return
+	}
+	s.Output(fmt.Sprintf("Dropped %d pending command(s)\n", s.Limiter.Flush()))
+}
@@ -0,0 +1,125 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/perlsaiyan/zif/config"
+	"gopkg.in/yaml.v2"
+)
+
+func newLimitedSession(t *testing.T, rate float64, burst int) (*Session, <-chan string) {
+	client, server := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		server.Close()
+	})
+
+	s := &Session{
+		Name:    "test",
+		Context: ctx,
+		Sub:     make(chan tea.Msg, 1000),
+		Socket:  client,
+		Limiter: NewSendLimiter(rate, burst),
+	}
+	s.SetConnected(true)
+	lines := make(chan string, 100)
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line[:len(line)-len(LineTerminator)]
+		}
+	}()
+	return s, lines
+}
+
+func receive(t *testing.T, lines <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-lines:
+		if got != want {
+			t.Errorf("received %q, want %q", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+func TestSendLimiter(t *testing.T) {
+	s, lines := newLimitedSession(t, 20, 2)
+
+	for _, cmd := range []string{"n", "e", "s", "w", "u"} {
+		s.Send(cmd)
+	}
+	receive(t, lines, "n")
+	receive(t, lines, "e")
+	if n := s.PendingSends(); n != 3 {
+		t.Errorf("%d sends pending after the burst, want 3", n)
+	}
+
+	// Password input is never held back
+	s.PasswordMode = true
+	s.Send("secret")
+	s.PasswordMode = false
+	receive(t, lines, "secret")
+
+	if n := s.Limiter.Flush(); n != 3 {
+		t.Errorf("Flush dropped %d commands, want 3", n)
+	}
+
+	// Held commands drain in order at the configured rate
+	s.StartSendLimiter()
+	start := time.Now()
+	for _, cmd := range []string{"a", "b", "c"} {
+		s.Send(cmd)
+	}
+	for _, cmd := range []string{"a", "b", "c"} {
+		receive(t, lines, cmd)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("three commands sent in %v with an empty bucket, faster than 20/s", elapsed)
+	}
+	select {
+	case got := <-lines:
+		t.Errorf("flushed command %q was sent", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSendLimiterFromConfig(t *testing.T) {
+	if l := sendLimiter(nil); l.Rate != DefaultSendRate || l.Burst != DefaultSendBurst {
+		t.Errorf("no config: rate %v, burst %d", l.Rate, l.Burst)
+	}
+	rate := func(r float64) *float64 { return &r }
+	if l := sendLimiter(&config.SessionConfig{SendRate: rate(2)}); l.Rate != 2 || l.Burst != DefaultSendBurst {
+		t.Errorf("send_rate only: rate %v, burst %d", l.Rate, l.Burst)
+	}
+	if l := sendLimiter(&config.SessionConfig{SendRate: rate(3), SendBurst: 4}); l.Rate != 3 || l.Burst != 4 {
+		t.Errorf("send_rate and send_burst: rate %v, burst %d", l.Rate, l.Burst)
+	}
+
+	// send_rate: 0 turns limiting off rather than meaning the default
+	var cfg config.SessionsConfig
+	if err := yaml.Unmarshal([]byte("sessions:\n  - name: x\n    send_rate: 0\n"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	l := sendLimiter(&cfg.Sessions[0])
+	if l.Rate != 0 {
+		t.Errorf("send_rate: 0 gave rate %v", l.Rate)
+	}
+	for i := 0; i < 2*DefaultSendBurst; i++ {
+		if !l.take("x") {
+			t.Fatalf("command %d held with limiting off", i)
+		}
+	}
+}
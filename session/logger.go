@@ -0,0 +1,584 @@
+package session
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/perlsaiyan/zif/config"
+)
+
+// LogFormat is how a session log writes MUD output
+type LogFormat string
+
+const (
+	LogRaw   LogFormat = "raw"   // lines exactly as received, escape sequences and all
+	LogANSI  LogFormat = "ansi"  // colours kept, other escape sequences removed
+	LogPlain LogFormat = "plain" // text only
+	LogHTML  LogFormat = "html"  // colours turned into styled spans
+)
+
+// logInputMarker starts each line of input in text logs
+const logInputMarker = ">>> "
+
+const logDateFormat = "2006-01-02"
+
+var (
+	sgrRE    = regexp.MustCompile("\x1b\\[[0-9;]*m")
+	escapeRE = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]|\x1b[^\\[]")
+)
+
+const htmlLogHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { background: #000; color: #c0c0c0; font-family: monospace; white-space: pre-wrap; }
+.input { color: #fff; font-weight: bold; }
+</style>
+</head>
+<body>
+`
+
+// ParseLogFormat checks a format name, defaulting to plain
+func ParseLogFormat(name string) (LogFormat, error) {
+	switch f := LogFormat(strings.ToLower(name)); f {
+	case "":
+		return LogPlain, nil
+	case LogRaw, LogANSI, LogPlain, LogHTML:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown log format %q, want raw, ansi, plain or html", name)
+}
+
+func (f LogFormat) ext() string {
+	switch f {
+	case LogHTML:
+		return ".html"
+	case LogPlain:
+		return ".txt"
+	}
+	return ".log"
+}
+
+// Logger writes a session's output and input to a file, either one named
+// by #log start or a new file each day
+type Logger struct {
+	session string
+	mu      sync.Mutex
+	file    *os.File
+	path    string
+	format  LogFormat
+	style   ansiStyle // colours carried from one line to the next in HTML
+
+	// Daily logs; dir is empty when logging to a single file
+	dir  string
+	keep int
+	day  string
+}
+
+// NewLogger returns a stopped logger for the named session
+func NewLogger(session string) *Logger {
+	return &Logger{session: session}
+}
+
+// Start logs to path, replacing any log already open
+func (l *Logger) Start(path string, format LogFormat) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.close()
+	l.dir = ""
+	return l.open(path, format)
+}
+
+// StartDaily logs to <dir>/<session>-<date> with a new file each day,
+// keeping the newest keep files (0 keeps them all)
+func (l *Logger) StartDaily(dir string, format LogFormat, keep int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.close()
+	l.dir, l.keep, l.format = dir, keep, format
+	return l.openDay(time.Now())
+}
+
+// Stop closes the log
+func (l *Logger) Stop() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dir = ""
+	return l.close()
+}
+
+// Active reports the open log's path and format
+func (l *Logger) Active() (path string, format LogFormat, daily bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return "", "", false
+	}
+	return l.path, l.format, l.dir != ""
+}
+
+// Line logs a line of MUD output
+func (l *Logger) Line(raw, stripped string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.ready() {
+		return
+	}
+	var out string
+	switch l.format {
+	case LogRaw:
+		out = raw
+	case LogANSI:
+		out = escapeRE.ReplaceAllStringFunc(raw, func(seq string) string {
+			if sgrRE.MatchString(seq) {
+				return seq
+			}
+			return ""
+		})
+	case LogHTML:
+		out = l.style.toHTML(raw)
+	default:
+		out = stripped
+	}
+	l.write(out + "\n")
+}
+
+// Input logs a line the user typed
+func (l *Logger) Input(cmd string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.ready() {
+		return
+	}
+	if l.format == LogHTML {
+		l.write(`<span class="input">` + html.EscapeString(logInputMarker+cmd) + "</span>\n")
+		return
+	}
+	l.write(logInputMarker + cmd + "\n")
+}
+
+// ready reports whether there is a log to write to, moving daily logs on
+// to a new file once the date changes
+func (l *Logger) ready() bool {
+	if l.file == nil {
+		return false
+	}
+	if l.dir != "" {
+		if now := time.Now(); now.Format(logDateFormat) != l.day {
+			l.close()
+			if err := l.openDay(now); err != nil {
+				log.Printf("Error rotating log for %s: %v", l.session, err)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (l *Logger) write(s string) {
+	if _, err := l.file.WriteString(s); err != nil {
+		log.Printf("Error writing log %s, stopping it: %v", l.path, err)
+		l.dir = ""
+		l.close()
+	}
+}
+
+func (l *Logger) open(path string, format LogFormat) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file, l.path, l.format, l.style = f, path, format, ansiStyle{}
+
+	if format == LogHTML {
+		if info, err := f.Stat(); err == nil && info.Size() == 0 {
+			l.write(fmt.Sprintf(htmlLogHeader, html.EscapeString(l.session+" - "+filepath.Base(path))))
+		}
+	}
+	return nil
+}
+
+func (l *Logger) openDay(now time.Time) error {
+	l.day = now.Format(logDateFormat)
+	path := filepath.Join(l.dir, l.session+"-"+l.day+l.format.ext())
+	if err := l.open(path, l.format); err != nil {
+		return err
+	}
+	l.prune()
+	return nil
+}
+
+// prune removes the oldest daily logs beyond keep
+func (l *Logger) prune() {
+	if l.keep <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(filepath.Join(l.dir, l.session+"-????-??-??"+l.format.ext()))
+	if err != nil || len(matches) <= l.keep {
+		return
+	}
+	// The date in the name sorts oldest first
+	sort.Strings(matches)
+	for _, old := range matches[:len(matches)-l.keep] {
+		if err := os.Remove(old); err != nil {
+			log.Printf("Error removing old log %s: %v", old, err)
+		}
+	}
+}
+
+func (l *Logger) close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// ansiStyle is the SGR state of the text being converted to HTML
+type ansiStyle struct {
+	fg, bg                                string
+	bold, dim, italic, underline, reverse bool
+}
+
+// xterm's 16 standard colours
+var ansiColors = [16]string{
+	"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+	"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+}
+
+// color256 returns the hex colour for an xterm 256-colour index
+func color256(n int) string {
+	switch {
+	case n < 0:
+		return ""
+	case n < 16:
+		return ansiColors[n]
+	case n < 232:
+		n -= 16
+		level := func(v int) int {
+			if v == 0 {
+				return 0
+			}
+			return 55 + v*40
+		}
+		return fmt.Sprintf("#%02x%02x%02x", level(n/36), level(n/6%6), level(n%6))
+	case n < 256:
+		g := 8 + (n-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", g, g, g)
+	}
+	return ""
+}
+
+// apply updates the style from the parameters of one SGR sequence
+func (st *ansiStyle) apply(params string) {
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		code, _ := strconv.Atoi(codes[i]) // an empty parameter is 0
+		switch {
+		case code == 0:
+			*st = ansiStyle{}
+		case code == 1:
+			st.bold = true
+		case code == 2:
+			st.dim = true
+		case code == 3:
+			st.italic = true
+		case code == 4:
+			st.underline = true
+		case code == 7:
+			st.reverse = true
+		case code == 22:
+			st.bold, st.dim = false, false
+		case code == 23:
+			st.italic = false
+		case code == 24:
+			st.underline = false
+		case code == 27:
+			st.reverse = false
+		case code >= 30 && code <= 37:
+			st.fg = ansiColors[code-30]
+		case code == 39:
+			st.fg = ""
+		case code >= 40 && code <= 47:
+			st.bg = ansiColors[code-40]
+		case code == 49:
+			st.bg = ""
+		case code >= 90 && code <= 97:
+			st.fg = ansiColors[code-90+8]
+		case code >= 100 && code <= 107:
+			st.bg = ansiColors[code-100+8]
+		case code == 38 || code == 48:
+			// 38;5;n or 38;2;r;g;b, likewise 48 for the background
+			var color string
+			if i+2 < len(codes) && codes[i+1] == "5" {
+				n, _ := strconv.Atoi(codes[i+2])
+				color = color256(n)
+				i += 2
+			} else if i+4 < len(codes) && codes[i+1] == "2" {
+				r, _ := strconv.Atoi(codes[i+2])
+				g, _ := strconv.Atoi(codes[i+3])
+				b, _ := strconv.Atoi(codes[i+4])
+				color = fmt.Sprintf("#%02x%02x%02x", r&255, g&255, b&255)
+				i += 4
+			}
+			if code == 38 {
+				st.fg = color
+			} else {
+				st.bg = color
+			}
+		}
+	}
+}
+
+// css returns the inline style for the current state, empty for the default
+func (st ansiStyle) css() string {
+	fg, bg := st.fg, st.bg
+	if st.reverse {
+		fg, bg = bg, fg
+		if fg == "" {
+			fg = "#000000"
+		}
+		if bg == "" {
+			bg = "#c0c0c0"
+		}
+	}
+	if st.bold && fg != "" {
+		// Bold brightens the standard colours, as most MUD clients show it
+		for i, c := range ansiColors[:8] {
+			if c == fg {
+				fg = ansiColors[i+8]
+			}
+		}
+	}
+
+	var props []string
+	if fg != "" {
+		props = append(props, "color:"+fg)
+	}
+	if bg != "" {
+		props = append(props, "background:"+bg)
+	}
+	if st.bold {
+		props = append(props, "font-weight:bold")
+	}
+	if st.dim {
+		props = append(props, "opacity:0.7")
+	}
+	if st.italic {
+		props = append(props, "font-style:italic")
+	}
+	if st.underline {
+		props = append(props, "text-decoration:underline")
+	}
+	return strings.Join(props, ";")
+}
+
+// toHTML escapes a line and turns its colour codes into spans. Spans are
+// closed at the end of the line; the style carries on into the next one.
+func (st *ansiStyle) toHTML(line string) string {
+	var b strings.Builder
+	open := false
+	span := func() {
+		if open {
+			b.WriteString("</span>")
+			open = false
+		}
+		if css := st.css(); css != "" {
+			b.WriteString(`<span style="` + css + `">`)
+			open = true
+		}
+	}
+	span()
+
+	for len(line) > 0 {
+		loc := escapeRE.FindStringIndex(line)
+		if loc == nil {
+			b.WriteString(html.EscapeString(line))
+			break
+		}
+		b.WriteString(html.EscapeString(line[:loc[0]]))
+		if seq := line[loc[0]:loc[1]]; sgrRE.MatchString(seq) {
+			st.apply(seq[2 : len(seq)-1])
+			span()
+		}
+		line = line[loc[1]:]
+	}
+	if open {
+		b.WriteString("</span>")
+	}
+	return strings.ReplaceAll(b.String(), "\r", "")
+}
+
+// logLine writes a line of MUD output to the session log, if one is open
+func (s *Session) logLine(raw, stripped string) {
+	if s.Logger != nil {
+		s.Logger.Line(raw, stripped)
+	}
+}
+
+// startConfiguredLog starts the daily log from the session's log: block in
+// sessions.yaml, if it has one
+func (s *Session) startConfiguredLog() {
+	if s.Logger == nil {
+		return
+	}
+	cfg := sessionLogConfig(s.Name)
+	if cfg == nil || !cfg.Daily {
+		return
+	}
+	if err := s.startDailyLog(cfg, ""); err != nil {
+		log.Printf("Warning: failed to start log for %s: %v", s.Name, err)
+		s.Output(fmt.Sprintf("Failed to start log: %v\n", err))
+	}
+}
+
+// startDailyLog starts daily logs as configured, overriding the format if
+// one is given
+func (s *Session) startDailyLog(cfg *config.LogConfig, format string) error {
+	if format == "" {
+		format = cfg.Format
+	}
+	f, err := ParseLogFormat(format)
+	if err != nil {
+		return err
+	}
+	dir, err := logDir(s.Name, cfg.Dir)
+	if err != nil {
+		return err
+	}
+	return s.Logger.StartDaily(dir, f, cfg.Keep)
+}
+
+// sessionLogConfig returns the session's log: block, or nil
+func sessionLogConfig(name string) *config.LogConfig {
+	if cfg := sessionConfig(name); cfg != nil {
+		return cfg.Log
+	}
+	return nil
+}
+
+// logDir resolves a configured log directory, defaulting to the logs
+// directory beside the session's config
+func logDir(session, dir string) (string, error) {
+	if dir == "" {
+		sessionDir, err := config.GetSessionDir(session)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(sessionDir, "logs"), nil
+	}
+	return expandHome(dir)
+}
+
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+// CmdLog starts and stops session logging:
+// #log start [file] [--format raw|ansi|plain|html], #log stop, #log
+func CmdLog(s *Session, cmd string) {
+	if s.Logger == nil {
+		s.Output("This session cannot be logged\n")
+		return
+	}
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		path, format, daily := s.Logger.Active()
+		switch {
+		case path == "":
+			s.Output("Not logging\n")
+		case daily:
+			s.Output(fmt.Sprintf("Logging daily (%s) to %s\n", format, path))
+		default:
+			s.Output(fmt.Sprintf("Logging (%s) to %s\n", format, path))
+		}
+		return
+	}
+
+	switch args[0] {
+	case "start":
+		var file, format string
+		for i := 1; i < len(args); i++ {
+			switch {
+			case args[i] == "--format" && i+1 < len(args):
+				i++
+				format = args[i]
+			case strings.HasPrefix(args[i], "--format="):
+				format = strings.TrimPrefix(args[i], "--format=")
+			case file == "" && !strings.HasPrefix(args[i], "--"):
+				file = args[i]
+			default:
+				s.Output("Usage: #log start [file] [--format raw|ansi|plain|html]\n")
+				return
+			}
+		}
+
+		if file == "" {
+			cfg := sessionLogConfig(s.Name)
+			if cfg == nil {
+				cfg = &config.LogConfig{}
+			}
+			if err := s.startDailyLog(cfg, format); err != nil {
+				s.Output(fmt.Sprintf("Failed to start log: %v\n", err))
+				return
+			}
+		} else {
+			if format == "" && (strings.HasSuffix(file, ".html") || strings.HasSuffix(file, ".htm")) {
+				format = string(LogHTML)
+			}
+			f, err := ParseLogFormat(format)
+			if err != nil {
+				s.Output(fmt.Sprintf("Failed to start log: %v\n", err))
+				return
+			}
+			path, err := expandHome(file)
+			if err != nil {
+				s.Output(fmt.Sprintf("Failed to start log: %v\n", err))
+				return
+			}
+			if err := s.Logger.Start(path, f); err != nil {
+				s.Output(fmt.Sprintf("Failed to start log: %v\n", err))
+				return
+			}
+		}
+		path, f, _ := s.Logger.Active()
+		s.Output(fmt.Sprintf("Logging (%s) to %s\n", f, path))
+
+	case "stop":
+		path, _, _ := s.Logger.Active()
+		if path == "" {
+			s.Output("Not logging\n")
+			return
+		}
+		if err := s.Logger.Stop(); err != nil {
+			s.Output(fmt.Sprintf("Error closing %s: %v\n", path, err))
+			return
+		}
+		s.Output(fmt.Sprintf("Stopped logging to %s\n", path))
+
+	default:
+		s.Output("Usage: #log [start [file] [--format raw|ansi|plain|html]|stop]\n")
+	}
+}
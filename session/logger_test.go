@@ -0,0 +1,138 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLoggerFormats(t *testing.T) {
+	dir := t.TempDir()
+	raw := "\x1b[1;31mA dragon\x1b[0m \x1b[2Kroars & <burns>"
+	stripped := "A dragon roars & <burns>"
+
+	want := map[LogFormat]string{
+		LogRaw:   raw + "\n>>> flee\n",
+		LogANSI:  "\x1b[1;31mA dragon\x1b[0m roars & <burns>\n>>> flee\n",
+		LogPlain: stripped + "\n>>> flee\n",
+	}
+	for format, w := range want {
+		l := NewLogger("test")
+		path := filepath.Join(dir, string(format))
+		if err := l.Start(path, format); err != nil {
+			t.Fatal(err)
+		}
+		l.Line(raw, stripped)
+		l.Input("flee")
+		l.Stop()
+		l.Line("after stop", "after stop")
+		if got := readLog(t, path); got != w {
+			t.Errorf("%s log = %q, want %q", format, got, w)
+		}
+	}
+}
+
+func TestLoggerHTML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.html")
+	l := NewLogger("test")
+	if err := l.Start(path, LogHTML); err != nil {
+		t.Fatal(err)
+	}
+	l.Line("\x1b[32mThe forest\x1b[1m <glows>", "")
+	l.Line("still green\x1b[0m plain", "")
+	l.Line("\x1b[38;5;196mred\x1b[48;2;0;0;255m on blue", "")
+	l.Input("look <tree>")
+	l.Stop()
+
+	got := readLog(t, path)
+	if !strings.HasPrefix(got, "<!DOCTYPE html>") {
+		t.Errorf("missing HTML header: %q", got)
+	}
+	for _, w := range []string{
+		`<span style="color:#00cd00">The forest</span><span style="color:#00ff00;font-weight:bold"> &lt;glows&gt;</span>` + "\n",
+		`<span style="color:#00ff00;font-weight:bold">still green</span> plain` + "\n",
+		`<span style="color:#ff0000">red</span><span style="color:#ff0000;background:#0000ff"> on blue</span>` + "\n",
+		`<span class="input">&gt;&gt;&gt; look &lt;tree&gt;</span>` + "\n",
+	} {
+		if !strings.Contains(got, w) {
+			t.Errorf("HTML log missing %q:\n%s", w, got)
+		}
+	}
+}
+
+func TestLoggerDaily(t *testing.T) {
+	dir := t.TempDir()
+	for _, day := range []string{"2020-01-01", "2020-01-02", "2020-01-03"} {
+		if err := os.WriteFile(filepath.Join(dir, "test-"+day+".txt"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := filepath.Join(dir, "other-2020-01-01.txt")
+	os.WriteFile(other, nil, 0644)
+
+	l := NewLogger("test")
+	if err := l.StartDaily(dir, LogPlain, 2); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	today, _, daily := l.Active()
+	if !daily || !strings.HasPrefix(filepath.Base(today), "test-") {
+		t.Fatalf("daily log at %q", today)
+	}
+
+	// Opening today's log kept it and the newest old log
+	left, _ := filepath.Glob(filepath.Join(dir, "test-*"))
+	if len(left) != 2 || filepath.Base(left[0]) != "test-2020-01-03.txt" {
+		t.Errorf("after pruning: %q", left)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error("pruned another session's log")
+	}
+
+	// Writing after midnight moves on to a new file
+	l.mu.Lock()
+	l.day = "2020-01-04"
+	l.mu.Unlock()
+	l.Line("next day", "next day")
+	if got := readLog(t, today); got != "next day\n" {
+		t.Errorf("rotated log = %q", got)
+	}
+	left, _ = filepath.Glob(filepath.Join(dir, "test-*"))
+	if len(left) != 2 {
+		t.Errorf("after rotating: %q", left)
+	}
+}
+
+func TestCmdLog(t *testing.T) {
+	s := &Session{Name: "test", Logger: NewLogger("test"), Sub: make(chan tea.Msg, 10)}
+	path := filepath.Join(t.TempDir(), "session.html")
+
+	CmdLog(s, "start "+path)
+	if p, format, _ := s.Logger.Active(); p != path || format != LogHTML {
+		t.Fatalf("logging %s to %q", format, p)
+	}
+	CmdLog(s, "start "+path+" --format ansi")
+	if _, format, _ := s.Logger.Active(); format != LogANSI {
+		t.Errorf("--format ansi logs %s", format)
+	}
+	CmdLog(s, "start "+path+" --format bogus")
+	if _, format, _ := s.Logger.Active(); format != LogANSI {
+		t.Errorf("bad format replaced the log with %s", format)
+	}
+	CmdLog(s, "stop")
+	if p, _, _ := s.Logger.Active(); p != "" {
+		t.Errorf("still logging to %q", p)
+	}
+}
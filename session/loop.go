@@ -0,0 +1,197 @@
+package session
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// loopQueueSize is how many jobs Do queues before blocking its caller
+const loopQueueSize = 1024
+
+// eventLoop runs a session's work one job at a time on a single goroutine.
+// Lines from the MUD, input, timers, queued commands and sends all become
+// jobs, so the session's registries, Data and LuaState are only ever used
+// by that goroutine and need no locks of their own.
+type eventLoop struct {
+	jobs chan func()
+
+	mu      sync.Mutex
+	posted  []func()            // jobs from Post, run in order
+	queries map[string]chan any // results of QueryCoalesced jobs, by key
+	wake    chan struct{}
+	done    chan struct{} // closed when the loop exits, nil until it starts
+}
+
+func newEventLoop() *eventLoop {
+	return &eventLoop{jobs: make(chan func(), loopQueueSize), queries: make(map[string]chan any), wake: make(chan struct{}, 1)}
+}
+
+// startLoop runs queued jobs until the session's context is cancelled.
+// Jobs queued before the loop starts wait for it.
+func (s *Session) startLoop() {
+	s.loop.done = make(chan struct{})
+	go s.runLoop()
+}
+
+func (s *Session) runLoop() {
+	l := s.loop
+	defer close(l.done)
+	for {
+		select {
+		case <-s.Context.Done():
+			return
+		case job := <-l.jobs:
+			s.runJob(job)
+		case <-l.wake:
+			l.mu.Lock()
+			posted := l.posted
+			l.posted = nil
+			l.mu.Unlock()
+			for _, job := range posted {
+				s.runJob(job)
+			}
+		}
+	}
+}
+
+// stopLoop cancels the session's context and waits up to timeout for the
+// job the loop is running to finish, so nothing else touches the session
+// afterwards. It returns false if the loop is still busy.
+func (s *Session) stopLoop(timeout time.Duration) bool {
+	if s.Cancel != nil {
+		s.Cancel()
+	}
+	if s.loop == nil || s.loop.done == nil {
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.loop.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// runJob runs one job, keeping the loop alive if it panics
+func (s *Session) runJob(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			logPanic("session loop", r, stack)
+
+			errMsg := fmt.Sprintf("PANIC in session %s: %v\n(Check ~/.config/zif/panic.log for details)", s.Name, r)
+			log.Printf("%s", errMsg)
+			s.Output("\n" + errMsg + "\n")
+		}
+	}()
+	job()
+}
+
+// Do queues fn to run on the session's loop, waiting if the queue is full.
+// It must not be called from the loop itself. A session without a loop
+// runs fn straight away, and once the session's context is cancelled fn is
+// dropped rather than waiting for a loop that has stopped.
+func (s *Session) Do(fn func()) {
+	if s.loop == nil {
+		fn()
+		return
+	}
+	select {
+	case s.loop.jobs <- fn:
+	case <-s.Context.Done():
+	}
+}
+
+// Post queues fn to run on the session's loop without ever waiting, for
+// callers the loop may be waiting on, such as the UI or another session.
+// Posted jobs run in the order they were posted.
+func (s *Session) Post(fn func()) {
+	if s.loop == nil {
+		fn()
+		return
+	}
+	l := s.loop
+	l.mu.Lock()
+	l.posted = append(l.posted, fn)
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Call runs fn on the session's loop and waits for it to finish. Like Do,
+// it must not be called from the loop. It returns without running fn if
+// the session's context is cancelled first.
+func (s *Session) Call(fn func()) {
+	done := make(chan struct{})
+	s.Do(func() {
+		defer close(done)
+		fn()
+	})
+	if s.loop == nil {
+		return
+	}
+	select {
+	case <-done:
+	case <-s.Context.Done():
+	}
+}
+
+// Query runs fn on the session's loop and returns its result, or false if
+// it takes longer than timeout. The UI uses it to read session state
+// without risking a wait on a busy loop.
+func Query[T any](s *Session, timeout time.Duration, fn func() T) (T, bool) {
+	result := make(chan T, 1)
+	s.Post(func() { result <- fn() })
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case v := <-result:
+		return v, true
+	case <-timer.C:
+		var zero T
+		return zero, false
+	}
+}
+
+// QueryCoalesced is Query for state the UI asks for over and over, such as
+// the status bar. Only one job per key is queued at a time: while an
+// earlier one that timed out is still waiting for a busy loop, no new one
+// is queued, and its result, when it comes, answers the next call.
+func QueryCoalesced[T any](s *Session, key string, timeout time.Duration, fn func() T) (T, bool) {
+	l := s.loop
+	if l == nil {
+		return Query(s, timeout, fn)
+	}
+
+	l.mu.Lock()
+	result, queued := l.queries[key]
+	if !queued {
+		result = make(chan any, 1)
+		l.queries[key] = result
+	}
+	l.mu.Unlock()
+	if !queued {
+		s.Post(func() { result <- fn() })
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case v := <-result:
+		l.mu.Lock()
+		delete(l.queries, key)
+		l.mu.Unlock()
+		return v.(T), true
+	case <-timer.C:
+		var zero T
+		return zero, false
+	}
+}
@@ -0,0 +1,240 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func newLoopTestSession(t *testing.T) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := &Session{Name: "test", Context: ctx, Sub: make(chan tea.Msg, 1000), loop: newEventLoop()}
+	s.startLoop()
+	return s
+}
+
+func TestLoopSerializesJobs(t *testing.T) {
+	s := newLoopTestSession(t)
+
+	// Unsynchronised state touched only from jobs; the race detector
+	// complains if two jobs ever run at once
+	count := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				switch j % 3 {
+				case 0:
+					s.Do(func() { count++ })
+				case 1:
+					s.Post(func() { count++ })
+				default:
+					s.Call(func() { count++ })
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Posted jobs may still be waiting, so poll from the loop
+	deadline := time.Now().Add(time.Second)
+	for {
+		var n int
+		s.Call(func() { n = count })
+		if n == 2000 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ran %d jobs, want 2000", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLoopPostOrder(t *testing.T) {
+	s := newLoopTestSession(t)
+
+	var got []int
+	for i := 0; i < 500; i++ {
+		s.Post(func() { got = append(got, i) })
+	}
+	done := make(chan struct{})
+	s.Post(func() { close(done) })
+	<-done
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("posted job %d ran as number %d", n, i)
+		}
+	}
+}
+
+func TestLoopSurvivesPanic(t *testing.T) {
+	s := newLoopTestSession(t)
+
+	s.Do(func() { panic("boom") })
+	ran := false
+	s.Call(func() { ran = true })
+	if !ran {
+		t.Error("loop stopped after a panicking job")
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	s := newLoopTestSession(t)
+
+	if v, ok := Query(s, time.Second, func() int { return 42 }); !ok || v != 42 {
+		t.Errorf("Query = %d, %v", v, ok)
+	}
+
+	release := make(chan struct{})
+	s.Do(func() { <-release })
+	if _, ok := Query(s, 20*time.Millisecond, func() int { return 1 }); ok {
+		t.Error("Query answered while the loop was busy")
+	}
+	close(release)
+}
+
+func TestQueryCoalesced(t *testing.T) {
+	s := newLoopTestSession(t)
+
+	busy, release := make(chan struct{}), make(chan struct{})
+	s.Do(func() { close(busy); <-release })
+	<-busy
+	var runs atomic.Int32
+	for i := 0; i < 5; i++ {
+		if _, ok := QueryCoalesced(s, "status", 5*time.Millisecond, func() int32 { return runs.Add(1) }); ok {
+			t.Error("QueryCoalesced answered while the loop was busy")
+		}
+	}
+	close(release)
+
+	// The one queued job answers the next call
+	deadline := time.Now().Add(time.Second)
+	for runs.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if v, ok := QueryCoalesced(s, "status", time.Second, func() int32 { return 100 }); !ok || v != 1 {
+		t.Errorf("after the loop freed up, QueryCoalesced = %d, %v; want the queued job's 1", v, ok)
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("timed out queries queued %d jobs, want 1", n)
+	}
+	if v, ok := QueryCoalesced(s, "status", time.Second, func() int32 { return 100 }); !ok || v != 100 {
+		t.Errorf("fresh QueryCoalesced = %d, %v", v, ok)
+	}
+}
+
+func TestStopLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{Name: "test", Context: ctx, Cancel: cancel, Sub: make(chan tea.Msg, 1000), loop: newEventLoop()}
+	s.startLoop()
+
+	// stopLoop waits for the running job before returning
+	busy, release := make(chan struct{}), make(chan struct{})
+	var finished atomic.Bool
+	s.Do(func() { close(busy); <-release; finished.Store(true) })
+	<-busy
+	if s.stopLoop(10 * time.Millisecond) {
+		t.Error("stopLoop returned while a job was running")
+	}
+	close(release)
+	if !s.stopLoop(time.Second) || !finished.Load() {
+		t.Error("stopLoop returned before the running job finished")
+	}
+
+	// Once stopped, a full queue no longer blocks Do or Call
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < loopQueueSize+10; i++ {
+			s.Do(func() {})
+		}
+		s.Call(func() {})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Do blocked on a stopped loop")
+	}
+}
+
+// TestSessionConcurrentWork feeds MUD lines, fires timers and types input
+// all at once, with actions, timers and input sharing the session's Data
+func TestSessionConcurrentWork(t *testing.T) {
+	s := newLoopTestSession(t)
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	s.Socket = client
+	s.SetConnected(true)
+	s.Limiter = NewSendLimiter(1000, 1000)
+	s.Data = map[string]interface{}{}
+	s.Actions = NewActionRegistry()
+	s.Aliases = NewAliasRegistry()
+	s.Ringlog = NewRingLog()
+	t.Cleanup(func() { s.Ringlog.Close() })
+	NewTickerRegistry(s.Context, s)
+
+	bump := func(key string) {
+		n, _ := s.Data[key].(int)
+		s.Data[key] = n + 1
+	}
+	s.AddAction(Action{Name: "hit", Pattern: "^You hit", Enabled: true, Fn: func(s *Session, _ ActionMatches) { bump("hits") }})
+	s.AddTicker(&TickerRecord{Name: "tick", Interval: 5, Fn: func(s *Session) { bump("ticks") }})
+	go io.Copy(io.Discard, server)
+	go func() {
+		for {
+			select {
+			case <-s.Sub:
+			case <-s.Context.Done():
+				return
+			}
+		}
+	}()
+	go s.mudReader()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			fmt.Fprintf(server, "You hit the rat %d.\n", i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			s.Post(func() { bump("typed"); s.HandleInput("kill rat") })
+		}
+	}()
+	wg.Wait()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var hits, typed, ticks int
+		s.Call(func() {
+			hits, _ = s.Data["hits"].(int)
+			typed, _ = s.Data["typed"].(int)
+			ticks, _ = s.Data["ticks"].(int)
+		})
+		if hits == 200 && typed == 200 && ticks > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hits %d, typed %d, ticks %d", hits, typed, ticks)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/perlsaiyan/zif/layout"
+	"github.com/perlsaiyan/zif/schedule"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -32,7 +33,13 @@ func GetCurrentModule(L *lua.LState) string {
 
 // RegisterLuaAPI registers all the Lua API functions with the session's Lua state
 func (s *Session) RegisterLuaAPI() {
-	L := s.LuaState
+	s.registerLuaAPI(s.LuaState)
+}
+
+// registerLuaAPI registers the API in state, which is the session's own
+// state or a module's. Callbacks registered through it run in state.
+func (s *Session) registerLuaAPI(state *lua.LState) {
+	L := state
 
 	// Create session table
 	sessionMT := L.NewTypeMetatable("session")
@@ -41,9 +48,7 @@ func (s *Session) RegisterLuaAPI() {
 	// session:send(command)
 	L.SetField(sessionMT, "send", L.NewFunction(func(L *lua.LState) int {
 		command := L.CheckString(1)
-		if s.Connected && s.Socket != nil {
-			s.Socket.Write([]byte(command + LineTerminator))
-		}
+		s.Send(command)
 		return 0
 	}))
 
@@ -73,7 +78,7 @@ func (s *Session) RegisterLuaAPI() {
 		return 0
 	}))
 
-	// session:register_trigger(name, pattern, func, color)
+	// session:register_trigger(name, pattern, func, color, condition)
 	L.SetField(sessionMT, "register_trigger", L.NewFunction(func(L *lua.LState) int {
 		name := L.CheckString(1)
 		pattern := L.CheckString(2)
@@ -82,13 +87,18 @@ func (s *Session) RegisterLuaAPI() {
 		if L.GetTop() >= 4 {
 			color = L.ToBool(4)
 		}
-
 		moduleName := GetCurrentModule(L)
 		if moduleName == "" {
 			L.RaiseError("register_trigger called outside of module context")
 			return 0
 		}
 
+		cond, err := luaCondition(state, moduleName, L.Get(5), "trigger "+name)
+		if err != nil {
+			L.RaiseError("invalid condition: %v", err)
+			return 0
+		}
+
 		// Compile regex
 		re, err := regexp.Compile(pattern)
 		if err != nil {
@@ -98,11 +108,12 @@ func (s *Session) RegisterLuaAPI() {
 
 		// Create action/trigger
 		action := Action{
-			Name:    name,
-			Pattern: pattern,
-			Color:   color,
-			Enabled: true,
-			RE:      re,
+			Name:      name,
+			Pattern:   pattern,
+			Color:     color,
+			Enabled:   true,
+			RE:        re,
+			Condition: cond,
 			Fn: func(sess *Session, matches ActionMatches) {
 				defer func() {
 					if r := recover(); r != nil {
@@ -113,20 +124,13 @@ func (s *Session) RegisterLuaAPI() {
 						}
 					}
 				}()
-				// Call Lua function with matches
-				L := sess.LuaState
-				L.Push(fn)
-				L.Push(lua.LString(matches.ANSILine))
-				L.Push(lua.LString(matches.Line))
-
-				// Push matches array
-				matchesTable := L.NewTable()
+				// Call Lua function with the line and matches array
+				matchesTable := state.NewTable()
 				for i, match := range matches.Matches {
-					L.RawSetInt(matchesTable, i+1, lua.LString(match))
+					state.RawSetInt(matchesTable, i+1, lua.LString(match))
 				}
-				L.Push(matchesTable)
-
-				if err := L.PCall(3, 0, nil); err != nil {
+				if err := sess.callLua(state, moduleName, "trigger "+name, fn, 0,
+					lua.LString(matches.ANSILine), lua.LString(matches.Line), matchesTable); err != nil {
 					log.Printf("Error calling Lua trigger %s: %v", name, err)
 				}
 			},
@@ -145,10 +149,11 @@ func (s *Session) RegisterLuaAPI() {
 		return 0
 	}))
 
-	// session:register_event(name, func)
+	// session:register_event(name, func, priority)
 	L.SetField(sessionMT, "register_event", L.NewFunction(func(L *lua.LState) int {
 		name := L.CheckString(1)
 		fn := L.CheckFunction(2)
+		priority := L.OptInt(3, 0)
 
 		moduleName := GetCurrentModule(L)
 		if moduleName == "" {
@@ -171,35 +176,60 @@ func (s *Session) RegisterLuaAPI() {
 					}
 				}()
 
-				// Call Lua function with event data
-				L := sess.LuaState
-				L.Push(fn)
-				L.Push(goValueToLua(L, data))
-
-				if err := L.PCall(1, 0, nil); err != nil {
+				// Call Lua function with event data and the name of the event,
+				// which differs from name for wildcard subscriptions
+				fired := sess.CurrentEvent()
+				if err := sess.callLua(state, moduleName, "event "+name, fn, 0,
+					eventPayload(state, data, fired), lua.LString(fired)); err != nil {
 					log.Printf("Error calling Lua event %s: %v", name, err)
 				}
 			},
-			Count: 0,
+			Count:    0,
+			Priority: priority,
 		}
 
 		s.AddEvent(name, listener)
+		if m := s.moduleOf(L); m != nil {
+			m.Events = append(without(m.Events, name), name)
+		}
 
 		return 0
 	}))
 
-	// session:register_alias(name, pattern, func)
+	// session:unregister_event(name)
+	L.SetField(sessionMT, "unregister_event", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+
+		moduleName := GetCurrentModule(L)
+		if moduleName == "" {
+			L.RaiseError("unregister_event called outside of module context")
+			return 0
+		}
+
+		if m := s.moduleOf(L); m != nil {
+			m.Events = without(m.Events, name)
+		}
+		L.Push(lua.LBool(s.RemoveEvent(name, "Lua:"+moduleName+":"+name)))
+		return 1
+	}))
+
+	// session:register_alias(name, pattern, func, condition)
 	L.SetField(sessionMT, "register_alias", L.NewFunction(func(L *lua.LState) int {
 		name := L.CheckString(1)
 		pattern := L.CheckString(2)
 		fn := L.CheckFunction(3)
-
 		moduleName := GetCurrentModule(L)
 		if moduleName == "" {
 			L.RaiseError("register_alias called outside of module context")
 			return 0
 		}
 
+		cond, err := luaCondition(state, moduleName, L.Get(4), "alias "+name)
+		if err != nil {
+			L.RaiseError("invalid condition: %v", err)
+			return 0
+		}
+
 		// Compile regex
 		re, err := regexp.Compile(pattern)
 		if err != nil {
@@ -209,9 +239,10 @@ func (s *Session) RegisterLuaAPI() {
 
 		// Create alias
 		alias := Alias{
-			Name:    name,
-			Pattern: pattern,
-			RE:      re,
+			Name:      name,
+			Pattern:   pattern,
+			RE:        re,
+			Condition: cond,
 			Fn: func(sess *Session, matches []string) {
 				defer func() {
 					if r := recover(); r != nil {
@@ -222,18 +253,12 @@ func (s *Session) RegisterLuaAPI() {
 						}
 					}
 				}()
-				// Call Lua function with matches
-				L := sess.LuaState
-				L.Push(fn)
-
-				// Push matches array
-				matchesTable := L.NewTable()
+				// Call Lua function with matches array
+				matchesTable := state.NewTable()
 				for i, match := range matches {
-					L.RawSetInt(matchesTable, i+1, lua.LString(match))
+					state.RawSetInt(matchesTable, i+1, lua.LString(match))
 				}
-				L.Push(matchesTable)
-
-				if err := L.PCall(1, 0, nil); err != nil {
+				if err := sess.callLua(state, moduleName, "alias "+name, fn, 0, matchesTable); err != nil {
 					log.Printf("Error calling Lua alias %s: %v", name, err)
 				}
 			},
@@ -252,11 +277,80 @@ func (s *Session) RegisterLuaAPI() {
 		return 0
 	}))
 
-	// session:add_timer(name, interval_ms, func)
+	// session:register_command(name, help, func)
+	L.SetField(sessionMT, "register_command", L.NewFunction(func(L *lua.LState) int {
+		name := strings.ToLower(L.CheckString(1))
+		help := L.CheckString(2)
+		fn := L.CheckFunction(3)
+		moduleName := GetCurrentModule(L)
+		if moduleName == "" {
+			L.RaiseError("register_command called outside of module context")
+			return 0
+		}
+		if name == "" || strings.ContainsAny(name, " #") {
+			L.RaiseError("invalid command name %q", name)
+			return 0
+		}
+		if isInternalCommand(name) {
+			L.RaiseError("#%s is a built-in command", name)
+			return 0
+		}
+
+		s.AddCommand(Command{
+			Name:   name,
+			Module: moduleName,
+			Fn: func(sess *Session, line string) {
+				defer func() {
+					if r := recover(); r != nil {
+						stack := debug.Stack()
+						logPanic(fmt.Sprintf("Lua command %s", name), r, stack)
+						sess.Output(fmt.Sprintf("\nPANIC in Lua command %s: %v\n(Check ~/.config/zif/panic.log for details)\n", name, r))
+					}
+				}()
+				args, err := splitArgs(line)
+				if err != nil {
+					sess.Output(fmt.Sprintf("#%s: %v\n", name, err))
+					return
+				}
+				// Call Lua function with the arguments and the line they came from
+				argsTable := state.NewTable()
+				for i, arg := range args {
+					state.RawSetInt(argsTable, i+1, lua.LString(arg))
+				}
+				err = sess.callLua(state, moduleName, "command "+name, fn, 0, argsTable, lua.LString(line))
+				if err != nil && err != errLuaBudget {
+					log.Printf("Error calling Lua command %s: %v", name, err)
+					sess.Output(fmt.Sprintf("Error in #%s: %v\n", name, err))
+				}
+			},
+		}, help)
+
+		if m := s.moduleOf(L); m != nil {
+			m.Commands = append(without(m.Commands, name), name)
+		}
+		return 0
+	}))
+
+	// session:unregister_command(name)
+	L.SetField(sessionMT, "unregister_command", L.NewFunction(func(L *lua.LState) int {
+		name := strings.ToLower(L.CheckString(1))
+		if c, ok := s.commands[name]; !ok || c.Module != GetCurrentModule(L) {
+			L.Push(lua.LFalse)
+			return 1
+		}
+		if m := s.moduleOf(L); m != nil {
+			m.Commands = without(m.Commands, name)
+		}
+		L.Push(lua.LBool(s.RemoveCommand(name)))
+		return 1
+	}))
+
+	// session:add_timer(name, interval_ms, func, opts)
 	L.SetField(sessionMT, "add_timer", L.NewFunction(func(L *lua.LState) int {
 		name := L.CheckString(1)
 		interval := L.CheckInt(2)
 		fn := L.CheckFunction(3)
+		opts := L.OptTable(4, L.NewTable())
 
 		moduleName := GetCurrentModule(L)
 		if moduleName == "" {
@@ -279,9 +373,7 @@ func (s *Session) RegisterLuaAPI() {
 					}
 				}()
 				// Call Lua function
-				L := sess.LuaState
-				L.Push(fn)
-				if err := L.PCall(0, 0, nil); err != nil {
+				if err := sess.callLua(state, moduleName, "timer "+name, fn, 0); err != nil {
 					log.Printf("Error calling Lua timer %s: %v", name, err)
 				}
 			},
@@ -289,8 +381,19 @@ func (s *Session) RegisterLuaAPI() {
 			LastFire: s.Birth,
 			Count:    0,
 		}
+		if err := luaTimerOptions(ticker, opts); err != nil {
+			L.RaiseError("add_timer %s: %v", name, err)
+			return 0
+		}
+		if ticker.Schedule == nil && interval <= 0 {
+			L.ArgError(2, "interval must be a positive number of milliseconds")
+			return 0
+		}
 
-		s.AddLuaTimer(ticker)
+		if err := s.AddLuaTimer(ticker); err != nil {
+			L.RaiseError("add_timer %s: %v", name, err)
+			return 0
+		}
 
 		// Track in module registry
 		if s.Modules != nil {
@@ -331,11 +434,73 @@ func (s *Session) RegisterLuaAPI() {
 		return 0
 	}))
 
+	// session:queue(command, opts)
+	L.SetField(sessionMT, "queue", L.NewFunction(func(L *lua.LState) int {
+		command := L.CheckString(1)
+		opts := L.OptTable(2, L.NewTable())
+
+		item := &QueueItem{Name: command, Command: command}
+		if name, ok := opts.RawGetString("name").(lua.LString); ok {
+			item.Name = string(name)
+		}
+		if n, ok := opts.RawGetString("priority").(lua.LNumber); ok {
+			item.Priority = int(n)
+		}
+		if n, ok := opts.RawGetString("after").(lua.LNumber); ok {
+			item.Dependency = uint64(n)
+		}
+		cond, err := luaCondition(state, GetCurrentModule(L), opts.RawGetString("when"), "queued "+command)
+		if err != nil {
+			L.ArgError(2, err.Error())
+			return 0
+		}
+		if cond != nil {
+			item.Check = cond.Check
+			item.When = cond.String()
+		}
+
+		id, err := s.Queue.Add(item)
+		if err != nil {
+			L.ArgError(2, err.Error())
+			return 0
+		}
+		L.Push(lua.LNumber(id))
+		return 1
+	}))
+
+	// session:queue_cancel(id)
+	L.SetField(sessionMT, "queue_cancel", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(s.Queue.Cancel(uint(L.CheckInt(1)))))
+		return 1
+	}))
+
+	// session:queue_clear()
+	L.SetField(sessionMT, "queue_clear", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(s.Queue.Clear()))
+		return 1
+	}))
+
+	// session:pause_timer(name)
+	L.SetField(sessionMT, "pause_timer", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(s.Tickers != nil && s.PauseTicker(L.CheckString(1))))
+		return 1
+	}))
+
+	// session:resume_timer(name)
+	L.SetField(sessionMT, "resume_timer", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(s.Tickers != nil && s.ResumeTicker(L.CheckString(1))))
+		return 1
+	}))
+
 	// session:add_one_shot_timer(name, delay_ms, func)
 	L.SetField(sessionMT, "add_one_shot_timer", L.NewFunction(func(L *lua.LState) int {
 		name := L.CheckString(1)
 		delay := L.CheckInt(2)
 		fn := L.CheckFunction(3)
+		if delay < 0 {
+			L.ArgError(2, "delay cannot be negative")
+			return 0
+		}
 
 		moduleName := GetCurrentModule(L)
 		if moduleName == "" {
@@ -358,9 +523,7 @@ func (s *Session) RegisterLuaAPI() {
 					}
 				}()
 				// Call Lua function
-				L := sess.LuaState
-				L.Push(fn)
-				if err := L.PCall(0, 0, nil); err != nil {
+				if err := sess.callLua(state, moduleName, "one-shot timer "+name, fn, 0); err != nil {
 					log.Printf("Error calling Lua one-shot timer %s: %v", name, err)
 				}
 				// Remove timer after firing
@@ -377,9 +540,10 @@ func (s *Session) RegisterLuaAPI() {
 					}
 				}
 			},
-			NextFire: time.Now().Add(time.Duration(delay) * time.Millisecond),
-			LastFire: s.Birth,
-			Count:    0,
+			NextFire:   time.Now().Add(time.Duration(delay) * time.Millisecond),
+			LastFire:   s.Birth,
+			Count:      0,
+			Iterations: 1,
 		}
 
 		s.AddLuaTimer(ticker)
@@ -396,15 +560,68 @@ func (s *Session) RegisterLuaAPI() {
 
 	// session:get_ringlog(limit)
 	L.SetField(sessionMT, "get_ringlog", L.NewFunction(func(L *lua.LState) int {
-		_ = 100 // limit - reserved for future implementation
-		if L.GetTop() >= 1 {
-			_ = L.CheckInt(1)
+		limit := L.OptInt(1, 100)
+		records, err := s.Ringlog.Recent(limit)
+		if err != nil {
+			L.RaiseError("ringlog query failed: %v", err)
+			return 0
+		}
+		L.Push(ringRecordsToLua(L, records))
+		return 1
+	}))
+
+	// session:ringlog_search(pattern, opts)
+	L.SetField(sessionMT, "ringlog_search", L.NewFunction(func(L *lua.LState) int {
+		q := RingQuery{Limit: 100}
+		if pattern := L.OptString(1, ""); pattern != "" {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				L.RaiseError("invalid regex pattern: %v", err)
+				return 0
+			}
+			q.Pattern = re
 		}
+		if opts := L.OptTable(2, nil); opts != nil {
+			if v, ok := opts.RawGetString("limit").(lua.LNumber); ok {
+				q.Limit = int(v)
+			}
+			if v, ok := opts.RawGetString("since").(lua.LNumber); ok {
+				q.Since = int64(float64(v) * 1e9)
+			}
+			if v, ok := opts.RawGetString("before").(lua.LNumber); ok {
+				q.Before = int64(float64(v) * 1e9)
+			}
+			switch v := opts.RawGetString("type").(type) {
+			case lua.LString:
+				q.Types = strings.Split(string(v), ",")
+			case *lua.LTable:
+				v.ForEach(func(_, t lua.LValue) {
+					q.Types = append(q.Types, t.String())
+				})
+			}
+			q.ANSI = lua.LVAsBool(opts.RawGetString("ansi"))
+		}
+
+		records, err := s.Ringlog.Search(q)
+		if err != nil {
+			L.RaiseError("ringlog query failed: %v", err)
+			return 0
+		}
+		L.Push(ringRecordsToLua(L, records))
+		return 1
+	}))
 
-		// Get ringlog entries (simplified - would need to implement proper ringlog query)
-		result := L.NewTable()
-		// TODO: Implement proper ringlog query
-		L.Push(result)
+	// session:ringlog_range(from_id, to_id)
+	L.SetField(sessionMT, "ringlog_range", L.NewFunction(func(L *lua.LState) int {
+		from := L.CheckInt(1)
+		to := L.OptInt(2, s.Ringlog.GetCurrentRingNumber())
+		L.Push(ringRecordsToLua(L, s.Ringlog.GetLog(from, to)))
+		return 1
+	}))
+
+	// session:ringlog_current()
+	L.SetField(sessionMT, "ringlog_current", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(s.Ringlog.GetCurrentRingNumber()))
 		return 1
 	}))
 
@@ -432,6 +649,23 @@ func (s *Session) RegisterLuaAPI() {
 		return 1
 	}))
 
+	// module:setting(key)
+	L.SetField(moduleMT, "setting", L.NewFunction(func(L *lua.LState) int {
+		// Skip the module table when called as module:setting(key)
+		arg := 1
+		if _, ok := L.Get(1).(*lua.LTable); ok {
+			arg = 2
+		}
+		key := L.CheckString(arg)
+		if s.Modules == nil {
+			L.Push(lua.LNil)
+			return 1
+		}
+		v, _ := s.ModuleSetting(GetCurrentModule(L), key)
+		L.Push(goValueToLua(L, v))
+		return 1
+	}))
+
 	// Layout control functions
 
 	// session:layout_split(direction, pane_id, pane_type, split_percent)
@@ -498,6 +732,10 @@ func (s *Session) RegisterLuaAPI() {
 			s.Sub <- UpdateMessage{Session: s.Name}
 		}
 
+		if m := s.moduleOf(L); m != nil {
+			m.Panes = append(m.Panes, newPaneID)
+		}
+
 		// Return the created pane ID
 		L.Push(lua.LString(newPaneID))
 		return 1
@@ -506,6 +744,9 @@ func (s *Session) RegisterLuaAPI() {
 	// session:layout_unsplit(pane_id)
 	L.SetField(sessionMT, "layout_unsplit", L.NewFunction(func(L *lua.LState) int {
 		paneID := L.CheckString(1)
+		if m := s.moduleOf(L); m != nil {
+			m.Panes = without(m.Panes, paneID)
+		}
 
 		// Send layout command message
 		if s.Handler != nil {
@@ -668,6 +909,9 @@ func (s *Session) RegisterLuaAPI() {
 		if width > 80 {
 			width = 80
 		}
+		if m := s.moduleOf(L); m != nil {
+			m.Progress = append(without(m.Progress, paneID), paneID)
+		}
 
 		// Send layout command message
 		if s.Handler != nil {
@@ -726,6 +970,9 @@ func (s *Session) RegisterLuaAPI() {
 	// session:progress_destroy(pane_id)
 	L.SetField(sessionMT, "progress_destroy", L.NewFunction(func(L *lua.LState) int {
 		paneID := L.CheckString(1)
+		if m := s.moduleOf(L); m != nil {
+			m.Progress = without(m.Progress, paneID)
+		}
 
 		// Send layout command message
 		if s.Handler != nil {
@@ -839,10 +1086,141 @@ func (s *Session) RegisterLuaAPI() {
 		}
 		return 1
 	}))
+
+	s.registerScriptAPI(state, sessionMT)
+	s.registerZifAPI(state)
+}
+
+// registerZifAPI registers the "zif" table of functions that reach across
+// sessions.
+func (s *Session) registerZifAPI(L *lua.LState) {
+	zif := L.NewTable()
+	L.SetGlobal("zif", zif)
+
+	// zif.sessions()
+	L.SetField(zif, "sessions", L.NewFunction(func(L *lua.LState) int {
+		names := L.NewTable()
+		if s.Handler != nil {
+			for _, name := range s.Handler.SessionNames() {
+				names.Append(lua.LString(name))
+			}
+		}
+		L.Push(names)
+		return 1
+	}))
+
+	// zif.send(session_name, command)
+	L.SetField(zif, "send", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		command := L.CheckString(2)
+		if s.Handler == nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString("no session handler"))
+			return 2
+		}
+		if err := s.Handler.SendTo(name, command); err != nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+
+	// zif.broadcast(event_name, data)
+	L.SetField(zif, "broadcast", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		data := map[string]interface{}{}
+		if tbl, ok := L.Get(2).(*lua.LTable); ok {
+			if m, ok := lValueToGo(tbl).(map[string]interface{}); ok {
+				data = m
+			}
+		}
+		if s.Handler != nil {
+			s.Handler.Broadcast(s.Name, name, data)
+		} else {
+			s.FireEvent(name, BroadcastEvent{BaseEvent: NewBaseEvent(), Source: s.Name, Data: data})
+		}
+		return 0
+	}))
+}
+
+// luaTimerOptions applies the optional table passed to add_timer:
+// {iterations = n, jitter = ms, schedule = "*/5 * * * *", paused = bool}
+func luaTimerOptions(t *TickerRecord, opts *lua.LTable) error {
+	if n, ok := opts.RawGetString("iterations").(lua.LNumber); ok {
+		t.Iterations = uint(n)
+	}
+	if n, ok := opts.RawGetString("jitter").(lua.LNumber); ok {
+		t.Jitter = int(n)
+	}
+	if spec, ok := opts.RawGetString("schedule").(lua.LString); ok {
+		sched, err := schedule.Parse(string(spec))
+		if err != nil {
+			return err
+		}
+		t.Schedule = sched
+	}
+	t.Paused = lua.LVAsBool(opts.RawGetString("paused"))
+	return nil
+}
+
+// luaCondition turns the optional condition argument of register_trigger and
+// register_alias into a Condition. Strings are compiled as condition
+// expressions; functions are called in state as predicates and their result
+// is truthy-tested.
+func luaCondition(state *lua.LState, module string, lv lua.LValue, label string) (*Condition, error) {
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LString:
+		return NewCondition(string(v))
+	case *lua.LFunction:
+		return &Condition{
+			Source: "lua function",
+			Fn: func(sess *Session) bool {
+				if err := sess.callLua(state, module, "condition for "+label, v, 1); err != nil {
+					log.Printf("Error calling Lua condition for %s: %v", label, err)
+					return false
+				}
+				ok := lua.LVAsBool(state.Get(-1))
+				state.Pop(1)
+				return ok
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("condition must be a string or function, got %s", lv.Type())
+	}
 }
 
 // Helper functions to convert between Lua values and Go values
 
+// ringRecordsToLua converts ring log entries to an array of tables
+func ringRecordsToLua(L *lua.LState, records []RingRecord) *lua.LTable {
+	result := L.NewTable()
+	for i, r := range records {
+		entry := L.NewTable()
+		entry.RawSetString("id", lua.LNumber(r.RingNumber))
+		entry.RawSetString("timestamp", lua.LNumber(float64(r.EpochNS)/1e9))
+		entry.RawSetString("type", lua.LString(r.Context))
+		entry.RawSetString("line", lua.LString(r.Message))
+		entry.RawSetString("stripped", lua.LString(r.Stripped))
+		result.RawSetInt(i+1, entry)
+	}
+	return result
+}
+
+// eventPayload converts event data for a Lua handler, adding the name of
+// the event that fired and when
+func eventPayload(L *lua.LState, data EventData, fired string) lua.LValue {
+	payload := goValueToLua(L, data)
+	if tbl, ok := payload.(*lua.LTable); ok {
+		tbl.RawSetString("event", lua.LString(fired))
+		tbl.RawSetString("timestamp", lua.LNumber(float64(data.Timestamp().UnixNano())/1e9))
+	}
+	return payload
+}
+
 // goValueToLua converts a Go value to a Lua value, handling complex types recursively
 func goValueToLua(L *lua.LState, val interface{}) lua.LValue {
 	if val == nil {
@@ -860,6 +1238,9 @@ func goValueToLua(L *lua.LState, val interface{}) lua.LValue {
 		return lua.LNumber(v)
 	case bool:
 		return lua.LBool(v)
+	case time.Time:
+		// Seconds since the epoch, like os.time() but with a fraction
+		return lua.LNumber(float64(v.UnixNano()) / 1e9)
 	case []interface{}:
 		// Convert array to Lua table with 1-based indexing
 		table := L.NewTable()
@@ -892,6 +1273,14 @@ func goValueToLua(L *lua.LState, val interface{}) lua.LValue {
 					continue
 				}
 
+				// Flatten embedded structs, e.g. BaseEvent in event payloads
+				if field.Anonymous && field.Type.Kind() == reflect.Struct {
+					if embedded, ok := goValueToLua(L, vVal.Field(i).Interface()).(*lua.LTable); ok {
+						embedded.ForEach(func(k, v lua.LValue) { table.RawSet(k, v) })
+					}
+					continue
+				}
+
 				// Use json tag if available, otherwise field name
 				fieldName := field.Name
 				if tag := field.Tag.Get("json"); tag != "" {
@@ -936,6 +1325,20 @@ func lValueToGo(lv lua.LValue) interface{} {
 		return float64(v)
 	case lua.LBool:
 		return bool(v)
+	case *lua.LTable:
+		// Sequences become slices, anything else a map with string keys
+		if n := v.MaxN(); n > 0 {
+			items := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				items = append(items, lValueToGo(v.RawGetInt(i)))
+			}
+			return items
+		}
+		m := map[string]interface{}{}
+		v.ForEach(func(k, val lua.LValue) {
+			m[k.String()] = lValueToGo(val)
+		})
+		return m
 	default:
 		return nil
 	}
@@ -971,9 +1374,11 @@ func (s *Session) InjectContext() error {
 		return nil
 	}
 	for name, injector := range s.contextInjectors {
-		if err := injector(s, s.LuaState); err != nil {
-			log.Printf("Error injecting context %s: %v", name, err)
-			return err
+		for _, L := range s.luaStates() {
+			if err := injector(s, L); err != nil {
+				log.Printf("Error injecting context %s: %v", name, err)
+				return err
+			}
 		}
 	}
 	return nil
@@ -985,9 +1390,11 @@ func (s *Session) UpdateContextInjector(name string) error {
 		return nil
 	}
 	if injector, ok := s.contextInjectors[name]; ok {
-		if err := injector(s, s.LuaState); err != nil {
-			log.Printf("Error updating context injector %s: %v", name, err)
-			return err
+		for _, L := range s.luaStates() {
+			if err := injector(s, L); err != nil {
+				log.Printf("Error updating context injector %s: %v", name, err)
+				return err
+			}
 		}
 	}
 	return nil
@@ -78,3 +78,75 @@ func TestLuaRegisterEvent(t *testing.T) {
 		}
 	}
 }
+
+func TestLuaEventPayloadAndUnregister(t *testing.T) {
+	s := &Session{
+		Name:     "test",
+		Events:   NewEventRegistry(),
+		LuaState: lua.NewState(),
+		Modules:  NewModuleRegistry(),
+	}
+	s.RegisterLuaAPI()
+	SetCurrentModule(s.LuaState, "test_module")
+	s.Modules.Modules["test_module"] = &Module{Name: "test_module"}
+
+	script := `
+		seen = {}
+		session.register_event("core.*", function(evt, name)
+			table.insert(seen, name .. "=" .. evt.event .. ":" .. tostring(evt.line) .. ":" .. tostring(evt.timestamp > 0))
+		end)
+	`
+	if err := s.LuaState.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+
+	s.FireEvent(EventLine, LineEvent{BaseEvent: NewBaseEvent(), Line: "You are hungry."})
+	if err := s.LuaState.DoString(`removed = session.unregister_event("core.*")`); err != nil {
+		t.Fatal(err)
+	}
+	s.FireEvent(EventLine, LineEvent{BaseEvent: NewBaseEvent(), Line: "ignored"})
+
+	if s.LuaState.GetGlobal("removed") != lua.LTrue {
+		t.Error("unregister_event returned false")
+	}
+	seen := s.LuaState.GetGlobal("seen").(*lua.LTable)
+	if seen.Len() != 1 || seen.RawGetInt(1).String() != "core.line=core.line:You are hungry.:true" {
+		t.Errorf("seen = %v entries, first %q", seen.Len(), seen.RawGetInt(1).String())
+	}
+}
+
+func TestLuaNestedEvents(t *testing.T) {
+	s := &Session{
+		Name:     "test",
+		Events:   NewEventRegistry(),
+		LuaState: lua.NewState(),
+		Modules:  NewModuleRegistry(),
+	}
+	s.RegisterLuaAPI()
+	SetCurrentModule(s.LuaState, "test_module")
+	s.Modules.Modules["test_module"] = &Module{Name: "test_module"}
+
+	// A Go handler fires a second event that a Lua handler registered from
+	// inside the first Lua handler picks up.
+	s.AddEvent("kallisti.death", Event{Name: "loot", Fn: func(s *Session, _ EventData) {
+		s.FireEvent("loot.corpse", NewBaseEvent())
+	}})
+	script := `
+		order = {}
+		session.register_event("kallisti.death", function(evt, name)
+			table.insert(order, name)
+			session.register_event("loot.corpse", function(evt, name)
+				table.insert(order, name)
+			end)
+		end, 1)
+	`
+	if err := s.LuaState.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	s.FireEvent("kallisti.death", NewBaseEvent())
+
+	order := s.LuaState.GetGlobal("order").(*lua.LTable)
+	if order.Len() != 2 || order.RawGetInt(2).String() != "loot.corpse" {
+		t.Errorf("order has %d entries, want kallisti.death then loot.corpse", order.Len())
+	}
+}
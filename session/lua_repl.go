@@ -0,0 +1,322 @@
+package session
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/perlsaiyan/zif/layout"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// replScrollback is how many lines of the Lua prompt's transcript are kept
+const replScrollback = 2000
+
+// replHistory is how many lines typed at the Lua prompt are remembered
+const replHistory = 500
+
+// LuaREPL is a session's interactive Lua prompt. Lines are gathered until
+// they make a complete chunk, as in the standalone lua interpreter, so a
+// function or loop can be typed over several lines. It is safe for the UI
+// to read while the session's loop evaluates.
+type LuaREPL struct {
+	Output *Scrollback // transcript shown in the prompt's pane
+
+	mu      sync.Mutex
+	module  string   // module whose state the prompt uses, "" for the session's own
+	pending []string // lines of an incomplete chunk
+	history []string
+}
+
+func newLuaREPL() *LuaREPL {
+	return &LuaREPL{Output: NewScrollback(replScrollback)}
+}
+
+// REPL returns the session's Lua prompt
+func (s *Session) REPL() *LuaREPL {
+	s.replOnce.Do(func() { s.repl = newLuaREPL() })
+	return s.repl
+}
+
+// Prompt returns the prompt to show for the next line
+func (r *LuaREPL) Prompt() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.prompt()
+}
+
+// prompt is Prompt with r.mu held
+func (r *LuaREPL) prompt() string {
+	prompt := "lua"
+	if r.module != "" {
+		prompt += ":" + r.module
+	}
+	if len(r.pending) > 0 {
+		return prompt + ">> "
+	}
+	return prompt + "> "
+}
+
+// History returns the lines typed at the prompt, oldest first
+func (r *LuaREPL) History() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.history...)
+}
+
+// Module returns the module whose state the prompt uses
+func (r *LuaREPL) Module() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.module
+}
+
+// SetModule points the prompt at a module's state, or the session's own for
+// "", dropping any unfinished chunk
+func (r *LuaREPL) SetModule(module string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.module = module
+	r.pending = nil
+}
+
+// Enter adds a line typed at s's Lua prompt, evaluating the chunk once it
+// is complete. It runs on the session's loop.
+func (r *LuaREPL) Enter(s *Session, line string) {
+	r.mu.Lock()
+	prompt := r.prompt()
+	if t := strings.TrimSpace(line); t != "" && (len(r.history) == 0 || r.history[len(r.history)-1] != line) {
+		r.history = append(r.history, line)
+		if len(r.history) > replHistory {
+			r.history = r.history[len(r.history)-replHistory:]
+		}
+	}
+	r.pending = append(r.pending, line)
+	chunk := strings.Join(r.pending, "\n")
+	module := r.module
+	r.mu.Unlock()
+
+	r.Output.Write(prompt + line + "\n")
+	if luaIncomplete(chunk) {
+		s.Sub <- UpdateMessage{Session: s.Name}
+		return
+	}
+
+	r.mu.Lock()
+	r.pending = nil
+	r.mu.Unlock()
+
+	L, err := s.luaEvalState(module)
+	if err == nil {
+		var out string
+		out, err = s.EvalLua(L, module, chunk)
+		r.Output.Write(out)
+	}
+	if err != nil {
+		r.Output.Write(fmt.Sprintf("error: %v\n", err))
+	}
+	s.Sub <- UpdateMessage{Session: s.Name}
+}
+
+// luaIncomplete reports whether a chunk only fails to compile because it
+// ends too soon, so more lines should be read
+func luaIncomplete(chunk string) bool {
+	_, err := parse.Parse(strings.NewReader(chunk), "<repl>")
+	return err != nil && strings.Contains(err.Error(), "at EOF:") && strings.Contains(err.Error(), "syntax error")
+}
+
+// luaEvalState returns the Lua state of the named module, or the session's
+// own for ""
+func (s *Session) luaEvalState(module string) (*lua.LState, error) {
+	if module == "" {
+		if s.LuaState == nil {
+			return nil, fmt.Errorf("session has no Lua state")
+		}
+		return s.LuaState, nil
+	}
+	if s.Modules != nil {
+		if m, ok := s.Modules.Modules[module]; ok && m.LuaState != nil {
+			return m.LuaState, nil
+		}
+	}
+	return nil, fmt.Errorf("module %s not found", module)
+}
+
+// EvalLua runs code in L under the session's budget and returns what it
+// printed followed by its results, pretty-printed. Code that is an
+// expression is evaluated as one, so "1 + 1" gives 2.
+func (s *Session) EvalLua(L *lua.LState, module, code string) (string, error) {
+	fn, err := L.LoadString("return " + code)
+	if err != nil {
+		if fn, err = L.LoadString(code); err != nil {
+			return "", err
+		}
+	}
+
+	// Collect print output rather than let it reach the terminal
+	var out strings.Builder
+	oldPrint := L.GetGlobal("print")
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		parts := make([]string, L.GetTop())
+		for i := range parts {
+			parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		out.WriteString(strings.Join(parts, "\t") + "\n")
+		return 0
+	}))
+	defer L.SetGlobal("print", oldPrint)
+
+	top := L.GetTop()
+	if err := s.callLua(L, module, "#lua", fn, lua.MultRet); err != nil {
+		return out.String(), err
+	}
+	for i := top + 1; i <= L.GetTop(); i++ {
+		out.WriteString(formatLuaValue(L.Get(i)) + "\n")
+	}
+	L.SetTop(top)
+	return out.String(), nil
+}
+
+// luaRaw is shown as is by formatMSDPValue, where a string would be quoted
+type luaRaw string
+
+// formatLuaValue pretty-prints a Lua value, laying tables out like #msdp
+func formatLuaValue(v lua.LValue) string {
+	if v == lua.LNil {
+		return "nil"
+	}
+	return formatMSDPValue(luaToDisplay(v, 0), 0)
+}
+
+// luaToDisplay converts a Lua value to what formatMSDPValue prints. Tables
+// nested too deeply, such as ones that contain themselves, are elided.
+func luaToDisplay(v lua.LValue, depth int) interface{} {
+	switch val := v.(type) {
+	case lua.LBool:
+		return bool(val)
+	case lua.LString:
+		return string(val)
+	case lua.LNumber:
+		if f := float64(val); f == float64(int(f)) {
+			return int(f)
+		}
+		return luaRaw(val.String())
+	case *lua.LTable:
+		if depth >= 8 {
+			return luaRaw("{...}")
+		}
+		if n := val.Len(); n > 0 && n == luaTableSize(val) {
+			items := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				items = append(items, luaToDisplay(val.RawGetInt(i), depth+1))
+			}
+			return items
+		}
+		fields := make(map[string]interface{})
+		val.ForEach(func(k, item lua.LValue) {
+			key := k.String()
+			if _, ok := k.(lua.LString); !ok {
+				key = "[" + key + "]"
+			}
+			fields[key] = luaToDisplay(item, depth+1)
+		})
+		return fields
+	}
+	return luaRaw(v.String())
+}
+
+// luaTableSize counts a table's entries
+func luaTableSize(t *lua.LTable) int {
+	n := 0
+	t.ForEach(func(_, _ lua.LValue) { n++ })
+	return n
+}
+
+// luaCompletable matches the dotted name being typed at the end of a line
+var luaCompletable = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*(?:[.:][A-Za-z_][A-Za-z0-9_]*)*[.:]?$|[.:]$|^$`)
+
+// CompleteLua returns the ways line can be completed by finishing the name
+// at its end, such as session.reg to session.register_alias. Names are
+// looked up from the globals of L.
+func CompleteLua(L *lua.LState, line string) []string {
+	loc := luaCompletable.FindStringIndex(line)
+	if loc == nil {
+		return nil
+	}
+	before, name := line[:loc[0]], line[loc[0]:]
+
+	// Walk the tables named before the last separator
+	sep := strings.LastIndexAny(name, ".:")
+	table := L.G.Global
+	path, partial := "", name
+	if sep >= 0 {
+		path, partial = name[:sep+1], name[sep+1:]
+		for _, part := range strings.FieldsFunc(name[:sep], func(r rune) bool { return r == '.' || r == ':' }) {
+			next, ok := table.RawGetString(part).(*lua.LTable)
+			if !ok {
+				return nil
+			}
+			table = next
+		}
+	}
+
+	var matches []string
+	table.ForEach(func(k, _ lua.LValue) {
+		key, ok := k.(lua.LString)
+		if !ok || strings.HasPrefix(string(key), "__") {
+			return
+		}
+		if strings.HasPrefix(string(key), partial) {
+			matches = append(matches, before+path+string(key))
+		}
+	})
+	sort.Strings(matches)
+	return matches
+}
+
+// Complete returns the completions of line in the prompt's Lua state. It
+// runs on the session's loop.
+func (r *LuaREPL) Complete(s *Session, line string) []string {
+	L, err := s.luaEvalState(r.Module())
+	if err != nil {
+		return nil
+	}
+	return CompleteLua(L, line)
+}
+
+// CmdLua evaluates Lua, or opens the Lua prompt:
+// #lua [--module <name>] [code]
+func CmdLua(s *Session, cmd string) {
+	cmd = strings.TrimSpace(cmd)
+	module := ""
+	if rest, ok := strings.CutPrefix(cmd, "--module"); ok {
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			s.Output("Usage: #lua [--module <name>] [code]\n")
+			return
+		}
+		module = fields[0]
+		cmd = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), module))
+	}
+
+	L, err := s.luaEvalState(module)
+	if err != nil {
+		s.Output(fmt.Sprintf("Lua error: %v\n", err))
+		return
+	}
+
+	if cmd == "" {
+		s.REPL().SetModule(module)
+		s.Sub <- layout.LayoutCommandMsg{Command: "lua_repl", Session: s}
+		return
+	}
+
+	out, err := s.EvalLua(L, module, cmd)
+	s.Output(out)
+	if err != nil {
+		s.Output(fmt.Sprintf("Lua error: %v\n", err))
+	}
+}
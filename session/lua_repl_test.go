@@ -0,0 +1,127 @@
+package session
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/perlsaiyan/zif/layout"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func newREPLTestSession(t *testing.T) *Session {
+	s := newModuleTestSession()
+	s.LuaState = lua.NewState()
+	t.Cleanup(s.LuaState.Close)
+	s.RegisterLuaAPI()
+	return s
+}
+
+func TestEvalLua(t *testing.T) {
+	s := newREPLTestSession(t)
+	for code, want := range map[string]string{
+		"1 + 1":                            "2\n",
+		"0.5":                              "0.5\n",
+		`"hi", nil, true`:                  "\"hi\"\nnil\ntrue\n",
+		"x = 3":                            "",
+		"print('a', 1) return 'b'":         "a\t1\n\"b\"\n",
+		"{1, 2, 3}":                        "[1, 2, 3]\n",
+		"{}":                               "{}\n",
+		"{hp = 10, name = 'Bob', [5] = 1}": "{\n  [5]: 1,\n  hp: 10,\n  name: \"Bob\"\n}\n",
+	} {
+		got, err := s.EvalLua(s.LuaState, "", code)
+		if err != nil || got != want {
+			t.Errorf("EvalLua(%q) = %q, %v, want %q", code, got, err, want)
+		}
+	}
+
+	// Tables that contain themselves are cut off
+	got, err := s.EvalLua(s.LuaState, "", "(function() local t = {} t.self = t return t end)()")
+	if err != nil || !strings.Contains(got, "{...}") {
+		t.Errorf("self-referencing table = %q, %v", got, err)
+	}
+
+	if _, err := s.EvalLua(s.LuaState, "", "error('nope')"); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("error not returned: %v", err)
+	}
+	if _, err := s.EvalLua(s.LuaState, "", "1 +"); err == nil {
+		t.Error("syntax error not returned")
+	}
+}
+
+func TestCmdLua(t *testing.T) {
+	s := newREPLTestSession(t)
+	path := writeModule(t, t.TempDir(), "counter", "count = 7")
+	if err := LoadModule(s, path); err != nil {
+		t.Fatal(err)
+	}
+
+	CmdLua(s, "count")
+	CmdLua(s, "--module counter count * 2")
+	CmdLua(s, "--module missing 1")
+	got := s.Scrollback.String()
+	for _, want := range []string{"nil\n", "14\n", "Lua error: module missing not found"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q:\n%s", want, got)
+		}
+	}
+
+	for len(s.Sub) > 0 {
+		<-s.Sub
+	}
+	CmdLua(s, "--module counter")
+	msg, ok := (<-s.Sub).(layout.LayoutCommandMsg)
+	if !ok || msg.Command != "lua_repl" || s.REPL().Module() != "counter" {
+		t.Errorf("#lua --module counter sent %#v, prompt on %q", msg, s.REPL().Module())
+	}
+}
+
+func TestREPL(t *testing.T) {
+	s := newREPLTestSession(t)
+	repl := s.REPL()
+
+	for _, line := range []string{"function twice(n)", "  return n * 2", "end"} {
+		repl.Enter(s, line)
+		if line != "end" && repl.Prompt() != "lua>> " {
+			t.Errorf("prompt after %q is %q", line, repl.Prompt())
+		}
+	}
+	if repl.Prompt() != "lua> " {
+		t.Errorf("prompt after a complete chunk is %q", repl.Prompt())
+	}
+	repl.Enter(s, "twice(21)")
+	repl.Enter(s, "twice(nil)")
+	repl.Enter(s, "twice(21)")
+
+	got := repl.Output.String()
+	for _, want := range []string{"lua> function twice(n)\n", "lua>>   return n * 2\n", "lua> twice(21)\n42\n", "error: "} {
+		if !strings.Contains(got, want) {
+			t.Errorf("transcript missing %q:\n%s", want, got)
+		}
+	}
+	history := repl.History()
+	if len(history) != 6 || history[5] != "twice(21)" {
+		t.Errorf("history = %q", history)
+	}
+}
+
+func TestCompleteLua(t *testing.T) {
+	s := newREPLTestSession(t)
+	s.LuaState.DoString("player = {name = 'Bob', stats = {hp = 1, hunger = 2}}")
+
+	for line, want := range map[string][]string{
+		"sess":                 {"session"},
+		"session.register_al":  {"session.register_alias"},
+		"x = session:send_":    nil,
+		"print(player.stats.h": {"print(player.stats.hp", "print(player.stats.hunger"},
+		"player.":              {"player.name", "player.stats"},
+		"nosuch.x":             nil,
+	} {
+		got := CompleteLua(s.LuaState, line)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("CompleteLua(%q) = %q, want %q", line, got, want)
+		}
+	}
+	if got := CompleteLua(s.LuaState, "session:"); len(got) < 10 {
+		t.Errorf("session: completed to only %q", got)
+	}
+}
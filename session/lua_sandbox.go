@@ -0,0 +1,189 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/perlsaiyan/zif/config"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// DefaultLuaBudget is how long a single Lua call may run before it is
+// stopped
+const DefaultLuaBudget = time.Second
+
+// LuaSandbox limits what a session's modules may do. Each module runs in
+// its own Lua state, so one module cannot overwrite another's globals, and
+// every call into Lua is stopped if it runs past the budget.
+type LuaSandbox struct {
+	Budget  time.Duration   // longest a single call may run, DefaultLuaBudget if zero
+	Trusted map[string]bool // modules given the full os and io libraries
+	Watch   bool            // reload modules when their files change
+}
+
+func (b LuaSandbox) budget() time.Duration {
+	if b.Budget <= 0 {
+		return DefaultLuaBudget
+	}
+	return b.Budget
+}
+
+// luaSandbox returns the sandbox from a session's lua: block
+func luaSandbox(cfg *config.SessionConfig) LuaSandbox {
+	var b LuaSandbox
+	if cfg == nil || cfg.Lua == nil {
+		return b
+	}
+	b.Budget = time.Duration(cfg.Lua.Budget) * time.Millisecond
+	b.Watch = cfg.Lua.Watch
+	if len(cfg.Lua.Trusted) > 0 {
+		b.Trusted = make(map[string]bool)
+		for _, name := range cfg.Lua.Trusted {
+			b.Trusted[name] = true
+		}
+	}
+	return b
+}
+
+// safeOSFuncs are the os functions a module gets unless it is trusted
+var safeOSFuncs = []string{"clock", "date", "difftime", "time"}
+
+// newModuleState returns a Lua state for a module with the session API
+// registered. Unless the module is trusted it has no io library, os only
+// tells the time, and require only finds files inside the module.
+func (s *Session) newModuleState(m *Module) *lua.LState {
+	if s.Sandbox.Trusted[m.Name] {
+		L := lua.NewState()
+		s.setupModuleState(L, m)
+		return L
+	}
+
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.LoadLibName, lua.OpenPackage},
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.CoroutineLibName, lua.OpenCoroutine},
+		{lua.OsLibName, lua.OpenOs},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	osTable := L.NewTable()
+	if full, ok := L.GetGlobal(lua.OsLibName).(*lua.LTable); ok {
+		for _, name := range safeOSFuncs {
+			osTable.RawSetString(name, full.RawGetString(name))
+		}
+	}
+	L.SetGlobal(lua.OsLibName, osTable)
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+	if pkg, ok := L.GetGlobal(lua.LoadLibName).(*lua.LTable); ok {
+		pkg.RawSetString("path", lua.LString(filepath.Join(m.Path, "?.lua")+";"+filepath.Join(m.Path, "?", "init.lua")))
+		pkg.RawSetString("cpath", lua.LString(""))
+	}
+
+	s.setupModuleState(L, m)
+	return L
+}
+
+// setupModuleState registers the session API in a module's state and gives
+// it whatever context plugins inject
+func (s *Session) setupModuleState(L *lua.LState, m *Module) {
+	SetCurrentModule(L, m.Name)
+	s.registerLuaAPI(L)
+	for name, injector := range s.contextInjectors {
+		if err := injector(s, L); err != nil {
+			log.Printf("Error injecting context %s into module %s: %v", name, m.Name, err)
+		}
+	}
+}
+
+// luaStates returns the session's own Lua state and those of its modules
+func (s *Session) luaStates() []*lua.LState {
+	var states []*lua.LState
+	if s.LuaState != nil {
+		states = append(states, s.LuaState)
+	}
+	if s.Modules != nil {
+		for _, m := range s.Modules.Modules {
+			if m.LuaState != nil {
+				states = append(states, m.LuaState)
+			}
+		}
+	}
+	return states
+}
+
+// errLuaBudget is returned for a Lua call stopped for running too long
+var errLuaBudget = errors.New("exceeded its time budget")
+
+// callLua calls fn in L with args, leaving nret results on the stack. A
+// call that runs past the session's budget is stopped, reported in the
+// session as what in module, and returns errLuaBudget. A call made while
+// another is running in L shares the outer call's budget.
+func (s *Session) callLua(L *lua.LState, module, what string, fn *lua.LFunction, nret int, args ...lua.LValue) error {
+	var ctx context.Context
+	if L.Context() == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), s.Sandbox.budget())
+		L.SetContext(ctx)
+		defer func() {
+			L.RemoveContext()
+			cancel()
+		}()
+	}
+
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	err := L.PCall(len(args), nret, nil)
+	if err != nil && ctx != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		s.reportBudget(module, what)
+		return errLuaBudget
+	}
+	return err
+}
+
+// runLuaFile runs a file of module code in L under the session's budget,
+// returning the value the file returns
+func (s *Session) runLuaFile(L *lua.LState, module, path string) (lua.LValue, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return lua.LNil, err
+	}
+	fn, err := L.LoadString(string(content))
+	if err != nil {
+		return lua.LNil, err
+	}
+	if err := s.callLua(L, module, filepath.Base(path), fn, 1); err != nil {
+		return lua.LNil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return ret, nil
+}
+
+// reportBudget tells the user which module's code was stopped
+func (s *Session) reportBudget(module, what string) {
+	msg := fmt.Sprintf("Lua %s", what)
+	if module != "" {
+		msg += " in module " + module
+	}
+	msg += fmt.Sprintf(" ran longer than %v and was stopped", s.Sandbox.budget())
+	log.Print(msg)
+	s.Output(msg + "\n")
+}
@@ -0,0 +1,147 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// writeModule creates a module directory holding init.lua
+func writeModule(t *testing.T, dir, name, init string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "init.lua"), []byte(init), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newModuleTestSession() *Session {
+	return &Session{
+		Name:       "test",
+		Sub:        make(chan tea.Msg, 100),
+		Scrollback: NewScrollback(0),
+		Actions:    NewActionRegistry(),
+		Aliases:    NewAliasRegistry(),
+		Events:     NewEventRegistry(),
+		Modules:    NewModuleRegistry(),
+		Data:       map[string]interface{}{},
+	}
+}
+
+func luaGlobal(L *lua.LState, code string) string {
+	if err := L.DoString("result = " + code); err != nil {
+		return err.Error()
+	}
+	return L.GetGlobal("result").String()
+}
+
+func TestModuleStatesAreIsolated(t *testing.T) {
+	dir := t.TempDir()
+	s := newModuleTestSession()
+	for _, name := range []string{"one", "two"} {
+		path := writeModule(t, dir, name, `
+			owner = module.get_name()
+			session.register_alias("who_`+name+`", "^who `+name+`$", function()
+				session.output(owner .. "\n")
+			end)
+		`)
+		if err := LoadModule(s, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.dispatchInput("who one")
+	s.dispatchInput("who two")
+	if got := s.Scrollback.String(); got != "one\ntwo\n" {
+		t.Errorf("aliases saw owners %q", got)
+	}
+
+	L := s.Modules.Modules["one"].LuaState
+	for code, want := range map[string]string{
+		"type(io)":         "nil",
+		"type(os.execute)": "nil",
+		"type(os.time)":    "function",
+		"type(dofile)":     "nil",
+		"type(string.rep)": "function",
+	} {
+		if got := luaGlobal(L, code); got != want {
+			t.Errorf("%s = %s, want %s", code, got, want)
+		}
+	}
+}
+
+func TestTrustedModule(t *testing.T) {
+	s := newModuleTestSession()
+	s.Sandbox.Trusted = map[string]bool{"trusted": true}
+	if err := LoadModule(s, writeModule(t, t.TempDir(), "trusted", "")); err != nil {
+		t.Fatal(err)
+	}
+	if got := luaGlobal(s.Modules.Modules["trusted"].LuaState, "type(io.open)"); got != "function" {
+		t.Errorf("trusted module has io.open %s", got)
+	}
+}
+
+func TestLuaBudget(t *testing.T) {
+	s := newModuleTestSession()
+	s.Sandbox.Budget = 20 * time.Millisecond
+	path := writeModule(t, t.TempDir(), "spinner", `
+		session.register_trigger("spin", "^spin$", function()
+			while true do end
+		end)
+		session.register_alias("ok", "^ok$", function()
+			session.output("still working\n")
+		end)
+	`)
+	if err := LoadModule(s, path); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	s.matchActions("spin", "spin")
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("runaway trigger ran for %v", d)
+	}
+	s.dispatchInput("ok")
+
+	got := s.Scrollback.String()
+	if !strings.Contains(got, "Lua trigger spin in module spinner ran longer than 20ms") {
+		t.Errorf("budget not reported: %q", got)
+	}
+	if !strings.Contains(got, "still working") {
+		t.Error("module state unusable after a stopped call")
+	}
+
+	// A script gets a fresh budget each time it wakes
+	s.Scripts = NewScriptRegistry()
+	path = writeModule(t, t.TempDir(), "busy", `
+		session.spawn("loop", function()
+			session.wait_event("test.go")
+			while true do end
+		end)
+	`)
+	if err := LoadModule(s, path); err != nil {
+		t.Fatal(err)
+	}
+	s.FireEvent("test.go", TestEventData{BaseEvent: NewBaseEvent()})
+	if !strings.Contains(s.Scrollback.String(), "Lua script loop in module busy ran longer") {
+		t.Error("runaway script not reported")
+	}
+	if len(s.Scripts.Scripts) != 0 {
+		t.Error("stopped script is still registered")
+	}
+
+	// A runaway init.lua fails the load rather than hanging it
+	path = writeModule(t, t.TempDir(), "hang", "while true do end")
+	if err := LoadModule(s, path); err == nil {
+		t.Error("loading a module that never finishes succeeded")
+	}
+}
@@ -0,0 +1,262 @@
+package session
+
+import (
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// actionMatcher is a prefilter over the enabled triggers. Every trigger whose
+// regex requires a literal substring is indexed in an Aho-Corasick automaton,
+// so one pass over the line tells us which regexes can possibly match.
+// Triggers without a usable literal are always tested.
+type actionMatcher struct {
+	entries []matcherEntry  // in evaluation order: priority, then name
+	sets    [4]*ahoCorasick // indexed by matcherEntry.set
+	size    int             // number of actions when built, to catch direct map edits
+}
+
+// Literal sets: which text a literal is searched in.
+const (
+	setPlain     = iota // stripped line
+	setColor            // ANSI line
+	setPlainFold        // lower-cased stripped line
+	setColorFold        // lower-cased ANSI line
+)
+
+type matcherEntry struct {
+	name    string
+	set     int
+	literal int // index into sets[set], -1 if always tested
+}
+
+// requiredLiteral returns the longest literal that every match of pattern
+// must contain, or "" if there is none. If fold is true the literal comes from
+// a case-insensitive part of the pattern and is returned in lower case.
+func requiredLiteral(pattern string) (lit string, fold bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	return longestRequired(re.Simplify())
+}
+
+func literalOf(re *syntax.Regexp) (string, bool) {
+	if re.Flags&syntax.FoldCase == 0 {
+		return string(re.Rune), false
+	}
+	// Only ASCII literals can be folded reliably with foldLine.
+	for _, r := range re.Rune {
+		if r > unicode.MaxASCII {
+			return "", true
+		}
+	}
+	return strings.ToLower(string(re.Rune)), true
+}
+
+func longestRequired(re *syntax.Regexp) (string, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return literalOf(re)
+	case syntax.OpCapture, syntax.OpPlus:
+		return longestRequired(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return longestRequired(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		var best, run string
+		var bestFold, runFold bool
+		flush := func() {
+			if len(run) > len(best) {
+				best, bestFold = run, runFold
+			}
+			run = ""
+		}
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral {
+				lit, fold := literalOf(sub)
+				if lit != "" && (run == "" || fold == runFold) {
+					run += lit
+					runFold = fold
+					continue
+				}
+				flush()
+				run, runFold = lit, fold
+				continue
+			}
+			flush()
+			if lit, fold := longestRequired(sub); len(lit) > len(best) {
+				best, bestFold = lit, fold
+			}
+		}
+		flush()
+		return best, bestFold
+	}
+	return "", false
+}
+
+// foldLine lower-cases a line for the case-insensitive prefilter. The two
+// non-ASCII runes that fold to ASCII letters are mapped as well, so a line
+// that matches a (?i) regex always contains its lower-cased literal.
+func foldLine(line string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case 0x212A: // KELVIN SIGN
+			return 'k'
+		case 0x017F: // LATIN SMALL LETTER LONG S
+			return 's'
+		}
+		return unicode.ToLower(r)
+	}, line)
+}
+
+func newActionMatcher(actions map[string]Action) *actionMatcher {
+	m := &actionMatcher{size: len(actions)}
+
+	names := make([]string, 0, len(actions))
+	for name := range actions {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := actions[names[i]].Priority, actions[names[j]].Priority
+		if pi != pj {
+			return pi > pj
+		}
+		return names[i] < names[j]
+	})
+
+	var lits [4][]string
+	for _, name := range names {
+		a := actions[name]
+		e := matcherEntry{name: name, literal: -1}
+		if lit, fold := requiredLiteral(a.Pattern); lit != "" {
+			if a.Color {
+				e.set = setColor
+			}
+			if fold {
+				e.set += setPlainFold
+			}
+			e.literal = len(lits[e.set])
+			lits[e.set] = append(lits[e.set], lit)
+		}
+		m.entries = append(m.entries, e)
+	}
+
+	for i := range lits {
+		if len(lits[i]) > 0 {
+			m.sets[i] = newAhoCorasick(lits[i])
+		}
+	}
+	return m
+}
+
+// candidates returns, in evaluation order, the names of triggers whose
+// required literal occurs in the line (or which have none).
+func (m *actionMatcher) candidates(ansiLine, stripped string) []string {
+	texts := [4]func() string{
+		func() string { return stripped },
+		func() string { return ansiLine },
+		func() string { return foldLine(stripped) },
+		func() string { return foldLine(ansiLine) },
+	}
+	var seen [4][]bool
+	for i, ac := range m.sets {
+		if ac != nil {
+			seen[i] = ac.scan(texts[i]())
+		}
+	}
+
+	out := make([]string, 0, 8)
+	for _, e := range m.entries {
+		if e.literal >= 0 && !seen[e.set][e.literal] {
+			continue
+		}
+		out = append(out, e.name)
+	}
+	return out
+}
+
+// ahoCorasick is a byte-oriented Aho-Corasick automaton.
+type ahoCorasick struct {
+	next     []map[byte]int
+	fail     []int
+	out      [][]int
+	patterns int
+}
+
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	a := &ahoCorasick{
+		next:     []map[byte]int{{}},
+		fail:     []int{0},
+		out:      [][]int{nil},
+		patterns: len(patterns),
+	}
+
+	for id, p := range patterns {
+		node := 0
+		for i := 0; i < len(p); i++ {
+			child, ok := a.next[node][p[i]]
+			if !ok {
+				child = len(a.next)
+				a.next = append(a.next, map[byte]int{})
+				a.fail = append(a.fail, 0)
+				a.out = append(a.out, nil)
+				a.next[node][p[i]] = child
+			}
+			node = child
+		}
+		a.out[node] = append(a.out[node], id)
+	}
+
+	// Breadth-first pass to compute failure links and merge outputs.
+	queue := make([]int, 0, len(a.next))
+	for _, child := range a.next[0] {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for b, child := range a.next[node] {
+			queue = append(queue, child)
+			f := a.fail[node]
+			for {
+				if target, ok := a.next[f][b]; ok && target != child {
+					a.fail[child] = target
+					break
+				}
+				if f == 0 {
+					a.fail[child] = 0
+					break
+				}
+				f = a.fail[f]
+			}
+			a.out[child] = append(a.out[child], a.out[a.fail[child]]...)
+		}
+	}
+	return a
+}
+
+// scan reports which patterns occur in text.
+func (a *ahoCorasick) scan(text string) []bool {
+	seen := make([]bool, a.patterns)
+	node := 0
+	for i := 0; i < len(text); i++ {
+		b := text[i]
+		for {
+			if child, ok := a.next[node][b]; ok {
+				node = child
+				break
+			}
+			if node == 0 {
+				break
+			}
+			node = a.fail[node]
+		}
+		for _, id := range a.out[node] {
+			seen[id] = true
+		}
+	}
+	return seen
+}
@@ -0,0 +1,240 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"gopkg.in/yaml.v2"
+)
+
+// ModuleManifest describes a module. It comes from module.yaml in the
+// module's directory or, failing that, the table init.lua returns.
+type ModuleManifest struct {
+	Name         string   `yaml:"name"`
+	Version      string   `yaml:"version"`
+	Description  string   `yaml:"description"`
+	Author       string   `yaml:"author"`
+	Dependencies []string `yaml:"dependencies"` // modules loaded before this one
+	Plugins      []string `yaml:"plugins"`      // plugins the module needs
+
+	Settings map[string]ModuleSetting `yaml:"settings"` // options users change with #set
+}
+
+// moduleManifestFile is the optional manifest in a module's directory
+const moduleManifestFile = "module.yaml"
+
+// readModuleManifest reads a module's module.yaml, returning nil if it has
+// none
+func readModuleManifest(modulePath string) (*ModuleManifest, error) {
+	data, err := os.ReadFile(filepath.Join(modulePath, moduleManifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m ModuleManifest
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", moduleManifestFile, err)
+	}
+	return &m, nil
+}
+
+// manifestFromLua reads a manifest from the table init.lua returned
+func manifestFromLua(v lua.LValue) *ModuleManifest {
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return nil
+	}
+
+	str := func(key string) string {
+		if s, ok := t.RawGetString(key).(lua.LString); ok {
+			return string(s)
+		}
+		return ""
+	}
+	list := func(key string) []string {
+		var names []string
+		if l, ok := t.RawGetString(key).(*lua.LTable); ok {
+			l.ForEach(func(_, v lua.LValue) {
+				if s, ok := v.(lua.LString); ok {
+					names = append(names, string(s))
+				}
+			})
+		}
+		return names
+	}
+
+	m := &ModuleManifest{
+		Name:         str("name"),
+		Version:      str("version"),
+		Description:  str("description"),
+		Author:       str("author"),
+		Dependencies: list("dependencies"),
+		Plugins:      list("plugins"),
+	}
+	if settings, ok := t.RawGetString("settings").(*lua.LTable); ok {
+		m.Settings = make(map[string]ModuleSetting)
+		settings.ForEach(func(k, v lua.LValue) {
+			spec, ok := v.(*lua.LTable)
+			if !ok {
+				return
+			}
+			setting := ModuleSetting{
+				Type:        lua.LVAsString(spec.RawGetString("type")),
+				Description: lua.LVAsString(spec.RawGetString("description")),
+			}
+			if def := spec.RawGetString("default"); def != lua.LNil {
+				setting.Default = def.String()
+			}
+			m.Settings[k.String()] = setting
+		})
+	}
+	return m
+}
+
+// moduleNameFor returns the name a module in modulePath is known by: the name
+// in its manifest, or its directory name
+func moduleNameFor(modulePath string, manifest *ModuleManifest) string {
+	if manifest != nil && manifest.Name != "" {
+		return manifest.Name
+	}
+	return filepath.Base(modulePath)
+}
+
+// requires lists the modules and plugins a module needs, for display
+func (m ModuleManifest) requires() string {
+	needs := append([]string{}, m.Dependencies...)
+	for _, p := range m.Plugins {
+		needs = append(needs, "plugin "+p)
+	}
+	return strings.Join(needs, ", ")
+}
+
+// checkModuleRequirements reports the first dependency or plugin a module
+// needs that the session does not have
+func (s *Session) checkModuleRequirements(manifest *ModuleManifest) error {
+	if manifest == nil {
+		return nil
+	}
+	for _, dep := range manifest.Dependencies {
+		if _, ok := s.Modules.Modules[dep]; !ok {
+			return fmt.Errorf("requires module %s, which is not loaded", dep)
+		}
+	}
+	for _, name := range manifest.Plugins {
+		if !s.hasPlugin(name) {
+			return fmt.Errorf("requires plugin %s, which is not loaded", name)
+		}
+	}
+	return nil
+}
+
+// hasPlugin reports whether a plugin is loaded, matching its name without
+// regard to case
+func (s *Session) hasPlugin(name string) bool {
+	if s.Handler == nil || s.Handler.Plugins == nil {
+		return false
+	}
+	for key, p := range s.Handler.Plugins.Plugins {
+		if strings.EqualFold(key, name) || strings.EqualFold(p.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleCandidate is a module found on disk but not yet loaded
+type moduleCandidate struct {
+	name     string
+	path     string
+	manifest *ModuleManifest
+	err      error // reading the manifest failed
+}
+
+// findModules returns the modules in dirs by name. A module in a later
+// directory replaces one with the same name in an earlier one, so session
+// modules override global ones.
+func findModules(dirs ...string) map[string]*moduleCandidate {
+	found := make(map[string]*moduleCandidate)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if _, err := os.Stat(filepath.Join(path, "init.lua")); err != nil {
+				continue
+			}
+			manifest, err := readModuleManifest(path)
+			c := &moduleCandidate{name: moduleNameFor(path, manifest), path: path, manifest: manifest, err: err}
+			found[c.name] = c
+		}
+	}
+	return found
+}
+
+// orderModules sorts modules so each comes after its dependencies, with
+// names breaking ties. Modules caught in a dependency cycle are returned
+// separately.
+func orderModules(found map[string]*moduleCandidate) (ordered, cyclic []*moduleCandidate) {
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Only dependencies that were found hold a module back; a missing one
+	// is reported when the module loads
+	waiting := make(map[string]int)
+	dependents := make(map[string][]string)
+	for _, name := range names {
+		if m := found[name].manifest; m != nil {
+			for _, dep := range m.Dependencies {
+				if _, ok := found[dep]; ok && dep != name {
+					waiting[name]++
+					dependents[dep] = append(dependents[dep], name)
+				}
+			}
+		}
+	}
+
+	var ready []string
+	for _, name := range names {
+		if waiting[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+	done := make(map[string]bool)
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		done[name] = true
+		ordered = append(ordered, found[name])
+
+		var next []string
+		for _, d := range dependents[name] {
+			if waiting[d]--; waiting[d] == 0 {
+				next = append(next, d)
+			}
+		}
+		ready = append(ready, next...)
+		sort.Strings(ready)
+	}
+
+	for _, name := range names {
+		if !done[name] {
+			cyclic = append(cyclic, found[name])
+		}
+	}
+	return ordered, cyclic
+}
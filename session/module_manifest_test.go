@@ -0,0 +1,118 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeManifest gives a module a module.yaml
+func writeManifest(t *testing.T, path, manifest string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(path, moduleManifestFile), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleLoadOrder(t *testing.T) {
+	global, local := t.TempDir(), t.TempDir()
+	announce := func(name string) string { return `session.output("` + name + `\n")` }
+
+	writeManifest(t, writeModule(t, global, "alpha", announce("alpha")), "version: 1.0\ndependencies: [zeta]\n")
+	writeModule(t, global, "zeta", announce("zeta"))
+	writeManifest(t, writeModule(t, global, "beta", announce("beta")), "dependencies: [missing]\n")
+	writeManifest(t, writeModule(t, global, "gamma", announce("gamma")), "dependencies: [beta]\n")
+	writeManifest(t, writeModule(t, global, "c1", announce("c1")), "dependencies: [c2]\n")
+	writeManifest(t, writeModule(t, global, "c2", announce("c2")), "dependencies: [c1]\n")
+	writeModule(t, global, "shared", announce("global shared"))
+	sessionShared := writeModule(t, local, "shared", announce("session shared"))
+
+	s := newModuleTestSession()
+	if err := loadModulesFromDirs(s, global, local); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.Scrollback.String(); got != "session shared\nzeta\nalpha\n" {
+		t.Errorf("modules loaded as %q", got)
+	}
+	if m := s.Modules.Modules["shared"]; m == nil || m.Path != sessionShared {
+		t.Error("session module did not replace the global one")
+	}
+	if v := s.Modules.Modules["alpha"].Manifest.Version; v != "1.0" {
+		t.Errorf("alpha version %q", v)
+	}
+	for name, reason := range map[string]string{
+		"beta":  "requires module missing",
+		"gamma": "requires module beta",
+		"c1":    "dependency cycle",
+		"c2":    "dependency cycle",
+	} {
+		if got := s.Modules.Refused[name]; !strings.Contains(got, reason) {
+			t.Errorf("%s refused with %q, want %q", name, got, reason)
+		}
+		if _, ok := s.Modules.Modules[name]; ok {
+			t.Errorf("%s was loaded", name)
+		}
+	}
+}
+
+func TestModuleManifestFromInit(t *testing.T) {
+	dir := t.TempDir()
+	s := newModuleTestSession()
+
+	path := writeModule(t, dir, "described", `
+		return {
+			version = "2.1",
+			description = "Says hello",
+			author = "Someone",
+		}
+	`)
+	if err := LoadModule(s, path); err != nil {
+		t.Fatal(err)
+	}
+	if m := s.Modules.Modules["described"].Manifest; m.Version != "2.1" || m.Author != "Someone" {
+		t.Errorf("manifest from init.lua = %+v", m)
+	}
+	CmdModules(s, "info described")
+	if got := s.Scrollback.String(); !strings.Contains(got, "Description:  Says hello") {
+		t.Errorf("#modules info showed %q", got)
+	}
+
+	// A requirement declared by init.lua is checked once it has run
+	path = writeModule(t, dir, "needy", `
+		session.register_alias("hi", "^hi$", function() end)
+		return { dependencies = { "absent" } }
+	`)
+	if err := LoadModule(s, path); err == nil {
+		t.Error("module with a missing dependency loaded")
+	}
+	if _, ok := s.Aliases.Aliases["hi"]; ok {
+		t.Error("refused module's alias was left behind")
+	}
+	if _, ok := s.Modules.Refused["needy"]; !ok {
+		t.Error("refused module not listed")
+	}
+}
+
+func TestModuleRequiresPlugin(t *testing.T) {
+	path := writeModule(t, t.TempDir(), "mapper", "")
+	writeManifest(t, path, "name: Mapper\nplugins: [kallisti]\n")
+
+	s := newModuleTestSession()
+	if err := LoadModule(s, path); err == nil || !strings.Contains(err.Error(), "requires plugin kallisti") {
+		t.Errorf("loading without the plugin: %v", err)
+	}
+
+	s.Handler = &SessionHandler{Plugins: NewPluginRegistry()}
+	s.Handler.Plugins.Plugins["kallisti"] = PluginInfo{Name: "Kallisti"}
+	if err := LoadModule(s, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Modules.Modules["Mapper"]; !ok {
+		t.Error("module not known by its manifest name")
+	}
+	if _, ok := s.Modules.Refused["Mapper"]; ok {
+		t.Error("loaded module still listed as refused")
+	}
+}
@@ -0,0 +1,178 @@
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reloadModuleV1 = `
+	session.register_trigger("greet", "^hello$", function()
+		session.output("v1\n")
+	end)
+	session.register_alias("hi", "^hi$", function()
+		session.output("alias v1\n")
+	end)
+	session.register_event("test.go", function()
+		session.output("event v1\n")
+	end)
+	session.add_timer("tick", 60000, function() end)
+`
+
+func newReloadTestSession(t *testing.T) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := newModuleTestSession()
+	s.Context = ctx
+	NewTickerRegistry(ctx, s)
+	return s
+}
+
+func TestReloadModule(t *testing.T) {
+	s := newReloadTestSession(t)
+	path := writeModule(t, t.TempDir(), "greeter", reloadModuleV1)
+	if err := LoadModule(s, path); err != nil {
+		t.Fatal(err)
+	}
+
+	v2 := strings.ReplaceAll(reloadModuleV1, "v1", "v2")
+	v2 = strings.ReplaceAll(v2, `session.add_timer("tick", 60000, function() end)`, "")
+	if err := os.WriteFile(filepath.Join(path, "init.lua"), []byte(v2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadModule("greeter"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.matchActions("hello", "hello")
+	s.dispatchInput("hi")
+	s.FireEvent("test.go", TestEventData{BaseEvent: NewBaseEvent()})
+	if got := s.Scrollback.String(); got != "v2\nalias v2\nevent v2\n" {
+		t.Errorf("after reload got %q", got)
+	}
+	if n := len(s.Actions.Actions); n != 1 {
+		t.Errorf("%d triggers after reload, want 1", n)
+	}
+	if _, ok := s.Tickers.Entries["tick"]; ok {
+		t.Error("timer dropped from the module survived the reload")
+	}
+
+	// A disabled module stays disabled
+	s.DisableModule("greeter")
+	if err := s.ReloadModule("greeter"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Modules.Modules["greeter"].Enabled || s.Aliases.Aliases["hi"].Enabled {
+		t.Error("reload enabled a disabled module")
+	}
+}
+
+func TestReloadModuleError(t *testing.T) {
+	s := newReloadTestSession(t)
+	path := writeModule(t, t.TempDir(), "broken", reloadModuleV1)
+	if err := LoadModule(s, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "init.lua"), []byte("session.output("), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	CmdModules(s, "reload broken")
+	if got := s.Scrollback.String(); !strings.Contains(got, "Error reloading module broken") {
+		t.Errorf("syntax error not reported: %q", got)
+	}
+	if len(s.Actions.Actions) != 0 || len(s.Aliases.Aliases) != 0 {
+		t.Error("the old module's triggers and aliases were left behind")
+	}
+	// It stays listed so that a fixed version can be reloaded
+	if _, ok := s.Modules.Modules["broken"]; !ok {
+		t.Error("module forgotten after a failed reload")
+	}
+}
+
+func TestWatchModules(t *testing.T) {
+	s := newReloadTestSession(t)
+	path := writeModule(t, t.TempDir(), "watched", `session.output("init ran\n")`)
+	if err := LoadModule(s, path); err != nil {
+		t.Fatal(err)
+	}
+
+	CmdModules(s, "watch on")
+	if !s.WatchingModules() {
+		t.Fatal("#modules watch on did not start the watcher")
+	}
+
+	s.reloadChangedModules()
+	if got := strings.Count(s.Scrollback.String(), "init ran"); got != 1 {
+		t.Fatalf("unchanged module reloaded, init ran %d times", got)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(path, "init.lua"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadChangedModules()
+	got := s.Scrollback.String()
+	if strings.Count(got, "init ran") != 2 || !strings.Contains(got, "Module watched changed, reloaded") {
+		t.Errorf("changed module not reloaded: %q", got)
+	}
+
+	CmdModules(s, "watch off")
+	if s.WatchingModules() {
+		t.Error("#modules watch off left the watcher running")
+	}
+}
+
+func TestReloadRefusedModule(t *testing.T) {
+	s := newReloadTestSession(t)
+	path := writeModule(t, t.TempDir(), "greeter", reloadModuleV1)
+	writeManifest(t, path, "version: 1.0.0\n")
+	if err := LoadModule(s, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A half-written module.yaml keeps the loaded version running
+	writeManifest(t, path, "version: [1.0\n")
+	if err := s.ReloadModule("greeter"); err == nil || !strings.Contains(err.Error(), "keeping the loaded version") {
+		t.Errorf("reload with a broken module.yaml: %v", err)
+	}
+	s.matchActions("hello", "hello")
+	if !strings.Contains(s.Scrollback.String(), "v1") {
+		t.Error("module stopped working after a refused reload")
+	}
+
+	// A module refused by the manifest init.lua returns can still be
+	// reloaded, and the watcher loads it once it is fixed
+	os.Remove(filepath.Join(path, "module.yaml"))
+	needy := reloadModuleV1 + `return {dependencies = {"missing"}}`
+	if err := os.WriteFile(filepath.Join(path, "init.lua"), []byte(needy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadModule("greeter"); err == nil || !strings.Contains(err.Error(), "requires module missing") {
+		t.Errorf("reload with a missing dependency: %v", err)
+	}
+	if _, ok := s.Modules.Modules["greeter"]; ok {
+		t.Fatal("refused module still loaded")
+	}
+	if err := s.ReloadModule("greeter"); err == nil || strings.Contains(err.Error(), "not found") {
+		t.Errorf("refused module could not be reloaded: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(path, "init.lua"), []byte(reloadModuleV1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(path, "init.lua"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadChangedModules()
+	if _, ok := s.Modules.Modules["greeter"]; !ok || !strings.Contains(s.Scrollback.String(), "Module greeter changed, loaded") {
+		t.Errorf("fixed module not loaded by the watcher: %q", s.Scrollback.String())
+	}
+	if _, ok := s.Modules.Refused["greeter"]; ok {
+		t.Error("loaded module still listed as refused")
+	}
+}
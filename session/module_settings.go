@@ -0,0 +1,233 @@
+package session
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/evertras/bubble-table/table"
+	"github.com/perlsaiyan/zif/config"
+)
+
+// ModuleSetting is an option a module declares for users to change with
+// #set. Type is "string" (the default), "number" or "boolean". A setting
+// without a default has no value until one is set.
+type ModuleSetting struct {
+	Type        string `yaml:"type"`
+	Default     string `yaml:"default"`
+	Description string `yaml:"description"`
+}
+
+// parse converts a value typed by the user to the setting's type
+func (m ModuleSetting) parse(value string) (interface{}, error) {
+	switch m.Type {
+	case "", "string":
+		return value, nil
+	case "number":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return n, nil
+	case "boolean":
+		switch strings.ToLower(value) {
+		case "true", "on", "yes", "1":
+			return true, nil
+		case "false", "off", "no", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("%q is not on or off", value)
+	}
+	return nil, fmt.Errorf("unknown setting type %q", m.Type)
+}
+
+// validateSettings checks that each setting has a known type and a default
+// of that type
+func (m *ModuleManifest) validateSettings() error {
+	for key, setting := range m.Settings {
+		if strings.ContainsAny(key, ". ") {
+			return fmt.Errorf("setting %q: names cannot contain dots or spaces", key)
+		}
+		switch setting.Type {
+		case "", "string", "number", "boolean":
+		default:
+			return fmt.Errorf("setting %s has unknown type %q", key, setting.Type)
+		}
+		if setting.Default == "" {
+			continue
+		}
+		if _, err := setting.parse(setting.Default); err != nil {
+			return fmt.Errorf("setting %s: default %v", key, err)
+		}
+	}
+	return nil
+}
+
+// settings returns the values set with #set, loading them from the
+// session's settings.yaml the first time
+func (s *Session) settings() *config.SettingsConfig {
+	if s.moduleSettings == nil {
+		cfg, err := config.LoadSessionSettings(s.Name)
+		if err != nil {
+			log.Printf("Failed to load settings for session %s: %v", s.Name, err)
+			cfg = &config.SettingsConfig{Modules: make(map[string]map[string]string)}
+		}
+		s.moduleSettings = cfg
+	}
+	return s.moduleSettings
+}
+
+// ModuleSetting returns a module's setting as a string, number or bool: the
+// value set with #set, or else the declared default. It reports false if
+// the module has no such setting or no value for it.
+func (s *Session) ModuleSetting(moduleName, key string) (interface{}, bool) {
+	module, ok := s.Modules.Modules[moduleName]
+	if !ok {
+		return nil, false
+	}
+	setting, ok := module.Manifest.Settings[key]
+	if !ok {
+		return nil, false
+	}
+
+	if value, ok := s.settings().Modules[moduleName][key]; ok {
+		v, err := setting.parse(value)
+		if err == nil {
+			return v, true
+		}
+		log.Printf("Ignoring saved setting %s.%s: %v", moduleName, key, err)
+	}
+	if setting.Default == "" {
+		return nil, false
+	}
+	v, err := setting.parse(setting.Default)
+	return v, err == nil
+}
+
+// SetModuleSetting changes a module's setting, saves it with the session's
+// settings and fires EventSettingChange
+func (s *Session) SetModuleSetting(moduleName, key, value string) error {
+	module, ok := s.Modules.Modules[moduleName]
+	if !ok {
+		return fmt.Errorf("module %s not found", moduleName)
+	}
+	setting, ok := module.Manifest.Settings[key]
+	if !ok {
+		return fmt.Errorf("module %s has no setting %s", moduleName, key)
+	}
+	v, err := setting.parse(value)
+	if err != nil {
+		return err
+	}
+
+	old, _ := s.ModuleSetting(moduleName, key)
+	cfg := s.settings()
+	if cfg.Modules[moduleName] == nil {
+		cfg.Modules[moduleName] = make(map[string]string)
+	}
+	cfg.Modules[moduleName][key] = value
+	if err := config.SaveSessionSettings(s.Name, cfg); err != nil {
+		log.Printf("Failed to save settings for session %s: %v", s.Name, err)
+		s.Output(fmt.Sprintf("Setting changed but not saved: %v\n", err))
+	}
+
+	s.FireEvent(EventSettingChange, SettingChangeEvent{
+		BaseEvent: NewBaseEvent(),
+		Module:    moduleName,
+		Key:       key,
+		Value:     v,
+		Old:       old,
+	})
+	return nil
+}
+
+// CmdSet changes a module setting: #set <module>.<key> <value>
+func CmdSet(s *Session, cmd string) {
+	target, value, _ := strings.Cut(strings.TrimSpace(cmd), " ")
+	moduleName, key, ok := strings.Cut(target, ".")
+	if !ok || moduleName == "" || key == "" {
+		s.Output("Usage: #set <module>.<setting> <value>\n")
+		return
+	}
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		if v, ok := s.ModuleSetting(moduleName, key); ok {
+			s.Output(fmt.Sprintf("%s.%s = %v\n", moduleName, key, v))
+		} else {
+			s.Output(fmt.Sprintf("%s.%s is not set\n", moduleName, key))
+		}
+		return
+	}
+
+	if err := s.SetModuleSetting(moduleName, key, value); err != nil {
+		s.Output(fmt.Sprintf("Error setting %s.%s: %v\n", moduleName, key, err))
+		return
+	}
+	v, _ := s.ModuleSetting(moduleName, key)
+	s.Output(fmt.Sprintf("%s.%s = %v\n", moduleName, key, v))
+}
+
+// CmdSettings lists the settings of one module, or of every module
+func CmdSettings(s *Session, cmd string) {
+	var names []string
+	if name := strings.TrimSpace(cmd); name != "" {
+		if _, ok := s.Modules.Modules[name]; !ok {
+			s.Output(fmt.Sprintf("Module %s not found\n", name))
+			return
+		}
+		names = []string{name}
+	} else {
+		for name := range s.Modules.Modules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var rows []table.Row
+	for _, name := range names {
+		module := s.Modules.Modules[name]
+		keys := make([]string, 0, len(module.Manifest.Settings))
+		for key := range module.Manifest.Settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			setting := module.Manifest.Settings[key]
+			value := ""
+			if v, ok := s.ModuleSetting(name, key); ok {
+				value = fmt.Sprint(v)
+			}
+			typ := setting.Type
+			if typ == "" {
+				typ = "string"
+			}
+			rows = append(rows, table.NewRow(table.RowData{
+				"setting":     name + "." + key,
+				"type":        typ,
+				"value":       value,
+				"default":     setting.Default,
+				"description": setting.Description,
+			}))
+		}
+	}
+	if len(rows) == 0 {
+		s.Output("No module settings\n")
+		return
+	}
+
+	t := table.New([]table.Column{
+		table.NewColumn("setting", "Setting", 30).WithStyle(lipgloss.NewStyle().Align(lipgloss.Left)),
+		table.NewColumn("type", "Type", 9).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("value", "Value", 15).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("default", "Default", 15).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("description", "Description", 40).WithStyle(lipgloss.NewStyle().Align(lipgloss.Left)),
+	}).
+		WithRows(rows).
+		BorderRounded()
+
+	s.Output(t.View() + "\n")
+}
@@ -0,0 +1,94 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const healerManifest = `settings:
+  heal_at:
+    type: number
+    default: 50
+    description: Heal below this percentage
+  spell:
+    default: cure light
+  auto:
+    type: boolean
+`
+
+const healerInit = `
+	session.register_alias("status", "^status$", function()
+		session.output(string.format("heal at %d with %s, auto %s\n",
+			module:setting("heal_at"), module:setting("spell"), tostring(module:setting("auto"))))
+	end)
+	session.register_event("core.setting_change", function(data)
+		if data.module == module.get_name() then
+			session.output(data.key .. " changed from " .. tostring(data.old) .. " to " .. tostring(data.value) .. "\n")
+		end
+	end)
+`
+
+func TestModuleSettings(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	path := writeModule(t, t.TempDir(), "Healer", healerInit)
+	writeManifest(t, path, healerManifest)
+
+	s := newModuleTestSession()
+	if err := LoadModule(s, path); err != nil {
+		t.Fatal(err)
+	}
+
+	s.dispatchInput("status")
+	CmdSet(s, "Healer.heal_at 35")
+	CmdSet(s, "Healer.auto on")
+	CmdSet(s, "Healer.heal_at lots")
+	CmdSet(s, "Healer.nope 1")
+	s.dispatchInput("status")
+
+	got := s.Scrollback.String()
+	for _, want := range []string{
+		"heal at 50 with cure light, auto nil",
+		"heal_at changed from 50 to 35",
+		"auto changed from nil to true",
+		`Error setting Healer.heal_at: "lots" is not a number`,
+		"Error setting Healer.nope: module Healer has no setting nope",
+		"heal at 35 with cure light, auto true",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q:\n%s", want, got)
+		}
+	}
+
+	// Values are saved with the session and survive a reload
+	data, err := os.ReadFile(filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "zif", "sessions", "test", "settings.yaml"))
+	if err != nil || !strings.Contains(string(data), "heal_at: \"35\"") {
+		t.Errorf("settings.yaml = %q, %v", data, err)
+	}
+	fresh := newModuleTestSession()
+	if err := LoadModule(fresh, path); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := fresh.ModuleSetting("Healer", "heal_at"); v != 35.0 {
+		t.Errorf("saved heal_at read back as %v", v)
+	}
+
+	s.Scrollback = NewScrollback(0)
+	CmdSettings(s, "Healer")
+	for _, want := range []string{"Healer.heal_at", "Heal below this percentage", "cure light"} {
+		if !strings.Contains(s.Scrollback.String(), want) {
+			t.Errorf("#settings missing %q", want)
+		}
+	}
+}
+
+func TestModuleSettingsValidated(t *testing.T) {
+	path := writeModule(t, t.TempDir(), "bad", "")
+	writeManifest(t, path, "settings:\n  level:\n    type: number\n    default: high\n")
+
+	s := newModuleTestSession()
+	if err := LoadModule(s, path); err == nil || !strings.Contains(err.Error(), `"high" is not a number`) {
+		t.Errorf("bad default loaded: %v", err)
+	}
+}
@@ -1,18 +1,24 @@
 package session
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/perlsaiyan/zif/config"
+	"github.com/perlsaiyan/zif/layout"
 	lua "github.com/yuin/gopher-lua"
 )
 
-// Module represents a loaded Lua module
+// Module represents a loaded Lua module. Each module runs in its own Lua
+// state, so its globals are its own.
 type Module struct {
 	Name     string
 	Path     string
@@ -20,18 +26,56 @@ type Module struct {
 	Triggers []string
 	Aliases  []string
 	Timers   []string
+	Events   []string       // events with a handler from the module
+	Panes    []string       // panes the module split off
+	Progress []string       // panes the module put a progress bar in
+	Commands []string       // #commands the module registered
+	Manifest ModuleManifest // name, version and requirements, if the module declares them
+	LuaState *lua.LState
+
+	modTime  time.Time // newest file in the module when it was loaded
+	disabled []Command // the module's commands, removed while it is disabled
 }
 
 // ModuleRegistry tracks all loaded modules for a session
 type ModuleRegistry struct {
 	Modules map[string]*Module
+	Refused map[string]string // modules that were not loaded, with the reason
+
+	refusedAt map[string]refusedModule // where refused modules are, so a fix can be loaded
+}
+
+// refusedModule is a module that was not loaded, and when its files last
+// changed, so the watcher can retry it once they change again
+type refusedModule struct {
+	path    string
+	modTime time.Time
 }
 
 // NewModuleRegistry creates a new module registry
 func NewModuleRegistry() *ModuleRegistry {
 	return &ModuleRegistry{
 		Modules: make(map[string]*Module),
+		Refused: make(map[string]string),
+
+		refusedAt: make(map[string]refusedModule),
+	}
+}
+
+// LoadModules loads the global modules and those of the named session, in
+// dependency order. A session module replaces a global module with the same
+// name.
+func LoadModules(s *Session, sessionName string) error {
+	globalModulesDir, err := config.GetGlobalModulesDir()
+	if err != nil {
+		return fmt.Errorf("failed to get global modules directory: %v", err)
+	}
+	sessionModulesDir, err := config.GetSessionModulesDir(sessionName)
+	if err != nil {
+		return fmt.Errorf("failed to get session modules directory: %v", err)
 	}
+
+	return loadModulesFromDirs(s, globalModulesDir, sessionModulesDir)
 }
 
 // LoadGlobalModules loads all modules from the global modules directory
@@ -41,7 +85,7 @@ func LoadGlobalModules(s *Session) error {
 		return fmt.Errorf("failed to get global modules directory: %v", err)
 	}
 
-	return loadModulesFromDir(s, globalModulesDir)
+	return loadModulesFromDirs(s, globalModulesDir)
 }
 
 // LoadSessionModules loads all modules from a session's modules directory
@@ -51,55 +95,88 @@ func LoadSessionModules(s *Session, sessionName string) error {
 		return fmt.Errorf("failed to get session modules directory: %v", err)
 	}
 
-	return loadModulesFromDir(s, sessionModulesDir)
+	return loadModulesFromDirs(s, sessionModulesDir)
 }
 
-// loadModulesFromDir discovers and loads modules from a directory
-func loadModulesFromDir(s *Session, dir string) error {
-	// Check if directory exists
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		// Directory doesn't exist, that's okay
-		return nil
-	}
+// loadModulesFromDirs discovers the modules in dirs and loads them so that
+// each follows its dependencies. A module in a later directory replaces one
+// of the same name in an earlier directory.
+func loadModulesFromDirs(s *Session, dirs ...string) error {
+	ordered, cyclic := orderModules(findModules(dirs...))
 
-	// Read directory entries
-	entries, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return fmt.Errorf("failed to read modules directory %s: %v", dir, err)
+	for _, c := range cyclic {
+		s.refuseModule(c.name, c.path, fmt.Errorf("module %s is part of a dependency cycle", c.name))
 	}
 
-	// Find all directories that contain init.lua
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-
-		modulePath := filepath.Join(dir, entry.Name())
-		initPath := filepath.Join(modulePath, "init.lua")
-
-		// Check if init.lua exists
-		if _, err := os.Stat(initPath); os.IsNotExist(err) {
+	for _, c := range ordered {
+		if c.err != nil {
+			s.refuseModule(c.name, c.path, fmt.Errorf("module %s: %v", c.name, c.err))
 			continue
 		}
-
-		// Load the module
-		if err := LoadModule(s, modulePath); err != nil {
-			log.Printf("Failed to load module %s: %v", entry.Name(), err)
-			continue
+		if err := LoadModule(s, c.path); err != nil {
+			log.Printf("Failed to load module %s: %v", c.name, err)
 		}
 	}
 
 	return nil
 }
 
-// LoadModule loads a single module from a directory path
+// refuseModule records why a module was not loaded
+func (s *Session) refuseModule(name, path string, err error) {
+	log.Printf("Refusing module %s: %v", name, err)
+	s.refuse(name, path, err.Error())
+	s.FireEvent(EventModuleLoad, ModuleLoadEvent{BaseEvent: NewBaseEvent(), Module: name, Path: path, Error: err.Error()})
+}
+
+// refuse records a module as not loaded, remembering where it is so that
+// #modules reload and the watcher can try it again
+func (s *Session) refuse(name, path, reason string) {
+	s.Modules.Refused[name] = reason
+	s.Modules.refusedAt[name] = refusedModule{path: path, modTime: moduleModTime(path)}
+}
+
+// LoadModule loads a single module from a directory path, replacing any
+// loaded module with the same name. A module whose dependencies or plugins
+// are not loaded is refused.
 func LoadModule(s *Session, modulePath string) error {
-	moduleName := filepath.Base(modulePath)
+	name, err := loadModule(s, modulePath)
+	evt := ModuleLoadEvent{BaseEvent: NewBaseEvent(), Module: name, Path: modulePath}
+	if err != nil {
+		evt.Error = err.Error()
+	}
+	s.FireEvent(EventModuleLoad, evt)
+	return err
+}
+
+func loadModule(s *Session, modulePath string) (string, error) {
 	initPath := filepath.Join(modulePath, "init.lua")
 
 	// Check if init.lua exists
 	if _, err := os.Stat(initPath); os.IsNotExist(err) {
-		return fmt.Errorf("init.lua not found in %s", modulePath)
+		return filepath.Base(modulePath), fmt.Errorf("init.lua not found in %s", modulePath)
+	}
+
+	manifest, err := readModuleManifest(modulePath)
+	moduleName := moduleNameFor(modulePath, manifest)
+	if err == nil && manifest != nil {
+		err = manifest.validateSettings()
+	}
+	if err != nil {
+		s.refuse(moduleName, modulePath, err.Error())
+		return moduleName, fmt.Errorf("module %s: %v", moduleName, err)
+	}
+	if err := s.checkModuleRequirements(manifest); err != nil {
+		s.refuse(moduleName, modulePath, err.Error())
+		return moduleName, fmt.Errorf("module %s %v", moduleName, err)
+	}
+	delete(s.Modules.Refused, moduleName)
+	delete(s.Modules.refusedAt, moduleName)
+
+	// A module of the same name, such as a global module overridden by a
+	// session module, is torn down first
+	if old, ok := s.Modules.Modules[moduleName]; ok {
+		log.Printf("Module %s at %s replaces %s", moduleName, modulePath, old.Path)
+		s.unloadModule(old)
 	}
 
 	// Create module entry
@@ -110,54 +187,70 @@ func LoadModule(s *Session, modulePath string) error {
 		Triggers: make([]string, 0),
 		Aliases:  make([]string, 0),
 		Timers:   make([]string, 0),
+		modTime:  moduleModTime(modulePath),
+	}
+	if manifest != nil {
+		module.Manifest = *manifest
 	}
 
 	// Register module before loading (so it can track registrations)
 	s.Modules.Modules[moduleName] = module
 
-	// Set current module context
-	SetCurrentModule(s.LuaState, moduleName)
+	// Give the module its own sandboxed state, with the session API and
+	// the module's name registered
+	module.LuaState = s.newModuleState(module)
 
-	// Register Lua API if not already done
-	if s.LuaState.GetGlobal("session").Type() == lua.LTNil {
-		s.RegisterLuaAPI()
-	}
-
-	// Read and execute init.lua
-	initContent, err := ioutil.ReadFile(initPath)
+	// Execute init.lua
+	ret, err := s.runLuaFile(module.LuaState, moduleName, initPath)
 	if err != nil {
-		return fmt.Errorf("failed to read init.lua: %v", err)
+		return moduleName, fmt.Errorf("failed to execute init.lua: %v", err)
 	}
 
-	// Execute init.lua
-	if err := s.LuaState.DoString(string(initContent)); err != nil {
-		return fmt.Errorf("failed to execute init.lua: %v", err)
+	// Without a module.yaml, init.lua may return the manifest. It is read
+	// too late to order the module, but its requirements are still checked.
+	if manifest == nil {
+		if m := manifestFromLua(ret); m != nil {
+			if m.Name != "" && m.Name != moduleName {
+				log.Printf("Module %s: init.lua names it %s; use module.yaml to rename a module", moduleName, m.Name)
+			}
+			m.Name = moduleName
+			module.Manifest = *m
+			err := m.validateSettings()
+			if err == nil {
+				err = s.checkModuleRequirements(m)
+			}
+			if err != nil {
+				s.unloadModule(module)
+				s.refuse(moduleName, modulePath, err.Error())
+				return moduleName, fmt.Errorf("module %s %v", moduleName, err)
+			}
+		}
 	}
 
 	// Load triggers, aliases, and scripts from subdirectories
-	if err := loadModuleSubdirs(s, modulePath, moduleName); err != nil {
+	if err := loadModuleSubdirs(s, module); err != nil {
 		log.Printf("Warning: failed to load subdirectories for module %s: %v", moduleName, err)
+		return moduleName, err
 	}
 
 	log.Printf("Loaded module: %s from %s", moduleName, modulePath)
-	return nil
+	return moduleName, nil
 }
 
-// loadModuleSubdirs loads triggers/, aliases/, and scripts/ subdirectories
-func loadModuleSubdirs(s *Session, modulePath string, moduleName string) error {
+// loadModuleSubdirs loads triggers/, aliases/, and scripts/ subdirectories,
+// returning the errors from any files that failed
+func loadModuleSubdirs(s *Session, module *Module) error {
+	modulePath := module.Path
+	var errs []error
 	// Load triggers
 	triggersDir := filepath.Join(modulePath, "triggers")
 	if entries, err := ioutil.ReadDir(triggersDir); err == nil {
 		for _, entry := range entries {
 			if strings.HasSuffix(entry.Name(), ".lua") {
 				triggerPath := filepath.Join(triggersDir, entry.Name())
-				content, err := ioutil.ReadFile(triggerPath)
-				if err != nil {
-					log.Printf("Failed to read trigger %s: %v", triggerPath, err)
-					continue
-				}
-				if err := s.LuaState.DoString(string(content)); err != nil {
+				if _, err := s.runLuaFile(module.LuaState, module.Name, triggerPath); err != nil {
 					log.Printf("Failed to execute trigger %s: %v", triggerPath, err)
+					errs = append(errs, fmt.Errorf("%s: %v", entry.Name(), err))
 				}
 			}
 		}
@@ -169,13 +262,9 @@ func loadModuleSubdirs(s *Session, modulePath string, moduleName string) error {
 		for _, entry := range entries {
 			if strings.HasSuffix(entry.Name(), ".lua") {
 				aliasPath := filepath.Join(aliasesDir, entry.Name())
-				content, err := ioutil.ReadFile(aliasPath)
-				if err != nil {
-					log.Printf("Failed to read alias %s: %v", aliasPath, err)
-					continue
-				}
-				if err := s.LuaState.DoString(string(content)); err != nil {
+				if _, err := s.runLuaFile(module.LuaState, module.Name, aliasPath); err != nil {
 					log.Printf("Failed to execute alias %s: %v", aliasPath, err)
+					errs = append(errs, fmt.Errorf("%s: %v", entry.Name(), err))
 				}
 			}
 		}
@@ -187,19 +276,15 @@ func loadModuleSubdirs(s *Session, modulePath string, moduleName string) error {
 		for _, entry := range entries {
 			if strings.HasSuffix(entry.Name(), ".lua") {
 				scriptPath := filepath.Join(scriptsDir, entry.Name())
-				content, err := ioutil.ReadFile(scriptPath)
-				if err != nil {
-					log.Printf("Failed to read script %s: %v", scriptPath, err)
-					continue
-				}
-				if err := s.LuaState.DoString(string(content)); err != nil {
+				if _, err := s.runLuaFile(module.LuaState, module.Name, scriptPath); err != nil {
 					log.Printf("Failed to execute script %s: %v", scriptPath, err)
+					errs = append(errs, fmt.Errorf("%s: %v", entry.Name(), err))
 				}
 			}
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 // EnableModule enables a module and all its triggers/aliases/timers
@@ -231,6 +316,12 @@ func (s *Session) EnableModule(moduleName string) error {
 		}
 	}
 
+	// Restore its commands
+	for _, c := range module.disabled {
+		s.AddCommand(c, "")
+	}
+	module.disabled = nil
+
 	// Timers are automatically enabled when added to TickerRegistry
 	log.Printf("Enabled module: %s", moduleName)
 	return nil
@@ -270,7 +361,211 @@ func (s *Session) DisableModule(moduleName string) error {
 		s.RemoveLuaTimer(timerName)
 	}
 
+	// Remove its commands until it is enabled again
+	for _, name := range module.Commands {
+		if c, ok := s.commands[name]; ok && c.Module == module.Name {
+			module.disabled = append(module.disabled, c)
+			s.RemoveCommand(name)
+		}
+	}
+
 	log.Printf("Disabled module: %s", moduleName)
 	return nil
 }
 
+// moduleOf returns the module whose code is running in L, if any
+func (s *Session) moduleOf(L *lua.LState) *Module {
+	if s.Modules == nil {
+		return nil
+	}
+	return s.Modules.Modules[GetCurrentModule(L)]
+}
+
+// without returns names with name removed
+func without(names []string, name string) []string {
+	for i, n := range names {
+		if n == name {
+			return append(names[:i], names[i+1:]...)
+		}
+	}
+	return names
+}
+
+// unloadModule removes everything a module registered (triggers, aliases,
+// event handlers, timers, commands, scripts, panes and progress bars) and
+// forgets it.
+// Its Lua state is left to the garbage collector rather than closed, as
+// queued commands may still hold conditions that call into it.
+func (s *Session) unloadModule(m *Module) {
+	for _, name := range m.Triggers {
+		if _, ok := s.Actions.Actions[name]; ok {
+			s.RemoveAction(name)
+		}
+	}
+	for _, name := range m.Aliases {
+		if _, ok := s.Aliases.Aliases[name]; ok {
+			s.RemoveAlias(name)
+		}
+	}
+	for _, hook := range m.Events {
+		s.RemoveEvent(hook, "Lua:"+m.Name+":"+hook)
+	}
+	for _, name := range m.Timers {
+		s.RemoveLuaTimer(name)
+	}
+	for _, name := range m.Commands {
+		if c, ok := s.commands[name]; ok && c.Module == m.Name {
+			s.RemoveCommand(name)
+		}
+	}
+	if s.Scripts != nil {
+		var scripts []string
+		s.Scripts.mu.Lock()
+		for name, sc := range s.Scripts.Scripts {
+			if sc.Module == m.Name {
+				scripts = append(scripts, name)
+			}
+		}
+		s.Scripts.mu.Unlock()
+		for _, name := range scripts {
+			s.CancelScript(name)
+		}
+	}
+	sub := s.Sub
+	if s.Handler != nil {
+		sub = s.Handler.Sub
+	}
+	for _, id := range m.Progress {
+		sub <- layout.LayoutCommandMsg{Command: "progress_destroy", Args: []string{id}, Session: s}
+	}
+	for _, id := range m.Panes {
+		sub <- layout.LayoutCommandMsg{Command: "unsplit", Args: []string{id}, Session: s}
+	}
+	delete(s.Modules.Modules, m.Name)
+}
+
+// ReloadModule tears a module down and loads it again from its files. A
+// disabled module stays disabled. If its init.lua is gone, or its
+// module.yaml no longer reads or asks for something that is not loaded, the
+// loaded version is kept. A refused module is tried again.
+func (s *Session) ReloadModule(moduleName string) error {
+	module, ok := s.Modules.Modules[moduleName]
+	if !ok {
+		if refused, ok := s.Modules.refusedAt[moduleName]; ok {
+			return LoadModule(s, refused.path)
+		}
+		return fmt.Errorf("module %s not found", moduleName)
+	}
+
+	_, err := os.Stat(filepath.Join(module.Path, "init.lua"))
+	var manifest *ModuleManifest
+	if err == nil {
+		manifest, err = readModuleManifest(module.Path)
+	}
+	if err == nil && manifest != nil {
+		err = manifest.validateSettings()
+	}
+	if err == nil {
+		err = s.checkModuleRequirements(manifest)
+	}
+	if err != nil {
+		// Wait for the next change before trying again
+		module.modTime = moduleModTime(module.Path)
+		return fmt.Errorf("module %s not reloaded, keeping the loaded version: %v", moduleName, err)
+	}
+
+	s.unloadModule(module)
+	err = LoadModule(s, module.Path)
+	if _, loaded := s.Modules.Modules[moduleName]; loaded && !module.Enabled {
+		if derr := s.DisableModule(moduleName); derr != nil {
+			err = errors.Join(err, derr)
+		}
+	}
+	log.Printf("Reloaded module: %s", moduleName)
+	return err
+}
+
+// moduleWatchTimer names the ticker that polls module files for changes
+const moduleWatchTimer = "modules:watch"
+
+// moduleWatchInterval is how often, in milliseconds, module files are polled
+const moduleWatchInterval = 1000
+
+// WatchModules starts or stops reloading modules whose files change
+func (s *Session) WatchModules(on bool) {
+	if s.Tickers == nil {
+		NewTickerRegistry(s.Context, s)
+	}
+	if !on {
+		s.RemoveTicker(moduleWatchTimer)
+		return
+	}
+	s.AddTicker(&TickerRecord{
+		Name:     moduleWatchTimer,
+		Interval: moduleWatchInterval,
+		Fn:       func(sess *Session) { sess.reloadChangedModules() },
+	})
+}
+
+// WatchingModules reports whether modules are reloaded when they change
+func (s *Session) WatchingModules() bool {
+	if s.Tickers == nil {
+		return false
+	}
+	s.Tickers.mu.Lock()
+	defer s.Tickers.mu.Unlock()
+	_, ok := s.Tickers.Entries[moduleWatchTimer]
+	return ok
+}
+
+// reloadChangedModules reloads each module with a file newer than when it
+// was loaded, and tries again each refused module whose files have changed
+func (s *Session) reloadChangedModules() {
+	var changed, retry []string
+	for name, module := range s.Modules.Modules {
+		if moduleModTime(module.Path).After(module.modTime) {
+			changed = append(changed, name)
+		}
+	}
+	for name, refused := range s.Modules.refusedAt {
+		if _, loaded := s.Modules.Modules[name]; !loaded && moduleModTime(refused.path).After(refused.modTime) {
+			retry = append(retry, name)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(retry)
+
+	for _, name := range changed {
+		if _, ok := s.Modules.Modules[name]; !ok {
+			continue
+		}
+		if err := s.ReloadModule(name); err != nil {
+			s.Output(fmt.Sprintf("Module %s changed, errors reloading it:\n%v\n", name, err))
+		} else {
+			s.Output(fmt.Sprintf("Module %s changed, reloaded\n", name))
+		}
+	}
+	for _, name := range retry {
+		if err := s.ReloadModule(name); err != nil {
+			s.Output(fmt.Sprintf("Module %s changed, still not loaded:\n%v\n", name, err))
+		} else {
+			s.Output(fmt.Sprintf("Module %s changed, loaded\n", name))
+		}
+	}
+}
+
+// moduleModTime returns the modification time of the newest file in a
+// module's directory
+func moduleModTime(path string) time.Time {
+	var newest time.Time
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return newest
+}
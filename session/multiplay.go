@@ -0,0 +1,96 @@
+package session
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BroadcastEvent is fired on every session by SessionHandler.Broadcast
+type BroadcastEvent struct {
+	BaseEvent
+	Source string                 `json:"source"`
+	Data   map[string]interface{} `json:"data"`
+}
+
+// SessionNames returns the names of all sessions in alphabetical order
+func (h *SessionHandler) SessionNames() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	names := make([]string, 0, len(h.Sessions))
+	for name := range h.Sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Broadcast fires an event on every session, including the source, so a
+// handler in one session can react to something another session saw. Each
+// session handles it on its own loop.
+func (h *SessionHandler) Broadcast(source, name string, data map[string]interface{}) {
+	for _, sessName := range h.SessionNames() {
+		if sess, ok := h.Session(sessName); ok {
+			sess.Post(func() {
+				sess.FireEvent(name, BroadcastEvent{BaseEvent: NewBaseEvent(), Source: source, Data: data})
+			})
+		}
+	}
+}
+
+// SendTo writes a command to the named session's MUD connection, bypassing
+// its aliases.
+func (h *SessionHandler) SendTo(name, cmd string) error {
+	sess, ok := h.Session(name)
+	if !ok {
+		return fmt.Errorf("no such session: %s", name)
+	}
+	if !sess.IsConnected() {
+		return fmt.Errorf("session %s is not connected", name)
+	}
+	sess.Post(func() { sess.ParseCommand(cmd) })
+	return nil
+}
+
+// routeInput runs cmd in another session as if it had been typed there
+func (s *Session) routeInput(target *Session, cmd string) {
+	if target != s {
+		s.Output(fmt.Sprintf("[%s] %s\n", target.Name, cmd))
+		target.Post(func() { target.HandleInput(cmd) })
+		return
+	}
+	target.HandleInput(cmd)
+}
+
+// CmdAll runs a command in every session: #all <cmd>
+func CmdAll(s *Session, cmd string) {
+	cmd = strings.TrimSpace(cmd)
+	if cmd == "" || s.Handler == nil {
+		s.Output("Usage: #all <command>\n")
+		return
+	}
+	sent := false
+	for _, name := range s.Handler.SessionNames() {
+		if target, ok := s.Handler.Session(name); ok && target.IsConnected() {
+			s.routeInput(target, cmd)
+			sent = true
+		}
+	}
+	if !sent {
+		s.Output("No connected sessions.\n")
+	}
+}
+
+// sessionCommand handles "#<session> <cmd>", returning false if the
+// command does not name a session.
+func (s *Session) sessionCommand(name, cmd string) bool {
+	if s.Handler == nil {
+		return false
+	}
+	target, ok := s.Handler.Session(name)
+	if !ok {
+		return false
+	}
+	s.routeInput(target, strings.TrimSpace(cmd))
+	return true
+}
@@ -0,0 +1,75 @@
+package session
+
+import (
+	"reflect"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func newMultiplayHandler() (*SessionHandler, map[string]*[]string) {
+	h := &SessionHandler{Sessions: map[string]*Session{}}
+	said := map[string]*[]string{}
+	for _, name := range []string{"healer", "tank"} {
+		s, captured := newAliasTestSession()
+		s.Name = name
+		s.Handler = h
+		s.SetConnected(true)
+		s.Events = NewEventRegistry()
+		s.LuaState = lua.NewState()
+		s.Modules = NewModuleRegistry()
+		s.RegisterLuaAPI()
+		SetCurrentModule(s.LuaState, "party")
+		s.Modules.Modules["party"] = &Module{Name: "party"}
+		h.Sessions[name] = s
+		said[name] = captured
+	}
+	return h, said
+}
+
+func TestSessionCommandRouting(t *testing.T) {
+	h, said := newMultiplayHandler()
+	tank := h.Sessions["tank"]
+
+	tank.ParseInternalCommand("#healer say heal me")
+	tank.ParseInternalCommand("#all say ready")
+
+	if want := []string{"heal me", "ready"}; !reflect.DeepEqual(*said["healer"], want) {
+		t.Errorf("healer said %q, want %q", *said["healer"], want)
+	}
+	if want := []string{"ready"}; !reflect.DeepEqual(*said["tank"], want) {
+		t.Errorf("tank said %q, want %q", *said["tank"], want)
+	}
+}
+
+func TestLuaBroadcast(t *testing.T) {
+	h, _ := newMultiplayHandler()
+
+	err := h.Sessions["healer"].LuaState.DoString(`
+		session.register_event("party.tell", function(evt)
+			got = evt.source .. ":" .. evt.data.from .. ":" .. evt.data.text
+		end)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.Sessions["tank"].LuaState.DoString(`
+		names = table.concat(zif.sessions(), ",")
+		zif.broadcast("party.tell", {from = "Bob", text = "heal"})
+		ok, err = zif.send("nobody", "say hi")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := h.Sessions["healer"].LuaState.GetGlobal("got").String(); got != "tank:Bob:heal" {
+		t.Errorf("healer got %q", got)
+	}
+	tankL := h.Sessions["tank"].LuaState
+	if names := tankL.GetGlobal("names").String(); names != "healer,tank" {
+		t.Errorf("zif.sessions() = %q", names)
+	}
+	if tankL.GetGlobal("ok") != lua.LFalse || tankL.GetGlobal("err").String() != "no such session: nobody" {
+		t.Errorf("zif.send to unknown session = %v, %v", tankL.GetGlobal("ok"), tankL.GetGlobal("err"))
+	}
+}
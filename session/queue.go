@@ -3,93 +3,249 @@ package session
 import (
 	"container/heap"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/evertras/bubble-table/table"
+	"github.com/perlsaiyan/zif/tintin"
 )
 
+// DefaultQueueInterval is the minimum time between two queued commands
+const DefaultQueueInterval = 500 * time.Millisecond
+
+// queuePoll is how often waiting items are rechecked for readiness
+const queuePoll = 100 * time.Millisecond
+
+// QueueItem is a command waiting to be sent. It is sent once the item it
+// depends on (by ID, 0 for none) has been sent and Check, if set, returns true.
 type QueueItem struct {
 	ID         uint
 	Name       string
 	Command    string
 	Dependency uint64
 	Check      func(*Session) bool
+	When       string // description of Check for #queue
 	Priority   int
 	index      int // needed for container/heap interface
 }
 
 type PriorityQueue []*QueueItem
 
+// QueueRegistry holds a session's queued commands. The dispatcher started
+// by StartQueueDispatcher sends the highest priority ready item at most
+// once per Interval.
 type QueueRegistry struct {
 	Queue     PriorityQueue
 	LastIndex uint
+	Interval  time.Duration
+
+	mu   sync.Mutex
+	wake chan struct{}
 }
 
 func NewQueueRegistry() *QueueRegistry {
-	qr := &QueueRegistry{Queue: make(PriorityQueue, 0), LastIndex: 0}
+	qr := &QueueRegistry{Queue: make(PriorityQueue, 0), LastIndex: 0, Interval: DefaultQueueInterval, wake: make(chan struct{}, 1)}
 	heap.Init(&qr.Queue)
 	return qr
 }
 
 // add a new item to the queue and return the ID of the item
-// This is convenient to add task chains
-func (q *QueueRegistry) Add(item *QueueItem) uint {
-	item.ID = q.LastIndex
+// This is convenient to add task chains. An item cannot depend on itself or
+// on an ID that has not been given out, as it would never be sent.
+func (q *QueueRegistry) Add(item *QueueItem) (uint, error) {
+	q.mu.Lock()
+	switch {
+	case item.Dependency == uint64(q.LastIndex)+1:
+		q.mu.Unlock()
+		return 0, fmt.Errorf("item #%d cannot depend on itself", item.Dependency)
+	case item.Dependency > uint64(q.LastIndex):
+		q.mu.Unlock()
+		return 0, fmt.Errorf("no queued item #%d to wait for", item.Dependency)
+	}
 	q.LastIndex++
+	item.ID = q.LastIndex
 	heap.Push(&q.Queue, item)
-	return item.ID
+	q.mu.Unlock()
+
+	q.notify()
+	return item.ID, nil
 }
 
 func (q *QueueRegistry) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 	return q.Queue.Len()
 }
 
 // Get sorted queue without emptying it
 func (q *QueueRegistry) ViewQueue() []*QueueItem {
-	tempQueue := make(PriorityQueue, 0)
-	var queue []*QueueItem
+	q.mu.Lock()
+	queue := append(PriorityQueue(nil), q.Queue...)
+	q.mu.Unlock()
 
-	for q.Queue.Len() > 0 {
-		item := heap.Pop(&q.Queue).(*QueueItem)
-		queue = append(queue, item)
-		tempQueue = append(tempQueue, item)
+	sort.Slice(queue, queue.Less)
+	return queue
+}
+
+// Cancel removes an item and every item that depends on it, directly or
+// through a chain, and returns how many were removed.
+func (q *QueueRegistry) Cancel(id uint) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cancelled := map[uint64]bool{uint64(id): true}
+	removed := 0
+	for changed := true; changed; {
+		changed = false
+		for _, item := range q.Queue {
+			if cancelled[uint64(item.ID)] || cancelled[item.Dependency] {
+				cancelled[uint64(item.ID)] = true
+				heap.Remove(&q.Queue, item.index)
+				removed++
+				changed = true
+				break
+			}
+		}
 	}
+	return removed
+}
 
-	for tempQueue.Len() > 0 {
-		heap.Push(&q.Queue, heap.Pop(&tempQueue))
+// Clear empties the queue and returns how many items were dropped
+func (q *QueueRegistry) Clear() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := q.Queue.Len()
+	for _, item := range q.Queue {
+		item.index = -1
 	}
+	q.Queue = q.Queue[:0]
+	return n
+}
 
-	return queue
+// notify wakes the dispatcher
+func (q *QueueRegistry) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *QueueRegistry) interval() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.Interval
 }
 
 // This function will return the first item that is ready to be processed
+// and remove it from the queue. Checks run without the queue locked, so
+// they may queue further commands.
 func (s *Session) GetQueueItem() *QueueItem {
-	tempQueue := make(PriorityQueue, 0)
-
-	for s.Queue.Queue.Len() > 0 {
-		item := heap.Pop(&s.Queue.Queue).(*QueueItem)
-		if item.Check == nil || item.Check(s) {
-			// Push the items back to the main queue
-			for tempQueue.Len() > 0 {
-				heap.Push(&s.Queue.Queue, heap.Pop(&tempQueue))
-			}
+	q := s.Queue
+	items := q.ViewQueue()
+	pending := make(map[uint64]bool, len(items))
+	for _, item := range items {
+		pending[uint64(item.ID)] = true
+	}
+
+	for _, item := range items {
+		if item.Dependency != 0 && pending[item.Dependency] {
+			continue
+		}
+		if item.Check != nil && !item.Check(s) {
+			continue
+		}
+
+		q.mu.Lock()
+		// The item may have been cancelled while it was being checked
+		taken := item.index >= 0 && item.index < q.Queue.Len() && q.Queue[item.index] == item
+		if taken {
+			heap.Remove(&q.Queue, item.index)
+		}
+		q.mu.Unlock()
+		if taken {
 			return item
-		} else {
-			heap.Push(&tempQueue, item)
 		}
 	}
+	return nil
+}
 
-	// Push the items back to the main queue if no item was found
-	for tempQueue.Len() > 0 {
-		heap.Push(&s.Queue.Queue, heap.Pop(&tempQueue))
+// queueStatus describes why an item has not been sent yet
+func (s *Session) queueStatus(item *QueueItem, pending map[uint64]bool) string {
+	switch {
+	case item.Dependency != 0 && pending[item.Dependency]:
+		return fmt.Sprintf("after #%d", item.Dependency)
+	case item.Check != nil && !item.Check(s):
+		return "waiting"
 	}
+	return "ready"
+}
 
-	return nil
+// StartQueueDispatcher sends queued commands until the session's context
+// is cancelled.
+func (s *Session) StartQueueDispatcher() {
+	go s.queueDispatcher()
+}
+
+func (s *Session) queueDispatcher() {
+	q := s.Queue
+	var lastSent time.Time
+	for {
+		var poll <-chan time.Time
+		var timer *time.Timer
+		if q.Len() > 0 {
+			wait := queuePoll
+			if gap := q.interval() - time.Since(lastSent); gap > wait {
+				wait = gap
+			}
+			timer = time.NewTimer(wait)
+			poll = timer.C
+		}
+
+		select {
+		case <-s.Context.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-q.wake:
+		case <-poll:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if time.Since(lastSent) < q.interval() {
+			continue
+		}
+		// Conditions may run Lua, so items are checked and sent on the
+		// session's loop
+		sent := false
+		s.Call(func() {
+			if item := s.GetQueueItem(); item != nil {
+				sent = true
+				s.dispatchInput(item.Command)
+			}
+		})
+		if sent {
+			lastSent = time.Now()
+		}
+	}
 }
 
 func (pq PriorityQueue) Len() int { return len(pq) }
 
 func (pq PriorityQueue) Less(i, j int) bool {
 	// We want Pop to give us the highest, not lowest, priority so we use greater than here.
-	return pq[i].Priority > pq[j].Priority
+	// Equal priorities go out in the order they were queued.
+	if pq[i].Priority != pq[j].Priority {
+		return pq[i].Priority > pq[j].Priority
+	}
+	return pq[i].ID < pq[j].ID
 }
 
 func (pq PriorityQueue) Swap(i, j int) {
@@ -116,20 +272,140 @@ func (pq *PriorityQueue) Pop() interface{} {
 	return item
 }
 
-func CmdQueue(s *Session, cmd string) {
-	var builder strings.Builder
-
-	builder.WriteString("ID\tName\tCommand\tDependency\tPriority\n")
-	for _, item := range s.Queue.ViewQueue() {
-		line := fmt.Sprintf("%d\t%s\t%s\t%d\t%d\n", item.ID, item.Name, item.Command, item.Dependency, item.Priority)
-		builder.WriteString(line)
+func makeQueueRow(item *QueueItem, status string) table.Row {
+	after := ""
+	if item.Dependency != 0 {
+		after = fmt.Sprint(item.Dependency)
 	}
+	return table.NewRow(table.RowData{
+		"id":       item.ID,
+		"name":     item.Name,
+		"command":  item.Command,
+		"priority": item.Priority,
+		"after":    after,
+		"when":     item.When,
+		"status":   status,
+	})
+}
 
-	for s.Queue.Queue.Len() > 0 {
-		item := s.GetQueueItem()
-		line := fmt.Sprintf("Run %s\n", item.Name)
-		builder.WriteString(line)
+// parseQueueAdd parses "{command} [priority N] [after ID] [when {condition}]"
+func parseQueueAdd(args string) (*QueueItem, error) {
+	fields := tintin.BraceArgs(args)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing command")
 	}
+	item := &QueueItem{Command: fields[0], Name: fields[0]}
+	for i := 1; i < len(fields); i += 2 {
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("%s needs a value", fields[i])
+		}
+		val := fields[i+1]
+		switch strings.ToLower(fields[i]) {
+		case "priority":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("bad priority %q", val)
+			}
+			item.Priority = n
+		case "after":
+			n, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad item ID %q", val)
+			}
+			item.Dependency = n
+		case "when":
+			cond, err := NewCondition(val)
+			if err != nil {
+				return nil, err
+			}
+			item.Check = cond.Check
+			item.When = cond.String()
+		case "name":
+			item.Name = val
+		default:
+			return nil, fmt.Errorf("unknown option %q", fields[i])
+		}
+	}
+	return item, nil
+}
 
-	s.Output(builder.String())
+// CmdQueue lists and manages the command queue:
+// #queue [list|add|cancel|clear|rate]
+func CmdQueue(s *Session, cmd string) {
+	sub, rest, _ := strings.Cut(strings.TrimSpace(cmd), " ")
+	rest = strings.TrimSpace(rest)
+
+	switch strings.ToLower(sub) {
+	case "", "list":
+		items := s.Queue.ViewQueue()
+		if len(items) == 0 {
+			s.Output("The queue is empty.\n")
+			return
+		}
+		pending := make(map[uint64]bool, len(items))
+		for _, item := range items {
+			pending[uint64(item.ID)] = true
+		}
+		var rows []table.Row
+		for _, item := range items {
+			rows = append(rows, makeQueueRow(item, s.queueStatus(item, pending)))
+		}
+
+		t := table.New([]table.Column{
+			table.NewColumn("id", "ID", 5).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+			table.NewColumn("name", "Name", 15).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+			table.NewColumn("command", "Command", 25).WithStyle(lipgloss.NewStyle().Align(lipgloss.Left)),
+			table.NewColumn("priority", "Pri", 5).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+			table.NewColumn("after", "After", 6).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+			table.NewColumn("when", "When", 20).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+			table.NewColumn("status", "Status", 12).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center).Foreground(lipgloss.Color("#8c8"))),
+		}).
+			WithRows(rows).
+			BorderRounded()
+
+		s.Output(t.View() + "\n")
+
+	case "add":
+		item, err := parseQueueAdd(rest)
+		if err != nil {
+			s.Output(fmt.Sprintf("Error: %v\nUsage: #queue add {command} [priority N] [after ID] [when {condition}] [name NAME]\n", err))
+			return
+		}
+		id, err := s.Queue.Add(item)
+		if err != nil {
+			s.Output(fmt.Sprintf("Error: %v\n", err))
+			return
+		}
+		s.Output(fmt.Sprintf("Queued #%d: %s\n", id, item.Command))
+
+	case "cancel":
+		id, err := strconv.ParseUint(rest, 10, 64)
+		if err != nil {
+			s.Output("Usage: #queue cancel <id>\n")
+			return
+		}
+		n := s.Queue.Cancel(uint(id))
+		if n == 0 {
+			s.Output(fmt.Sprintf("No queued item #%d\n", id))
+			return
+		}
+		s.Output(fmt.Sprintf("Cancelled %d queued item(s)\n", n))
+
+	case "clear":
+		s.Output(fmt.Sprintf("Cleared %d queued item(s)\n", s.Queue.Clear()))
+
+	case "rate":
+		perSecond, err := strconv.ParseFloat(rest, 64)
+		if err != nil || perSecond <= 0 {
+			s.Output(fmt.Sprintf("Queue sends %.2f commands per second. Usage: #queue rate <commands per second>\n", float64(time.Second)/float64(s.Queue.interval())))
+			return
+		}
+		s.Queue.mu.Lock()
+		s.Queue.Interval = time.Duration(float64(time.Second) / perSecond)
+		s.Queue.mu.Unlock()
+		s.Output(fmt.Sprintf("Queue rate set to %g commands per second\n", perSecond))
+
+	default:
+		s.Output("Usage: #queue [list|add|cancel <id>|clear|rate <per second>]\n")
+	}
 }
@@ -0,0 +1,93 @@
+package session
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueDispatch(t *testing.T) {
+	s, said := newAliasTestSession()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Context = ctx
+	s.loop = newEventLoop()
+	s.startLoop()
+	s.Data = map[string]interface{}{}
+	s.Queue = NewQueueRegistry()
+	s.Queue.Interval = 0
+
+	// Dependencies and priorities are honoured; a condition holds back its item
+	first, _ := s.Queue.Add(&QueueItem{Command: "say first", Priority: -1})
+	s.Queue.Add(&QueueItem{Command: "say second", Dependency: uint64(first), Priority: 5})
+	cond, _ := NewCondition("data.balance == true")
+	s.Queue.Add(&QueueItem{Command: "say balanced", Check: cond.Check})
+	s.Queue.Add(&QueueItem{Command: "say urgent", Priority: 10})
+	cancelled, _ := s.Queue.Add(&QueueItem{Command: "say cancelled", Priority: -5})
+	s.Queue.Add(&QueueItem{Command: "say dependent", Dependency: uint64(cancelled)})
+
+	if n := s.Queue.Cancel(cancelled); n != 2 {
+		t.Errorf("Cancel removed %d items, want 2", n)
+	}
+
+	var sent []string
+	for item := s.GetQueueItem(); item != nil; item = s.GetQueueItem() {
+		sent = append(sent, item.Command)
+	}
+	if want := []string{"say urgent", "say first", "say second"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+
+	// The dispatcher sends the held item once its condition holds
+	s.Data["balance"] = true
+	s.StartQueueDispatcher()
+	deadline := time.Now().Add(time.Second)
+	var got []string
+	for len(got) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		s.Call(func() { got = append([]string(nil), *said...) })
+	}
+	if want := []string{"balanced"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dispatcher sent %q, want %q", got, want)
+	}
+	if s.Queue.Len() != 0 {
+		t.Errorf("%d items left in queue", s.Queue.Len())
+	}
+}
+
+func TestQueueRejectsUnreachableDependencies(t *testing.T) {
+	q := NewQueueRegistry()
+	first, err := q.Add(&QueueItem{Command: "look"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next ID would be the item's own
+	if _, err := q.Add(&QueueItem{Command: "wait", Dependency: uint64(first) + 1}); err == nil || !strings.Contains(err.Error(), "itself") {
+		t.Errorf("self dependency: %v", err)
+	}
+	if _, err := q.Add(&QueueItem{Command: "wait", Dependency: 99}); err == nil || !strings.Contains(err.Error(), "no queued item #99") {
+		t.Errorf("dependency on an unknown ID: %v", err)
+	}
+	if q.Len() != 1 {
+		t.Errorf("rejected items were queued: %d items", q.Len())
+	}
+	if _, err := q.Add(&QueueItem{Command: "after look", Dependency: uint64(first)}); err != nil {
+		t.Errorf("dependency on a queued item: %v", err)
+	}
+}
+
+func TestParseQueueAdd(t *testing.T) {
+	item, err := parseQueueAdd("{kill orc;loot} priority 3 after 2 when {not data.fighting}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Command != "kill orc;loot" || item.Priority != 3 || item.Dependency != 2 || item.When != "not data.fighting" {
+		t.Errorf("unexpected item %+v", *item)
+	}
+	if _, err := parseQueueAdd("{look} priority"); err == nil {
+		t.Error("expected an error for a missing value")
+	}
+}
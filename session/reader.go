@@ -13,7 +13,9 @@ import (
 	kallisti "github.com/perlsaiyan/zif/protocol"
 )
 
-// Read from the MUD stream, parse MSDP, etc
+// Read from the MUD stream, parse MSDP, etc. Reading stays on this
+// goroutine, while everything a line or negotiation changes is done on the
+// session's loop.
 func (s *Session) mudReader() tea.Cmd {
 	defer func() {
 		if r := recover(); r != nil {
@@ -43,7 +45,11 @@ func (s *Session) mudReader() tea.Cmd {
 			} else {
 				fmt.Println("Error: ", err)
 				sub <- tea.KeyMsg.String
-				s.Connected = false
+				s.Do(func() {
+					s.SetConnected(false)
+					s.Ringlog.Flush()
+					s.FireEvent(EventDisconnect, DisconnectEvent{BaseEvent: NewBaseEvent(), Session: s.Name, Address: s.Address, Error: err.Error()})
+				})
 				// TODO return a command to close out the session, otherwise we just hang
 				return nil
 
@@ -55,12 +61,21 @@ func (s *Session) mudReader() tea.Cmd {
 			if len(outbuf) > 0 {
 				linestring := string(outbuf)
 				strippedlinestring := stripansi.Strip(linestring)
-				s.AddRinglogEntry(time.Now().UnixNano(), linestring, strippedlinestring)
-				s.ActionParser(outbuf)
-				s.Content += linestring
-				sub <- UpdateMessage{Session: s.Name, Content: linestring}
-				// Call MUD line hooks
-				s.OnMUDLine(linestring, strippedlinestring)
+				s.Do(func() {
+					id := s.AddRinglogEntry(time.Now().UnixNano(), RingContextLine, linestring, strippedlinestring)
+					s.logLine(linestring, strippedlinestring)
+					fx := s.matchActions(linestring, strippedlinestring)
+					if fx.gag {
+						s.Ringlog.Retag(id, RingContextGagged)
+					} else {
+						shown := fx.render(linestring, strippedlinestring)
+						s.show(shown)
+						sub <- UpdateMessage{Session: s.Name, Content: shown}
+					}
+					s.FireEvent(EventLine, LineEvent{BaseEvent: NewBaseEvent(), Line: linestring, Stripped: strippedlinestring, Gagged: fx.gag})
+					// Call MUD line hooks
+					s.OnMUDLine(linestring, strippedlinestring)
+				})
 				outbuf = outbuf[:0]
 			}
 		} else if buffer[0] == 255 {
@@ -68,50 +83,60 @@ func (s *Session) mudReader() tea.Cmd {
 			_, _ = s.Socket.Read(buffer) // read one char for now to eat GA
 			if buffer[0] == 249 {        //this is GO AHEAD
 				//store it, this is likely a prompt
-				linestring := strings.TrimRight(string(outbuf), "\r\n")
-				strippedlinestring := stripansi.Strip(linestring)
-				s.AddRinglogEntry(time.Now().UnixNano(), linestring, strippedlinestring)
-
-				s.Content += string(outbuf) + "\n"
-				s.FireEvent("core.prompt", NewBaseEvent())
-
-				sub <- UpdateMessage{Session: s.Name, Content: string(outbuf) + "\n"}
-				s.ActionParser(outbuf)
-				// Call MUD line hooks
-				s.OnMUDLine(linestring, strippedlinestring)
+				raw := string(outbuf)
+				stripped := stripansi.Strip(raw)
+				linestring := strings.TrimRight(raw, "\r\n")
+				strippedlinestring := strings.TrimRight(stripped, "\r\n")
+				s.Do(func() {
+					id := s.AddRinglogEntry(time.Now().UnixNano(), RingContextPrompt, linestring, strippedlinestring)
+					s.logLine(linestring, strippedlinestring)
+					fx := s.matchActions(raw, stripped)
+					if fx.gag {
+						s.Ringlog.Retag(id, RingContextGagged)
+					} else {
+						shown := fx.render(raw, strippedlinestring)
+						s.show(shown + "\n")
+						sub <- UpdateMessage{Session: s.Name, Content: shown + "\n"}
+					}
+					s.FireEvent(EventPrompt, LineEvent{BaseEvent: NewBaseEvent(), Line: linestring, Stripped: strippedlinestring, Prompt: true, Gagged: fx.gag})
+					// Call MUD line hooks
+					s.OnMUDLine(linestring, strippedlinestring)
+				})
 				outbuf = outbuf[:0]
 			} else if buffer[0] == 251 { // WILL
 				_, _ = s.Socket.Read(buffer)
 				log.Printf("DEBUG IAC WILL: %v (decimal: %d)", buffer[0], buffer[0])
 				if buffer[0] == 1 { // ECHO / password mask
-					log.Printf("DEBUG: Got password mask request (IAC WILL ECHO), current PasswordMode: %v, EchoNegotiated: %v, LoginComplete: %v", s.PasswordMode, s.EchoNegotiated, s.LoginComplete)
-
-					// Only accept ECHO requests during login (before LoginComplete)
-					// After login is complete, ignore ECHO requests to prevent password mode from turning on in-game
-					if s.LoginComplete {
-						log.Printf("DEBUG: Login complete, ignoring ECHO request (infinite loop protection)")
-						// Don't respond at all - this prevents password mode from turning on in-game
-						// The ECHO handling is done, continue to next iteration
-					} else {
-						// Infinite loop protection: only respond if we haven't already negotiated this
-						if !s.EchoNegotiated {
-							s.EchoNegotiated = true
-							s.PasswordMode = true
-							log.Printf("DEBUG: Setting PasswordMode to true and sending DO ECHO")
-							buf := []byte{255, 253, 1} // send IAC DO ECHO
-							s.Socket.Write(buf)
-							sub <- TextinputMsg{Session: s.Name, Password_mode: true, Toggle_password: true}
+					s.Do(func() {
+						log.Printf("DEBUG: Got password mask request (IAC WILL ECHO), current PasswordMode: %v, EchoNegotiated: %v, LoginComplete: %v", s.PasswordMode, s.EchoNegotiated, s.LoginComplete)
+
+						// Only accept ECHO requests during login (before LoginComplete)
+						// After login is complete, ignore ECHO requests to prevent password mode from turning on in-game
+						if s.LoginComplete {
+							log.Printf("DEBUG: Login complete, ignoring ECHO request (infinite loop protection)")
+							// Don't respond at all - this prevents password mode from turning on in-game
+							// The ECHO handling is done, continue to next iteration
 						} else {
-							log.Printf("DEBUG: Already negotiated ECHO, skipping DO ECHO (infinite loop protection)")
+							// Infinite loop protection: only respond if we haven't already negotiated this
+							if !s.EchoNegotiated {
+								s.EchoNegotiated = true
+								s.PasswordMode = true
+								log.Printf("DEBUG: Setting PasswordMode to true and sending DO ECHO")
+								buf := []byte{255, 253, 1} // send IAC DO ECHO
+								s.Socket.Write(buf)
+								sub <- TextinputMsg{Session: s.Name, Password_mode: true, Toggle_password: true}
+							} else {
+								log.Printf("DEBUG: Already negotiated ECHO, skipping DO ECHO (infinite loop protection)")
+							}
 						}
-					}
+					})
 
 				} else if buffer[0] == 69 {
 					log.Printf("Offered MSDP, accepting")
 					buf := []byte{255, 253, 69, 255, kallisti.SB, kallisti.MSDP, kallisti.MSDP_VAR, 'L', 'I', 'S', 'T',
 						kallisti.MSDP_VAL, 'C', 'O', 'M', 'M', 'A', 'N', 'D', 'S', 255, kallisti.SE}
 					s.Socket.Write(buf)
-					s.MSDP.HandleWill(s.Socket)
+					s.Do(func() { s.MSDP.HandleWill(s.Socket) })
 
 				} else {
 					log.Printf("SERVER WILL %v (unhandled)\n", buffer)
@@ -120,14 +145,16 @@ func (s *Session) mudReader() tea.Cmd {
 				_, _ = s.Socket.Read(buffer)
 				log.Printf("DEBUG IAC WONT: %v (decimal: %d)", buffer[0], buffer[0])
 				if buffer[0] == 1 {
-					log.Printf("DEBUG: Got password unmask request (IAC WONT ECHO), current PasswordMode: %v, EchoNegotiated: %v", s.PasswordMode, s.EchoNegotiated)
-					// Clear the negotiation flag and mark login as complete
-					// After this point, we should ignore any future ECHO requests to prevent password mode from turning on in-game
-					s.EchoNegotiated = false
-					s.PasswordMode = false
-					s.LoginComplete = true // Mark login as complete after password entry
-					log.Printf("DEBUG: Setting PasswordMode to false, marking login as complete")
-					sub <- TextinputMsg{Session: s.Name, Password_mode: false, Toggle_password: true}
+					s.Do(func() {
+						log.Printf("DEBUG: Got password unmask request (IAC WONT ECHO), current PasswordMode: %v, EchoNegotiated: %v", s.PasswordMode, s.EchoNegotiated)
+						// Clear the negotiation flag and mark login as complete
+						// After this point, we should ignore any future ECHO requests to prevent password mode from turning on in-game
+						s.EchoNegotiated = false
+						s.PasswordMode = false
+						s.LoginComplete = true // Mark login as complete after password entry
+						log.Printf("DEBUG: Setting PasswordMode to false, marking login as complete")
+						sub <- TextinputMsg{Session: s.Name, Password_mode: false, Toggle_password: true}
+					})
 				} else {
 					log.Printf("SERVER WONT %v (unhandled)\n", buffer)
 				}
@@ -156,11 +183,13 @@ func (s *Session) mudReader() tea.Cmd {
 				// Good SB: MSDP subnegotiation received
 				switch sb[0] {
 				case 69:
-					if s.MSDP != nil {
-						s.MSDP.HandleSB(s.Socket, sb)
-						// Call MSDP update hooks after handling MSDP
-						s.OnMSDPUpdate(s.MSDP.GetAllData())
-					}
+					s.Do(func() {
+						if s.MSDP != nil {
+							s.MSDP.HandleSB(s.Socket, sb)
+							// Call MSDP update hooks after handling MSDP
+							s.OnMSDPUpdate(s.MSDP.GetAllData())
+						}
+					})
 				case 24:
 					switch s.TTCount {
 					case 0:
@@ -182,15 +211,24 @@ func (s *Session) mudReader() tea.Cmd {
 			}
 		} else if buffer[0] == 10 {
 			// newline, print big buf and go
-			linestring := strings.TrimRight(string(outbuf), "\r\n")
-			strippedlinestring := stripansi.Strip(linestring)
-			s.AddRinglogEntry(time.Now().UnixNano(), linestring, strippedlinestring)
-			s.ActionParser(outbuf)
-
-			s.Content += linestring + "\n"
-			sub <- UpdateMessage{Session: s.Name, Content: string(outbuf) + "\n"}
-			// Call MUD line hooks
-			s.OnMUDLine(linestring, strippedlinestring)
+			raw := string(outbuf)
+			stripped := stripansi.Strip(raw)
+			linestring := strings.TrimRight(raw, "\r\n")
+			strippedlinestring := strings.TrimRight(stripped, "\r\n")
+			s.Do(func() {
+				id := s.AddRinglogEntry(time.Now().UnixNano(), RingContextLine, linestring, strippedlinestring)
+				s.logLine(linestring, strippedlinestring)
+				fx := s.matchActions(raw, stripped)
+				if fx.gag {
+					s.Ringlog.Retag(id, RingContextGagged)
+				} else {
+					s.show(fx.render(linestring, strippedlinestring) + "\n")
+					sub <- UpdateMessage{Session: s.Name, Content: fx.render(raw, strippedlinestring) + "\n"}
+				}
+				s.FireEvent(EventLine, LineEvent{BaseEvent: NewBaseEvent(), Line: linestring, Stripped: strippedlinestring, Gagged: fx.gag})
+				// Call MUD line hooks
+				s.OnMUDLine(linestring, strippedlinestring)
+			})
 			outbuf = outbuf[:0]
 		} else {
 			outbuf = append(outbuf, buffer[0])
@@ -2,17 +2,65 @@ package session
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/acarl005/stripansi"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/perlsaiyan/zif/config"
 )
 
+// DefaultRingLogSize is how many lines a session's ring log keeps
+const DefaultRingLogSize = 10000
+
+// RingLog keeps the last Size lines received from the MUD in SQLite,
+// numbering them 0 to Size-1 and wrapping around. Lines are added to a
+// pending batch and written by a background goroutine; queries write any
+// pending lines first so they always see everything added.
 type RingLog struct {
 	Db            *sql.DB
-	CurrentNumber int
+	Size          int
+	CurrentNumber int // number of the newest line, guarded by mu
+
+	mu      sync.Mutex
+	pending []RingRecord
+	closed  bool
+	failed  int // lines lost to write errors
+
+	writeMu sync.Mutex // keeps batches in order
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+
+	fts string // full-text index module in use: "fts5", "fts4" or "" for none
 }
 
+// RingLogOptions configures OpenRingLog
+type RingLogOptions struct {
+	Size int    // lines kept, DefaultRingLogSize if zero
+	Path string // database file, in memory if empty
+}
+
+// Ring log contexts, recording what kind of output an entry was
+const (
+	RingContextLine   = "line"   // a line from the MUD
+	RingContextPrompt = "prompt" // a prompt from the MUD, ended by GA
+	RingContextGagged = "gagged" // a line or prompt from the MUD hidden by a trigger
+	RingContextInput  = "input"  // a line typed by the user, as echoed
+	RingContextSent   = "sent"   // a command written to the MUD
+	RingContextSystem = "system" // zif's own output
+)
+
+// RingContexts lists every context, in the order above
+var RingContexts = []string{RingContextLine, RingContextPrompt, RingContextGagged, RingContextInput, RingContextSent, RingContextSystem}
+
 type RingRecord struct {
 	RingNumber int
 	EpochNS    int64
@@ -21,134 +69,443 @@ type RingRecord struct {
 	Stripped   string
 }
 
-func NewRingLog() RingLog {
-
-	db, err := sql.Open("sqlite3", ":memory:")
-
+// NewRingLog returns an in-memory ring log of the default size
+func NewRingLog() *RingLog {
+	r, err := OpenRingLog(RingLogOptions{})
 	if err != nil {
 		panic(err)
 	}
+	return r
+}
+
+// OpenRingLog opens a ring log, creating its database if needed. A
+// persistent log carries on numbering from its newest line; lines beyond
+// a reduced Size are dropped.
+func OpenRingLog(opts RingLogOptions) (*RingLog, error) {
+	if opts.Size <= 0 {
+		opts.Size = DefaultRingLogSize
+	}
+	dsn := ":memory:"
+	if opts.Path != "" {
+		dsn = "file:" + opts.Path + "?_journal_mode=WAL&_busy_timeout=5000"
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Every connection to :memory: is a separate database, and one
+	// connection is plenty for a single session's log
+	db.SetMaxOpenConns(1)
 
 	sqlStmt := `
-	PRAGMA journal_mode=WAL;
 	create table if not exists ring_log(ring_number not null primary key, epoch_ns, context, message, stripped);
 	create index if not exists ring_log_n1 on ring_log(epoch_ns);
 	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		log.Printf("%q: %s\n", err, sqlStmt)
-		panic(err)
+	if _, err = db.Exec(sqlStmt); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating ring log: %w", err)
+	}
+	if _, err = db.Exec("delete from ring_log where ring_number >= ?", opts.Size); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("resizing ring log: %w", err)
 	}
 
-	return RingLog{Db: db}
+	r := &RingLog{Db: db, Size: opts.Size, wake: make(chan struct{}, 1), done: make(chan struct{}), stopped: make(chan struct{})}
+	if err := r.openIndex(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("indexing ring log: %w", err)
+	}
+	err = db.QueryRow("select ring_number from ring_log order by epoch_ns desc, rowid desc limit 1").Scan(&r.CurrentNumber)
+	if err != nil && err != sql.ErrNoRows {
+		db.Close()
+		return nil, fmt.Errorf("reading ring log: %w", err)
+	}
+
+	go r.writer()
+	return r, nil
 }
 
-func (s Session) AddRinglogEntry(ts int64, line string, stripped string) {
+// openIndex sets up the full-text index used by word searches, keyed by
+// ring number. FTS5 needs the sqlite_fts5 build tag; without it FTS4 is
+// used, and if neither is available word searches scan the log instead.
+func (r *RingLog) openIndex() error {
+	var existing string
+	err := r.Db.QueryRow("select sql from sqlite_master where name = 'ring_fts'").Scan(&existing)
+	if err == nil {
+		r.fts = "fts4"
+		if strings.Contains(strings.ToLower(existing), "fts5") {
+			r.fts = "fts5"
+		}
+		_, err = r.Db.Exec("delete from ring_fts where rowid not in (select ring_number from ring_log)")
+		return err
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
 
-	// mod 10k so we ring the log
-	// TODO: we could make this adjustable
-	id := (s.Ringlog.GetCurrentRingNumber() + 1) % 10000
-	s.Ringlog.CurrentNumber = id
+	for _, module := range []string{"fts5", "fts4"} {
+		if _, err := r.Db.Exec("create virtual table ring_fts using " + module + "(stripped)"); err != nil {
+			continue
+		}
+		r.fts = module
+		// A log written before the index existed
+		_, err := r.Db.Exec("insert into ring_fts(rowid, stripped) select ring_number, stripped from ring_log")
+		return err
+	}
+	return nil
+}
 
-	tx, err := s.Ringlog.Db.Begin()
-	if err != nil {
-		log.Fatal(err)
+// Add queues a line for writing and returns its ring number
+func (r *RingLog) Add(ts int64, context, line, stripped string) int {
+	r.mu.Lock()
+	r.CurrentNumber = (r.CurrentNumber + 1) % r.Size
+	id := r.CurrentNumber
+	if !r.closed {
+		r.pending = append(r.pending, RingRecord{RingNumber: id, EpochNS: ts, Context: context, Message: line, Stripped: stripped})
+		// If the database has stalled, lines older than the ring are
+		// overwritten anyway
+		if over := len(r.pending) - r.Size; over > 0 {
+			r.pending = r.pending[over:]
+			r.failed += over
+		}
+	}
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return id
+}
+
+// Retag changes the context of a line already added, e.g. once triggers
+// have gagged it
+func (r *RingLog) Retag(id int, context string) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	r.mu.Lock()
+	for i := len(r.pending) - 1; i >= 0; i-- {
+		if r.pending[i].RingNumber == id {
+			r.pending[i].Context = context
+			r.mu.Unlock()
+			return nil
+		}
+	}
+	r.mu.Unlock()
+
+	// Already written; holding writeMu means no batch is part way through
+	_, err := r.Db.Exec("update ring_log set context = ? where ring_number = ?", context, id)
+	return err
+}
+
+// AddRinglogEntry records a line in the session's ring log and returns its
+// ring number
+func (s *Session) AddRinglogEntry(ts int64, context string, line string, stripped string) int {
+	return s.Ringlog.Add(ts, context, line, stripped)
+}
+
+// recordLines adds each line of text to the ring log, if the session has one
+func (s *Session) recordLines(context, text string) {
+	if s.Ringlog == nil {
+		return
+	}
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		s.Ringlog.Add(now, context, line, stripansi.Strip(line))
+	}
+}
+
+// writer writes pending lines in batches until the log is closed
+func (r *RingLog) writer() {
+	defer close(r.stopped)
+	for {
+		select {
+		case <-r.wake:
+			r.Flush()
+		case <-r.done:
+			r.Flush()
+			return
+		}
 	}
-	stmt, err := tx.Prepare("insert or replace into ring_log(ring_number, epoch_ns, message, stripped) values(?,?,?,?)")
+}
+
+// Flush writes pending lines now. Lines that fail to write are dropped
+// and logged rather than retried.
+func (r *RingLog) Flush() error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	r.mu.Lock()
+	batch := r.pending
+	r.pending = nil
+	r.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := r.write(batch)
 	if err != nil {
-		log.Fatal(err)
+		r.mu.Lock()
+		r.failed += len(batch)
+		r.mu.Unlock()
+		log.Printf("Ring log: dropped %d line(s): %v", len(batch), err)
 	}
-	defer stmt.Close()
+	return err
+}
 
-	_, err = stmt.Exec(id, ts, line, stripped)
+func (r *RingLog) write(batch []RingRecord) error {
+	tx, err := r.Db.Begin()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	err = tx.Commit()
+	stmt, err := tx.Prepare("insert or replace into ring_log(ring_number, epoch_ns, context, message, stripped) values(?,?,?,?,?)")
 	if err != nil {
-		log.Fatal(err)
+		tx.Rollback()
+		return err
 	}
+	defer stmt.Close()
 
-}
-
-func (r RingLog) GetCurrentRingNumber() int {
-	if r.CurrentNumber == 0 {
-		stmt, err := r.Db.Prepare("select ring_number from ring_log order by epoch_ns desc limit 1")
-		if err != nil {
-			log.Fatal(err)
+	var unindex, index *sql.Stmt
+	if r.fts != "" {
+		if unindex, err = tx.Prepare("delete from ring_fts where rowid = ?"); err == nil {
+			index, err = tx.Prepare("insert into ring_fts(rowid, stripped) values(?,?)")
 		}
-		defer stmt.Close()
-		var id int
-		err = stmt.QueryRow().Scan(&id)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				// no rows, return 0
-				return 0
-			}
+			tx.Rollback()
+			return err
 		}
+		defer unindex.Close()
+		defer index.Close()
+	}
 
-		return id
+	for _, rec := range batch {
+		if _, err := stmt.Exec(rec.RingNumber, rec.EpochNS, rec.Context, rec.Message, rec.Stripped); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if index == nil {
+			continue
+		}
+		if _, err := unindex.Exec(rec.RingNumber); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := index.Exec(rec.RingNumber, rec.Stripped); err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
-	return r.CurrentNumber
+	return tx.Commit()
 }
 
-func (r RingLog) GetRingEntry(id int) *RingRecord {
-	stmt, err := r.Db.Prepare("select ring_number, epoch_ns, message, stripped from ring_log where ring_number = ?")
-	if err != nil {
-		log.Fatal(err)
+// Dropped returns how many lines were lost to write errors
+func (r *RingLog) Dropped() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed
+}
+
+// Close writes any pending lines and closes the database
+func (r *RingLog) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
 	}
-	defer stmt.Close()
+	r.closed = true
+	r.mu.Unlock()
+
+	close(r.done)
+	<-r.stopped
+	return r.Db.Close()
+}
+
+func (r *RingLog) GetCurrentRingNumber() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.CurrentNumber
+}
+
+// GetRingEntry returns one line, or nil if there is no such line
+func (r *RingLog) GetRingEntry(id int) *RingRecord {
+	r.Flush()
 	var record RingRecord
-	err = stmt.QueryRow(id).Scan(&record.RingNumber, &record.EpochNS, &record.Message, &record.Stripped)
+	err := r.Db.QueryRow("select ring_number, epoch_ns, coalesce(context, ''), message, stripped from ring_log where ring_number = ?", id).
+		Scan(&record.RingNumber, &record.EpochNS, &record.Context, &record.Message, &record.Stripped)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil
+		if err != sql.ErrNoRows {
+			log.Printf("Ring log: reading line %d: %v", id, err)
 		}
-		log.Fatal(err)
+		return nil
 	}
 
 	return &record
 }
 
-func (r RingLog) GetLog(start int, end int) []RingRecord {
+// GetLog returns the lines from start to end inclusive, following the
+// ring if end is before start. Errors are logged and end the result early.
+func (r *RingLog) GetLog(start int, end int) []RingRecord {
+	r.Flush()
 	var records []RingRecord
 
 	// Handle wrapping if start > end (ring buffer)
 	// But for now let's assume simple case or handle the query logic
-	// Since it's a ring buffer 0-9999, if start > end, it means we wrapped around.
+	// Since it's a ring buffer 0 to Size-1, if start > end, it means we wrapped around.
 
 	var query string
 	var rows *sql.Rows
 	var err error
 
 	if start <= end {
-		query = "select ring_number, epoch_ns, message, stripped from ring_log where ring_number >= ? and ring_number <= ? order by ring_number asc"
+		query = "select ring_number, epoch_ns, coalesce(context, ''), message, stripped from ring_log where ring_number >= ? and ring_number <= ? order by ring_number asc"
 		rows, err = r.Db.Query(query, start, end)
 	} else {
 		// Wrapped around
-		// Get from start to 9999
+		// Get from start to Size-1
 		// Get from 0 to end
 		// Actually we can just use OR
-		query = "select ring_number, epoch_ns, message, stripped from ring_log where ring_number >= ? OR ring_number <= ? order by case when ring_number >= ? then 0 else 1 end, ring_number asc"
+		query = "select ring_number, epoch_ns, coalesce(context, ''), message, stripped from ring_log where ring_number >= ? OR ring_number <= ? order by case when ring_number >= ? then 0 else 1 end, ring_number asc"
 		rows, err = r.Db.Query(query, start, end, start)
 	}
 
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Ring log: reading lines %d-%d: %v", start, end, err)
+		return nil
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var record RingRecord
-		err = rows.Scan(&record.RingNumber, &record.EpochNS, &record.Message, &record.Stripped)
+		err = rows.Scan(&record.RingNumber, &record.EpochNS, &record.Context, &record.Message, &record.Stripped)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Ring log: reading lines %d-%d: %v", start, end, err)
+			break
 		}
 		records = append(records, record)
 	}
 	return records
 }
 
+// Recent returns the last limit entries, oldest first
+func (r *RingLog) Recent(limit int) ([]RingRecord, error) {
+	return r.Search(RingQuery{Limit: limit})
+}
+
+// RingQuery selects ring log entries for Search. Zero values match
+// everything; Since and Before are Unix times in nanoseconds.
+type RingQuery struct {
+	Pattern *regexp.Regexp // matched against the stripped text, or the raw text if ANSI is set
+	ANSI    bool
+	Words   []string // every word must start a word in the stripped text, in any case
+	Types   []string // contexts to include, e.g. RingContextLine
+	Since   int64
+	Before  int64
+	Limit   int // most recent matches to return, 0 for all
+}
+
+// Search returns the entries matching q, oldest first. When more than
+// Limit entries match, the most recent are kept.
+func (r *RingLog) Search(q RingQuery) ([]RingRecord, error) {
+	r.Flush()
+	var where []string
+	var args []interface{}
+	if len(q.Types) > 0 {
+		where = append(where, "context in (?"+strings.Repeat(",?", len(q.Types)-1)+")")
+		for _, t := range q.Types {
+			args = append(args, t)
+		}
+	}
+	if q.Since != 0 {
+		where = append(where, "epoch_ns >= ?")
+		args = append(args, q.Since)
+	}
+	if q.Before != 0 {
+		where = append(where, "epoch_ns < ?")
+		args = append(args, q.Before)
+	}
+	var wordREs []*regexp.Regexp
+	if len(q.Words) > 0 && r.fts != "" {
+		terms := make([]string, len(q.Words))
+		for i, w := range q.Words {
+			// Lower case keeps words like "or" from being read as operators
+			terms[i] = strings.ToLower(w) + "*"
+		}
+		where = append(where, "ring_number in (select rowid from ring_fts where ring_fts match ?)")
+		args = append(args, strings.Join(terms, " "))
+	} else {
+		for _, w := range q.Words {
+			wordREs = append(wordREs, regexp.MustCompile(`(?i)\b`+regexp.QuoteMeta(w)))
+		}
+	}
+	filtered := q.Pattern != nil || len(wordREs) > 0
+
+	query := "select ring_number, epoch_ns, coalesce(context, ''), message, stripped from ring_log"
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	// Newest first so we can stop at the limit
+	query += " order by epoch_ns desc, ring_number desc"
+	if q.Limit > 0 && !filtered {
+		query += " limit " + strconv.Itoa(q.Limit)
+	}
+
+	rows, err := r.Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []RingRecord
+	for rows.Next() && (q.Limit <= 0 || len(records) < q.Limit) {
+		var record RingRecord
+		if err := rows.Scan(&record.RingNumber, &record.EpochNS, &record.Context, &record.Message, &record.Stripped); err != nil {
+			return nil, err
+		}
+		if q.Pattern != nil {
+			text := record.Stripped
+			if q.ANSI {
+				text = record.Message
+			}
+			if !q.Pattern.MatchString(text) {
+				continue
+			}
+		}
+		if !matchesAll(wordREs, record.Stripped) {
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+func matchesAll(res []*regexp.Regexp, text string) bool {
+	for _, re := range res {
+		if !re.MatchString(text) {
+			return false
+		}
+	}
+	return true
+}
+
+// Indexed reports which full-text index word searches use, or "" if they
+// scan the log
+func (r *RingLog) Indexed() string {
+	return r.fts
+}
+
 func CmdRingtest(s *Session, cmd string) {
 	id, err := strconv.Atoi(cmd)
 	if err != nil {
@@ -156,17 +513,38 @@ func CmdRingtest(s *Session, cmd string) {
 		return
 	}
 
-	stmt, err := s.Ringlog.Db.Prepare("select stripped from ring_log where ring_number = ?")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer stmt.Close()
-	var line string
-	err = stmt.QueryRow(id).Scan(&line)
-	if err != nil {
+	record := s.Ringlog.GetRingEntry(id)
+	if record == nil {
 		s.Output("No record found\n")
 		return
 	}
 
-	s.Output("Record: " + line + "\n")
+	s.Output("Record: " + record.Stripped + "\n")
+}
+
+// openSessionRinglog opens the ring log configured for a session in
+// sessions.yaml, falling back to an in-memory log of the default size.
+func openSessionRinglog(name string) *RingLog {
+	var opts RingLogOptions
+	if sc := sessionConfig(name); sc != nil && sc.Ringlog != nil {
+		opts.Size = sc.Ringlog.Size
+		if sc.Ringlog.Persist {
+			dir, err := config.GetSessionDir(name)
+			if err == nil {
+				err = os.MkdirAll(dir, 0755)
+			}
+			if err != nil {
+				log.Printf("Warning: keeping %s ring log in memory: %v", name, err)
+			} else {
+				opts.Path = filepath.Join(dir, "ringlog.db")
+			}
+		}
+	}
+
+	r, err := OpenRingLog(opts)
+	if err != nil {
+		log.Printf("Warning: failed to open ring log for %s, keeping it in memory: %v", name, err)
+		return NewRingLog()
+	}
+	return r
 }
@@ -0,0 +1,262 @@
+package session
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func newRinglogTestSession(t *testing.T) *Session {
+	s := &Session{Name: "test", Ringlog: NewRingLog(), LuaState: lua.NewState(), Modules: NewModuleRegistry(), Events: NewEventRegistry()}
+	t.Cleanup(s.LuaState.Close)
+	s.RegisterLuaAPI()
+
+	lines := []struct {
+		context, line string
+	}{
+		{RingContextLine, "\x1b[1;36mThe Town Square\x1b[0m"},
+		{RingContextLine, "A fountain gurgles here."},
+		{RingContextLine, "A guard is standing here."},
+		{RingContextPrompt, "<100hp 50mv>"},
+		{RingContextLine, "The guard leaves north."},
+	}
+	for i, l := range lines {
+		s.AddRinglogEntry(int64(i+1)*1e9, l.context, l.line, ansiRE.ReplaceAllString(l.line, ""))
+	}
+	return s
+}
+
+var ansiRE = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func TestRinglogSearch(t *testing.T) {
+	s := newRinglogTestSession(t)
+
+	recent, err := s.Ringlog.Recent(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 2 || recent[0].Stripped != "<100hp 50mv>" || recent[1].Stripped != "The guard leaves north." {
+		t.Errorf("Recent(2) = %+v", recent)
+	}
+
+	tests := []struct {
+		q    RingQuery
+		want []string
+	}{
+		{RingQuery{Pattern: regexp.MustCompile("guard")}, []string{"A guard is standing here.", "The guard leaves north."}},
+		{RingQuery{Pattern: regexp.MustCompile("guard"), Limit: 1}, []string{"The guard leaves north."}},
+		{RingQuery{Types: []string{RingContextPrompt}}, []string{"<100hp 50mv>"}},
+		{RingQuery{Since: 2e9, Before: 4e9}, []string{"A fountain gurgles here.", "A guard is standing here."}},
+		{RingQuery{Pattern: regexp.MustCompile(`^\x1b\[1;36m`), ANSI: true}, []string{"The Town Square"}},
+	}
+	for _, tt := range tests {
+		got, err := s.Ringlog.Search(tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stripped []string
+		for _, r := range got {
+			stripped = append(stripped, r.Stripped)
+		}
+		if len(stripped) != len(tt.want) {
+			t.Errorf("Search(%+v) = %q, want %q", tt.q, stripped, tt.want)
+			continue
+		}
+		for i := range stripped {
+			if stripped[i] != tt.want[i] {
+				t.Errorf("Search(%+v) = %q, want %q", tt.q, stripped, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestLuaRinglog(t *testing.T) {
+	s := newRinglogTestSession(t)
+
+	err := s.LuaState.DoString(`
+		last = session.get_ringlog(1)[1]
+		found = session.ringlog_search("guard", {type = "line", since = 3})
+		room = session.ringlog_range(1, 3)
+		current = session.ringlog_current()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := s.LuaState.GetGlobal("last").(*lua.LTable)
+	if last.RawGetString("stripped").String() != "The guard leaves north." || last.RawGetString("timestamp").(lua.LNumber) != 5 || last.RawGetString("type").String() != RingContextLine {
+		t.Errorf("get_ringlog returned %v", lValueToGo(last))
+	}
+	if found := s.LuaState.GetGlobal("found").(*lua.LTable); found.Len() != 2 {
+		t.Errorf("ringlog_search found %d entries, want 2", found.Len())
+	}
+	room := s.LuaState.GetGlobal("room").(*lua.LTable)
+	if room.Len() != 3 || room.RawGetInt(1).(*lua.LTable).RawGetString("line").String() != "\x1b[1;36mThe Town Square\x1b[0m" {
+		t.Errorf("ringlog_range returned %v", lValueToGo(room))
+	}
+	if current := s.LuaState.GetGlobal("current"); current.(lua.LNumber) != 5 {
+		t.Errorf("ringlog_current = %v, want 5", current)
+	}
+}
+
+func TestRinglogWrap(t *testing.T) {
+	r, err := OpenRingLog(RingLogOptions{Size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for i := 1; i <= 12; i++ {
+		r.Add(int64(i), RingContextLine, fmt.Sprint("line ", i), fmt.Sprint("line ", i))
+	}
+	if n := r.GetCurrentRingNumber(); n != 2 {
+		t.Errorf("current ring number %d, want 2", n)
+	}
+
+	// 3 and 4 hold lines 8 and 9, then the ring wraps to 0-2 (lines 10-12)
+	var got []string
+	for _, rec := range r.GetLog(3, 2) {
+		got = append(got, rec.Stripped)
+	}
+	if want := "line 8,line 9,line 10,line 11,line 12"; strings.Join(got, ",") != want {
+		t.Errorf("GetLog(3, 2) = %q, want %q", got, want)
+	}
+}
+
+func TestRinglogPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ringlog.db")
+	r, err := OpenRingLog(RingLogOptions{Size: 100, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		r.Add(int64(i), RingContextLine, fmt.Sprint("line ", i), fmt.Sprint("line ", i))
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Adding after Close is ignored rather than fatal
+	r.Add(11, RingContextLine, "late", "late")
+
+	// Shrinking the ring drops the lines numbered beyond it
+	r, err = OpenRingLog(RingLogOptions{Size: 8, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if n := r.GetCurrentRingNumber(); n != 7 {
+		t.Errorf("reopened ring number %d, want 7", n)
+	}
+	if id := r.Add(20, RingContextLine, "new", "new"); id != 0 {
+		t.Errorf("next line numbered %d, want 0", id)
+	}
+	if rec := r.GetRingEntry(7); rec == nil || rec.Stripped != "line 7" {
+		t.Errorf("GetRingEntry(7) = %+v", rec)
+	}
+	if rec := r.GetRingEntry(8); rec != nil {
+		t.Errorf("line 8 survived shrinking the ring: %+v", rec)
+	}
+}
+
+func TestRinglogWriteErrors(t *testing.T) {
+	r, err := OpenRingLog(RingLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := r.Db.Exec("drop table ring_log"); err != nil {
+		t.Fatal(err)
+	}
+	r.Add(1, RingContextLine, "lost", "lost")
+	if err := r.Flush(); err == nil {
+		t.Error("Flush succeeded without a table")
+	}
+	if n := r.Dropped(); n != 1 {
+		t.Errorf("Dropped() = %d, want 1", n)
+	}
+	if recs := r.GetLog(0, 10); len(recs) != 0 {
+		t.Errorf("GetLog returned %d records", len(recs))
+	}
+}
+
+func benchmarkRinglog(b *testing.B, opts RingLogOptions, flushEach bool) {
+	r, err := OpenRingLog(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+	line := "\x1b[1;32mA cityguard is standing here, watching for trouble.\x1b[0m"
+	stripped := ansiRE.ReplaceAllString(line, "")
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		r.Add(time.Now().UnixNano(), RingContextLine, line, stripped)
+		if flushEach {
+			r.Flush()
+		}
+	}
+	r.Flush()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "lines/s")
+}
+
+// BenchmarkRinglogAdd measures lines written in batches, as the reader does
+func BenchmarkRinglogAdd(b *testing.B) {
+	benchmarkRinglog(b, RingLogOptions{}, false)
+}
+
+// BenchmarkRinglogAddSync writes every line in its own transaction, as the
+// ring log used to
+func BenchmarkRinglogAddSync(b *testing.B) {
+	benchmarkRinglog(b, RingLogOptions{}, true)
+}
+
+func BenchmarkRinglogAddFile(b *testing.B) {
+	benchmarkRinglog(b, RingLogOptions{Path: filepath.Join(b.TempDir(), "ringlog.db")}, false)
+}
+
+func TestRinglogContexts(t *testing.T) {
+	s, sent := newLimitedSession(t, 100, 100)
+	s.Ringlog = NewRingLog()
+	t.Cleanup(func() { s.Ringlog.Close() })
+
+	s.HandleInput("look")
+	receive(t, sent, "look")
+	id := s.AddRinglogEntry(1, RingContextLine, "spam", "spam")
+	s.Output("Hello\nWorld\n")
+	if err := s.Ringlog.Retag(id, RingContextGagged); err != nil {
+		t.Fatal(err)
+	}
+	s.PasswordMode = true
+	s.HandleInput("secret")
+	receive(t, sent, "secret")
+
+	recs, err := s.Ringlog.Recent(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range recs {
+		got = append(got, r.Context+":"+r.Stripped)
+	}
+	// Ordered by time, so the line stamped 1 comes first
+	want := "gagged:spam,input:look,sent:look,system:Hello,system:World"
+	if strings.Join(got, ",") != want {
+		t.Errorf("ring log holds %q, want %q", strings.Join(got, ","), want)
+	}
+
+	// Retagging a line already written updates the database
+	if err := s.Ringlog.Retag(id, RingContextLine); err != nil {
+		t.Fatal(err)
+	}
+	if rec := s.Ringlog.GetRingEntry(id); rec == nil || rec.Context != RingContextLine {
+		t.Errorf("retagged entry = %+v", rec)
+	}
+}
@@ -0,0 +1,441 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/evertras/bubble-table/table"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// scriptWait is what a suspended script is waiting for
+type scriptWait int
+
+const (
+	waitNone scriptWait = iota
+	waitSleep
+	waitLine
+	waitEvent
+)
+
+// Script is a Lua function started with session.spawn. It runs as a
+// coroutine that suspends itself in session.sleep, session.wait_for or
+// session.wait_event; the session resumes it when the timer fires, a line
+// matches or the event is fired.
+type Script struct {
+	Name    string
+	Module  string
+	Started time.Time
+
+	state    *lua.LState // the module state the script was spawned in
+	co       *lua.LState
+	cancel   context.CancelFunc
+	fn       *lua.LFunction
+	wait     scriptWait
+	waitID   uint64 // bumped on every wakeup so a late timeout or match is ignored
+	re       *regexp.Regexp
+	event    string
+	deadline time.Time // zero when waiting without a timeout
+	done     bool
+}
+
+// ScriptRegistry holds a session's running scripts. Only one script runs
+// at a time; wakeups that arrive while one is running are queued in ready
+// and handled once it suspends.
+type ScriptRegistry struct {
+	Scripts map[string]*Script
+
+	mu      sync.Mutex
+	running bool
+	ready   []scriptResume
+}
+
+type scriptResume struct {
+	sc   *Script
+	args []lua.LValue
+}
+
+func NewScriptRegistry() *ScriptRegistry {
+	return &ScriptRegistry{Scripts: make(map[string]*Script)}
+}
+
+// scriptTimer and scriptHook name the ticker and event handlers a
+// suspended script uses to wake up
+func scriptTimer(name string) string { return "script:" + name }
+func scriptHook(name string) string  { return "Script:" + name }
+
+// SpawnScript starts fn, a function from state, as a script, replacing any
+// script with the same name. It runs until it first suspends, or, when
+// called from inside another script, as soon as that script suspends.
+func (s *Session) SpawnScript(state *lua.LState, name, module string, fn *lua.LFunction, args ...lua.LValue) {
+	s.CancelScript(name)
+
+	co, cancel := state.NewThread()
+	sc := &Script{Name: name, Module: module, Started: time.Now(), state: state, co: co, cancel: cancel, fn: fn}
+	s.Scripts.mu.Lock()
+	s.Scripts.Scripts[name] = sc
+	s.Scripts.mu.Unlock()
+
+	s.resumeScript(sc, args...)
+}
+
+// CancelScript stops a script and reports whether it existed
+func (s *Session) CancelScript(name string) bool {
+	s.Scripts.mu.Lock()
+	sc, ok := s.Scripts.Scripts[name]
+	s.Scripts.mu.Unlock()
+	if ok {
+		s.finishScript(sc)
+	}
+	return ok
+}
+
+// finishScript removes a script along with whatever it was waiting on
+func (s *Session) finishScript(sc *Script) {
+	r := s.Scripts
+	r.mu.Lock()
+	if sc.done {
+		r.mu.Unlock()
+		return
+	}
+	sc.done = true
+	if r.Scripts[sc.Name] == sc {
+		delete(r.Scripts, sc.Name)
+	}
+	wait, event := sc.wait, sc.event
+	r.mu.Unlock()
+
+	s.dropWait(sc.Name, wait, event)
+	if sc.cancel != nil {
+		sc.cancel()
+	}
+}
+
+// dropWait removes the timer and event handlers a script was waiting on
+func (s *Session) dropWait(name string, wait scriptWait, event string) {
+	if s.Tickers != nil {
+		s.RemoveTicker(scriptTimer(name))
+	}
+	switch wait {
+	case waitLine:
+		s.RemoveEvent(EventLine, scriptHook(name))
+		s.RemoveEvent(EventPrompt, scriptHook(name))
+	case waitEvent:
+		s.RemoveEvent(event, scriptHook(name))
+	}
+}
+
+// suspend records what a script is about to wait for and arranges for it
+// to be woken. timeout of zero or less waits forever.
+func (s *Session) suspend(sc *Script, wait scriptWait, timeout time.Duration) {
+	s.Scripts.mu.Lock()
+	if sc.done {
+		// Cancelled from inside itself; it is simply never resumed
+		s.Scripts.mu.Unlock()
+		return
+	}
+	sc.wait = wait
+	id, re, event := sc.waitID, sc.re, sc.event
+	if timeout > 0 {
+		sc.deadline = time.Now().Add(timeout)
+	} else {
+		sc.deadline = time.Time{}
+	}
+	s.Scripts.mu.Unlock()
+
+	if timeout > 0 {
+		s.AddTicker(&TickerRecord{
+			Name:       scriptTimer(sc.Name),
+			Interval:   int(timeout.Milliseconds()),
+			Iterations: 1,
+			Fn: func(sess *Session) {
+				// The script always gets a value back: gopher-lua fails
+				// resuming a yielded Go function with nothing
+				sess.wakeScript(sc, id, lua.LNil)
+			},
+		})
+	}
+
+	hook := func(sess *Session, data EventData) {
+		switch wait {
+		case waitLine:
+			line, ok := data.(LineEvent)
+			if !ok {
+				return
+			}
+			m := re.FindStringSubmatch(line.Stripped)
+			if m == nil {
+				return
+			}
+			matches := sc.state.NewTable()
+			for i, match := range m {
+				matches.RawSetInt(i+1, lua.LString(match))
+			}
+			sess.wakeScript(sc, id, matches)
+		case waitEvent:
+			sess.wakeScript(sc, id, eventPayload(sc.state, data, sess.CurrentEvent()))
+		}
+	}
+	switch wait {
+	case waitLine:
+		s.AddEvent(EventLine, Event{Name: scriptHook(sc.Name), Enabled: true, Fn: hook})
+		s.AddEvent(EventPrompt, Event{Name: scriptHook(sc.Name), Enabled: true, Fn: hook})
+	case waitEvent:
+		s.AddEvent(event, Event{Name: scriptHook(sc.Name), Enabled: true, Fn: hook})
+	}
+}
+
+// wakeScript resumes a script with args if it is still in the wait
+// identified by id.
+func (s *Session) wakeScript(sc *Script, id uint64, args ...lua.LValue) {
+	r := s.Scripts
+	r.mu.Lock()
+	if sc.done || sc.waitID != id || sc.wait == waitNone {
+		r.mu.Unlock()
+		return
+	}
+	wait, event := sc.wait, sc.event
+	sc.waitID++
+	sc.wait = waitNone
+	sc.re = nil
+	sc.event = ""
+	r.mu.Unlock()
+
+	s.dropWait(sc.Name, wait, event)
+
+	s.resumeScript(sc, args...)
+}
+
+// resumeScript runs a script until it next suspends. If another script is
+// running the resumption waits its turn.
+func (s *Session) resumeScript(sc *Script, args ...lua.LValue) {
+	r := s.Scripts
+	r.mu.Lock()
+	r.ready = append(r.ready, scriptResume{sc: sc, args: args})
+	if r.running {
+		r.mu.Unlock()
+		return
+	}
+	r.running = true
+	for len(r.ready) > 0 {
+		next := r.ready[0]
+		r.ready = r.ready[1:]
+		r.mu.Unlock()
+		s.stepScript(next.sc, next.args)
+		r.mu.Lock()
+	}
+	r.running = false
+	r.mu.Unlock()
+}
+
+func (s *Session) stepScript(sc *Script, args []lua.LValue) {
+	s.Scripts.mu.Lock()
+	done := sc.done
+	s.Scripts.mu.Unlock()
+	if done {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic(fmt.Sprintf("Lua script %s", sc.Name), r, debug.Stack())
+			s.Output(fmt.Sprintf("\nPANIC in Lua script %s: %v\n(Check ~/.config/zif/panic.log for details)\n", sc.Name, r))
+			s.finishScript(sc)
+		}
+	}()
+
+	// Each run between suspensions gets the session's Lua budget
+	ctx, cancel := context.WithTimeout(context.Background(), s.Sandbox.budget())
+	sc.co.SetContext(ctx)
+	state, err, _ := sc.state.Resume(sc.co, sc.fn, args...)
+	sc.co.RemoveContext()
+	cancel()
+	switch state {
+	case lua.ResumeYield:
+		return
+	case lua.ResumeError:
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			s.reportBudget(sc.Module, "script "+sc.Name)
+		} else {
+			s.Output(fmt.Sprintf("Script %s failed: %v\n", sc.Name, err))
+		}
+	}
+	s.finishScript(sc)
+}
+
+// scriptFor returns the script running on the coroutine L, if any
+func (s *Session) scriptFor(L *lua.LState) *Script {
+	s.Scripts.mu.Lock()
+	defer s.Scripts.mu.Unlock()
+	for _, sc := range s.Scripts.Scripts {
+		if sc.co == L {
+			return sc
+		}
+	}
+	return nil
+}
+
+// describe says what a script is doing for #scripts
+func (sc *Script) describe(now time.Time) string {
+	var what string
+	switch sc.wait {
+	case waitNone:
+		return "running"
+	case waitSleep:
+		what = "sleeping"
+	case waitLine:
+		what = "waiting for /" + sc.re.String() + "/"
+	case waitEvent:
+		what = "waiting for " + sc.event
+	}
+	if !sc.deadline.IsZero() {
+		what += fmt.Sprintf(" (%s left)", sc.deadline.Sub(now).Round(100*time.Millisecond))
+	}
+	return what
+}
+
+// registerScriptAPI adds the coroutine functions to the session table in
+// state
+func (s *Session) registerScriptAPI(state *lua.LState, sessionMT *lua.LTable) {
+	L := state
+	if s.Scripts == nil {
+		s.Scripts = NewScriptRegistry()
+	}
+
+	// session:spawn(name, fn, ...)
+	L.SetField(sessionMT, "spawn", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		fn := L.CheckFunction(2)
+		var args []lua.LValue
+		for i := 3; i <= L.GetTop(); i++ {
+			args = append(args, L.Get(i))
+		}
+		s.SpawnScript(state, name, GetCurrentModule(L), fn, args...)
+		return 0
+	}))
+
+	// session:cancel_script(name)
+	L.SetField(sessionMT, "cancel_script", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(s.CancelScript(L.CheckString(1))))
+		return 1
+	}))
+
+	// session:sleep(ms)
+	L.SetField(sessionMT, "sleep", L.NewFunction(func(L *lua.LState) int {
+		ms := L.CheckInt(1)
+		sc := s.scriptFor(L)
+		if sc == nil {
+			L.RaiseError("sleep called outside of a script, use session.spawn")
+			return 0
+		}
+		if ms < 1 {
+			ms = 1
+		}
+		s.suspend(sc, waitSleep, time.Duration(ms)*time.Millisecond)
+		return L.Yield()
+	}))
+
+	// session:wait_for(pattern, timeout_ms)
+	L.SetField(sessionMT, "wait_for", L.NewFunction(func(L *lua.LState) int {
+		pattern := L.CheckString(1)
+		timeout := L.OptInt(2, 0)
+		sc := s.scriptFor(L)
+		if sc == nil {
+			L.RaiseError("wait_for called outside of a script, use session.spawn")
+			return 0
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			L.RaiseError("invalid regex pattern: %v", err)
+			return 0
+		}
+		s.Scripts.mu.Lock()
+		sc.re = re
+		s.Scripts.mu.Unlock()
+		s.suspend(sc, waitLine, time.Duration(timeout)*time.Millisecond)
+		return L.Yield()
+	}))
+
+	// session:wait_event(name, timeout_ms)
+	L.SetField(sessionMT, "wait_event", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		timeout := L.OptInt(2, 0)
+		sc := s.scriptFor(L)
+		if sc == nil {
+			L.RaiseError("wait_event called outside of a script, use session.spawn")
+			return 0
+		}
+		s.Scripts.mu.Lock()
+		sc.event = name
+		s.Scripts.mu.Unlock()
+		s.suspend(sc, waitEvent, time.Duration(timeout)*time.Millisecond)
+		return L.Yield()
+	}))
+}
+
+func makeScriptRow(sc *Script, now time.Time) table.Row {
+	return table.NewRow(table.RowData{
+		"name":   sc.Name,
+		"module": sc.Module,
+		"state":  sc.describe(now),
+		"age":    now.Sub(sc.Started).Round(time.Second).String(),
+	})
+}
+
+// CmdScripts lists running scripts or cancels one: #scripts [cancel <name>]
+func CmdScripts(s *Session, cmd string) {
+	sub, rest, _ := strings.Cut(strings.TrimSpace(cmd), " ")
+	rest = strings.TrimSpace(rest)
+
+	switch strings.ToLower(sub) {
+	case "", "list":
+		now := time.Now()
+		s.Scripts.mu.Lock()
+		names := make([]string, 0, len(s.Scripts.Scripts))
+		for name := range s.Scripts.Scripts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var rows []table.Row
+		for _, name := range names {
+			rows = append(rows, makeScriptRow(s.Scripts.Scripts[name], now))
+		}
+		s.Scripts.mu.Unlock()
+
+		if len(rows) == 0 {
+			s.Output("No scripts running.\n")
+			return
+		}
+		t := table.New([]table.Column{
+			table.NewColumn("name", "Name", 20).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+			table.NewColumn("module", "Module", 15).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+			table.NewColumn("state", "State", 40).WithStyle(lipgloss.NewStyle().Align(lipgloss.Left)),
+			table.NewColumn("age", "Age", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		}).
+			WithRows(rows).
+			BorderRounded()
+		s.Output(t.View() + "\n")
+
+	case "cancel", "kill":
+		if rest == "" {
+			s.Output("Usage: #scripts cancel <name>\n")
+			return
+		}
+		if !s.CancelScript(rest) {
+			s.Output(fmt.Sprintf("No script named %s\n", rest))
+			return
+		}
+		s.Output(fmt.Sprintf("Cancelled script %s\n", rest))
+
+	default:
+		s.Output("Usage: #scripts [cancel <name>]\n")
+	}
+}
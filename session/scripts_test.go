@@ -0,0 +1,151 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func newScriptTestSession(t *testing.T) *Session {
+	s := newTickerTestSession(t)
+	s.Events = NewEventRegistry()
+	s.LuaState = lua.NewState()
+	s.Modules = NewModuleRegistry()
+	t.Cleanup(s.LuaState.Close)
+	s.RegisterLuaAPI()
+	return s
+}
+
+// doString runs Lua code on the session's loop, as a script would run
+func doString(s *Session, code string) error {
+	var err error
+	s.Call(func() { err = s.LuaState.DoString(code) })
+	return err
+}
+
+// fireEvent fires an event on the session's loop
+func fireEvent(s *Session, name string, data EventData) {
+	s.Call(func() { s.FireEvent(name, data) })
+}
+
+// expectOutput reads session output until want appears
+func expectOutput(t *testing.T, s *Session, want string) {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case msg := <-s.Sub:
+			if u, ok := msg.(UpdateMessage); ok && strings.Contains(u.Content, want) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for output %q", want)
+		}
+	}
+}
+
+// waitSuspended waits until the named script is suspended in wait and no
+// script is running, so the test may safely fire lines and events
+func waitSuspended(t *testing.T, s *Session, name string, wait scriptWait) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(time.Millisecond) {
+		s.Scripts.mu.Lock()
+		sc := s.Scripts.Scripts[name]
+		ok := sc != nil && sc.wait == wait && !s.Scripts.running
+		s.Scripts.mu.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatalf("script %s never suspended", name)
+}
+
+func TestScriptSequence(t *testing.T) {
+	s := newScriptTestSession(t)
+
+	err := doString(s, `
+		session.spawn("seq", function(who)
+			session.output("start " .. who .. "\n")
+			session.sleep(20)
+			session.output("slept\n")
+			local m = session.wait_for("^(\\w+) arrives", 5000)
+			session.output("saw " .. m[2] .. "\n")
+			local evt = session.wait_event("test.go")
+			session.output("event " .. evt.event .. "\n")
+			local none = session.wait_for("never matches", 30)
+			session.output("timeout " .. tostring(none) .. "\n")
+		end, "bob")
+	`)
+	if err != nil {
+		t.Fatalf("spawn failed: %v", err)
+	}
+	expectOutput(t, s, "start bob")
+	expectOutput(t, s, "slept")
+
+	waitSuspended(t, s, "seq", waitLine)
+	fireEvent(s, EventLine, LineEvent{BaseEvent: NewBaseEvent(), Line: "Someone leaves", Stripped: "Someone leaves"})
+	fireEvent(s, EventLine, LineEvent{BaseEvent: NewBaseEvent(), Line: "Alice arrives", Stripped: "Alice arrives"})
+	expectOutput(t, s, "saw Alice")
+
+	waitSuspended(t, s, "seq", waitEvent)
+	fireEvent(s, "test.go", TestEventData{BaseEvent: NewBaseEvent()})
+	expectOutput(t, s, "event test.go")
+
+	expectOutput(t, s, "timeout nil")
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		s.Scripts.mu.Lock()
+		n := len(s.Scripts.Scripts)
+		s.Scripts.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("finished script is still registered")
+		}
+	}
+}
+
+func TestScriptCancel(t *testing.T) {
+	s := newScriptTestSession(t)
+
+	if err := doString(s, `session.sleep(10)`); err == nil {
+		t.Error("sleep outside a script did not fail")
+	}
+
+	err := doString(s, `
+		session.spawn("loop", function()
+			while true do
+				session.wait_for("tick")
+				session.output("ticked\n")
+			end
+		end)
+	`)
+	if err != nil {
+		t.Fatalf("spawn failed: %v", err)
+	}
+	waitSuspended(t, s, "loop", waitLine)
+
+	s.Call(func() { CmdScripts(s, "") })
+	expectOutput(t, s, "waiting for /tick/")
+
+	s.Call(func() { CmdScripts(s, "cancel loop") })
+	expectOutput(t, s, "Cancelled script loop")
+	s.Call(func() {
+		if len(s.Scripts.Scripts) != 0 {
+			t.Error("script still registered after cancel")
+		}
+		for _, evt := range s.Events.Events[EventLine] {
+			if evt.Name == scriptHook("loop") {
+				t.Error("cancelled script is still listening for lines")
+			}
+		}
+	})
+	fireEvent(s, EventLine, LineEvent{BaseEvent: NewBaseEvent(), Line: "tick", Stripped: "tick"})
+	select {
+	case msg := <-s.Sub:
+		t.Errorf("cancelled script produced output: %v", msg)
+	default:
+	}
+}
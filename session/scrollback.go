@@ -0,0 +1,141 @@
+package session
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/muesli/reflow/wordwrap"
+)
+
+// DefaultScrollbackLines is how many lines a session keeps for the main
+// window
+const DefaultScrollbackLines = 20000
+
+// Scrollback holds the text shown in a session's main window as a ring of
+// lines, dropping the oldest once it holds Max. Each line caches its rows
+// wrapped to the last width asked for, so the window only wraps lines it
+// has not seen at that width.
+type Scrollback struct {
+	Max int
+
+	mu      sync.Mutex
+	lines   []scrollLine // ring of complete lines, oldest at head once full
+	head    int
+	partial scrollLine // text after the last newline
+}
+
+type scrollLine struct {
+	text  string
+	width int // width rows were wrapped to, 0 if not wrapped yet
+	rows  []string
+}
+
+// NewScrollback returns an empty scrollback keeping max lines, or
+// DefaultScrollbackLines if max is zero
+func NewScrollback(max int) *Scrollback {
+	if max <= 0 {
+		max = DefaultScrollbackLines
+	}
+	return &Scrollback{Max: max}
+}
+
+// Write appends text, which may hold several lines or part of one
+func (b *Scrollback) Write(text string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			break
+		}
+		b.push(b.partial.text + text[:i])
+		b.partial = scrollLine{}
+		text = text[i+1:]
+	}
+	if text != "" {
+		b.partial = scrollLine{text: b.partial.text + text}
+	}
+}
+
+func (b *Scrollback) push(text string) {
+	if len(b.lines) < b.Max {
+		b.lines = append(b.lines, scrollLine{text: text})
+		return
+	}
+	b.lines[b.head] = scrollLine{text: text}
+	b.head = (b.head + 1) % len(b.lines)
+}
+
+// line returns the ith line, oldest first, with the partial line last
+func (b *Scrollback) line(i int) *scrollLine {
+	if i == len(b.lines) {
+		return &b.partial
+	}
+	return &b.lines[(b.head+i)%len(b.lines)]
+}
+
+// Len returns the number of complete lines held
+func (b *Scrollback) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.lines)
+}
+
+// String returns the text held, as it was written
+func (b *Scrollback) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var sb strings.Builder
+	for i := 0; i < len(b.lines); i++ {
+		sb.WriteString(b.line(i).text)
+		sb.WriteByte('\n')
+	}
+	sb.WriteString(b.partial.text)
+	return sb.String()
+}
+
+// Tail returns the last n rows wrapped to width, the partial line being the
+// last row. Only the lines needed are visited, so the cost depends on n
+// rather than the size of the scrollback.
+func (b *Scrollback) Tail(n, width int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var chunks [][]string
+	count := 0
+	for i := len(b.lines); i >= 0 && count < n; i-- {
+		rows := b.line(i).wrap(width)
+		chunks = append(chunks, rows)
+		count += len(rows)
+	}
+
+	out := make([]string, 0, count)
+	for i := len(chunks) - 1; i >= 0; i-- {
+		out = append(out, chunks[i]...)
+	}
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// Rows returns every row wrapped to width
+func (b *Scrollback) Rows(width int) []string {
+	return b.Tail(int(^uint(0)>>1), width)
+}
+
+// wrap returns the line's rows at width, wrapping it if the cached rows
+// are for another width
+func (l *scrollLine) wrap(width int) []string {
+	if width <= 0 {
+		return []string{l.text}
+	}
+	if l.width != width {
+		l.width = width
+		if l.text == "" {
+			l.rows = []string{""}
+		} else {
+			l.rows = strings.Split(wordwrap.String(l.text, width), "\n")
+		}
+	}
+	return l.rows
+}
@@ -0,0 +1,85 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/muesli/reflow/wordwrap"
+)
+
+func TestScrollbackWrite(t *testing.T) {
+	b := NewScrollback(3)
+	b.Write("one\ntw")
+	b.Write("o\n")
+	if got := b.String(); got != "one\ntwo\n" {
+		t.Errorf("String() = %q", got)
+	}
+	// "five" is still a partial line, so four lines have been written and
+	// the cap of 3 dropped "one"
+	b.Write("three\nfour\nfive")
+	if got := b.String(); got != "two\nthree\nfour\nfive" {
+		t.Errorf("after wrapping the ring, String() = %q", got)
+	}
+	if n := b.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+}
+
+func TestScrollbackTail(t *testing.T) {
+	b := NewScrollback(0)
+	b.Write("short\n")
+	b.Write("a line long enough to wrap\n")
+	b.Write("\x1b[1;32mgreen\x1b[0m\n")
+
+	want := []string{"a line long", "enough to", "wrap", "\x1b[1;32mgreen\x1b[0m", ""}
+	if got := b.Tail(5, 12); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Tail(5, 12) = %q, want %q", got, want)
+	}
+	if got := b.Tail(2, 0); strings.Join(got, "|") != "\x1b[1;32mgreen\x1b[0m|" {
+		t.Errorf("unwrapped Tail(2, 0) = %q", got)
+	}
+	// A new width rewraps the cached rows
+	if got := b.Rows(80); len(got) != 4 || got[1] != "a line long enough to wrap" {
+		t.Errorf("Rows(80) = %q", got)
+	}
+}
+
+var benchLine = "\x1b[1;32mA cityguard is standing here, watching for trouble and keeping the peace in the town square.\x1b[0m\n"
+
+// BenchmarkScrollbackFollow measures adding a line and refreshing a
+// following viewport, which should not depend on how much scrollback there is
+func BenchmarkScrollbackFollow(b *testing.B) {
+	for _, size := range []int{1000, 100000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			sb := NewScrollback(size)
+			for i := 0; i < size; i++ {
+				sb.Write(benchLine)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sb.Write(benchLine)
+				strings.Join(sb.Tail(200, 80), "\n")
+			}
+		})
+	}
+}
+
+// BenchmarkContentRewrap is the old approach, appending to one string and
+// rewrapping all of it for every update
+func BenchmarkContentRewrap(b *testing.B) {
+	for _, size := range []int{1000, 100000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			content := strings.Repeat(benchLine, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				content += benchLine
+				lines := strings.Split(content, "\n")
+				for j, l := range lines {
+					lines[j] = wordwrap.String(l, 80)
+				}
+				strings.Join(lines, "\n")
+			}
+		})
+	}
+}
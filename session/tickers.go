@@ -1,17 +1,23 @@
 package session
 
 import (
+	"container/heap"
 	"context"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/evertras/bubble-table/table"
 	"github.com/perlsaiyan/zif/config"
+	"github.com/perlsaiyan/zif/schedule"
 )
 
 // logPanic writes panic information to a panic log file
@@ -37,11 +43,21 @@ func logPanic(location string, panicValue interface{}, stack []byte) {
 	log.Printf("PANIC in %s: %v\nStack:\n%s", location, panicValue, string(stack))
 }
 
+// TickerRegistry schedules a session's timers. Entries is keyed by name and
+// guarded by mu; due timers are kept in a heap ordered by NextFire so the
+// scheduler goroutine sleeps until the next one is due.
 type TickerRegistry struct {
 	Context context.Context
 	Entries map[string]*TickerRecord
+
+	mu   sync.Mutex
+	due  tickerHeap
+	wake chan struct{}
 }
 
+// TickerRecord is a timer. It fires every Interval milliseconds, plus up to
+// Jitter milliseconds at random, or at the times given by Schedule if set.
+// With Iterations set it is removed after firing that many times.
 type TickerRecord struct {
 	Name       string
 	Interval   int
@@ -51,17 +67,199 @@ type TickerRecord struct {
 	NextFire   time.Time
 	Count      uint
 	Iterations uint
+	Jitter     int
+	Schedule   schedule.Schedule
+	Paused     bool
+	Drift      time.Duration // how late the last firing was
+
+	remaining time.Duration // time left until NextFire when paused
+	index     int           // position in the heap, -1 when not scheduled
+}
+
+// next computes when a ticker fires after t
+func (t *TickerRecord) next(after time.Time) time.Time {
+	if t.Schedule != nil {
+		return t.Schedule.Next(after)
+	}
+	d := time.Duration(t.Interval) * time.Millisecond
+	if t.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(t.Jitter)+1)) * time.Millisecond
+	}
+	return after.Add(d)
+}
+
+type tickerHeap []*TickerRecord
+
+func (h tickerHeap) Len() int           { return len(h) }
+func (h tickerHeap) Less(i, j int) bool { return h[i].NextFire.Before(h[j].NextFire) }
+func (h tickerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *tickerHeap) Push(x interface{}) {
+	t := x.(*TickerRecord)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+func (h *tickerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
 }
 
 func NewTickerRegistry(ctx context.Context, s *Session) {
-	s.Tickers = &TickerRegistry{Context: ctx, Entries: make(map[string]*TickerRecord)}
+	s.Tickers = &TickerRegistry{Context: ctx, Entries: make(map[string]*TickerRecord), wake: make(chan struct{}, 1)}
 	go SessionTicker(s)
 }
 
-func (s *Session) AddTicker(ticker *TickerRecord) {
-	s.Tickers.Entries[ticker.Name] = ticker
+// minTickerInterval is the shortest interval a repeating ticker may have.
+// A shorter one would be due again as soon as it fired and keep the
+// scheduler from ever sleeping.
+const minTickerInterval = 10
+
+// AddTicker schedules a ticker, replacing any with the same name. A zero
+// NextFire means one interval (or the next scheduled time) from now.
+// Repeating tickers fire at most every minTickerInterval milliseconds. A
+// ticker whose schedule has no next time is refused, leaving any ticker of
+// the same name in place.
+func (s *Session) AddTicker(ticker *TickerRecord) error {
+	if ticker.Schedule == nil && ticker.Iterations != 1 && ticker.Interval < minTickerInterval {
+		log.Printf("Ticker %s interval %dms raised to %dms", ticker.Name, ticker.Interval, minTickerInterval)
+		ticker.Interval = minTickerInterval
+	}
+	if ticker.NextFire.IsZero() {
+		ticker.NextFire = ticker.next(time.Now())
+	}
+	if ticker.NextFire.IsZero() {
+		return fmt.Errorf("ticker %s never falls due", ticker.Name)
+	}
+
+	r := s.Tickers
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if old, ok := r.Entries[ticker.Name]; ok {
+		r.unschedule(old)
+	}
+	ticker.index = -1
+	r.Entries[ticker.Name] = ticker
+	if ticker.Paused {
+		ticker.remaining = time.Until(ticker.NextFire)
+	} else {
+		heap.Push(&r.due, ticker)
+		r.notify()
+	}
+	return nil
+}
+
+func (s *Session) RemoveTicker(name string) {
+	r := s.Tickers
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.Entries[name]; ok {
+		r.unschedule(t)
+		delete(r.Entries, name)
+	}
+}
+
+// PauseTicker stops a ticker from firing until it is resumed, keeping the
+// time it had left. It reports whether the ticker exists.
+func (s *Session) PauseTicker(name string) bool {
+	r := s.Tickers
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.Entries[name]
+	if ok && !t.Paused {
+		r.unschedule(t)
+		t.Paused = true
+		t.remaining = time.Until(t.NextFire)
+	}
+	return ok
+}
+
+// ResumeTicker restarts a paused ticker. It reports whether the ticker exists.
+func (s *Session) ResumeTicker(name string) bool {
+	r := s.Tickers
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.Entries[name]
+	if ok && t.Paused {
+		t.Paused = false
+		t.NextFire = time.Now().Add(t.remaining)
+		heap.Push(&r.due, t)
+		r.notify()
+	}
+	return ok
+}
+
+func (r *TickerRegistry) unschedule(t *TickerRecord) {
+	if t.index >= 0 && t.index < len(r.due) && r.due[t.index] == t {
+		heap.Remove(&r.due, t.index)
+	}
+}
+
+// notify wakes the scheduler so it recomputes its sleep
+func (r *TickerRegistry) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
 }
 
+// popDue takes the tickers due at now off the heap, reschedules those that
+// repeat and returns them in firing order.
+func (r *TickerRegistry) popDue(now time.Time) []*TickerRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var fired []*TickerRecord
+	for len(r.due) > 0 && !r.due[0].NextFire.After(now) {
+		t := heap.Pop(&r.due).(*TickerRecord)
+		t.Drift = now.Sub(t.NextFire)
+		t.LastFire = now
+		t.Count++
+		fired = append(fired, t)
+
+		if t.Iterations > 0 && t.Count >= t.Iterations {
+			delete(r.Entries, t.Name)
+			continue
+		}
+		// Schedule from the intended time so drift doesn't accumulate,
+		// but never fire twice for one missed interval
+		next := t.next(t.NextFire)
+		if !next.After(now) {
+			next = t.next(now)
+		}
+		t.NextFire = next
+		if next.IsZero() {
+			delete(r.Entries, t.Name)
+			continue
+		}
+		heap.Push(&r.due, t)
+	}
+	return fired
+}
+
+// nextWait returns how long the scheduler may sleep
+func (r *TickerRegistry) nextWait(now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.due) == 0 {
+		return time.Hour
+	}
+	return r.due[0].NextFire.Sub(now)
+}
+
+// SessionTicker fires a session's tickers as they fall due until the
+// session's context is cancelled, running each on the session's loop.
 func SessionTicker(s *Session) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -77,57 +275,120 @@ func SessionTicker(s *Session) {
 	}()
 
 	s.Output("Launching ticker!!\n")
+	r := s.Tickers
+	timer := time.NewTimer(r.nextWait(time.Now()))
+	defer timer.Stop()
 	for {
 		select {
-		case <-s.Context.Done():
+		case <-r.Context.Done():
 			s.Output("KILLING TICKER!!!\n")
 			return
+		case <-r.wake:
+		case <-timer.C:
+		}
 
-		default:
-
-			for k, v := range s.Tickers.Entries {
-				if v.NextFire.Before(time.Now()) {
-					v.LastFire = time.Now()
-					//log.Printf("Firing ticker " + v.Name + "\n")
-					if v.Fn != nil {
-						v.Fn(s)
-					} else if len(v.Command) > 0 {
-						s.Socket.Write([]byte(v.Command + LineTerminator))
-					}
-					// Check if timer still exists (might have been removed by one-shot timer)
-					if _, exists := s.Tickers.Entries[k]; exists {
-						v.NextFire = time.Now().Add(time.Duration(v.Interval) * time.Millisecond)
-						s.Tickers.Entries[k] = v
-					}
-				}
-			}
-
-			time.Sleep(50 * time.Millisecond)
+		// Timers fire on the session's loop, in order
+		for _, t := range r.popDue(time.Now()) {
+			s.Do(func() { r.fire(s, t) })
 		}
 
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(r.nextWait(time.Now()))
 	}
+}
 
+// fire runs a ticker that fell due, unless it was paused while its job
+// waited for the session's loop
+func (r *TickerRegistry) fire(s *Session, t *TickerRecord) {
+	r.mu.Lock()
+	paused := t.Paused
+	r.mu.Unlock()
+	if paused {
+		return
+	}
+	if t.Fn != nil {
+		t.Fn(s)
+	} else if len(t.Command) > 0 {
+		s.ParseCommand(t.Command)
+	}
 }
 
-func makeTickerRow(name string, last time.Time, next time.Time) table.Row {
+func makeTickerRow(t *TickerRecord) table.Row {
+	next := time.Until(t.NextFire).Round(time.Second).String()
+	if t.Paused {
+		next = "paused (" + t.remaining.Round(time.Second).String() + ")"
+	}
+	last := "never"
+	if t.Count > 0 {
+		last = time.Since(t.LastFire).Round(time.Second).String() + " ago"
+	}
+	every := (time.Duration(t.Interval) * time.Millisecond).String()
+	if t.Schedule != nil {
+		every = t.Schedule.String()
+	} else if t.Jitter > 0 {
+		every += fmt.Sprintf(" +%dms", t.Jitter)
+	}
+	count := fmt.Sprint(t.Count)
+	if t.Iterations > 0 {
+		count += fmt.Sprintf("/%d", t.Iterations)
+	}
 
 	return table.NewRow(table.RowData{
-		"name":      name,
-		"last fire": time.Since(last).Round(time.Second).String() + " ago",
-		"next fire": time.Until(next).Round(time.Second),
+		"name":      t.Name,
+		"every":     every,
+		"last fire": last,
+		"next fire": next,
+		"count":     count,
+		"drift":     t.Drift.Round(time.Millisecond).String(),
 	})
 }
 
+// CmdTickers lists tickers, or pauses and resumes them:
+// #tickers [pause|resume <name>]
 func CmdTickers(s *Session, cmd string) {
+	fields := strings.Fields(cmd)
+	if len(fields) == 2 && (fields[0] == "pause" || fields[0] == "resume") {
+		ok := false
+		if fields[0] == "pause" {
+			ok = s.PauseTicker(fields[1])
+		} else {
+			ok = s.ResumeTicker(fields[1])
+		}
+		if !ok {
+			s.Output(fmt.Sprintf("No ticker named %s\n", fields[1]))
+		} else {
+			s.Output(fmt.Sprintf("Ticker %s %sd\n", fields[1], fields[0]))
+		}
+		return
+	} else if len(fields) > 0 {
+		s.Output("Usage: #tickers [pause|resume <name>]\n")
+		return
+	}
+
+	s.Tickers.mu.Lock()
+	names := make([]string, 0, len(s.Tickers.Entries))
+	for name := range s.Tickers.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 	var rows []table.Row
-	for _, i := range s.Tickers.Entries {
-		rows = append(rows, makeTickerRow(i.Name, i.LastFire, i.NextFire))
+	for _, name := range names {
+		rows = append(rows, makeTickerRow(s.Tickers.Entries[name]))
 	}
+	s.Tickers.mu.Unlock()
 
 	t := table.New([]table.Column{
 		table.NewColumn("name", "Name", 25).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
-		table.NewColumn("last fire", "Last Fire", 20).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
-		table.NewColumn("next fire", "Next Fire", 20).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center).Foreground(lipgloss.Color("#8c8"))),
+		table.NewColumn("every", "Every", 16).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("last fire", "Last Fire", 14).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("next fire", "Next Fire", 16).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center).Foreground(lipgloss.Color("#8c8"))),
+		table.NewColumn("count", "Count", 8).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
+		table.NewColumn("drift", "Drift", 10).WithStyle(lipgloss.NewStyle().Align(lipgloss.Center)),
 	}).
 		WithRows(rows).
 		BorderRounded()
@@ -143,11 +404,11 @@ func CmdCancelTicker(s *Session, cmd string) {
 }
 
 func CmdTestTicker(s *Session, cmd string) {
-	s.Tickers.Entries["test1"] = &TickerRecord{
+	s.AddTicker(&TickerRecord{
 		Name:     "test1",
 		Interval: 5000,
 		Command:  "smile",
 		NextFire: time.Now().Add(5000 * time.Millisecond),
 		LastFire: time.Now(),
-	}
+	})
 }
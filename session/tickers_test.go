@@ -0,0 +1,144 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func newTickerTestSession(t *testing.T) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := &Session{Name: "test", Context: ctx, Sub: make(chan tea.Msg, 1000), loop: newEventLoop()}
+	s.startLoop()
+	NewTickerRegistry(ctx, s)
+	return s
+}
+
+func TestTickerIterationsAndPause(t *testing.T) {
+	s := newTickerTestSession(t)
+
+	var limited, paused atomic.Int32
+	s.AddTicker(&TickerRecord{Name: "limited", Interval: 10, Iterations: 3, Fn: func(*Session) { limited.Add(1) }})
+	s.AddTicker(&TickerRecord{Name: "paused", Interval: 10, Paused: true, Fn: func(*Session) { paused.Add(1) }})
+
+	time.Sleep(150 * time.Millisecond)
+	if n := limited.Load(); n != 3 {
+		t.Errorf("limited ticker fired %d times, want 3", n)
+	}
+	s.Tickers.mu.Lock()
+	_, stillThere := s.Tickers.Entries["limited"]
+	s.Tickers.mu.Unlock()
+	if stillThere {
+		t.Error("ticker was not removed after its last iteration")
+	}
+	if n := paused.Load(); n != 0 {
+		t.Errorf("paused ticker fired %d times", n)
+	}
+
+	if !s.ResumeTicker("paused") {
+		t.Fatal("ResumeTicker failed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	s.PauseTicker("paused")
+	n := paused.Load()
+	if n == 0 {
+		t.Error("resumed ticker did not fire")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if paused.Load() != n {
+		t.Error("ticker fired after being paused again")
+	}
+}
+
+func TestTickerConcurrentChanges(t *testing.T) {
+	s := newTickerTestSession(t)
+
+	var fired atomic.Int32
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				name := fmt.Sprintf("t%d-%d", g, i%5)
+				s.AddTicker(&TickerRecord{Name: name, Interval: 1, Jitter: 2, Fn: func(*Session) { fired.Add(1) }})
+				if i%3 == 0 {
+					s.RemoveTicker(name)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(g)
+	}
+	wg.Wait()
+	time.Sleep(20 * time.Millisecond)
+
+	if fired.Load() == 0 {
+		t.Error("no tickers fired")
+	}
+	s.Tickers.mu.Lock()
+	defer s.Tickers.mu.Unlock()
+	if len(s.Tickers.due) != len(s.Tickers.Entries) {
+		t.Errorf("heap has %d tickers, registry %d", len(s.Tickers.due), len(s.Tickers.Entries))
+	}
+}
+
+func TestZeroIntervalTicker(t *testing.T) {
+	s := newTickerTestSession(t)
+
+	// A repeating ticker without an interval must not keep the scheduler busy
+	var fired atomic.Int32
+	s.AddTicker(&TickerRecord{Name: "zero", Fn: func(*Session) { fired.Add(1) }})
+	time.Sleep(55 * time.Millisecond)
+	s.RemoveTicker("zero")
+	if n := fired.Load(); n == 0 || n > 6 {
+		t.Errorf("zero interval ticker fired %d times in 55ms", n)
+	}
+
+	s.Modules = NewModuleRegistry()
+	path := writeModule(t, t.TempDir(), "spin", `session.add_timer("x", 0, function() end)`)
+	if err := LoadModule(s, path); err == nil || !strings.Contains(err.Error(), "interval must be a positive") {
+		t.Errorf("add_timer with a zero interval: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.AddTicker(&TickerRecord{Name: "after", Interval: 1000, Fn: func(*Session) {}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("scheduler hung")
+	}
+}
+
+// never is a schedule with no next time
+type never struct{}
+
+func (never) Next(time.Time) time.Time { return time.Time{} }
+func (never) String() string           { return "never" }
+
+func TestTickerWithoutNextTime(t *testing.T) {
+	s := newTickerTestSession(t)
+
+	s.AddTicker(&TickerRecord{Name: "t", Interval: 1000, Fn: func(*Session) {}})
+	var fired atomic.Int32
+	if err := s.AddTicker(&TickerRecord{Name: "t", Schedule: never{}, Fn: func(*Session) { fired.Add(1) }}); err == nil {
+		t.Error("AddTicker accepted a ticker that never falls due")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if n := fired.Load(); n != 0 {
+		t.Errorf("refused ticker fired %d times", n)
+	}
+	s.Tickers.mu.Lock()
+	defer s.Tickers.mu.Unlock()
+	if tk, ok := s.Tickers.Entries["t"]; !ok || tk.Schedule != nil || len(s.Tickers.due) != 1 {
+		t.Error("refused ticker replaced the one already scheduled")
+	}
+}
@@ -0,0 +1,155 @@
+package session
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/perlsaiyan/zif/config"
+	"github.com/perlsaiyan/zif/tintin"
+)
+
+// MaxAliasDepth limits how deeply aliases may expand into other aliases
+const MaxAliasDepth = 10
+
+var placeholderRE = regexp.MustCompile(`%([0-9*])`)
+
+// ExpandAliasBody substitutes placeholders in an alias body. %0 is the whole
+// input line, %1-%9 are the words after the alias name and %* is everything
+// after the alias name. If the body uses no placeholders the arguments are
+// appended to it, so "#alias {k} {kill}" turns "k orc" into "kill orc".
+func ExpandAliasBody(body string, input string) string {
+	input = strings.TrimSpace(input)
+	rest := ""
+	if _, after, ok := strings.Cut(input, " "); ok {
+		rest = strings.TrimSpace(after)
+	}
+	words := strings.Fields(rest)
+
+	if !placeholderRE.MatchString(body) {
+		if rest == "" {
+			return body
+		}
+		return body + " " + rest
+	}
+
+	return placeholderRE.ReplaceAllStringFunc(body, func(m string) string {
+		switch m[1] {
+		case '0':
+			return input
+		case '*':
+			return rest
+		default:
+			n := int(m[1] - '0')
+			if n <= len(words) {
+				return words[n-1]
+			}
+			return ""
+		}
+	})
+}
+
+// AddTintinAlias registers an alias that expands to a command body.
+func (s *Session) AddTintinAlias(name string, body string) {
+	s.AddAlias(Alias{
+		Name:    name,
+		Pattern: `^` + regexp.QuoteMeta(name) + `(?:\s+.*)?$`,
+		Body:    body,
+		Enabled: true,
+		Fn: func(sess *Session, matches []string) {
+			sess.RunCommands(tintin.SplitCommands(ExpandAliasBody(body, matches[0])))
+		},
+	})
+}
+
+// RunCommands runs each command as if it had been typed, without echoing it.
+// Aliases may expand into other aliases up to MaxAliasDepth levels deep.
+func (s *Session) RunCommands(cmds []string) {
+	if s.aliasDepth >= MaxAliasDepth {
+		s.Output(fmt.Sprintf("Alias recursion limit (%d) reached, dropping: %s\n", MaxAliasDepth, strings.Join(cmds, ";")))
+		return
+	}
+	s.aliasDepth++
+	defer func() { s.aliasDepth-- }()
+
+	for _, cmd := range cmds {
+		s.dispatchInput(cmd)
+	}
+}
+
+// saveUserAliases writes the session's #alias aliases to its
+// user_aliases.yaml. aliases.yaml is left for the user to edit by hand.
+func (s *Session) saveUserAliases() error {
+	var cfg config.AliasesConfig
+	for _, a := range s.Aliases.Aliases {
+		if _, declared := s.declared.aliases[a.Name]; a.Body == "" || declared {
+			continue
+		}
+		cfg.Aliases = append(cfg.Aliases, config.AliasConfig{Name: a.Name, Body: a.Body})
+	}
+	sort.Slice(cfg.Aliases, func(i, j int) bool { return cfg.Aliases[i].Name < cfg.Aliases[j].Name })
+	return config.SaveSessionUserAliases(s.Name, &cfg)
+}
+
+func CmdAlias(s *Session, cmd string) {
+	args := tintin.BraceArgs(cmd)
+
+	switch len(args) {
+	case 0:
+		CmdAliases(s, "")
+		return
+	case 1:
+		if a, ok := s.Aliases.Aliases[args[0]]; ok {
+			s.Output(fmt.Sprintf("#alias {%s} {%s}\n", a.Name, a.Body))
+		} else {
+			s.Output(fmt.Sprintf("No alias named %s\n", args[0]))
+		}
+		return
+	}
+
+	name := args[0]
+	body := strings.Join(args[1:], " ")
+	if strings.ContainsAny(name, " \t") {
+		s.Output("Alias names cannot contain spaces\n")
+		return
+	}
+
+	// Redefining an alias from aliases.yaml makes it an #alias alias, which
+	// is loaded after aliases.yaml and so wins
+	s.AddTintinAlias(name, body)
+	delete(s.declared.aliases, name)
+	if err := s.saveUserAliases(); err != nil {
+		log.Printf("Failed to save aliases for %s: %v", s.Name, err)
+		s.Output(fmt.Sprintf("Alias set, but could not be saved: %v\n", err))
+		return
+	}
+	s.Output(fmt.Sprintf("Alias {%s} now expands to {%s}\n", name, body))
+}
+
+func CmdUnalias(s *Session, cmd string) {
+	args := tintin.BraceArgs(cmd)
+	if len(args) != 1 {
+		s.Output("Usage: #unalias {name}\n")
+		return
+	}
+
+	a, ok := s.Aliases.Aliases[args[0]]
+	if !ok || a.Body == "" {
+		s.Output(fmt.Sprintf("No alias named %s\n", args[0]))
+		return
+	}
+	if file, ok := s.declared.aliases[args[0]]; ok {
+		s.Output(fmt.Sprintf("Alias %s is defined in %s; remove it there and #reload config\n", args[0], file))
+		return
+	}
+
+	s.RemoveAlias(args[0])
+	if err := s.saveUserAliases(); err != nil {
+		log.Printf("Failed to save aliases for %s: %v", s.Name, err)
+		s.Output(fmt.Sprintf("Alias removed, but could not be saved: %v\n", err))
+		return
+	}
+	s.Output(fmt.Sprintf("Removed alias %s\n", args[0]))
+}
@@ -0,0 +1,74 @@
+package session
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestExpandAliasBody(t *testing.T) {
+	tests := []struct {
+		body, input, want string
+	}{
+		{"kill %1", "k orc", "kill orc"},
+		{"kill", "k orc", "kill orc"},
+		{"kill", "k", "kill"},
+		{"tell %1 %*", "t bob hello there", "tell bob bob hello there"},
+		{"say %0", "s hi", "say s hi"},
+		{"cast '%1' %2", "c fireball", "cast 'fireball' "},
+	}
+	for _, tt := range tests {
+		if got := ExpandAliasBody(tt.body, tt.input); got != tt.want {
+			t.Errorf("ExpandAliasBody(%q, %q) = %q, want %q", tt.body, tt.input, got, tt.want)
+		}
+	}
+}
+
+func newAliasTestSession() (*Session, *[]string) {
+	s := &Session{
+		Name:       "test",
+		Sub:        make(chan tea.Msg, 1000),
+		Aliases:    NewAliasRegistry(),
+		Scrollback: NewScrollback(0),
+	}
+	var said []string
+	s.AddAlias(Alias{
+		Name:    "say",
+		Pattern: `^say (.*)$`,
+		Enabled: true,
+		Fn:      func(_ *Session, m []string) { said = append(said, m[1]) },
+	})
+	return s, &said
+}
+
+func TestTintinAliasExpansion(t *testing.T) {
+	s, said := newAliasTestSession()
+	s.AddTintinAlias("greet", "say hello %1;say bye %1")
+	s.AddTintinAlias("g2", "greet %1;say done")
+
+	s.dispatchInput("g2 bob")
+
+	want := []string{"hello bob", "bye bob", "done"}
+	if !reflect.DeepEqual(*said, want) {
+		t.Errorf("said %q, want %q", *said, want)
+	}
+	if s.aliasDepth != 0 {
+		t.Errorf("alias depth not restored: %d", s.aliasDepth)
+	}
+}
+
+func TestTintinAliasRecursionLimit(t *testing.T) {
+	s, _ := newAliasTestSession()
+	s.AddTintinAlias("loop", "loop")
+
+	s.dispatchInput("loop")
+
+	if !strings.Contains(s.Scrollback.String(), "recursion limit") {
+		t.Errorf("expected recursion limit message, got %q", s.Scrollback.String())
+	}
+	if s.aliasDepth != 0 {
+		t.Errorf("alias depth not restored: %d", s.aliasDepth)
+	}
+}
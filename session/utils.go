@@ -1,6 +1,21 @@
 package session
 
+// Output shows zif's own output in the session and records it in the ring
+// log as system output
 func (s *Session) Output(msg string) {
-	s.Content += msg
+	s.recordLines(RingContextSystem, msg)
+	s.display(msg)
+}
+
+// display shows text in the session without recording it
+func (s *Session) display(msg string) {
+	s.show(msg)
 	s.Sub <- UpdateMessage{Session: s.Name, Content: msg}
 }
+
+// show adds text to the session's scrollback
+func (s *Session) show(text string) {
+	if s.Scrollback != nil {
+		s.Scrollback.Write(text)
+	}
+}
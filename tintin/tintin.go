@@ -0,0 +1,76 @@
+// Package tintin parses the tintin++ command syntax shared by zif's #alias
+// family of commands and the tintin and zMUD importers.
+package tintin
+
+import "strings"
+
+// BraceArgs splits tintin-style arguments. Words are separated by
+// whitespace and a {braced} group is a single argument with the outer
+// braces removed; braces may nest.
+//
+//	BraceArgs("{k} {kill %1;loot}") => ["k", "kill %1;loot"]
+func BraceArgs(s string) []string {
+	var args []string
+	var cur strings.Builder
+	depth := 0
+	inArg := false
+
+	for _, r := range s {
+		switch {
+		case r == '{':
+			if depth > 0 {
+				cur.WriteRune(r)
+			}
+			depth++
+			inArg = true
+		case r == '}' && depth > 0:
+			depth--
+			if depth > 0 {
+				cur.WriteRune(r)
+			} else {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		case (r == ' ' || r == '\t' || r == '\n' || r == '\r') && depth == 0:
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+// SplitCommands splits a command body on semicolons that are not inside braces.
+func SplitCommands(body string) []string {
+	var cmds []string
+	var cur strings.Builder
+	depth := 0
+	for _, r := range body {
+		switch {
+		case r == '{':
+			depth++
+		case r == '}' && depth > 0:
+			depth--
+		case r == ';' && depth == 0:
+			if c := strings.TrimSpace(cur.String()); c != "" {
+				cmds = append(cmds, c)
+			}
+			cur.Reset()
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	if c := strings.TrimSpace(cur.String()); c != "" {
+		cmds = append(cmds, c)
+	}
+	return cmds
+}
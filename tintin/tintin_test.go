@@ -0,0 +1,31 @@
+package tintin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBraceArgs(t *testing.T) {
+	tests := map[string][]string{
+		`{k} {kill %1;loot}`:       {"k", "kill %1;loot"},
+		`k kill %1`:                {"k", "kill", "%1"},
+		`{gt} {#all {tell %1 %*}}`: {"gt", "#all {tell %1 %*}"},
+		`  {a b}   c  `:            {"a b", "c"},
+		"{a}\n\t{b\nc}\r\n":        {"a", "b\nc"},
+		`{}`:                       {""},
+		``:                         nil,
+	}
+	for in, want := range tests {
+		if got := BraceArgs(in); !reflect.DeepEqual(got, want) {
+			t.Errorf("BraceArgs(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSplitCommands(t *testing.T) {
+	got := SplitCommands("kill orc; loot all ;{say a;b};")
+	want := []string{"kill orc", "loot all", "{say a;b}"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SplitCommands = %q, want %q", got, want)
+	}
+}